@@ -2,13 +2,23 @@ package client
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	pb "gRPC-Playground/ecommerce"
-	"log"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// ErrSecondFactorRequired is returned by Login when the user has enrolled a
+// second factor, which this client cannot provide.
+var ErrSecondFactorRequired = errors.New("second factor required")
+
+// ErrTOTPEnrollmentRequired is returned by Login when the role of the user
+// requires a second factor that the user has not enrolled yet.
+var ErrTOTPEnrollmentRequired = errors.New("second factor enrollment required")
+
 // AuthClient struct to call authentication service.
 type AuthClient struct {
 	// AuthServiceClient service field generated by protoc.
@@ -29,8 +39,18 @@ func NewAuthClient(cc *grpc.ClientConn, username, password string) *AuthClient {
 
 // Login() function to call Login RPC to get access token.
 func (client *AuthClient) Login() (string, error) {
+	return client.login(context.Background())
+}
+
+// Refresh() function calls Login RPC to get a new access token, presenting
+// the current one so that the server can tell it is a refresh.
+func (client *AuthClient) Refresh(accessToken string) (string, error) {
+	return client.login(metadata.AppendToOutgoingContext(context.Background(), "authorization", accessToken))
+}
+
+func (client *AuthClient) login(ctx context.Context) (string, error) {
 	// create a context with timeout of 5 seconds,
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// *** Implementing our Login unary rpc remote method
@@ -43,8 +63,18 @@ func (client *AuthClient) Login() (string, error) {
 		},
 	)
 
+	// If there's an error, we return it to the caller, which decides whether to retry.
 	if err != nil {
-		log.Fatalf("Unable to log in user: %v", err)
+		return "", fmt.Errorf("unable to log in user %s: %w", client.username, err)
+	}
+
+	// A user with a second factor gets a challenge instead of a token, and a user
+	// who must enroll one gets a token that is useless for anything else.
+	if resp.GetChallengeId() != "" {
+		return "", fmt.Errorf("unable to log in user %s: %w", client.username, ErrSecondFactorRequired)
+	}
+	if resp.GetTotpEnrollmentRequired() {
+		return "", fmt.Errorf("unable to log in user %s: %w", client.username, ErrTOTPEnrollmentRequired)
 	}
 
 	// Else, we return the responded access token to the caller. 
@@ -5,17 +5,27 @@ import (
 	"context"
 	"fmt"
 	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// createLaptopAttempts is the number of times a CreateLaptop call is sent.
+	createLaptopAttempts = 3
+	// createLaptopRetryDelay is the wait before a CreateLaptop call is sent again.
+	createLaptopRetryDelay = 100 * time.Millisecond
+)
+
 // LaptopClient is a client to call laptop service RPCs
 type LaptopClient struct {
 	service pb.LaptopServiceClient
@@ -27,23 +37,35 @@ func NewLaptopClient(cc *grpc.ClientConn) *LaptopClient {
 	return &LaptopClient{service}
 }
 
-func (laptopClient *LaptopClient) CreateLaptopClient(laptop *pb.Laptop) string {
-	// generate a new laptop
-	//laptop := sampledata.NewLaptop()
+// NewIdempotencyKey() function returns a new idempotency key for a request.
+// The key is generated once per request, and sent again with each of its retries.
+func NewIdempotencyKey() string {
+	return uuid.New().String()
+}
 
+// CreateLaptopClient() function creates the laptop, and returns its ID.
+// The request is sent with the idempotencyKey, which the caller generates once
+// with NewIdempotencyKey(): a call that failed without a response, because the
+// server was unavailable or the deadline was exceeded, is retried with the
+// same key, so that the server cannot create a second laptop.
+func (laptopClient *LaptopClient) CreateLaptopClient(laptop *pb.Laptop, idempotencyKey string) string {
 	// make a new request object,
 	req := &pb.CreateLaptopRequest{
 		Laptop: laptop,
 	}
 
-	// set timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var res *pb.CreateLaptopResponse
+	var err error
+	for attempt := 1; attempt <= createLaptopAttempts; attempt++ {
+		res, err = laptopClient.createLaptop(req, idempotencyKey)
+		if !retryable(err) {
+			break
+		}
 
-	defer cancel()
+		log.Printf("cannot create laptop (attempt %d of %d): %v", attempt, createLaptopAttempts, err)
+		time.Sleep(createLaptopRetryDelay)
+	}
 
-	// *** Implementing our CreateLaptop unary rpc remote method
-	// call laptopClient.Createlaptop() our unary RPC remote method with the request and a context
-	res, err := laptopClient.service.CreateLaptop(ctx, req)
 	// If error is not nil, we convert it into a status object.
 	if err != nil {
 		st, ok := status.FromError(err)
@@ -55,13 +77,36 @@ func (laptopClient *LaptopClient) CreateLaptopClient(laptop *pb.Laptop) string {
 			// Else, we write a fatal log.
 			log.Fatal("cannot create laptop: ", err)
 		}
-		return res.Id
+		return laptop.GetId()
 	}
 
 	log.Printf("created laptop with id: %s", res.Id)
 	return res.Id
 }
 
+// createLaptop() function sends a single CreateLaptop request with the idempotency key.
+func (laptopClient *LaptopClient) createLaptop(req *pb.CreateLaptopRequest, idempotencyKey string) (*pb.CreateLaptopResponse, error) {
+	// set timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	// send the idempotency key, so that a retry of this request gets the laptop
+	// of the first attempt back.
+	ctx = metadata.AppendToOutgoingContext(ctx, "idempotency-key", idempotencyKey)
+
+	// *** Implementing our CreateLaptop unary rpc remote method
+	// call laptopClient.Createlaptop() our unary RPC remote method with the request and a context
+	return laptopClient.service.CreateLaptop(ctx, req)
+}
+
+// retryable() function reports whether a call failed without knowing if the
+// server ran it, so that it can be retried with the same idempotency key.
+func retryable(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
 func (laptopClient *LaptopClient) GetLaptopByIDClient(laptopID string) {
 	// set timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -106,7 +151,7 @@ func (laptopClient *LaptopClient) SearchLaptopClient() {
 		ctx,
 		&pb.SearchLaptopRequest{
 			Filter: &pb.Filter{
-				MaxPriceUsd: 3000,
+				MaxPrice:    &pb.Money{CurrencyCode: "USD", Units: 3000},
 				MinCpuCores: 4,
 				MinCpuGhz:   2.5,
 				MinRam: &pb.Memory{
@@ -148,7 +193,7 @@ func (laptopClient *LaptopClient) SearchLaptopClient() {
 		log.Print("  + cpu cores: ", laptop.GetCpu().GetNumberCores())
 		log.Print("  + cpu min ghz: ", laptop.GetCpu().GetMinGhz())
 		log.Print("  + ram: ", laptop.GetRam())
-		log.Print("  + price: ", laptop.GetPriceUsd())
+		log.Print("  + price: ", money.Format(laptop.GetPrice()))
 
 	}
 }
@@ -0,0 +1,99 @@
+package client_test
+
+import (
+	"context"
+	"gRPC-Playground/client"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateLaptopClientRetry(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	user, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	token, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptopServer := service.NewLaptopServer(laptopStore, nil, nil)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles())
+	idempotencyInterceptor := service.NewIdempotencyInterceptor(time.Minute, service.IdempotentMethods()...)
+
+	// the response of the first CreateLaptop call is lost after the laptop is created.
+	var calls int32
+	var mutex sync.Mutex
+	var keys []string
+	loseFirstResponse := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mutex.Lock()
+		keys = append(keys, md.Get("idempotency-key")...)
+		mutex.Unlock()
+
+		res, err := handler(ctx, req)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, status.Errorf(codes.Unavailable, "connection reset")
+		}
+		return res, err
+	}
+
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(loseFirstResponse, interceptor.Unary(), idempotencyInterceptor.Unary()))
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	authenticate := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, "authorization", token), method, req, reply, cc, opts...)
+	}
+	conn, err := grpc.Dial(
+		listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(authenticate),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the server generates the ID of the laptop, so that a second run of the
+	// request would create a second laptop.
+	laptop := sampledata.NewLaptop()
+	laptop.Id = ""
+
+	laptopID := client.NewLaptopClient(conn).CreateLaptopClient(laptop, client.NewIdempotencyKey())
+	require.NotEmpty(t, laptopID)
+
+	// the retry is sent with the same key, and gets the laptop of the first attempt.
+	require.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	mutex.Lock()
+	require.Len(t, keys, 2)
+	require.Equal(t, keys[0], keys[1])
+	mutex.Unlock()
+
+	// an infinite max price lets every laptop through.
+	found := 0
+	err = laptopStore.Search(context.Background(), &pb.Filter{MaxPriceUsd: math.Inf(1)}, func(laptop *pb.Laptop) error {
+		require.Equal(t, laptopID, laptop.GetId())
+		found++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, found)
+}
@@ -0,0 +1,358 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCredentialsClosed is returned when a closed TokenCredentials is used
+var ErrCredentialsClosed = errors.New("token credentials are closed")
+
+/*
+Note: TokenCredentials attaches an access token to the gRPC requests that
+need authentication. It is plugged into a connection with the
+grpc.WithPerRPCCredentials() dial option, and its Unary() interceptor
+to retry a call once when the server rejects the token.
+*/
+
+// TokenCredentials implements credentials.PerRPCCredentials with an access token
+// obtained from the auth service. The token is refreshed shortly before it
+// expires, and whenever the server answers Unauthenticated.
+// It is safe for concurrent use.
+type TokenCredentials struct {
+	authClient  *AuthClient
+	authMethods map[string]bool
+	// refreshBefore tells us how long before its expiry the token is refreshed.
+	refreshBefore time.Duration
+
+	mutex       sync.Mutex
+	accessToken string
+	issuedAt    time.Time
+	expiresAt   time.Time
+	timer       *time.Timer
+	closed      bool
+	// refreshing is the refresh in progress, which the other callers wait for
+	// instead of calling the auth service again.
+	refreshing *tokenRefresh
+}
+
+// tokenRefresh is a call to the auth service for a new token.
+type tokenRefresh struct {
+	// done is closed when the call has finished.
+	done        chan struct{}
+	accessToken string
+	err         error
+}
+
+// NewTokenCredentials logs in with the auth client to get a first access token,
+// and returns the credentials that keep it fresh until Close() is called.
+// refreshBefore must be positive.
+func NewTokenCredentials(
+	authClient *AuthClient,
+	authMethods map[string]bool, // tell us which methods need authentication.
+	refreshBefore time.Duration,
+) (*TokenCredentials, error) {
+	if refreshBefore <= 0 {
+		return nil, fmt.Errorf("token refresh delay %v must be positive", refreshBefore)
+	}
+
+	tokenCredentials := &TokenCredentials{
+		authClient:    authClient,
+		authMethods:   authMethods,
+		refreshBefore: refreshBefore,
+	}
+
+	_, err := tokenCredentials.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenCredentials, nil
+}
+
+// GetRequestMetadata returns the authorization metadata for the request,
+// refreshing the token first if it is about to expire.
+func (tokenCredentials *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	// Only the methods that need authentication get the token.
+	requestInfo, ok := credentials.RequestInfoFromContext(ctx)
+	if ok && !tokenCredentials.authMethods[requestInfo.Method] {
+		return nil, nil
+	}
+
+	accessToken, err := tokenCredentials.token()
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: authorization key string must match with the one used on the server side.
+	return map[string]string{"authorization": accessToken}, nil
+}
+
+// RequireTransportSecurity returns false, because the server can be run
+// without TLS (see the -tls flag).
+func (tokenCredentials *TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Unary() function returns a gRPC unary client interceptor that retries a call
+// once with a fresh token when the server answers Unauthenticated.
+func (tokenCredentials *TokenCredentials) Unary() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unauthenticated || !tokenCredentials.authMethods[method] {
+			return err
+		}
+
+		log.Printf("--> %s: token rejected, retrying with a fresh token", method)
+
+		err = tokenCredentials.Invalidate()
+		if err != nil {
+			return err
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// Stream() function returns a gRPC stream client interceptor that refreshes the
+// token when the server rejects it. A stream cannot be replayed, so it is the
+// next call that uses the fresh token.
+func (tokenCredentials *TokenCredentials) Stream() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &refreshingClientStream{ClientStream: stream, tokenCredentials: tokenCredentials}, nil
+	}
+}
+
+// Invalidate() function drops the current token and logs in again.
+func (tokenCredentials *TokenCredentials) Invalidate() error {
+	tokenCredentials.mutex.Lock()
+	if tokenCredentials.closed {
+		tokenCredentials.mutex.Unlock()
+		return ErrCredentialsClosed
+	}
+	tokenCredentials.accessToken = ""
+	tokenCredentials.mutex.Unlock()
+
+	_, err := tokenCredentials.refresh()
+	return err
+}
+
+// Close() function stops refreshing the token. The credentials cannot be used afterward.
+func (tokenCredentials *TokenCredentials) Close() {
+	tokenCredentials.mutex.Lock()
+	defer tokenCredentials.mutex.Unlock()
+
+	tokenCredentials.closed = true
+	tokenCredentials.accessToken = ""
+	if tokenCredentials.timer != nil {
+		tokenCredentials.timer.Stop()
+	}
+}
+
+// token() function returns the current token, refreshing it first if it is
+// due for a refresh. A token that is not expired yet is still returned when
+// the refresh fails.
+func (tokenCredentials *TokenCredentials) token() (string, error) {
+	tokenCredentials.mutex.Lock()
+	if tokenCredentials.closed {
+		tokenCredentials.mutex.Unlock()
+		return "", ErrCredentialsClosed
+	}
+
+	accessToken := tokenCredentials.accessToken
+	now := time.Now()
+	if accessToken != "" && now.Before(tokenCredentials.refreshAt()) {
+		tokenCredentials.mutex.Unlock()
+		return accessToken, nil
+	}
+	valid := accessToken != "" && now.Before(tokenCredentials.expiresAt)
+	tokenCredentials.mutex.Unlock()
+
+	refreshed, err := tokenCredentials.refresh()
+	if err != nil {
+		if valid && !errors.Is(err, ErrCredentialsClosed) {
+			log.Printf("cannot refresh token, using the current one: %v", err)
+			return accessToken, nil
+		}
+		return "", err
+	}
+
+	return refreshed, nil
+}
+
+// refreshAt() function returns when the token is due for a refresh, which is
+// refreshBefore its expiry, but never before half of its lifetime, so that a
+// refreshBefore longer than the lifetime of the tokens does not refresh them
+// in a loop. The mutex must be held by the caller.
+func (tokenCredentials *TokenCredentials) refreshAt() time.Time {
+	lifetime := tokenCredentials.expiresAt.Sub(tokenCredentials.issuedAt)
+
+	delay := lifetime - tokenCredentials.refreshBefore
+	if delay < lifetime/2 {
+		delay = lifetime / 2
+	}
+
+	return tokenCredentials.issuedAt.Add(delay)
+}
+
+// refresh() function gets a new token and schedules its next refresh. Only one
+// refresh runs at a time: the callers arriving while it is in progress wait for
+// it and share its result. The auth service is called without holding the mutex.
+func (tokenCredentials *TokenCredentials) refresh() (string, error) {
+	tokenCredentials.mutex.Lock()
+	if tokenCredentials.closed {
+		tokenCredentials.mutex.Unlock()
+		return "", ErrCredentialsClosed
+	}
+
+	if call := tokenCredentials.refreshing; call != nil {
+		tokenCredentials.mutex.Unlock()
+		<-call.done
+		return call.accessToken, call.err
+	}
+
+	call := &tokenRefresh{done: make(chan struct{})}
+	tokenCredentials.refreshing = call
+	currentToken := tokenCredentials.accessToken
+	tokenCredentials.mutex.Unlock()
+
+	issuedAt := time.Now()
+	accessToken, expiresAt, err := tokenCredentials.fetch(currentToken)
+
+	tokenCredentials.mutex.Lock()
+	defer tokenCredentials.mutex.Unlock()
+
+	tokenCredentials.refreshing = nil
+	if err == nil && tokenCredentials.closed {
+		err = ErrCredentialsClosed
+	}
+	if err == nil && !expiresAt.After(issuedAt) {
+		err = fmt.Errorf("access token expired at %v", expiresAt)
+	}
+
+	if err == nil {
+		tokenCredentials.accessToken = accessToken
+		tokenCredentials.issuedAt = issuedAt
+		tokenCredentials.expiresAt = expiresAt
+		log.Printf("token refreshed, expires at %v", expiresAt)
+
+		// schedule a refresh shortly before the expiry, so that an idle client
+		// also has a valid token when it makes its next call.
+		if tokenCredentials.timer != nil {
+			tokenCredentials.timer.Stop()
+		}
+		tokenCredentials.timer = time.AfterFunc(time.Until(tokenCredentials.refreshAt()), tokenCredentials.scheduledRefresh)
+	}
+
+	call.accessToken = accessToken
+	call.err = err
+	close(call.done)
+
+	return accessToken, err
+}
+
+// fetch() function logs in, or refreshes the current token when there is one,
+// and returns the new token with its expiry.
+func (tokenCredentials *TokenCredentials) fetch(currentToken string) (string, time.Time, error) {
+	var accessToken string
+	var err error
+
+	if currentToken == "" {
+		accessToken, err = tokenCredentials.authClient.Login()
+	} else {
+		accessToken, err = tokenCredentials.authClient.Refresh(currentToken)
+	}
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt, err := tokenExpiry(accessToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return accessToken, expiresAt, nil
+}
+
+func (tokenCredentials *TokenCredentials) scheduledRefresh() {
+	tokenCredentials.mutex.Lock()
+	// a concurrent call may have refreshed the token already.
+	due := !tokenCredentials.closed && !time.Now().Before(tokenCredentials.refreshAt())
+	tokenCredentials.mutex.Unlock()
+
+	if !due {
+		return
+	}
+
+	_, err := tokenCredentials.refresh()
+	if err != nil && !errors.Is(err, ErrCredentialsClosed) {
+		// the next call will try again.
+		log.Printf("cannot refresh token: %v", err)
+	}
+}
+
+// tokenExpiry() function reads the exp claim of a JWT. The signature is not
+// verified here, that is the job of the server.
+func tokenExpiry(accessToken string) (time.Time, error) {
+	claims := &jwt.RegisteredClaims{}
+
+	_, _, err := jwt.NewParser().ParseUnverified(accessToken, claims)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse access token: %w", err)
+	}
+
+	if claims.ExpiresAt == nil {
+		return time.Time{}, fmt.Errorf("access token has no expiry")
+	}
+
+	return claims.ExpiresAt.Time, nil
+}
+
+// refreshingClientStream invalidates the token when the server rejects it
+// while the stream is in progress.
+type refreshingClientStream struct {
+	grpc.ClientStream
+	tokenCredentials *TokenCredentials
+}
+
+func (stream *refreshingClientStream) RecvMsg(m interface{}) error {
+	err := stream.ClientStream.RecvMsg(m)
+	if status.Code(err) == codes.Unauthenticated {
+		refreshErr := stream.tokenCredentials.Invalidate()
+		if refreshErr != nil {
+			log.Printf("cannot refresh token: %v", refreshErr)
+		}
+	}
+
+	return err
+}
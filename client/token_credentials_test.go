@@ -0,0 +1,174 @@
+package client_test
+
+import (
+	"context"
+	"gRPC-Playground/client"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const laptopServicePath = "/ecommerce.LaptopService/"
+
+func TestTokenCredentials(t *testing.T) {
+	t.Parallel()
+
+	var logins int32
+	var rejectNext int32
+	serverAddress := startTestServer(t, 2*time.Second, 0, &logins, &rejectNext)
+
+	authConn, err := grpc.Dial(serverAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer authConn.Close()
+
+	authMethods := map[string]bool{laptopServicePath + "CreateLaptop": true}
+
+	// with 2 seconds tokens, refreshing 1 second before the expiry means a
+	// refresh every second.
+	tokenCredentials, err := client.NewTokenCredentials(client.NewAuthClient(authConn, "admin1", "secret"), authMethods, time.Second)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&logins))
+
+	conn, err := grpc.Dial(
+		serverAddress,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(tokenCredentials),
+		grpc.WithUnaryInterceptor(tokenCredentials.Unary()),
+		grpc.WithStreamInterceptor(tokenCredentials.Stream()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	laptopClient := pb.NewLaptopServiceClient(conn)
+
+	createLaptop := func() error {
+		_, err := laptopClient.CreateLaptop(context.Background(), &pb.CreateLaptopRequest{Laptop: sampledata.NewLaptop()})
+		return err
+	}
+
+	// the credentials can be used concurrently.
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- createLaptop()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// the token is refreshed before it expires, even without calls.
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&logins) >= 2
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// a call rejected with Unauthenticated is retried once with a fresh token.
+	before := atomic.LoadInt32(&logins)
+	atomic.StoreInt32(&rejectNext, 1)
+	require.NoError(t, createLaptop())
+	require.Greater(t, atomic.LoadInt32(&logins), before)
+
+	// once closed, the credentials stop refreshing and cannot be used anymore.
+	tokenCredentials.Close()
+	closedAt := atomic.LoadInt32(&logins)
+	require.Error(t, createLaptop())
+	time.Sleep(2 * time.Second)
+	require.Equal(t, closedAt, atomic.LoadInt32(&logins))
+}
+
+func TestTokenCredentialsRefreshDelay(t *testing.T) {
+	t.Parallel()
+
+	var logins int32
+	var rejectNext int32
+	serverAddress := startTestServer(t, 4*time.Second, 200*time.Millisecond, &logins, &rejectNext)
+
+	authConn, err := grpc.Dial(serverAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer authConn.Close()
+	authClient := client.NewAuthClient(authConn, "admin1", "secret")
+
+	// the refresh delay must be positive.
+	for _, refreshBefore := range []time.Duration{0, -time.Second} {
+		_, err := client.NewTokenCredentials(authClient, nil, refreshBefore)
+		require.Error(t, err)
+	}
+	require.Zero(t, atomic.LoadInt32(&logins))
+
+	tokenCredentials, err := client.NewTokenCredentials(authClient, nil, time.Minute)
+	require.NoError(t, err)
+	defer tokenCredentials.Close()
+	require.EqualValues(t, 1, atomic.LoadInt32(&logins))
+
+	// the concurrent refreshes share a single call to the auth service.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, tokenCredentials.Invalidate())
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 2, atomic.LoadInt32(&logins))
+
+	// refreshing 1 minute before the expiry of 4 seconds tokens does not refresh
+	// them in a loop, but once half of their lifetime has passed.
+	time.Sleep(time.Second)
+	require.LessOrEqual(t, atomic.LoadInt32(&logins), int32(3))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&logins) >= 3
+	}, 4*time.Second, 50*time.Millisecond)
+}
+
+// startTestServer starts an auth and laptop server issuing tokens with the given duration.
+// It counts the logins, which take loginDelay, and rejects the next laptop call
+// with Unauthenticated when rejectNext is set.
+func startTestServer(t *testing.T, tokenDuration time.Duration, loginDelay time.Duration, logins *int32, rejectNext *int32) string {
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, service.SeedUsers(userStore))
+
+	jwtManager := service.NewJWTManager("secret", tokenDuration)
+	limiter := service.NewLoginLimiter(service.DefaultLoginLimiterConfig(), nil)
+	authServer := service.NewAuthServer(userStore, jwtManager, limiter, nil)
+	laptopServer := service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles())
+
+	testInterceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/ecommerce.AuthService/Login" {
+			atomic.AddInt32(logins, 1)
+			time.Sleep(loginDelay)
+		}
+		if info.FullMethod == laptopServicePath+"CreateLaptop" && atomic.CompareAndSwapInt32(rejectNext, 1, 0) {
+			return nil, status.Errorf(codes.Unauthenticated, "access token is invalid")
+		}
+		return handler(ctx, req)
+	}
+
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(testInterceptor, interceptor.Unary()))
+	pb.RegisterAuthServiceServer(grpcServer, authServer)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
@@ -18,9 +18,10 @@ import (
 )
 
 const (
-	username        = "admin1"
-	password        = "secret"
-	refreshDuration = 30 * time.Second
+	username = "admin1"
+	password = "secret"
+	// refresh the access token 30 seconds before it expires.
+	refreshBefore = 30 * time.Second
 )
 
 /*
@@ -153,20 +154,24 @@ func main() {
 
 	authClient := client.NewAuthClient(conn1, username, password)
 
-	// create a new interceptor with the auth client
-	interceptor, err := client.NewAuthInterceptor(authClient, authMethods(), refreshDuration)
+	// create new token credentials with the auth client
+	tokenCredentials, err := client.NewTokenCredentials(authClient, authMethods(), refreshBefore)
 	if err != nil {
-		log.Fatal("cannot create auth interceptor: ", err)
+		log.Fatal("cannot create token credentials: ", err)
 	}
 
+	defer tokenCredentials.Close()
+
 	// dial server to create another connection. But this time,
-	// we also add 2 dial options: the unary interceptor and the stream interceptor.
+	// we also add the per-RPC token credentials, and the unary and stream
+	// interceptors that refresh the token when the server rejects it.
 	conn2, err := grpc.Dial(
 		*serverAddress,
 		//grpc.WithTransportCredentials(tlsCredentials),
 		transportOption,
-		grpc.WithUnaryInterceptor(interceptor.Unary()),
-		grpc.WithStreamInterceptor(interceptor.Stream()),
+		grpc.WithPerRPCCredentials(tokenCredentials),
+		grpc.WithUnaryInterceptor(tokenCredentials.Unary()),
+		grpc.WithStreamInterceptor(tokenCredentials.Stream()),
 	)
 	if err != nil {
 		log.Fatal("cannot dial server: ", err)
@@ -205,7 +210,7 @@ func authMethods() map[string]bool {
 
 func testCreateLaptop(laptopClient *client.LaptopClient) {
 	laptop := sampledata.NewLaptop()
-	laptopClient.CreateLaptopClient(laptop)
+	laptopClient.CreateLaptopClient(laptop, client.NewIdempotencyKey())
 }
 
 func testSearchLaptop(laptopClient *client.LaptopClient) {
@@ -213,7 +218,7 @@ func testSearchLaptop(laptopClient *client.LaptopClient) {
 
 	// create 10 laptops to search from
 	for i := 0; i < 10; i++ {
-		laptopClient.CreateLaptopClient(laptop)
+		laptopClient.CreateLaptopClient(laptop, client.NewIdempotencyKey())
 	}
 	laptopClient.SearchLaptopClient()
 
@@ -221,14 +226,14 @@ func testSearchLaptop(laptopClient *client.LaptopClient) {
 
 func testGetLaptopByID(laptopClient *client.LaptopClient) {
 	laptop := sampledata.NewLaptop()
-	laptopClient.CreateLaptopClient(laptop)
+	laptopClient.CreateLaptopClient(laptop, client.NewIdempotencyKey())
 	laptopClient.GetLaptopByIDClient(laptop.GetId())
 
 }
 
 func testUploadImage(laptopClient *client.LaptopClient) {
 	laptop := sampledata.NewLaptop()
-	laptopClient.CreateLaptopClient(laptop)
+	laptopClient.CreateLaptopClient(laptop, client.NewIdempotencyKey())
 	laptopClient.UploadImageClient(laptop.GetId(), "tmp/laptop.jpg")
 }
 
@@ -244,7 +249,7 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 	for i := 0; i < n; i++ {
 		laptop := sampledata.NewLaptop()
 		laptopIDs[i] = laptop.GetId()
-		laptopClient.CreateLaptopClient(laptop)
+		laptopClient.CreateLaptopClient(laptop, client.NewIdempotencyKey())
 	}
 
 	// Then we also make a slice to keep the scores. I want to rate these 3 laptops
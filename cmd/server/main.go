@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
@@ -15,12 +16,13 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/reflection"
 )
 
 const (
-	secretKey     = "secret"
-	tokenDuration = 15 * time.Minute
+	// idempotencyTTL is how long the response of a CreateLaptop or AddOrder call is kept for its retries.
+	idempotencyTTL = 24 * time.Hour
 )
 
 /*
@@ -28,11 +30,11 @@ const (
 // loadServerSideTLSCredentials function returns a TranportCredentials object or an error
 // It is implements a server side TLS
 // Note: In Server-Side TLS, only the server shares its certificate with the client.
-func loadServerSideTLSCredentials() (credentials.TransportCredentials, error) {
+func loadServerSideTLSCredentials(tlsConfig service.TLSConfig) (credentials.TransportCredentials, error) {
 	//For sever side TLS, load server’s certificate and private key.
-	// use tls.LoadX509KeyPair() function to load the server-cert.pem and
-	// server-key.pem files from the cert folder.
-	serverCert, err := tls.LoadX509KeyPair("cert/server-cert.pem", "cert/server-key.pem")
+	// use tls.LoadX509KeyPair() function to load the server certificate and
+	// key files of the config.
+	serverCert, err := tls.LoadX509KeyPair(tlsConfig.ServerCert, tlsConfig.ServerKey)
 
 	// check for errors
 	if err != nil {
@@ -57,10 +59,10 @@ func loadServerSideTLSCredentials() (credentials.TransportCredentials, error) {
 // loadMutualTLSCredentials function returns a TranportCredentials object or an error
 // It is implements Mutual TLS
 // For mutual TLS, the client also has to share its certificate with the server.
-func loadMutualTLSCredentials() (credentials.TransportCredentials, error) {
+func loadMutualTLSCredentials(tlsConfig service.TLSConfig) (credentials.TransportCredentials, error) {
 	// Load certificate of the CA who signed client's certificate
 	// In our case: It is just one single CA that signs both the client and server
-	pemClientCA, err := os.ReadFile("cert/ca-cert.pem")
+	pemClientCA, err := os.ReadFile(tlsConfig.CACert)
 	if err != nil {
 		return nil, err
 	}
@@ -72,9 +74,9 @@ func loadMutualTLSCredentials() (credentials.TransportCredentials, error) {
 	}
 
 	// load server’s certificate and private key.
-	// use tls.LoadX509KeyPair() function to load the server-cert.pem and
-	// server-key.pem files from the cert folder.
-	serverCert, err := tls.LoadX509KeyPair("cert/server-cert.pem", "cert/server-key.pem")
+	// use tls.LoadX509KeyPair() function to load the server certificate and
+	// key files of the config.
+	serverCert, err := tls.LoadX509KeyPair(tlsConfig.ServerCert, tlsConfig.ServerKey)
 
 	// check for errors
 	if err != nil {
@@ -96,97 +98,208 @@ func loadMutualTLSCredentials() (credentials.TransportCredentials, error) {
 }
 
 func main() {
-	// use the flag.Int() function to get port from command line arguments.
-	port := flag.Int("port", 0, "the server port")
-
-	// enable TLS on our gRPC server or not.
-	enableTLS := flag.Bool("tls", false, "enable SSL/TLS")
-
+	// the YAML or JSON file configuring the server, see cmd/server/server.yaml.
+	// Each setting can be overridden by an environment variable such as SERVER_PORT.
+	configPath := flag.String("config", "", "the YAML or JSON server config file, the defaults are used when empty")
 	flag.Parse()
-	log.Printf("start server on port %d", *port)
 
-	// Create a new user InMemoryStore
-	userStore := service.NewInMemoryUserStore()
-	// Call SeedUser to create a new user and store in the InMemoryUserStore
-	err := service.SeedUsers(userStore)
+	config, err := service.LoadServerConfig(*configPath, os.Environ())
 	if err != nil {
-		log.Fatal("cannot seed users: ", err)
+		log.Fatal("cannot load server config: ", err)
 	}
-
-	// create a new laptop store with an in-memory laptop store.
-	laptopStore := service.NewInMemoryLaptopStore()
-
-	// create a new ImageStore store with an NewDiskImageStore.
-	imageStore := service.NewDiskImageStore("assets")
-
-	// create a new rating store with an in-memory rating store.
-	ratingStore := service.NewInMemoryRatingStore()
+	log.Printf("start server on port %d with the services %v", config.Port, config.Services)
 
 	// Create a new JWTManager
-	jwtManager := service.NewJWTManager(secretKey, tokenDuration)
+	jwtManager := service.NewJWTManager(config.Auth.TokenSecret, config.Auth.TokenDuration)
 
-	// Create a new auth server
-	authServer := service.NewAuthServer(userStore, jwtManager)
+	// Open the security audit log, rotated every 10 MB.
+	auditLog, err := service.NewFileAuditLog(config.Auth.AuditLog, 10<<20, time.Now)
+	if err != nil {
+		log.Fatal("cannot open audit log: ", err)
+	}
+	defer auditLog.Close()
 
-	// create a new laptop server with an in-memory laptop store.
-	laptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	// the stores are shared by the services, and by the interceptors checking
+	// the callers, so they are created even when their service is not hosted.
+	laptopStore := service.NewInMemoryLaptopStore()
+	productStore := service.NewInMemoryProductStore()
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	orderStore := service.NewInMemoryOrderStore()
 
 	// Retrieve the accessible roles list
 	accessibleRoles := service.AccessibleRoles()
 
-	// create a new interceptor object with the jwt manager and a map of accessible roles.
-	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles)
+	// the ownership rules are checked against each decoded request.
+	interceptorOptions := []service.AuthInterceptorOption{
+		service.WithOwnershipRules(service.OwnershipRules(laptopStore, orderStore)),
+		// machine clients can send an API key instead of an access token.
+		service.WithAPIKeys(apiKeyStore),
+		// every allow/deny decision goes to the audit log.
+		service.WithAuditLog(auditLog),
+	}
 
-	// call loadMutualTLSCredentials() to get the Mutual TLS credential object.
-	// Note: To load Server-Side TLS, use loadServerSideTLSCredentials function
-	//tlsCredentials, err := loadMutualTLSCredentials()
+	// With mutual TLS, callers can also authenticate with their client certificate
+	// alone, when its identity is mapped to a role.
+	if config.TLS.Enabled && config.TLS.CertRoles != "" {
+		certIdentityConfig, err := service.LoadCertIdentityConfig(config.TLS.CertRoles)
+		if err != nil {
+			log.Fatal("cannot load cert identity config: ", err)
+		}
+
+		interceptorOptions = append(interceptorOptions, service.WithCertIdentities(certIdentityConfig))
+	}
 
-	// log error
-	//if err != nil {
-	//	log.Fatal("cannot load TLS Credentials: ", err)
-	//}
+	// create a new interceptor object with the jwt manager, a map of accessible roles,
+	// and the interceptor options.
+	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles, interceptorOptions...)
 
 	// serverOptions slice to hold the our interceptors
+	// the idempotency interceptor runs after the auth interceptor, since the
+	// idempotency keys are scoped to the caller.
+	idempotencyInterceptor := service.NewIdempotencyInterceptor(idempotencyTTL, service.IdempotentMethods()...)
+
 	serverOptions := []grpc.ServerOption{
-		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.ChainUnaryInterceptor(interceptor.Unary(), idempotencyInterceptor.Unary()),
 		grpc.StreamInterceptor(interceptor.Stream()),
 	}
 
-	if *enableTLS {
+	if config.TLS.Enabled {
 		// call loadMutualTLSCredentials() to get the Mutual TLS credential object.
 		// Note: To load Server-Side TLS, use loadServerSideTLSCredentials function
-		tlsCredentials, err := loadMutualTLSCredentials()
+		tlsCredentials, err := loadMutualTLSCredentials(config.TLS)
 
 		// log error
 		if err != nil {
 			log.Fatal("cannot load TLS Credentials: ", err)
 		}
 
-		// append the Mutual/Server-Side TLS credential to the gRPC server 
+		// append the Mutual/Server-Side TLS credential to the gRPC server
 		// by using the grpc.Creds() option.
 		serverOptions = append(serverOptions, grpc.Creds(tlsCredentials))
-
 	}
 
-	// create the gRPC server by calling grpc.NewServer() function.
-	// pass the our interceptors via serverOptions variable 
-	//grpcServer := grpc.NewServer(
-		// add the server-side TLS credential to the gRPC server by using the grpc.Creds() option.
-		//grpc.Creds(tlsCredentials),
-		// Registering the unary interceptor with the gRPC server.
-		//grpc.UnaryInterceptor(interceptor.Unary()),
-		// Registering the stream interceptor with the gRPC server.
-		//grpc.StreamInterceptor(interceptor.Stream()),
-	//)
+	// the catalogs the orders are priced with, when they are hosted by this server.
+	var productServer pb.ProductInfoServer
+	var laptopServer pb.LaptopServiceServer
 
 	// create the gRPC server by calling grpc.NewServer() function.
-	// pass the our interceptors via serverOptions variable 
+	// pass the our interceptors via serverOptions variable
 	grpcServer := grpc.NewServer(serverOptions...)
 
-	// call pb.RegisterAuthServiceServer to add it to the gRPC server.
-	pb.RegisterAuthServiceServer(grpcServer, authServer)
-	// register the laptop service server on that gRPC server.
-	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	if config.HostsService(service.AuthServiceName) {
+		// Create a new user InMemoryStore
+		userStore := service.NewInMemoryUserStore()
+		// Call SeedUser to create a new user and store in the InMemoryUserStore
+		err := service.SeedUsers(userStore)
+		if err != nil {
+			log.Fatal("cannot seed users: ", err)
+		}
+
+		// Create a new login limiter to protect the Login RPC from brute-force attacks.
+		loginLimiter := service.NewLoginLimiter(service.DefaultLoginLimiterConfig(), time.Now)
+
+		// Create a new auth server
+		var authServerOptions []service.AuthServerOption
+		if len(config.Auth.RequireTOTP) > 0 {
+			authServerOptions = append(authServerOptions, service.WithRequiredTOTPRoles(config.Auth.RequireTOTP...))
+		}
+		authServer := service.NewAuthServer(userStore, jwtManager, loginLimiter, auditLog, authServerOptions...)
+
+		// call pb.RegisterAuthServiceServer to add it to the gRPC server.
+		pb.RegisterAuthServiceServer(grpcServer, authServer)
+	}
+
+	if config.HostsService(service.APIKeyServiceName) {
+		// register the api key service server on that gRPC server.
+		pb.RegisterAPIKeyServiceServer(grpcServer, service.NewAPIKeyServer(apiKeyStore, auditLog))
+	}
+
+	if config.HostsService(service.LaptopServiceName) {
+		// create a new ImageStore store with an NewDiskImageStore.
+		imageStore := service.NewDiskImageStore(config.Store.ImageFolder)
+
+		// create a new rating store with an in-memory rating store.
+		ratingStore := service.NewInMemoryRatingStore()
+
+		// create a new laptop server with an in-memory laptop store.
+		laptopServerOptions := []service.LaptopServerOption{service.WithProductCatalog(productStore)}
+		if config.ExchangeRates != "" {
+			rateProvider, err := service.NewFileRateProvider(config.ExchangeRates)
+			if err != nil {
+				log.Fatal("cannot load exchange rates: ", err)
+			}
+			laptopServerOptions = append(laptopServerOptions, service.WithCurrencyConverter(service.NewCurrencyConverter(rateProvider)))
+		}
+		laptopServer = service.NewLaptopServer(laptopStore, imageStore, ratingStore, laptopServerOptions...)
+
+		// register the laptop service server on that gRPC server.
+		pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	}
+
+	if config.HostsService(service.ProductServiceName) {
+		// the laptops that are not linked to the catalog yet are linked before it is served.
+		migrated, err := service.MigrateLaptops(context.Background(), laptopStore, productStore)
+		if err != nil {
+			log.Fatal("cannot migrate the laptops to the product catalog: ", err)
+		}
+		log.Printf("migrated %d laptops to the product catalog", migrated)
+
+		// the product server writes the price updates of the laptop products through to the laptops.
+		productServer = service.NewProductInfoServer(productStore, service.WithLaptopCatalog(laptopStore))
+
+		// register the product catalog on that gRPC server.
+		pb.RegisterProductInfoServer(grpcServer, productServer)
+	}
+
+	// the promotions managed with the PromotionService are applied to the orders priced by the server.
+	promotionStore := service.NewInMemoryPromotionStore()
+
+	if config.HostsService(service.PromotionServiceName) {
+		pb.RegisterPromotionServiceServer(grpcServer, service.NewPromotionServer(promotionStore))
+	}
+
+	if config.HostsService(service.OrderServiceName) {
+		// the stock of the laptops is known when their catalog is hosted by this server.
+		var stockStore service.LaptopStore
+		if config.HostsService(service.LaptopServiceName) {
+			stockStore = laptopStore
+		}
+
+		var pricer *service.OrderPricer
+		if config.PricesOrders() {
+			pricer, err = newOrderPricer(config, productServer, laptopServer)
+			if err != nil {
+				log.Fatalf("cannot connect to the catalogs: %v", err)
+			}
+		}
+
+		orderServer, closeOrderServer := newOrderServer(config.Orders, orderStore, pricer, promotionStore, stockStore)
+		defer closeOrderServer()
+
+		// Register our service implementation with the gRPC server.
+		pb.RegisterOrderManagementServer(grpcServer, orderServer)
+
+		// the carts take their prices from the catalogs, so the config only
+		// allows them along with the pricing.
+		if config.HostsService(service.CartServiceName) {
+			pb.RegisterCartServiceServer(grpcServer, service.NewCartServer(service.NewInMemoryCartStore(), orderServer))
+		}
+
+		// the sagas interrupted by a crash change orders and refunds that
+		// were lost with it, unless the stores are persistent.
+		if config.Store.Persistent() {
+			err = orderServer.ResumeOrderSagas(context.Background())
+			if err != nil {
+				log.Printf("cannot resume all the sagas: %v", err)
+			}
+		} else {
+			abandoned, err := orderServer.AbandonOrderSagas()
+			if err != nil {
+				log.Fatalf("cannot abandon the sagas: %v", err)
+			}
+			log.Printf("abandoned %d unfinished sagas, the orders are kept in memory", abandoned)
+		}
+	}
 
 	// Enable gRPC Reflection on the server
 	/*
@@ -199,7 +312,7 @@ func main() {
 	reflection.Register(grpcServer)
 
 	// create an address string with the port
-	address := fmt.Sprintf("0.0.0.0:%d", *port)
+	address := fmt.Sprintf("0.0.0.0:%d", config.Port)
 
 	// listen for TCP connections on this server address.
 	listener, err := net.Listen("tcp", address)
@@ -218,3 +331,138 @@ func main() {
 	}
 
 }
+
+// newOrderServer() function creates the order server with the saga and event
+// logs of the config, and seeds its order store. The orders are priced by
+// pricer, unless it is nil. The laptops of the orders are reserved within
+// their stock in stockStore, or without limit if it is nil.
+// The returned function closes the logs.
+func newOrderServer(config service.OrderConfig, orderStore service.OrderStore, pricer *service.OrderPricer, promotionStore service.PromotionStore, stockStore service.LaptopStore) (*service.OrderManagementServer, func()) {
+	// the cancel and refund sagas interrupted by a crash are resumed from this log.
+	sagaLog, err := service.NewFileSagaLog(config.SagaLog)
+	if err != nil {
+		log.Fatalf("cannot open saga log: %v", err)
+	}
+
+	// the consumers of WatchOrders catch up with the events kept in this log.
+	eventLog, err := service.NewFileOrderEventLog(config.EventLog, config.EventLogSize)
+	if err != nil {
+		log.Fatalf("cannot open event log: %v", err)
+	}
+
+	opts := []service.OrderServerOption{
+		service.WithSagaLog(sagaLog),
+		// the refunds are kept in memory, like the orders they belong to.
+		service.WithRefundLedger(service.NewInMemoryRefundLedger()),
+		service.WithOrderEventLog(eventLog),
+		service.WithPromotions(promotionStore),
+	}
+	if config.LegacyUpdateOrders {
+		opts = append(opts, service.WithLegacyUpdateOrders())
+	}
+	if stockStore != nil {
+		stockReservations := service.NewInMemoryStockReservations(service.WithLaptopStock(stockStore))
+		opts = append(opts, service.WithStockReservations(stockReservations))
+	}
+	if config.CarrierRules != "" {
+		rules, err := service.LoadCarrierRules(config.CarrierRules)
+		if err != nil {
+			log.Fatalf("cannot load carrier rules: %v", err)
+		}
+
+		opts = append(opts, service.WithCarrierRules(rules...))
+	}
+	if pricer != nil {
+		opts = append(opts, service.WithOrderPricing(pricer))
+	}
+
+	// initialize the order store with our sample data
+	err = service.SeedOrders(orderStore)
+	if err != nil {
+		log.Fatalf("cannot seed orders: %v", err)
+	}
+
+	// the orders stored with only a legacy float price get their Money amount.
+	migrated, err := service.MigrateOrderAmounts(orderStore)
+	if err != nil {
+		log.Fatalf("cannot migrate order amounts: %v", err)
+	}
+	log.Printf("migrated the amounts of %d orders", migrated)
+
+	return service.NewOrderManagementServer(orderStore, opts...), func() {
+		eventLog.Close()
+		sagaLog.Close()
+	}
+}
+
+// newOrderPricer() function returns the pricer of the orders. A catalog
+// hosted by this server, whose address is not configured, is called directly,
+// without a connection or an API key. The other catalogs are dialed with the
+// TLS config of the server, which presents its certificate to them.
+func newOrderPricer(config *service.ServerConfig, productServer pb.ProductInfoServer, laptopServer pb.LaptopServiceServer) (*service.OrderPricer, error) {
+	creds := insecure.NewCredentials()
+	if config.TLS.Enabled && (config.Orders.ProductAddress != "" || config.Orders.LaptopAddress != "") {
+		var err error
+		creds, err = loadClientTLSCredentials(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var productCatalog service.ProductCatalog
+	if config.Orders.ProductAddress != "" {
+		catalog, err := service.DialProductCatalog(config.Orders.ProductAddress, creds)
+		if err != nil {
+			return nil, err
+		}
+
+		productCatalog = catalog
+		log.Printf("pricing orders with the product catalog at %s", config.Orders.ProductAddress)
+	} else {
+		productCatalog = service.LocalProductCatalog(productServer)
+		log.Printf("pricing orders with the product catalog of this server")
+	}
+
+	var laptopCatalog service.LaptopCatalog
+	if config.Orders.LaptopAddress != "" {
+		catalog, err := service.DialLaptopCatalog(config.Orders.LaptopAddress, creds, config.Orders.LaptopAPIKey)
+		if err != nil {
+			return nil, err
+		}
+
+		laptopCatalog = catalog
+		log.Printf("pricing orders with the laptop catalog at %s", config.Orders.LaptopAddress)
+	} else {
+		laptopCatalog = service.LocalLaptopCatalog(laptopServer)
+		log.Printf("pricing orders with the laptop catalog of this server")
+	}
+
+	return service.NewOrderPricer(productCatalog, laptopCatalog, config.Orders.TaxRate), nil
+}
+
+// loadClientTLSCredentials() function returns the credentials used to call
+// the catalogs of another server: the server certificate of the config is
+// presented as the client certificate, and the catalogs are verified with its CA.
+func loadClientTLSCredentials(tlsConfig service.TLSConfig) (credentials.TransportCredentials, error) {
+	pemServerCA, err := os.ReadFile(tlsConfig.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(pemServerCA) {
+		return nil, fmt.Errorf("failed to add server CA's certificate")
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(tlsConfig.ServerCert, tlsConfig.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}
+
+	return credentials.NewTLS(config), nil
+}
@@ -25,6 +25,13 @@ const _ = grpc.SupportPackageIsVersion7
 type OrderManagementClient interface {
 	// addOrder is a remote method unary rpc to add an order and returns order id
 	// It's a single request single response rpc service
+	// When the server prices orders, the items of the order reference products of
+	// the ProductInfo and LaptopService catalogs, and the server computes the
+	// prices. Unknown products are rejected with InvalidArgument, and a
+	// google.rpc.BadRequest detail lists the offending fields.
+	// The order ID is always generated by the server, an order with an ID is
+	// rejected with InvalidArgument. A retry sends the idempotency-key metadata
+	// of the first attempt to get the ID of its order back.
 	AddOrder(ctx context.Context, in *Order, opts ...grpc.CallOption) (*wrapperspb.StringValue, error)
 	// getOrder is a remote method unary rpc to get an order.
 	// The client sends a request parameter of an oder id and the server responds with the order
@@ -33,16 +40,54 @@ type OrderManagementClient interface {
 	GetOrder(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*Order, error)
 	// searchOrders is a remote method server-side streaming rpc that receives a single request
 	//from the client and the server responses/returns stream of order messages to the client
+	// The orders are those with an item containing the search string, sent in order of ID.
 	SearchOrders(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (OrderManagement_SearchOrdersClient, error)
+	// queryOrders is a remote method unary rpc that returns one page of the orders
+	// matching a structured query. The next page is requested with the
+	// next_page_token of the response, and the same query.
+	QueryOrders(ctx context.Context, in *OrderQuery, opts ...grpc.CallOption) (*QueryOrdersResponse, error)
+	// Deprecated: Do not use.
 	// updateOrders is a remote mthod client- side streaming rpc that receives multiple input stream
 	// messages from the client. As the server only sends a single response, the return
 	// value is a single string message.
+	// It is replaced by batchUpdateOrders, and only served when the server is
+	// started with -legacy-update-orders. The stream fails on the first order
+	// that cannot be updated.
 	UpdateOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_UpdateOrdersClient, error)
+	// batchUpdateOrders is a client-streaming rpc that updates the orders
+	// received from the client one by one. An order that cannot be updated does
+	// not stop the stream: the response has the outcome of every order.
+	BatchUpdateOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_BatchUpdateOrdersClient, error)
 	// processOrders is bidirectional-streaming RPC, the client is sending a request to the
 	// server as a stream of messages. The server also responds with a stream of messages.
 	// The call has to be initiated from the client side, but after that, the
 	// communication is completely based on the application logic of the gRPC client and the server.
+	// The orders are combined by destination. A combined shipment is sent back when
+	// it is full, when it has waited for the batching window, or at the end of the
+	// client stream. Order IDs that cannot be processed get an error message each.
 	ProcessOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_ProcessOrdersClient, error)
+	// getShipment returns a combined shipment sent by processOrders.
+	GetShipment(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*CombinedShipment, error)
+	// listShipments returns one page of the combined shipments sent by
+	// processOrders. The next page is requested with the next_page_token of the
+	// response, and the same filters.
+	ListShipments(ctx context.Context, in *ListShipmentsRequest, opts ...grpc.CallOption) (*ListShipmentsResponse, error)
+	// transitionOrder moves an order to a new status of its lifecycle, and returns
+	// the updated order. Transitions that the lifecycle does not allow are
+	// rejected with FailedPrecondition.
+	TransitionOrder(ctx context.Context, in *TransitionOrderRequest, opts ...grpc.CallOption) (*Order, error)
+	// cancelOrder cancels an order that is not shipped yet. It releases the laptop
+	// stock reserved for the order, removes the order from the combined shipments
+	// being filled, and refunds the order if it was paid.
+	CancelOrder(ctx context.Context, in *CancelOrderRequest, opts ...grpc.CallOption) (*CancelOrderResponse, error)
+	// refundOrder refunds a delivered order, or a paid order that was cancelled
+	// without being refunded.
+	RefundOrder(ctx context.Context, in *RefundOrderRequest, opts ...grpc.CallOption) (*RefundOrderResponse, error)
+	// watchOrders is a server-streaming rpc that sends the order events after the
+	// given sequence number, then the new events as they happen. The server keeps
+	// a bounded number of events: resuming from an event that is no longer kept
+	// fails with OutOfRange, and the consumer has to resynchronize with queryOrders.
+	WatchOrders(ctx context.Context, in *WatchOrdersRequest, opts ...grpc.CallOption) (OrderManagement_WatchOrdersClient, error)
 }
 
 type orderManagementClient struct {
@@ -103,6 +148,16 @@ func (x *orderManagementSearchOrdersClient) Recv() (*Order, error) {
 	return m, nil
 }
 
+func (c *orderManagementClient) QueryOrders(ctx context.Context, in *OrderQuery, opts ...grpc.CallOption) (*QueryOrdersResponse, error) {
+	out := new(QueryOrdersResponse)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/queryOrders", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Deprecated: Do not use.
 func (c *orderManagementClient) UpdateOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_UpdateOrdersClient, error) {
 	stream, err := c.cc.NewStream(ctx, &OrderManagement_ServiceDesc.Streams[1], "/ecommerce.OrderManagement/updateOrders", opts...)
 	if err != nil {
@@ -137,8 +192,42 @@ func (x *orderManagementUpdateOrdersClient) CloseAndRecv() (*wrapperspb.StringVa
 	return m, nil
 }
 
+func (c *orderManagementClient) BatchUpdateOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_BatchUpdateOrdersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OrderManagement_ServiceDesc.Streams[2], "/ecommerce.OrderManagement/batchUpdateOrders", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderManagementBatchUpdateOrdersClient{stream}
+	return x, nil
+}
+
+type OrderManagement_BatchUpdateOrdersClient interface {
+	Send(*UpdateOrderRequest) error
+	CloseAndRecv() (*UpdateOrdersSummary, error)
+	grpc.ClientStream
+}
+
+type orderManagementBatchUpdateOrdersClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderManagementBatchUpdateOrdersClient) Send(m *UpdateOrderRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *orderManagementBatchUpdateOrdersClient) CloseAndRecv() (*UpdateOrdersSummary, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UpdateOrdersSummary)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *orderManagementClient) ProcessOrders(ctx context.Context, opts ...grpc.CallOption) (OrderManagement_ProcessOrdersClient, error) {
-	stream, err := c.cc.NewStream(ctx, &OrderManagement_ServiceDesc.Streams[2], "/ecommerce.OrderManagement/processOrders", opts...)
+	stream, err := c.cc.NewStream(ctx, &OrderManagement_ServiceDesc.Streams[3], "/ecommerce.OrderManagement/processOrders", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -148,7 +237,7 @@ func (c *orderManagementClient) ProcessOrders(ctx context.Context, opts ...grpc.
 
 type OrderManagement_ProcessOrdersClient interface {
 	Send(*wrapperspb.StringValue) error
-	Recv() (*CombinedShipment, error)
+	Recv() (*ProcessOrdersResponse, error)
 	grpc.ClientStream
 }
 
@@ -160,8 +249,85 @@ func (x *orderManagementProcessOrdersClient) Send(m *wrapperspb.StringValue) err
 	return x.ClientStream.SendMsg(m)
 }
 
-func (x *orderManagementProcessOrdersClient) Recv() (*CombinedShipment, error) {
-	m := new(CombinedShipment)
+func (x *orderManagementProcessOrdersClient) Recv() (*ProcessOrdersResponse, error) {
+	m := new(ProcessOrdersResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *orderManagementClient) GetShipment(ctx context.Context, in *wrapperspb.StringValue, opts ...grpc.CallOption) (*CombinedShipment, error) {
+	out := new(CombinedShipment)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/getShipment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderManagementClient) ListShipments(ctx context.Context, in *ListShipmentsRequest, opts ...grpc.CallOption) (*ListShipmentsResponse, error) {
+	out := new(ListShipmentsResponse)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/listShipments", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderManagementClient) TransitionOrder(ctx context.Context, in *TransitionOrderRequest, opts ...grpc.CallOption) (*Order, error) {
+	out := new(Order)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/transitionOrder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderManagementClient) CancelOrder(ctx context.Context, in *CancelOrderRequest, opts ...grpc.CallOption) (*CancelOrderResponse, error) {
+	out := new(CancelOrderResponse)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/cancelOrder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderManagementClient) RefundOrder(ctx context.Context, in *RefundOrderRequest, opts ...grpc.CallOption) (*RefundOrderResponse, error) {
+	out := new(RefundOrderResponse)
+	err := c.cc.Invoke(ctx, "/ecommerce.OrderManagement/refundOrder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderManagementClient) WatchOrders(ctx context.Context, in *WatchOrdersRequest, opts ...grpc.CallOption) (OrderManagement_WatchOrdersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OrderManagement_ServiceDesc.Streams[4], "/ecommerce.OrderManagement/watchOrders", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderManagementWatchOrdersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OrderManagement_WatchOrdersClient interface {
+	Recv() (*OrderEvent, error)
+	grpc.ClientStream
+}
+
+type orderManagementWatchOrdersClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderManagementWatchOrdersClient) Recv() (*OrderEvent, error) {
+	m := new(OrderEvent)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
@@ -174,6 +340,13 @@ func (x *orderManagementProcessOrdersClient) Recv() (*CombinedShipment, error) {
 type OrderManagementServer interface {
 	// addOrder is a remote method unary rpc to add an order and returns order id
 	// It's a single request single response rpc service
+	// When the server prices orders, the items of the order reference products of
+	// the ProductInfo and LaptopService catalogs, and the server computes the
+	// prices. Unknown products are rejected with InvalidArgument, and a
+	// google.rpc.BadRequest detail lists the offending fields.
+	// The order ID is always generated by the server, an order with an ID is
+	// rejected with InvalidArgument. A retry sends the idempotency-key metadata
+	// of the first attempt to get the ID of its order back.
 	AddOrder(context.Context, *Order) (*wrapperspb.StringValue, error)
 	// getOrder is a remote method unary rpc to get an order.
 	// The client sends a request parameter of an oder id and the server responds with the order
@@ -182,16 +355,54 @@ type OrderManagementServer interface {
 	GetOrder(context.Context, *wrapperspb.StringValue) (*Order, error)
 	// searchOrders is a remote method server-side streaming rpc that receives a single request
 	//from the client and the server responses/returns stream of order messages to the client
+	// The orders are those with an item containing the search string, sent in order of ID.
 	SearchOrders(*wrapperspb.StringValue, OrderManagement_SearchOrdersServer) error
+	// queryOrders is a remote method unary rpc that returns one page of the orders
+	// matching a structured query. The next page is requested with the
+	// next_page_token of the response, and the same query.
+	QueryOrders(context.Context, *OrderQuery) (*QueryOrdersResponse, error)
+	// Deprecated: Do not use.
 	// updateOrders is a remote mthod client- side streaming rpc that receives multiple input stream
 	// messages from the client. As the server only sends a single response, the return
 	// value is a single string message.
+	// It is replaced by batchUpdateOrders, and only served when the server is
+	// started with -legacy-update-orders. The stream fails on the first order
+	// that cannot be updated.
 	UpdateOrders(OrderManagement_UpdateOrdersServer) error
+	// batchUpdateOrders is a client-streaming rpc that updates the orders
+	// received from the client one by one. An order that cannot be updated does
+	// not stop the stream: the response has the outcome of every order.
+	BatchUpdateOrders(OrderManagement_BatchUpdateOrdersServer) error
 	// processOrders is bidirectional-streaming RPC, the client is sending a request to the
 	// server as a stream of messages. The server also responds with a stream of messages.
 	// The call has to be initiated from the client side, but after that, the
 	// communication is completely based on the application logic of the gRPC client and the server.
+	// The orders are combined by destination. A combined shipment is sent back when
+	// it is full, when it has waited for the batching window, or at the end of the
+	// client stream. Order IDs that cannot be processed get an error message each.
 	ProcessOrders(OrderManagement_ProcessOrdersServer) error
+	// getShipment returns a combined shipment sent by processOrders.
+	GetShipment(context.Context, *wrapperspb.StringValue) (*CombinedShipment, error)
+	// listShipments returns one page of the combined shipments sent by
+	// processOrders. The next page is requested with the next_page_token of the
+	// response, and the same filters.
+	ListShipments(context.Context, *ListShipmentsRequest) (*ListShipmentsResponse, error)
+	// transitionOrder moves an order to a new status of its lifecycle, and returns
+	// the updated order. Transitions that the lifecycle does not allow are
+	// rejected with FailedPrecondition.
+	TransitionOrder(context.Context, *TransitionOrderRequest) (*Order, error)
+	// cancelOrder cancels an order that is not shipped yet. It releases the laptop
+	// stock reserved for the order, removes the order from the combined shipments
+	// being filled, and refunds the order if it was paid.
+	CancelOrder(context.Context, *CancelOrderRequest) (*CancelOrderResponse, error)
+	// refundOrder refunds a delivered order, or a paid order that was cancelled
+	// without being refunded.
+	RefundOrder(context.Context, *RefundOrderRequest) (*RefundOrderResponse, error)
+	// watchOrders is a server-streaming rpc that sends the order events after the
+	// given sequence number, then the new events as they happen. The server keeps
+	// a bounded number of events: resuming from an event that is no longer kept
+	// fails with OutOfRange, and the consumer has to resynchronize with queryOrders.
+	WatchOrders(*WatchOrdersRequest, OrderManagement_WatchOrdersServer) error
 	mustEmbedUnimplementedOrderManagementServer()
 }
 
@@ -208,12 +419,36 @@ func (UnimplementedOrderManagementServer) GetOrder(context.Context, *wrapperspb.
 func (UnimplementedOrderManagementServer) SearchOrders(*wrapperspb.StringValue, OrderManagement_SearchOrdersServer) error {
 	return status.Errorf(codes.Unimplemented, "method SearchOrders not implemented")
 }
+func (UnimplementedOrderManagementServer) QueryOrders(context.Context, *OrderQuery) (*QueryOrdersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryOrders not implemented")
+}
 func (UnimplementedOrderManagementServer) UpdateOrders(OrderManagement_UpdateOrdersServer) error {
 	return status.Errorf(codes.Unimplemented, "method UpdateOrders not implemented")
 }
+func (UnimplementedOrderManagementServer) BatchUpdateOrders(OrderManagement_BatchUpdateOrdersServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchUpdateOrders not implemented")
+}
 func (UnimplementedOrderManagementServer) ProcessOrders(OrderManagement_ProcessOrdersServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProcessOrders not implemented")
 }
+func (UnimplementedOrderManagementServer) GetShipment(context.Context, *wrapperspb.StringValue) (*CombinedShipment, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetShipment not implemented")
+}
+func (UnimplementedOrderManagementServer) ListShipments(context.Context, *ListShipmentsRequest) (*ListShipmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListShipments not implemented")
+}
+func (UnimplementedOrderManagementServer) TransitionOrder(context.Context, *TransitionOrderRequest) (*Order, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransitionOrder not implemented")
+}
+func (UnimplementedOrderManagementServer) CancelOrder(context.Context, *CancelOrderRequest) (*CancelOrderResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelOrder not implemented")
+}
+func (UnimplementedOrderManagementServer) RefundOrder(context.Context, *RefundOrderRequest) (*RefundOrderResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefundOrder not implemented")
+}
+func (UnimplementedOrderManagementServer) WatchOrders(*WatchOrdersRequest, OrderManagement_WatchOrdersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchOrders not implemented")
+}
 func (UnimplementedOrderManagementServer) mustEmbedUnimplementedOrderManagementServer() {}
 
 // UnsafeOrderManagementServer may be embedded to opt out of forward compatibility for this service.
@@ -284,6 +519,24 @@ func (x *orderManagementSearchOrdersServer) Send(m *Order) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _OrderManagement_QueryOrders_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OrderQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).QueryOrders(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/queryOrders",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).QueryOrders(ctx, req.(*OrderQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _OrderManagement_UpdateOrders_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(OrderManagementServer).UpdateOrders(&orderManagementUpdateOrdersServer{stream})
 }
@@ -310,12 +563,38 @@ func (x *orderManagementUpdateOrdersServer) Recv() (*Order, error) {
 	return m, nil
 }
 
+func _OrderManagement_BatchUpdateOrders_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(OrderManagementServer).BatchUpdateOrders(&orderManagementBatchUpdateOrdersServer{stream})
+}
+
+type OrderManagement_BatchUpdateOrdersServer interface {
+	SendAndClose(*UpdateOrdersSummary) error
+	Recv() (*UpdateOrderRequest, error)
+	grpc.ServerStream
+}
+
+type orderManagementBatchUpdateOrdersServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderManagementBatchUpdateOrdersServer) SendAndClose(m *UpdateOrdersSummary) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *orderManagementBatchUpdateOrdersServer) Recv() (*UpdateOrderRequest, error) {
+	m := new(UpdateOrderRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _OrderManagement_ProcessOrders_Handler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(OrderManagementServer).ProcessOrders(&orderManagementProcessOrdersServer{stream})
 }
 
 type OrderManagement_ProcessOrdersServer interface {
-	Send(*CombinedShipment) error
+	Send(*ProcessOrdersResponse) error
 	Recv() (*wrapperspb.StringValue, error)
 	grpc.ServerStream
 }
@@ -324,7 +603,7 @@ type orderManagementProcessOrdersServer struct {
 	grpc.ServerStream
 }
 
-func (x *orderManagementProcessOrdersServer) Send(m *CombinedShipment) error {
+func (x *orderManagementProcessOrdersServer) Send(m *ProcessOrdersResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
@@ -336,6 +615,117 @@ func (x *orderManagementProcessOrdersServer) Recv() (*wrapperspb.StringValue, er
 	return m, nil
 }
 
+func _OrderManagement_GetShipment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).GetShipment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/getShipment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).GetShipment(ctx, req.(*wrapperspb.StringValue))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderManagement_ListShipments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListShipmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).ListShipments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/listShipments",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).ListShipments(ctx, req.(*ListShipmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderManagement_TransitionOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransitionOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).TransitionOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/transitionOrder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).TransitionOrder(ctx, req.(*TransitionOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderManagement_CancelOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).CancelOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/cancelOrder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).CancelOrder(ctx, req.(*CancelOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderManagement_RefundOrder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefundOrderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderManagementServer).RefundOrder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ecommerce.OrderManagement/refundOrder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderManagementServer).RefundOrder(ctx, req.(*RefundOrderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderManagement_WatchOrders_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchOrdersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OrderManagementServer).WatchOrders(m, &orderManagementWatchOrdersServer{stream})
+}
+
+type OrderManagement_WatchOrdersServer interface {
+	Send(*OrderEvent) error
+	grpc.ServerStream
+}
+
+type orderManagementWatchOrdersServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderManagementWatchOrdersServer) Send(m *OrderEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // OrderManagement_ServiceDesc is the grpc.ServiceDesc for OrderManagement service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -351,6 +741,30 @@ var OrderManagement_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "getOrder",
 			Handler:    _OrderManagement_GetOrder_Handler,
 		},
+		{
+			MethodName: "queryOrders",
+			Handler:    _OrderManagement_QueryOrders_Handler,
+		},
+		{
+			MethodName: "getShipment",
+			Handler:    _OrderManagement_GetShipment_Handler,
+		},
+		{
+			MethodName: "listShipments",
+			Handler:    _OrderManagement_ListShipments_Handler,
+		},
+		{
+			MethodName: "transitionOrder",
+			Handler:    _OrderManagement_TransitionOrder_Handler,
+		},
+		{
+			MethodName: "cancelOrder",
+			Handler:    _OrderManagement_CancelOrder_Handler,
+		},
+		{
+			MethodName: "refundOrder",
+			Handler:    _OrderManagement_RefundOrder_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -363,12 +777,22 @@ var OrderManagement_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _OrderManagement_UpdateOrders_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "batchUpdateOrders",
+			Handler:       _OrderManagement_BatchUpdateOrders_Handler,
+			ClientStreams: true,
+		},
 		{
 			StreamName:    "processOrders",
 			Handler:       _OrderManagement_ProcessOrders_Handler,
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "watchOrders",
+			Handler:       _OrderManagement_WatchOrders_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "order-mangement-service.proto",
 }
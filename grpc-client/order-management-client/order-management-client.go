@@ -7,15 +7,24 @@ import (
 	"log"
 	"time"
 
+	"gRPC-Playground/client"
 	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
 
 	wrapper "github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 const (
 	address = "localhost:50051"
+	// the orders are placed by a user logged in with the AuthService.
+	username = "admin1"
+	password = "secret"
+	// refresh the access token 30 seconds before it expires.
+	refreshBefore = 30 * time.Second
 )
 
 func main() {
@@ -34,9 +43,29 @@ func main() {
 
 	defer conn.Close()
 
+	// the orders are only managed by an authenticated user, so we login with the
+	// AuthService first, and send its access token with every order RPC.
+	tokenCredentials, err := client.NewTokenCredentials(client.NewAuthClient(conn, username, password), orderMethods(), refreshBefore)
+	if err != nil {
+		log.Fatalf("cannot login: %v", err)
+	}
+	defer tokenCredentials.Close()
+
+	authConn, err := grpc.Dial(
+		address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(tokenCredentials),
+		grpc.WithUnaryInterceptor(tokenCredentials.Unary()),
+		grpc.WithStreamInterceptor(tokenCredentials.Stream()),
+	)
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer authConn.Close()
+
 	// Once the gRPC channel is setup, we need a client stub to perform RPCs. We get it using
 	// the NewProductInfoClient method provided by the pb package generated from the .proto file.
-	c := pb.NewOrderManagementClient(conn)
+	c := pb.NewOrderManagementClient(authConn)
 
 	ctx, cancel := context.WithTimeout(
 		context.Background(),
@@ -45,6 +74,24 @@ func main() {
 
 	defer cancel()
 
+	// Calling the simple RPC AddOrder. The server generates the order ID.
+	// The idempotency key makes it safe to retry the call after a timeout.
+	addedOrderID, err := c.AddOrder(
+		metadata.AppendToOutgoingContext(ctx, "idempotency-key", "add-airpods-example"),
+		&pb.Order{
+			Items:       []string{"Apple AirPods Pro"},
+			Description: "Wireless earbuds",
+			Price:       249.00,
+			Destination: "San Jose, CA",
+		},
+	)
+
+	if err != nil {
+		log.Fatalf("Could not add order: %v", err)
+	}
+
+	log.Printf("Added order ID: %s\n", addedOrderID.GetValue())
+
 	// Calling the simple RPC GetOrder
 	retrievedOrder, err := c.GetOrder(
 		ctx,
@@ -60,7 +107,7 @@ func main() {
 	log.Printf("Order ID: %s\n", retrievedOrder.Id)
 	log.Printf("Order Items: %q\n", retrievedOrder.Items[:])
 	log.Printf("Order Description: %s\n", retrievedOrder.Description)
-	log.Printf("Order Price: %.2f\n", retrievedOrder.Price)
+	log.Printf("Order Amount: %s\n", money.Format(retrievedOrder.GetAmount()))
 	log.Printf("Order Destination: %s\n", retrievedOrder.Destination)
 
 	// searchOrder rpc client
@@ -88,21 +135,54 @@ func main() {
 		log.Print("Search Result : ", searchOrder)
 	}
 
-	// UpdateOrders rpc client
-	// Invoking UpdateOrders remote method.
+	// queryOrders rpc client: the pending orders to Mountain View, most expensive first,
+	// two per page. The next page is asked with the token of the previous one.
+	query := &pb.OrderQuery{
+		Destination: "Mountain View",
+		Statuses:    []pb.Order_Status{pb.Order_PENDING},
+		SortBy:      pb.OrderQuery_PRICE,
+		Descending:  true,
+		PageSize:    2,
+	}
+	for page := 1; ; page++ {
+		queryResult, err := c.QueryOrders(ctx, query)
+		if err != nil {
+			log.Fatalf("Could not query orders: %v", err)
+		}
+
+		for _, order := range queryResult.GetOrders() {
+			log.Printf("Query Result page %d : %s %s", page, order.GetId(), money.Format(order.GetAmount()))
+		}
+
+		if queryResult.GetNextPageToken() == "" {
+			break
+		}
+		query.PageToken = queryResult.GetNextPageToken()
+	}
+
+	// BatchUpdateOrders rpc client
+	// Invoking BatchUpdateOrders remote method.
 
-	updateStream, err := c.UpdateOrders(ctx)
+	updateStream, err := c.BatchUpdateOrders(ctx)
 
 	if err != nil {
-		log.Fatalf("%v.UpdateOrders(_) = _, %v", c, err)
+		log.Fatalf("%v.BatchUpdateOrders(_) = _, %v", c, err)
 	}
 
 	// *** Define Orders to Update ***
-	updOrder1 := pb.Order{Id: "102", Items: []string{"Google Pixel 3A", "Google Pixel Book"}, Destination: "Mountain View, CA", Price: 1100.00}
+	updOrder1 := pb.UpdateOrderRequest{Order: &pb.Order{Id: "102", Items: []string{"Google Pixel 3A", "Google Pixel Book"}, Destination: "Mountain View, CA", Price: 1100.00}}
 
-	updOrder2 := pb.Order{Id: "103", Items: []string{"Apple Watch S4", "Mac Book Pro", "iPad Pro"}, Destination: "San Jose, CA", Price: 2800.00}
+	// only the fields of the update mask are updated.
+	updOrder2 := pb.UpdateOrderRequest{
+		Order:      &pb.Order{Id: "103", Items: []string{"Apple Watch S4", "Mac Book Pro", "iPad Pro"}, Price: 2800.00},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"items", "price"}},
+	}
 
-	updOrder3 := pb.Order{Id: "104", Items: []string{"Google Home Mini", "Google Nest Hub", "iPad Mini"}, Destination: "Mountain View, CA", Price: 2200.00}
+	// the order is only updated if nobody else has changed it since it was placed.
+	updOrder3 := pb.UpdateOrderRequest{
+		Order:           &pb.Order{Id: "104", Items: []string{"Google Home Mini", "Google Nest Hub", "iPad Mini"}, Destination: "Mountain View, CA", Price: 2200.00},
+		ExpectedVersion: 1,
+	}
 
 	// Updating order 1
 	if err := updateStream.Send(&updOrder1); err != nil {
@@ -132,8 +212,32 @@ func main() {
 		log.Fatalf("%v.CloseAndRecv() got error %v, want %v", updateStream, err, nil)
 	}
 
-	// Otherwise
-	log.Printf("Update Orders Res : %s", updateRes)
+	// Otherwise, the response has the outcome of every order.
+	for _, result := range updateRes.GetResults() {
+		log.Printf("Update Orders Res : %s %s version %d %s", result.GetOrderId(), result.GetOutcome(), result.GetVersion(), result.GetMessage())
+	}
+
+	// Moving order 102 along its lifecycle with the TransitionOrder RPC.
+	// Illegal transitions, such as from PENDING to SHIPPED, fail with FailedPrecondition.
+	paidOrder, err := c.TransitionOrder(
+		ctx,
+		&pb.TransitionOrderRequest{OrderId: "102", Status: pb.Order_PAID, Reason: "payment received"},
+	)
+
+	if err != nil {
+		log.Fatalf("Could not transition order: %v", err)
+	}
+
+	log.Printf("Order %s is now %s", paidOrder.GetId(), paidOrder.GetStatus())
+
+	// Cancelling the paid order 102 with the CancelOrder RPC also refunds it.
+	cancelled, err := c.CancelOrder(ctx, &pb.CancelOrderRequest{OrderId: "102", Reason: "customer request"})
+
+	if err != nil {
+		log.Fatalf("Could not cancel order: %v", err)
+	}
+
+	log.Printf("Order %s is now %s, refunded %.2f", cancelled.GetOrder().GetId(), cancelled.GetOrder().GetStatus(), cancelled.GetRefund().GetAmount())
 
 	// =========================================
 	// Process Order : Bi-di streaming scenario
@@ -163,6 +267,12 @@ func main() {
 		log.Fatalf("%v.Send(%v) = %v", c, "104", err)
 	}
 
+	// An unknown order ID gets an error response, and the stream goes on.
+	if err := streamProcessOrder.Send(
+		&wrapper.StringValue{Value: "999"}); err != nil {
+		log.Fatalf("%v.Send(%v) = %v", c, "999", err)
+	}
+
 	// Create a channel for use with goroutines
 	channel := make(chan bool, 1)
 
@@ -179,19 +289,57 @@ func main() {
 
 	<-channel
 
+	// The shipments sent by processOrders can be listed afterwards, here those
+	// going to California.
+	shipments, err := c.ListShipments(ctx, &pb.ListShipmentsRequest{Region: "CA"})
+	if err != nil {
+		log.Fatalf("%v.ListShipments(_) = _, %v", c, err)
+	}
+
+	for _, shipment := range shipments.GetShipments() {
+		log.Printf("Shipment %s to %s by %s, delivered on %s", shipment.GetId(), shipment.GetDestination().GetCity(),
+			shipment.GetCarrier(), shipment.GetEstimatedDelivery().AsTime().Format("2006-01-02"))
+	}
+
 }
 
 func asyncClientBidirectionalRPC(streamProcessOrder pb.OrderManagement_ProcessOrdersClient, c chan bool)  {
 	for {
-		combinedShipment, err := streamProcessOrder.Recv()
+		res, err := streamProcessOrder.Recv()
 
 		if err == io.EOF {
 			break
 
 		}
 
-		log.Printf("Combined shipment : %s", combinedShipment.OrdersList)
+		if err != nil {
+			log.Printf("Process orders error : %v", err)
+			break
+		}
+
+		// Each response is either a combined shipment or the error of an order ID.
+		if processErr := res.GetError(); processErr != nil {
+			log.Printf("Cannot process order %s : %s", processErr.GetOrderId(), processErr.GetMessage())
+			continue
+		}
+
+		shipment := res.GetShipment()
+		log.Printf("Combined shipment by %s : %s", shipment.GetCarrier(), shipment.GetOrdersList())
 	}
 
 	c <- true
 }
+
+// orderMethods function returns the full names of the OrderManagement RPCs,
+// which all need the access token.
+func orderMethods() map[string]bool {
+	methods := make(map[string]bool)
+	for _, method := range pb.OrderManagement_ServiceDesc.Methods {
+		methods["/"+pb.OrderManagement_ServiceDesc.ServiceName+"/"+method.MethodName] = true
+	}
+	for _, stream := range pb.OrderManagement_ServiceDesc.Streams {
+		methods["/"+pb.OrderManagement_ServiceDesc.ServiceName+"/"+stream.StreamName] = true
+	}
+
+	return methods
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"time"
 
 	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -40,7 +42,7 @@ func main() {
 	description := `Meet Apple iPhone 11. All-new dual-camera system
 	                with Ultra Wide and Night mode.`
 
-	price := float32(1000.0)
+	price := &pb.Money{CurrencyCode: "USD", Units: 1000}
 
 	ctx, cancel := context.WithTimeout(
 		context.Background(),
@@ -55,7 +57,7 @@ func main() {
 		&pb.Product{
 			Name:        name,
 			Description: description,
-			Price:       price,
+			ListPrice:   price,
 		},
 	)
 
@@ -80,6 +82,61 @@ func main() {
 	log.Printf("Product ID: %s\n", product.Id)
 	log.Printf("Product Name: %s\n", product.Name)
 	log.Printf("Product Desc: %s\n", product.Description)
-	log.Printf("Product Price: %.2f\n", product.Price)
+	log.Printf("Product Price: %s\n", money.Format(product.GetListPrice()))
+
+	// Changing the price of the product with UpdateProduct
+	product.ListPrice = &pb.Money{CurrencyCode: "USD", Units: 899}
+	updated, err := c.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: product})
+	if err != nil {
+		log.Fatalf("Could not update product: %v", err)
+	}
+
+	log.Printf("Product Price updated to: %s\n", money.Format(updated.GetProduct().GetListPrice()))
+
+	// Searching the iPhones under 1000 with the server-streaming RPC SearchProducts
+	stream, err := c.SearchProducts(ctx, &pb.SearchProductsRequest{
+		Filter: &pb.ProductFilter{Name: "iphone", MaxPrice: 1000},
+	})
+	if err != nil {
+		log.Fatalf("Could not search products: %v", err)
+	}
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Could not receive product: %v", err)
+		}
+
+		log.Printf("Found product: %s %s\n", res.GetProduct().GetId(), res.GetProduct().GetName())
+	}
+
+	// Listing the catalog page by page with ListProducts
+	listReq := &pb.ListProductsRequest{PageSize: 10}
+	for {
+		page, err := c.ListProducts(ctx, listReq)
+		if err != nil {
+			log.Fatalf("Could not list products: %v", err)
+		}
+
+		for _, product := range page.GetProducts() {
+			log.Printf("Listed product: %s %s\n", product.GetId(), product.GetName())
+		}
+
+		if page.GetNextPageToken() == "" {
+			break
+		}
+		listReq.PageToken = page.GetNextPageToken()
+	}
+
+	// Removing the product with DeleteProduct
+	_, err = c.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: product.Id})
+	if err != nil {
+		log.Fatalf("Could not delete product: %v", err)
+	}
+
+	log.Printf("Product ID: %s deleted\n", product.Id)
 
 }
@@ -0,0 +1,219 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nanosPerUnit is the number of nanos in a unit of a Money.
+const nanosPerUnit = 1_000_000_000
+
+// centsPerUnit is the number of cents in a unit of a Money. The scaled
+// amounts are rounded to whole cents.
+const centsPerUnit = 100
+
+// ErrInvalid is returned when a Money has no valid currency code, or
+// nanos out of range or of another sign than its units.
+var ErrInvalid = errors.New("invalid money")
+
+// ErrCurrencyMismatch is returned when two amounts of different currencies are combined.
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// decimalAmount matches the decimal amounts accepted by Parse.
+var decimalAmount = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]{1,9})?$`)
+
+// Validate checks that a Money has a 3-letter uppercase currency code,
+// and nanos in range and of the same sign as its units.
+func Validate(money *pb.Money) error {
+	if money == nil {
+		return fmt.Errorf("%w: amount is missing", ErrInvalid)
+	}
+
+	code := money.GetCurrencyCode()
+	if !ValidCurrencyCode(code) {
+		return fmt.Errorf("%w: currency code %q is not a 3-letter ISO 4217 code", ErrInvalid, code)
+	}
+
+	units, nanos := money.GetUnits(), money.GetNanos()
+	if nanos <= -nanosPerUnit || nanos >= nanosPerUnit {
+		return fmt.Errorf("%w: nanos %d out of range", ErrInvalid, nanos)
+	}
+	if units > 0 && nanos < 0 || units < 0 && nanos > 0 {
+		return fmt.Errorf("%w: units %d and nanos %d have different signs", ErrInvalid, units, nanos)
+	}
+
+	return nil
+}
+
+// ValidCurrencyCode reports whether a currency code has 3 uppercase letters.
+func ValidCurrencyCode(code string) bool {
+	return len(code) == 3 && strings.IndexFunc(code, func(r rune) bool { return r < 'A' || r > 'Z' }) < 0
+}
+
+// Parse parses a decimal amount, such as "1800.25", with at most 9 decimals.
+func Parse(currencyCode string, amount string) (*pb.Money, error) {
+	if !decimalAmount.MatchString(amount) {
+		return nil, fmt.Errorf("%w: %q is not a decimal amount with at most 9 decimals", ErrInvalid, amount)
+	}
+
+	rat, _ := new(big.Rat).SetString(amount)
+	return fromRat(currencyCode, rat)
+}
+
+// FromFloat converts a float price to a Money. The float is read as the
+// shortest decimal that converts back to it with the given bit size, 32 for
+// a float field and 64 for a double field, so that a float32 29.99 is 29.99
+// and not 29.9899997711. The decimal is rounded to the nano.
+func FromFloat(currencyCode string, amount float64, bitSize int) (*pb.Money, error) {
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return nil, fmt.Errorf("%w: %v is not a finite amount", ErrInvalid, amount)
+	}
+
+	rat, _ := new(big.Rat).SetString(strconv.FormatFloat(amount, 'f', -1, bitSize))
+	return fromRat(currencyCode, rat)
+}
+
+// ToFloat returns the float closest to a Money, for the legacy float fields.
+func ToFloat(money *pb.Money) float64 {
+	amount, _ := toRat(money).Float64()
+	return amount
+}
+
+// Format formats a Money as a decimal amount followed by its currency
+// code, such as "1800.25 USD". It keeps at least 2 decimals.
+func Format(money *pb.Money) string {
+	amount := toRat(money).FloatString(9)
+	amount = strings.TrimRight(amount, "0")
+	if dot := strings.IndexByte(amount, '.'); len(amount)-dot < 3 {
+		amount += strings.Repeat("0", 3-(len(amount)-dot))
+	}
+
+	return amount + " " + money.GetCurrencyCode()
+}
+
+// Add returns a + b, exactly. They must have the same currency.
+func Add(a *pb.Money, b *pb.Money) (*pb.Money, error) {
+	err := checkCurrencies(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromNanos(a.GetCurrencyCode(), new(big.Int).Add(nanos(a), nanos(b)))
+}
+
+// Subtract returns a - b, exactly. They must have the same currency.
+func Subtract(a *pb.Money, b *pb.Money) (*pb.Money, error) {
+	err := checkCurrencies(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromNanos(a.GetCurrencyCode(), new(big.Int).Sub(nanos(a), nanos(b)))
+}
+
+// Multiply returns money times a quantity, exactly.
+func Multiply(money *pb.Money, quantity int64) (*pb.Money, error) {
+	err := Validate(money)
+	if err != nil {
+		return nil, err
+	}
+
+	return fromNanos(money.GetCurrencyCode(), new(big.Int).Mul(nanos(money), big.NewInt(quantity)))
+}
+
+// Scale returns money times a rate, such as a tax rate, a percentage or an
+// exchange rate, rounded to the cent, half away from zero.
+func Scale(money *pb.Money, rate *big.Rat) (*pb.Money, error) {
+	err := Validate(money)
+	if err != nil {
+		return nil, err
+	}
+
+	cents := roundRat(new(big.Rat).Mul(toRat(money), rate), centsPerUnit)
+	return fromNanos(money.GetCurrencyCode(), cents.Mul(cents, big.NewInt(nanosPerUnit/centsPerUnit)))
+}
+
+// Compare returns -1, 0 or 1 when a is less than, equal to, or greater
+// than b. They must have the same currency.
+func Compare(a *pb.Money, b *pb.Money) (int, error) {
+	err := checkCurrencies(a, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return nanos(a).Cmp(nanos(b)), nil
+}
+
+// Sign returns -1, 0 or 1 when money is negative, zero or positive.
+func Sign(money *pb.Money) int {
+	return nanos(money).Sign()
+}
+
+// checkCurrencies() function checks that two amounts are valid and of the same currency.
+func checkCurrencies(a *pb.Money, b *pb.Money) error {
+	for _, money := range []*pb.Money{a, b} {
+		err := Validate(money)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.GetCurrencyCode() != b.GetCurrencyCode() {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, a.GetCurrencyCode(), b.GetCurrencyCode())
+	}
+
+	return nil
+}
+
+// nanos() function returns the amount of a Money in nanos.
+func nanos(money *pb.Money) *big.Int {
+	nanos := new(big.Int).Mul(big.NewInt(money.GetUnits()), big.NewInt(nanosPerUnit))
+	return nanos.Add(nanos, big.NewInt(int64(money.GetNanos())))
+}
+
+// toRat() function returns the amount of a Money in units.
+func toRat(money *pb.Money) *big.Rat {
+	return new(big.Rat).SetFrac(nanos(money), big.NewInt(nanosPerUnit))
+}
+
+// fromNanos() function returns the Money of an amount in nanos, or an
+// error if its units do not fit in an int64.
+func fromNanos(currencyCode string, nanos *big.Int) (*pb.Money, error) {
+	// Quo and Rem truncate toward zero, so the units and the nanos have the same sign.
+	units, rem := new(big.Int).QuoRem(nanos, big.NewInt(nanosPerUnit), new(big.Int))
+	if !units.IsInt64() {
+		return nil, fmt.Errorf("%w: amount overflows", ErrInvalid)
+	}
+
+	money := &pb.Money{
+		CurrencyCode: currencyCode,
+		Units:        units.Int64(),
+		Nanos:        int32(rem.Int64()),
+	}
+
+	return money, Validate(money)
+}
+
+// fromRat() function rounds an amount to the nano, half away from zero.
+func fromRat(currencyCode string, amount *big.Rat) (*pb.Money, error) {
+	return fromNanos(currencyCode, roundRat(amount, nanosPerUnit))
+}
+
+// roundRat() function returns an amount times scale, rounded to an integer
+// half away from zero.
+func roundRat(amount *big.Rat, scale int64) *big.Int {
+	scaled := new(big.Rat).Mul(amount, new(big.Rat).SetInt64(scale))
+
+	rounded, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if new(big.Int).Mul(rem.Abs(rem), big.NewInt(2)).Cmp(scaled.Denom()) >= 0 {
+		rounded.Add(rounded, big.NewInt(int64(scaled.Sign())))
+	}
+
+	return rounded
+}
@@ -0,0 +1,71 @@
+package money_test
+
+import (
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// usd returns an amount in USD.
+func usd(t *testing.T, amount string) *pb.Money {
+	price, err := money.Parse("USD", amount)
+	require.NoError(t, err)
+	return price
+}
+
+func TestMoney(t *testing.T) {
+	t.Parallel()
+
+	require.True(t, proto.Equal(&pb.Money{CurrencyCode: "USD", Units: 1800, Nanos: 250000000}, usd(t, "1800.25")))
+	require.True(t, proto.Equal(&pb.Money{CurrencyCode: "USD", Nanos: -500000000}, usd(t, "-0.5")))
+	for _, amount := range []string{"", "1.2.3", "1e3", "1/3", "0.1234567891"} {
+		_, err := money.Parse("USD", amount)
+		require.ErrorIs(t, err, money.ErrInvalid, amount)
+	}
+	_, err := money.Parse("usd", "1")
+	require.ErrorIs(t, err, money.ErrInvalid)
+
+	// a float32 price is read as the decimal it was written as.
+	price, err := money.FromFloat("USD", float64(float32(29.99)), 32)
+	require.NoError(t, err)
+	require.Equal(t, "29.99 USD", money.Format(price))
+
+	// adding ten cents ten times is exactly a dollar, which it is not in floats.
+	sum := usd(t, "0")
+	for i := 0; i < 10; i++ {
+		sum, err = money.Add(sum, usd(t, "0.1"))
+		require.NoError(t, err)
+	}
+	require.True(t, proto.Equal(usd(t, "1"), sum))
+
+	diff, err := money.Subtract(usd(t, "1"), usd(t, "1.25"))
+	require.NoError(t, err)
+	require.Equal(t, "-0.25 USD", money.Format(diff))
+
+	product, err := money.Multiply(usd(t, "19.99"), 3)
+	require.NoError(t, err)
+	require.Equal(t, "59.97 USD", money.Format(product))
+
+	cmp, err := money.Compare(usd(t, "1999.999999999"), usd(t, "2000"))
+	require.NoError(t, err)
+	require.Equal(t, -1, cmp)
+
+	_, err = money.Add(usd(t, "1"), &pb.Money{CurrencyCode: "EUR", Units: 1})
+	require.ErrorIs(t, err, money.ErrCurrencyMismatch)
+	_, err = money.Add(usd(t, "1"), &pb.Money{CurrencyCode: "USD", Units: 1, Nanos: -1})
+	require.ErrorIs(t, err, money.ErrInvalid)
+
+	// the scaled amounts are rounded to the cent, half away from zero.
+	tax, err := money.Scale(usd(t, "19.99"), big.NewRat(825, 10000))
+	require.NoError(t, err)
+	require.Equal(t, "1.65 USD", money.Format(tax))
+	refund, err := money.Scale(usd(t, "-0.05"), big.NewRat(1, 2))
+	require.NoError(t, err)
+	require.Equal(t, "-0.03 USD", money.Format(refund))
+	require.Equal(t, -1, money.Sign(refund))
+	require.Equal(t, 0, money.Sign(usd(t, "0")))
+}
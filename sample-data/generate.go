@@ -121,6 +121,8 @@ func NewScreen() *pb.Screen {
 func NewLaptop() *pb.Laptop {
 	brand := randomLaptopBrand()
 	name := randomLaptopName(brand)
+	// the price is a whole number of cents, so that price_usd is the same amount.
+	cents := randomInt(150000, 350000)
 
 	laptop := &pb.Laptop{
 		Id:       randomID(),
@@ -135,7 +137,8 @@ func NewLaptop() *pb.Laptop {
 		Weight: &pb.Laptop_WeightKg{
 			WeightKg: randomFloat64(1.0, 3.0),
 		},
-		PriceUsd:    randomFloat64(1500, 3500),
+		Price:       &pb.Money{CurrencyCode: "USD", Units: int64(cents / 100), Nanos: int32(cents % 100 * 10000000)},
+		PriceUsd:    float64(cents) / 100,
 		ReleaseYear: uint32(randomInt(2015, 2019)),
 		UpdatedAt:   timestamppb.Now(),
 	}
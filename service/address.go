@@ -0,0 +1,148 @@
+package service
+
+import (
+	pb "gRPC-Playground/ecommerce"
+	"strings"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultCountry is the country of the destinations that do not have one.
+const defaultCountry = "US"
+
+// countryCodes maps the country names accepted at the end of a destination to their codes.
+var countryCodes = map[string]string{
+	"us":                       "US",
+	"usa":                      "US",
+	"united states":            "US",
+	"united states of america": "US",
+	"canada":                   "CA",
+	"mexico":                   "MX",
+}
+
+// countryNames are the names written at the end of the destinations outside the US.
+var countryNames = map[string]string{
+	"CA": "Canada",
+	"MX": "Mexico",
+}
+
+// usStateCodes maps the names of the US states to their codes.
+var usStateCodes = map[string]string{
+	"alabama": "AL", "alaska": "AK", "arizona": "AZ", "arkansas": "AR", "california": "CA",
+	"colorado": "CO", "connecticut": "CT", "delaware": "DE", "district of columbia": "DC",
+	"florida": "FL", "georgia": "GA", "hawaii": "HI", "idaho": "ID", "illinois": "IL",
+	"indiana": "IN", "iowa": "IA", "kansas": "KS", "kentucky": "KY", "louisiana": "LA",
+	"maine": "ME", "maryland": "MD", "massachusetts": "MA", "michigan": "MI", "minnesota": "MN",
+	"mississippi": "MS", "missouri": "MO", "montana": "MT", "nebraska": "NE", "nevada": "NV",
+	"new hampshire": "NH", "new jersey": "NJ", "new mexico": "NM", "new york": "NY",
+	"north carolina": "NC", "north dakota": "ND", "ohio": "OH", "oklahoma": "OK", "oregon": "OR",
+	"pennsylvania": "PA", "rhode island": "RI", "south carolina": "SC", "south dakota": "SD",
+	"tennessee": "TN", "texas": "TX", "utah": "UT", "vermont": "VT", "virginia": "VA",
+	"washington": "WA", "west virginia": "WV", "wisconsin": "WI", "wyoming": "WY",
+}
+
+// ParseAddress parses a destination written as "[street, ]city[, region [postal code]][, country]",
+// such as "San Jose, CA" or "1 Infinite Loop, Cupertino, California 95014, USA".
+// The spaces are normalized, and the US state names are replaced by their codes,
+// so that the same city written differently has the same address.
+func ParseAddress(destination string) (*pb.Address, error) {
+	var parts []string
+	for _, part := range strings.Split(destination, ",") {
+		part = strings.Join(strings.Fields(part), " ")
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "order destination is required")
+	}
+
+	address := &pb.Address{Country: defaultCountry}
+
+	// a country is only recognized after a city and a region, since CA is also California.
+	if len(parts) >= 3 {
+		if country, ok := countryCodes[strings.ToLower(parts[len(parts)-1])]; ok {
+			address.Country = country
+			parts = parts[:len(parts)-1]
+		}
+	}
+
+	if len(parts) >= 2 {
+		address.Region, address.PostalCode = parseRegion(parts[len(parts)-1], address.GetCountry())
+		parts = parts[:len(parts)-1]
+	}
+
+	address.City = parts[len(parts)-1]
+	address.Street = strings.Join(parts[:len(parts)-1], ", ")
+
+	return address, nil
+}
+
+// parseRegion() function splits the region part of a destination into the
+// region and the postal code, which are the words with digits at its end.
+func parseRegion(part string, country string) (string, string) {
+	words := strings.Fields(part)
+
+	end := len(words)
+	for end > 0 && strings.IndexFunc(words[end-1], unicode.IsDigit) >= 0 {
+		end--
+	}
+
+	region := strings.Join(words[:end], " ")
+	postalCode := strings.Join(words[end:], " ")
+
+	if code, ok := usStateCodes[strings.ToLower(region)]; ok && country == "US" {
+		return code, postalCode
+	}
+
+	return strings.ToUpper(region), postalCode
+}
+
+// formatAddress() function writes an address the way ParseAddress reads it.
+func formatAddress(address *pb.Address) string {
+	var parts []string
+	for _, part := range []string{address.GetStreet(), address.GetCity(),
+		strings.TrimSpace(address.GetRegion() + " " + address.GetPostalCode())} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if address.GetCountry() != defaultCountry {
+		parts = append(parts, countryNames[address.GetCountry()])
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// shipmentKey() function returns the key of the combined shipment of an
+// address: the orders going to the same city are shipped together.
+func shipmentKey(address *pb.Address) string {
+	return address.GetCountry() + "/" + address.GetRegion() + "/" + strings.ToLower(address.GetCity())
+}
+
+// orderAddress() function returns the address of an order, parsing its
+// destination if the order was stored before it had an address.
+func orderAddress(order *pb.Order) (*pb.Address, error) {
+	if order.GetAddress() != nil {
+		return order.GetAddress(), nil
+	}
+
+	return ParseAddress(order.GetDestination())
+}
+
+// setOrderAddress() function parses the destination of an order into its
+// address, and rewrites the destination in the normalized form.
+func setOrderAddress(order *pb.Order) error {
+	address, err := ParseAddress(order.GetDestination())
+	if err != nil {
+		return err
+	}
+
+	order.Address = address
+	order.Destination = formatAddress(address)
+	return nil
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// APIKeyServer is the server that lets admins manage API keys
+type APIKeyServer struct {
+	pb.UnimplementedAPIKeyServiceServer
+	keyStore APIKeyStore
+	auditLog AuditLog
+}
+
+// NewAPIKeyServer returns a new APIKeyServer
+func NewAPIKeyServer(keyStore APIKeyStore, auditLog AuditLog) *APIKeyServer {
+	return &APIKeyServer{
+		keyStore: keyStore,
+		auditLog: auditLog,
+	}
+}
+
+// CreateAPIKey is a unary RPC to create a new API key.
+// The plaintext key is only returned in this response.
+func (server *APIKeyServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "api key name is required")
+	}
+
+	if req.GetRole() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "api key role is required")
+	}
+
+	// a key with an unknown role could not call anything, it is most likely a typo.
+	if !isKnownRole(req.GetRole()) {
+		return nil, status.Errorf(codes.InvalidArgument, "api key role %q is unknown", req.GetRole())
+	}
+
+	for _, method := range req.GetMethods() {
+		if !strings.HasPrefix(method, "/") {
+			return nil, status.Errorf(codes.InvalidArgument, "method %q is not a full RPC method name", method)
+		}
+	}
+
+	// Every key must expire, so that a leaked key is not usable forever.
+	if req.GetExpiresAt() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "api key expiry date is required")
+	}
+
+	expiresAt := req.GetExpiresAt().AsTime()
+	if !expiresAt.After(time.Now()) {
+		return nil, status.Errorf(codes.InvalidArgument, "api key expiry date must be in the future")
+	}
+
+	key, secret, err := NewAPIKey(req.GetName(), req.GetRole(), req.GetMethods(), expiresAt)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate api key: %v", err)
+	}
+	key.Tenant = TenantFromContext(ctx)
+
+	err = server.keyStore.Save(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save api key to the store: %v", err)
+	}
+
+	log.Printf("created api key %s (%s) with role %s", key.ID, key.Name, key.Role)
+	server.audit(ctx, AuditTokenIssued, fmt.Sprintf("api key %s (%s) with role %s", key.ID, key.Name, key.Role))
+
+	res := &pb.CreateAPIKeyResponse{
+		Key:    apiKeyToProto(key),
+		Secret: secret,
+	}
+	return res, nil
+}
+
+// ListAPIKeys is a unary RPC to list all API keys of the admin's tenant, without their secrets.
+func (server *APIKeyServer) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	allKeys, err := server.keyStore.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list api keys: %v", err)
+	}
+
+	tenant := TenantFromContext(ctx)
+	keys := make([]*APIKey, 0, len(allKeys))
+	for _, key := range allKeys {
+		if key.Tenant == tenant {
+			keys = append(keys, key)
+		}
+	}
+
+	// sort the keys so that the listing is stable between calls.
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	res := &pb.ListAPIKeysResponse{}
+	for _, key := range keys {
+		res.Keys = append(res.Keys, apiKeyToProto(key))
+	}
+
+	return res, nil
+}
+
+// RevokeAPIKey is a unary RPC to revoke an API key. It takes effect on the next request.
+func (server *APIKeyServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	// The keys of other tenants are reported as not found, like unknown keys.
+	key, err := server.keyStore.Find(req.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find api key %s: %v", req.GetId(), err)
+	}
+	if key == nil || key.Tenant != TenantFromContext(ctx) {
+		return nil, status.Errorf(codes.NotFound, "cannot revoke api key %s: %v", req.GetId(), ErrNotFound)
+	}
+
+	err = server.keyStore.Revoke(req.GetId())
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		}
+		return nil, status.Errorf(code, "cannot revoke api key %s: %v", req.GetId(), err)
+	}
+
+	log.Printf("revoked api key %s", req.GetId())
+	server.audit(ctx, AuditTokenRevoked, "api key "+req.GetId())
+
+	return &pb.RevokeAPIKeyResponse{}, nil
+}
+
+// audit records an api key change in the audit log, along with the admin who made it.
+func (server *APIKeyServer) audit(ctx context.Context, event AuditEvent, reason string) {
+	method, _ := grpc.Method(ctx)
+	admin := ""
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		admin = claims.Username
+	}
+	recordAudit(server.auditLog, ctx, event, method, admin, reason)
+}
+
+// isKnownRole reports whether some RPC of AccessibleRoles() can be called with the role.
+func isKnownRole(role string) bool {
+	for _, roles := range AccessibleRoles() {
+		for _, accessibleRole := range roles {
+			if accessibleRole == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func apiKeyToProto(key *APIKey) *pb.APIKey {
+	return &pb.APIKey{
+		Id:        key.ID,
+		Name:      key.Name,
+		Role:      key.Role,
+		Methods:   key.Methods,
+		CreatedAt: timestamppb.New(key.CreatedAt),
+		ExpiresAt: timestamppb.New(key.ExpiresAt),
+		Revoked:   key.Revoked,
+	}
+}
@@ -0,0 +1,96 @@
+package service_test
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAPIKeyServer(t *testing.T) {
+	t.Parallel()
+
+	const createLaptop = "/ecommerce.LaptopService/CreateLaptop"
+
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	server := service.NewAPIKeyServer(apiKeyStore, nil)
+	ctx := adminContext()
+	expiresAt := timestamppb.New(time.Now().Add(time.Hour))
+
+	// create: the secret is only returned once.
+	created, err := server.CreateAPIKey(ctx, &pb.CreateAPIKeyRequest{
+		Name:      "importer",
+		Role:      "admin",
+		Methods:   []string{createLaptop},
+		ExpiresAt: expiresAt,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, created.GetSecret())
+	require.Equal(t, "importer", created.GetKey().GetName())
+	require.Equal(t, "admin", created.GetKey().GetRole())
+	require.False(t, created.GetKey().GetRevoked())
+
+	for _, req := range []*pb.CreateAPIKeyRequest{
+		{Role: "admin", ExpiresAt: expiresAt},
+		{Name: "importer", ExpiresAt: expiresAt},
+		{Name: "importer", Role: "superuser", ExpiresAt: expiresAt},
+		{Name: "importer", Role: "admin", Methods: []string{"CreateLaptop"}, ExpiresAt: expiresAt},
+		{Name: "importer", Role: "admin"},
+		{Name: "importer", Role: "admin", ExpiresAt: timestamppb.New(time.Now().Add(-time.Hour))},
+	} {
+		_, err := server.CreateAPIKey(ctx, req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), req.String())
+	}
+
+	// list: the keys are listed without their secrets.
+	list, err := server.ListAPIKeys(ctx, &pb.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetKeys(), 1)
+	require.Equal(t, created.GetKey().GetId(), list.GetKeys()[0].GetId())
+
+	_, secret, err := service.SplitAPIKey(created.GetSecret())
+	require.NoError(t, err)
+	require.NotContains(t, prototext.Format(list), secret)
+
+	// the key authenticates the caller until it is revoked.
+	interceptor := service.NewAuthInterceptor(service.NewJWTManager("secret", time.Minute), service.AccessibleRoles(), service.WithAPIKeys(apiKeyStore))
+	call := func() error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", created.GetSecret()))
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		}
+
+		_, err := interceptor.Unary()(ctx, &pb.CreateLaptopRequest{}, &grpc.UnaryServerInfo{FullMethod: createLaptop}, handler)
+		return err
+	}
+	require.NoError(t, call())
+
+	// revoke: the revoked key is rejected on the next request.
+	_, err = server.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{Id: created.GetKey().GetId()})
+	require.NoError(t, err)
+	require.Equal(t, codes.Unauthenticated, status.Code(call()))
+
+	list, err = server.ListAPIKeys(ctx, &pb.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.True(t, list.GetKeys()[0].GetRevoked())
+
+	_, err = server.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{Id: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the keys of another tenant are neither listed nor revoked.
+	otherCtx := service.ContextWithTenant(adminContext(), "acme")
+	list, err = server.ListAPIKeys(otherCtx, &pb.ListAPIKeysRequest{})
+	require.NoError(t, err)
+	require.Empty(t, list.GetKeys())
+	_, err = server.RevokeAPIKey(otherCtx, &pb.RevokeAPIKeyRequest{Id: created.GetKey().GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
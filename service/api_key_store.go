@@ -0,0 +1,77 @@
+package service
+
+import "sync"
+
+// APIKeyStore is an interface to store API keys
+type APIKeyStore interface {
+	// Save saves a new api key to the store
+	Save(key *APIKey) error
+	// Find finds an api key by ID, it returns nil if the key is not found
+	Find(id string) (*APIKey, error)
+	// List returns all api keys, including revoked and expired ones
+	List() ([]*APIKey, error)
+	// Revoke marks the api key with the given ID as revoked
+	Revoke(id string) error
+}
+
+// InMemoryAPIKeyStore stores api keys in memory
+type InMemoryAPIKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]*APIKey
+}
+
+// NewInMemoryAPIKeyStore returns a new InMemoryAPIKeyStore
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{
+		keys: make(map[string]*APIKey),
+	}
+}
+
+func (store *InMemoryAPIKeyStore) Save(key *APIKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.keys[key.ID] != nil {
+		return ErrAlreadyExists
+	}
+
+	store.keys[key.ID] = key.Clone()
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) Find(id string) (*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	key := store.keys[id]
+	if key == nil {
+		return nil, nil
+	}
+
+	return key.Clone(), nil
+}
+
+func (store *InMemoryAPIKeyStore) List() ([]*APIKey, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	keys := make([]*APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key.Clone())
+	}
+
+	return keys, nil
+}
+
+func (store *InMemoryAPIKeyStore) Revoke(id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	key := store.keys[id]
+	if key == nil {
+		return ErrNotFound
+	}
+
+	key.Revoked = true
+	return nil
+}
@@ -0,0 +1,376 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// AuditEvent is the kind of security decision recorded in the audit log.
+type AuditEvent string
+
+const (
+	AuditLoginSuccess   AuditEvent = "login_success"
+	AuditLoginFailure   AuditEvent = "login_failure"
+	AuditTokenIssued    AuditEvent = "token_issued"
+	AuditTokenRefreshed AuditEvent = "token_refreshed"
+	AuditTokenRevoked   AuditEvent = "token_revoked"
+	AuditAccessAllowed  AuditEvent = "access_allowed"
+	AuditAccessDenied   AuditEvent = "access_denied"
+	AuditAccountUnlock  AuditEvent = "account_unlocked"
+	// AuditSecondFactorRequired is recorded when a correct password opens a
+	// second factor challenge instead of issuing a token.
+	AuditSecondFactorRequired AuditEvent = "second_factor_required"
+	AuditRecoveryCodeUsed     AuditEvent = "recovery_code_used"
+	AuditTOTPEnrolled         AuditEvent = "totp_enrolled"
+	AuditTOTPDisabled         AuditEvent = "totp_disabled"
+)
+
+// AuditEntry is one line of the audit log.
+// Every entry carries the hash of the previous one, and its own hash covers all
+// of its other fields, so editing, removing or reordering entries breaks the chain.
+type AuditEntry struct {
+	Seq         uint64     `json:"seq"`
+	Time        time.Time  `json:"time"`
+	Event       AuditEvent `json:"event"`
+	Method      string     `json:"method,omitempty"`
+	Principal   string     `json:"principal,omitempty"`
+	Tenant      string     `json:"tenant,omitempty"`
+	PeerAddress string     `json:"peer_address,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	PrevHash    string     `json:"prev_hash"`
+	Hash        string     `json:"hash"`
+}
+
+// AuditLog records security decisions
+type AuditLog interface {
+	// Record fills in the sequence number, time and hashes of the entry,
+	// and appends it to the log.
+	Record(entry *AuditEntry) error
+}
+
+// recordAudit records an entry about the call in ctx, taking the peer address
+// and the tenant from the context. A nil audit log records nothing. Failures to write the
+// audit log are logged but do not fail the RPC.
+func recordAudit(auditLog AuditLog, ctx context.Context, event AuditEvent, method, principal, reason string) {
+	if auditLog == nil {
+		return
+	}
+
+	entry := &AuditEntry{
+		Event:     event,
+		Method:    method,
+		Principal: principal,
+		Reason:    reason,
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.PeerAddress = p.Addr.String()
+	}
+
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		entry.Tenant = tenant
+	}
+
+	err := auditLog.Record(entry)
+	if err != nil {
+		log.Printf("cannot write audit log entry: %v", err)
+	}
+}
+
+// hashAuditEntry computes the hash of an entry, chained to the previous hash.
+func hashAuditEntry(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal audit entry: %w", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(entry.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+const auditLogFileName = "audit.jsonl"
+
+// FileAuditLog writes the audit log as JSON lines into a folder.
+// The current file is audit.jsonl. It is only ever opened for appending, and
+// once it grows past maxSize it is rotated to a read-only file named after the
+// time of rotation. The hash chain carries on across rotated files.
+type FileAuditLog struct {
+	mutex   sync.Mutex
+	folder  string
+	maxSize int64
+	now     func() time.Time
+
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+}
+
+// NewFileAuditLog opens the audit log in the given folder, creating it if needed,
+// and resumes the hash chain from its last entry. If now is nil, time.Now is used.
+func NewFileAuditLog(folder string, maxSize int64, now func() time.Time) (*FileAuditLog, error) {
+	if now == nil {
+		now = time.Now
+	}
+
+	err := os.MkdirAll(folder, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create audit log folder: %w", err)
+	}
+
+	auditLog := &FileAuditLog{
+		folder:  folder,
+		maxSize: maxSize,
+		now:     now,
+	}
+
+	// The last entry is in the current file, or in the latest rotated one
+	// if the server stopped right after a rotation.
+	files, err := AuditLogFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditEntry(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			auditLog.seq = last.Seq
+			auditLog.lastHash = last.Hash
+			break
+		}
+	}
+
+	err = auditLog.openCurrentFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return auditLog, nil
+}
+
+func (auditLog *FileAuditLog) Record(entry *AuditEntry) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	entry.Seq = auditLog.seq + 1
+	entry.Time = auditLog.now().UTC()
+	entry.PrevHash = auditLog.lastHash
+
+	hash, err := hashAuditEntry(*entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if auditLog.size > 0 && auditLog.size+int64(len(line)) > auditLog.maxSize {
+		err = auditLog.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write audit entry: %w", err)
+	}
+
+	auditLog.seq = entry.Seq
+	auditLog.lastHash = entry.Hash
+	return nil
+}
+
+// Close closes the current audit log file.
+func (auditLog *FileAuditLog) Close() error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+
+	return auditLog.file.Close()
+}
+
+func (auditLog *FileAuditLog) openCurrentFile() error {
+	file, err := os.OpenFile(
+		filepath.Join(auditLog.folder, auditLogFileName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0o600,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat audit log file: %w", err)
+	}
+
+	auditLog.file = file
+	auditLog.size = info.Size()
+	return nil
+}
+
+func (auditLog *FileAuditLog) rotate() error {
+	err := auditLog.file.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close audit log file: %w", err)
+	}
+
+	current := filepath.Join(auditLog.folder, auditLogFileName)
+	rotated := filepath.Join(auditLog.folder, fmt.Sprintf("audit-%s-%d.jsonl",
+		auditLog.now().UTC().Format("20060102T150405Z"), auditLog.seq))
+
+	err = os.Rename(current, rotated)
+	if err != nil {
+		return fmt.Errorf("cannot rotate audit log file: %w", err)
+	}
+
+	// rotated files are never written again.
+	err = os.Chmod(rotated, 0o400)
+	if err != nil {
+		return fmt.Errorf("cannot make rotated audit log read-only: %w", err)
+	}
+
+	return auditLog.openCurrentFile()
+}
+
+// AuditLogFiles returns the audit log files of a folder, oldest first:
+// the rotated files in order of their last entry, then the current file.
+func AuditLogFiles(folder string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(folder, "audit-*.jsonl"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list audit log files: %w", err)
+	}
+
+	lastSeq := make(map[string]uint64, len(rotated))
+	for _, filename := range rotated {
+		// the suffix is the sequence number of the last entry in the file.
+		base := strings.TrimSuffix(filepath.Base(filename), ".jsonl")
+		var seq uint64
+		fmt.Sscanf(base[strings.LastIndex(base, "-")+1:], "%d", &seq)
+		lastSeq[filename] = seq
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return lastSeq[rotated[i]] < lastSeq[rotated[j]]
+	})
+
+	current := filepath.Join(folder, auditLogFileName)
+	if _, err := os.Stat(current); err == nil {
+		rotated = append(rotated, current)
+	}
+
+	return rotated, nil
+}
+
+// VerifyAuditLog checks the hash chain across the given files, in order.
+// It returns the number of verified entries, or an error pointing at the first
+// entry that was tampered with.
+func VerifyAuditLog(filenames ...string) (int, error) {
+	count := 0
+	prevHash := ""
+	var prevSeq uint64
+
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return count, fmt.Errorf("cannot open audit log file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			err := json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				file.Close()
+				return count, fmt.Errorf("%s: cannot parse entry after seq %d: %w", filename, prevSeq, err)
+			}
+
+			hash, err := hashAuditEntry(entry)
+			if err != nil {
+				file.Close()
+				return count, err
+			}
+
+			if entry.PrevHash != prevHash || entry.Hash != hash || (count > 0 && entry.Seq != prevSeq+1) {
+				file.Close()
+				return count, fmt.Errorf("%s: hash chain broken at seq %d", filename, entry.Seq)
+			}
+
+			prevHash = entry.Hash
+			prevSeq = entry.Seq
+			count++
+		}
+
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return count, fmt.Errorf("cannot read audit log file: %w", err)
+		}
+	}
+
+	return count, nil
+}
+
+// lastAuditEntry returns the last entry of an audit log file, or nil if the
+// file does not exist or is empty.
+func lastAuditEntry(filename string) (*AuditEntry, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log file: %w", err)
+	}
+	defer file.Close()
+
+	var last []byte
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			last = line
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read audit log file: %w", err)
+		}
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	entry := &AuditEntry{}
+	err = json.Unmarshal(last, entry)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse last audit entry: %w", err)
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,65 @@
+package service_test
+
+import (
+	"gRPC-Playground/service"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAuditLogHashChain(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+
+	// a tiny max size makes the log rotate every couple of entries.
+	auditLog, err := service.NewFileAuditLog(folder, 400, clock.Now)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		err := auditLog.Record(&service.AuditEntry{
+			Event:     service.AuditLoginFailure,
+			Method:    "/ecommerce.AuthService/Login",
+			Principal: "admin1",
+			Reason:    "incorrect username/password",
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, auditLog.Close())
+
+	// reopening the log resumes the hash chain where it stopped.
+	auditLog, err = service.NewFileAuditLog(folder, 400, clock.Now)
+	require.NoError(t, err)
+
+	entry := &service.AuditEntry{Event: service.AuditLoginSuccess, Principal: "admin1"}
+	require.NoError(t, auditLog.Record(entry))
+	require.EqualValues(t, 6, entry.Seq)
+	require.NoError(t, auditLog.Close())
+
+	files, err := service.AuditLogFiles(folder)
+	require.NoError(t, err)
+	require.Greater(t, len(files), 2)
+
+	count, err := service.VerifyAuditLog(files...)
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+
+	// changing a single entry breaks the chain.
+	last := files[len(files)-1]
+	data, err := os.ReadFile(last)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(last, []byte(strings.Replace(string(data), "admin1", "user1", 1)), 0o600))
+
+	_, err = service.VerifyAuditLog(files...)
+	require.Error(t, err)
+
+	// so does removing a rotated file.
+	require.NoError(t, os.WriteFile(last, data, 0o600))
+	_, err = service.VerifyAuditLog(files[1:]...)
+	require.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package service
+
+import "context"
+
+// claimsKey is the context key under which the AuthInterceptor stores the
+// verified claims of the caller. It is unexported so no other package can
+// overwrite it.
+type claimsKey struct{}
+
+// ContextWithClaims returns a copy of ctx that carries the given user claims.
+func ContextWithClaims(ctx context.Context, claims *UserClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the user claims stored in ctx by the AuthInterceptor.
+// The second return value is false when the call was not authenticated.
+func ClaimsFromContext(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*UserClaims)
+	return claims, ok && claims != nil
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"log"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -13,15 +14,57 @@ import (
 type AuthInterceptor struct {
 	jwtManager      *JWTManager
 	accessibleRoles map[string][]string
+	// ownershipRules maps an RPC method to the attribute-based check that
+	// runs on each decoded request message of that method.
+	ownershipRules map[string]OwnershipRule
+	// certIdentities maps client certificate identities to roles.
+	// It is nil when certificates are not accepted as credentials.
+	certIdentities *CertIdentityConfig
+	// apiKeyStore holds the API keys accepted in the x-api-key metadata header.
+	// It is nil when API keys are not accepted.
+	apiKeyStore APIKeyStore
+	// auditLog records every allow or deny decision on a protected RPC.
+	auditLog AuditLog
+}
+
+// AuthInterceptorOption configures optional behaviour of an AuthInterceptor.
+type AuthInterceptorOption func(interceptor *AuthInterceptor)
+
+// WithOwnershipRules makes the interceptor evaluate the given ownership rules
+// on every decoded request message, after the role check has passed.
+func WithOwnershipRules(rules map[string]OwnershipRule) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.ownershipRules = rules
+	}
+}
+
+// WithAPIKeys makes the interceptor accept the API keys of the given store,
+// sent in the x-api-key metadata header, as an alternative to an access token.
+func WithAPIKeys(apiKeyStore APIKeyStore) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.apiKeyStore = apiKeyStore
+	}
+}
+
+// WithAuditLog makes the interceptor record its authorization decisions.
+func WithAuditLog(auditLog AuditLog) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		interceptor.auditLog = auditLog
+	}
 }
 
 // NewAuthInterceptor() function builds and returns a new AuthInterceptor object.
-func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string) *AuthInterceptor {
-	return &AuthInterceptor{
+func NewAuthInterceptor(jwtManager *JWTManager, accessibleRoles map[string][]string, opts ...AuthInterceptorOption) *AuthInterceptor {
+	interceptor := &AuthInterceptor{
 		jwtManager:      jwtManager,
 		accessibleRoles: accessibleRoles,
 	}
 
+	for _, opt := range opts {
+		opt(interceptor)
+	}
+
+	return interceptor
 }
 
 // Unary() method auths the interceptor object, which will create and return a
@@ -36,7 +79,20 @@ func (interceptor *AuthInterceptor) Unary() grpc.UnaryServerInterceptor {
 		log.Println("--> unary interceptor: ", info.FullMethod)
 
 		// call interceptor.authorize() with the input context and info.FullMethod
-		err1 := interceptor.authorize(ctx, info.FullMethod)
+		claims, err1 := interceptor.authorize(ctx, info.FullMethod)
+
+		// Then we find out which tenant the call is for.
+		if err1 == nil {
+			ctx, err1 = interceptor.callContext(ctx, claims)
+		}
+
+		// The request is already decoded, so we can run the ownership rule
+		// of the method (if any) right away.
+		if rule, ok := interceptor.ownershipRules[info.FullMethod]; ok && err1 == nil {
+			err1 = rule(ctx, claims, req)
+		}
+
+		interceptor.audit(ctx, info.FullMethod, claims, err1)
 
 		if err1 != nil {
 			return nil, err1
@@ -59,15 +115,137 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 		log.Println("--> stream interceptor: ", info.FullMethod)
 
 		// call interceptor.authorize() with the stream context and info.FullMethod,
-		// and return right away if an error is returned.
-		err := interceptor.authorize(ss.Context(), info.FullMethod)
+		// and find out which tenant the call is for.
+		// Return right away if an error is returned.
+		ctx := ss.Context()
+		claims, err := interceptor.authorize(ctx, info.FullMethod)
+
+		if err == nil {
+			ctx, err = interceptor.callContext(ctx, claims)
+		}
+
+		interceptor.audit(ctx, info.FullMethod, claims, err)
 
 		if err != nil {
 			return err
 		}
 
-		return handler(srv, ss)
+		// Stream messages are only decoded when the handler receives them,
+		// so we wrap the stream to run the ownership rule on each of them.
+		return handler(srv, &authorizedServerStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			claims:       claims,
+			method:       info.FullMethod,
+			rule:         interceptor.ownershipRules[info.FullMethod],
+			interceptor:  interceptor,
+		})
+	}
+}
+
+// callContext() function resolves the tenant of the call, and returns a copy
+// of ctx that carries it along with the claims of the caller.
+func (interceptor *AuthInterceptor) callContext(ctx context.Context, claims *UserClaims) (context.Context, error) {
+	// Publicly accessible RPCs are not authenticated, but a caller that
+	// still sends its access token stays within its own tenant.
+	tenantClaims := claims
+	if tenantClaims == nil {
+		tenantClaims = interceptor.optionalClaims(ctx)
+	}
+
+	tenant, err := resolveTenant(ctx, tenantClaims)
+	if err != nil {
+		return ctx, err
+	}
+
+	return ContextWithTenant(ContextWithClaims(ctx, claims), tenant), nil
+}
+
+// optionalClaims() function returns the claims of the access token or of the
+// client certificate sent by the caller, or nil if there is no valid one.
+func (interceptor *AuthInterceptor) optionalClaims(ctx context.Context) *UserClaims {
+	var certClaims *UserClaims
+	if interceptor.certIdentities != nil {
+		certClaims = interceptor.certIdentities.certificateClaims(ctx)
+	}
+
+	if certClaims != nil && interceptor.certIdentities.Precedence == PreferCertificate {
+		return certClaims
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["authorization"]) == 0 {
+		return certClaims
 	}
+
+	claims, err := interceptor.jwtManager.Verify(md["authorization"][0])
+	if err != nil {
+		return certClaims
+	}
+
+	return claims
+}
+
+// audit() function records the authorization decision on a call in the audit log.
+// Publicly accessible RPCs without an ownership rule involve no decision,
+// so they are not recorded.
+func (interceptor *AuthInterceptor) audit(ctx context.Context, method string, claims *UserClaims, err error) {
+	_, protected := interceptor.accessibleRoles[method]
+	_, hasRule := interceptor.ownershipRules[method]
+	if !protected && !hasRule {
+		return
+	}
+
+	principal := ""
+	if claims != nil {
+		principal = claims.Username
+	}
+
+	if err != nil {
+		recordAudit(interceptor.auditLog, ctx, AuditAccessDenied, method, principal, status.Convert(err).Message())
+		return
+	}
+
+	reason := ""
+	if claims != nil {
+		reason = "role " + claims.Role
+	}
+	recordAudit(interceptor.auditLog, ctx, AuditAccessAllowed, method, principal, reason)
+}
+
+// authorizedServerStream wraps a grpc.ServerStream to carry the caller's claims
+// in its context, and to check every received message against an ownership rule.
+type authorizedServerStream struct {
+	grpc.ServerStream
+	ctx         context.Context
+	claims      *UserClaims
+	method      string
+	rule        OwnershipRule
+	interceptor *AuthInterceptor
+}
+
+func (stream *authorizedServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *authorizedServerStream) RecvMsg(m interface{}) error {
+	err := stream.ServerStream.RecvMsg(m)
+	if err != nil || stream.rule == nil {
+		return err
+	}
+
+	err = stream.rule(stream.ctx, stream.claims, m)
+	if err != nil {
+		stream.interceptor.audit(stream.ctx, stream.method, stream.claims, err)
+	}
+
+	return err
+}
+
+// totpEnrollmentMethods are the only RPCs a TOTP enrollment token gives access to.
+var totpEnrollmentMethods = map[string]bool{
+	"/ecommerce.AuthService/EnrollTOTP":  true,
+	"/ecommerce.AuthService/ConfirmTOTP": true,
 }
 
 // AccessibleRoles() function, builds a list of RPC methods and the roles that can access each of them.
@@ -80,14 +258,71 @@ func AccessibleRoles() map[string][]string {
 	// so I define a constant for it here.
 	const laptopServicePath = "/ecommerce.LaptopService/"
 
+	// All methods of APIKeyService are for admins only.
+	const apiKeyServicePath = "/ecommerce.APIKeyService/"
+
+	const authServicePath = "/ecommerce.AuthService/"
+
+	// The products of the catalog can be read by everyone, but only admins change them.
+	const productInfoPath = "/ecommerce.ProductInfo/"
+
+	// Only admins manage the promotions.
+	const promotionServicePath = "/ecommerce.PromotionService/"
+
+	// Every user has a cart of their own.
+	const cartServicePath = "/ecommerce.CartService/"
+
+	// Users place and manage their own orders, see OwnershipRules(), the
+	// fulfilment of all the orders is for admins only.
+	const orderManagementPath = "/ecommerce.OrderManagement/"
+
 	// create and return a map
 	return map[string][]string{
-		// The first method is CreateLaptop, which only admin users can call.
-		laptopServicePath + "CreateLaptop": {"admin"},
-		// The UploadImage method is also accessible for admin only.
-		laptopServicePath + "UploadImage": {"admin"},
-		// The RateLaptop method can be called by both admin and user.
-		laptopServicePath + "RateLaptop": {"admin", "user"},
+		// Only admins can lift a login lockout.
+		authServicePath + "UnlockUser": {"admin"},
+		// Every user can manage its own second factor.
+		authServicePath + "EnrollTOTP":  {"admin", "vendor", "user"},
+		authServicePath + "ConfirmTOTP": {"admin", "vendor", "user"},
+		authServicePath + "DisableTOTP": {"admin", "vendor", "user"},
+		apiKeyServicePath + "CreateAPIKey": {"admin"},
+		apiKeyServicePath + "ListAPIKeys":  {"admin"},
+		apiKeyServicePath + "RevokeAPIKey": {"admin"},
+
+		productInfoPath + "addProduct":    {"admin"},
+		productInfoPath + "UpdateProduct": {"admin"},
+		productInfoPath + "DeleteProduct": {"admin"},
+
+		cartServicePath + "AddItem":    {"admin", "vendor", "user"},
+		cartServicePath + "RemoveItem": {"admin", "vendor", "user"},
+		cartServicePath + "GetCart":    {"admin", "vendor", "user"},
+		cartServicePath + "Checkout":   {"admin", "vendor", "user"},
+
+		orderManagementPath + "addOrder":          {"admin", "vendor", "user"},
+		orderManagementPath + "getOrder":          {"admin", "vendor", "user"},
+		orderManagementPath + "queryOrders":       {"admin", "vendor", "user"},
+		orderManagementPath + "updateOrders":      {"admin", "vendor", "user"},
+		orderManagementPath + "batchUpdateOrders": {"admin", "vendor", "user"},
+		orderManagementPath + "cancelOrder":       {"admin", "vendor", "user"},
+		orderManagementPath + "searchOrders":      {"admin"},
+		orderManagementPath + "transitionOrder":   {"admin"},
+		orderManagementPath + "refundOrder":       {"admin"},
+		orderManagementPath + "processOrders":     {"admin"},
+		orderManagementPath + "getShipment":       {"admin"},
+		orderManagementPath + "listShipments":     {"admin"},
+		// the order events carry the customers and addresses of all the orders.
+		orderManagementPath + "watchOrders": {"admin"},
+
+		promotionServicePath + "CreatePromotion":     {"admin"},
+		promotionServicePath + "GetPromotion":        {"admin"},
+		promotionServicePath + "ListPromotions":      {"admin"},
+		promotionServicePath + "DeactivatePromotion": {"admin"},
+		// The first method is CreateLaptop, which admin and vendor users can call.
+		// Vendors are further restricted to their own brand by OwnershipRules().
+		laptopServicePath + "CreateLaptop": {"admin", "vendor"},
+		// The UploadImage method is also accessible for admin and vendor only.
+		laptopServicePath + "UploadImage": {"admin", "vendor"},
+		// The RateLaptop method can be called by admin, vendor and user.
+		laptopServicePath + "RateLaptop": {"admin", "vendor", "user"},
 		// let’s say the SearchLaptop API is accessible by everyone,
 		// even for non-registered users. So the idea is: we don’t put
 		// SearchLaptop or any other publicly accessible RPCs in this map.
@@ -96,14 +331,60 @@ func AccessibleRoles() map[string][]string {
 
 // Authorize() function, takes a context and method as input, and will
 // return an error if the request is unauthorized.
-func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) error {
+// It returns the verified claims of the caller, which are nil for publicly
+// accessible RPCs, and are also returned along with a PermissionDenied error
+// so the denial can be attributed.
+func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (*UserClaims, error) {
 	// First we get the list of roles that can access the target RPC method.
 	accessibleRoles, ok := interceptor.accessibleRoles[method]
 
 	// If it’s not in the map, then it means the RPC is publicly accessible,
 	// so we simply return nil in this case.
 	if !ok {
-		return nil
+		return nil, nil
+	}
+
+	// Else, we authenticate the caller with its client certificate or access token.
+	claims, err := interceptor.authenticate(ctx, method)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A user who must enroll a second factor cannot do anything else yet.
+	if claims.TOTPEnrollment && !totpEnrollmentMethods[method] {
+		return claims, status.Errorf(codes.PermissionDenied, "second factor enrollment required")
+	}
+
+	// Else, we iterate through the accessible roles to check
+	// if the user’s role can access this RPC or not.
+	for _, role := range accessibleRoles {
+		// If the user’s role is found in the list,
+		if role == claims.Role {
+			// we simply return the claims.
+			return claims, nil
+
+		}
+	}
+
+	//  If not, we return PermissionDenied status code, 
+	// and a message saying user doesn’t have permission to access this RPC.
+	return claims, status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+
+}
+
+// authenticate() function returns the claims of the caller, taken either from
+// its verified client certificate or from its access token, depending on which
+// ones are present and on the configured credential precedence.
+func (interceptor *AuthInterceptor) authenticate(ctx context.Context, method string) (*UserClaims, error) {
+	var certClaims *UserClaims
+	if interceptor.certIdentities != nil {
+		certClaims = interceptor.certIdentities.certificateClaims(ctx)
+	}
+
+	// When certificates take precedence, a mapped certificate is all we need.
+	if certClaims != nil && interceptor.certIdentities.Precedence == PreferCertificate {
+		return certClaims, nil
 	}
 
 	// Else, we should get the access token from the context.
@@ -111,16 +392,26 @@ func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string
 	md, ok := metadata.FromIncomingContext(ctx)
 
 	if !ok {
-		return status.Errorf(codes.Unauthenticated, "metadata not provided")
+		if certClaims != nil {
+			return certClaims, nil
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "metadata not provided")
 
 	}
 
 	// Else we get the values from the authorization metadata key.
 	value := md["authorization"]
 
-	// If it’s empty, we return Unauthenticated code because the token is not provided.
+	// If it’s empty, we fall back to an API key or to the client certificate, or return
+	// Unauthenticated code because none of the credentials is provided.
 	if len(value) == 0 {
-		return status.Errorf(codes.Unauthenticated, "Authorization token not provided")
+		if apiKey := md["x-api-key"]; len(apiKey) > 0 && interceptor.apiKeyStore != nil {
+			return interceptor.verifyAPIKey(apiKey[0], method)
+		}
+		if certClaims != nil {
+			return certClaims, nil
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "Authorization token not provided")
 	}
 
 	// Otherwise, the access token should be stored in the 1st element of the values.
@@ -130,22 +421,38 @@ func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string
 	claims, err := interceptor.jwtManager.Verify(accessToken)
 
 	if err != nil {
-		return status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "access token is invalid: %v", err)
 	}
 
-	// Else, we iterate through the accessible roles to check
-	// if the user’s role can access this RPC or not.
-	for _, role := range accessibleRoles {
-		// If the user’s role is found in the list,
-		if role == claims.Role {
-			// we simply return nil.
-			return nil
+	return claims, nil
+}
 
-		}
+// verifyAPIKey() function checks the full API key sent by the caller, and returns
+// claims carrying the role the key is scoped to.
+func (interceptor *AuthInterceptor) verifyAPIKey(fullKey string, method string) (*UserClaims, error) {
+	id, secret, err := SplitAPIKey(fullKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is invalid: %v", err)
 	}
 
-	//  If not, we return PermissionDenied status code, 
-	// and a message saying user doesn’t have permission to access this RPC.
-	return status.Errorf(codes.PermissionDenied, "no permission to access this RPC")
+	key, err := interceptor.apiKeyStore.Find(id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find api key: %v", err)
+	}
+
+	// Unknown, wrong, revoked and expired keys all get the same answer,
+	// so that callers cannot probe which key IDs exist.
+	if key == nil || !key.IsCorrectSecret(secret) || !key.IsActive(time.Now()) {
+		return nil, status.Errorf(codes.Unauthenticated, "api key is invalid or expired")
+	}
+
+	if !key.AllowsMethod(method) {
+		return nil, status.Errorf(codes.PermissionDenied, "api key is not allowed to access this RPC")
+	}
 
+	return &UserClaims{
+		Username: "api-key:" + key.ID,
+		Role:     key.Role,
+		Tenant:   key.Tenant,
+	}, nil
 }
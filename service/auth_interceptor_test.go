@@ -0,0 +1,512 @@
+package service_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestAuthInterceptorOwnershipRules(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+
+	interceptor := service.NewAuthInterceptor(
+		jwtManager,
+		service.AccessibleRoles(),
+		service.WithOwnershipRules(service.OwnershipRules(laptopStore, nil)),
+	)
+	serverAddress := startTestAuthLaptopServer(t, interceptor, laptopStore, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	vendor, err := service.NewUser("vendor1", "secret", "vendor")
+	require.NoError(t, err)
+	vendor.Brand = "Apple"
+
+	token, err := jwtManager.Generate(vendor)
+	require.NoError(t, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+
+	ownLaptop := sampledata.NewLaptop()
+	ownLaptop.Brand = "Apple"
+	otherLaptop := sampledata.NewLaptop()
+	otherLaptop.Brand = "Dell"
+
+	// unary: a vendor can create a laptop of its own brand, but not of another brand.
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: ownLaptop})
+	require.NoError(t, err)
+
+	_, err = laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: otherLaptop})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// stream: each rating message is checked, so rating another brand works,
+	// while rating its own brand stops the stream.
+	require.NoError(t, laptopStore.Save(context.Background(), otherLaptop))
+
+	stream, err := laptopClient.RateLaptop(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: otherLaptop.GetId(), Score: 8}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, otherLaptop.GetId(), res.GetLaptopId())
+
+	require.NoError(t, stream.Send(&pb.RateLaptopRequest{LaptopId: ownLaptop.GetId(), Score: 10}))
+	_, err = stream.Recv()
+	require.NotEqual(t, io.EOF, err)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAuthInterceptorOrderOwnership(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+
+	interceptor := service.NewAuthInterceptor(
+		jwtManager,
+		service.AccessibleRoles(),
+		service.WithOwnershipRules(service.OwnershipRules(nil, orderStore)),
+	)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterOrderManagementServer(grpcServer, service.NewOrderManagementServer(orderStore, service.WithLegacyUpdateOrders()))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	orderClient := pb.NewOrderManagementClient(conn)
+
+	login := func(username string, role string) context.Context {
+		user, err := service.NewUser(username, "secret", role)
+		require.NoError(t, err)
+		token, err := jwtManager.Generate(user)
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+	}
+	aliceCtx := login("alice", "user")
+	bobCtx := login("bob", "user")
+	adminCtx := login("admin1", "admin")
+
+	addOrder := func(ctx context.Context) string {
+		res, err := orderClient.AddOrder(ctx, &pb.Order{Items: []string{"Kindle"}, Price: 90, Destination: "Austin, TX"})
+		require.NoError(t, err)
+		return res.GetValue()
+	}
+	aliceOrder := addOrder(aliceCtx)
+	bobOrder := addOrder(bobCtx)
+
+	// the orders are not public.
+	_, err = orderClient.GetOrder(context.Background(), &wrapper.StringValue{Value: aliceOrder})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// unary: a customer only gets and cancels its own orders, the admins manage all of them.
+	_, err = orderClient.GetOrder(aliceCtx, &wrapper.StringValue{Value: aliceOrder})
+	require.NoError(t, err)
+	_, err = orderClient.GetOrder(adminCtx, &wrapper.StringValue{Value: aliceOrder})
+	require.NoError(t, err)
+	_, err = orderClient.GetOrder(bobCtx, &wrapper.StringValue{Value: aliceOrder})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = orderClient.GetOrder(bobCtx, &wrapper.StringValue{Value: "102"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = orderClient.CancelOrder(bobCtx, &pb.CancelOrderRequest{OrderId: aliceOrder})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = orderClient.QueryOrders(bobCtx, &pb.OrderQuery{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = orderClient.QueryOrders(bobCtx, &pb.OrderQuery{Customer: "alice"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	res, err := orderClient.QueryOrders(bobCtx, &pb.OrderQuery{Customer: "bob"})
+	require.NoError(t, err)
+	require.Len(t, res.GetOrders(), 1)
+	require.Equal(t, bobOrder, res.GetOrders()[0].GetId())
+
+	// only the admins follow the events of all the orders.
+	watchStream, err := orderClient.WatchOrders(bobCtx, &pb.WatchOrdersRequest{})
+	require.NoError(t, err)
+	_, err = watchStream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// stream: each update is checked, so updating its own order works, while
+	// updating the order of another customer stops the stream.
+	batchStream, err := orderClient.BatchUpdateOrders(bobCtx)
+	require.NoError(t, err)
+	require.NoError(t, batchStream.Send(&pb.UpdateOrderRequest{
+		Order:      &pb.Order{Id: bobOrder, Description: "gift"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"description"}},
+	}))
+	batchStream.Send(&pb.UpdateOrderRequest{
+		Order:      &pb.Order{Id: aliceOrder, Description: "gift"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"description"}},
+	})
+	_, err = batchStream.CloseAndRecv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	legacyStream, err := orderClient.UpdateOrders(bobCtx)
+	require.NoError(t, err)
+	legacyStream.Send(&pb.Order{Id: aliceOrder, Items: []string{"Kindle"}, Price: 1, Destination: "Austin, TX"})
+	_, err = legacyStream.CloseAndRecv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	order, err := orderClient.GetOrder(aliceCtx, &wrapper.StringValue{Value: aliceOrder})
+	require.NoError(t, err)
+	require.Empty(t, order.GetDescription())
+	require.Equal(t, float32(90), order.GetPrice())
+	order, err = orderClient.GetOrder(bobCtx, &wrapper.StringValue{Value: bobOrder})
+	require.NoError(t, err)
+	require.Equal(t, "gift", order.GetDescription())
+}
+
+func TestAccessibleRolesOrderManagement(t *testing.T) {
+	t.Parallel()
+
+	// no order RPC is public.
+	roles := service.AccessibleRoles()
+	for _, method := range pb.OrderManagement_ServiceDesc.Methods {
+		require.NotEmpty(t, roles["/ecommerce.OrderManagement/"+method.MethodName], method.MethodName)
+	}
+	for _, stream := range pb.OrderManagement_ServiceDesc.Streams {
+		require.NotEmpty(t, roles["/ecommerce.OrderManagement/"+stream.StreamName], stream.StreamName)
+	}
+
+	// the events of all the orders are for admins only.
+	require.Equal(t, []string{"admin"}, roles["/ecommerce.OrderManagement/watchOrders"])
+}
+
+func TestAuthInterceptorTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	laptopStore := service.NewInMemoryLaptopStore()
+
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles())
+	serverAddress := startTestAuthLaptopServer(t, interceptor, laptopStore, service.NewInMemoryRatingStore())
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	tenantContext := func(tenant string, metadataPairs ...string) context.Context {
+		admin, err := service.NewUser("admin1", "secret", "admin")
+		require.NoError(t, err)
+		admin.Tenant = tenant
+
+		token, err := jwtManager.Generate(admin)
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(context.Background(), append(metadataPairs, "authorization", token)...)
+	}
+	acmeCtx := tenantContext("acme")
+	defaultCtx := tenantContext(service.DefaultTenant)
+
+	laptop := sampledata.NewLaptop()
+	_, err := laptopClient.CreateLaptop(acmeCtx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	_, err = laptopClient.GetLaptopByID(acmeCtx, &pb.GetLaptopByIDRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+
+	// the laptop does not exist for the admin of another tenant.
+	_, err = laptopClient.GetLaptopByID(defaultCtx, &pb.GetLaptopByIDRequest{Id: laptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// nor can that admin ask for the other tenant, even on a public RPC.
+	crossCtx := tenantContext(service.DefaultTenant, "x-tenant-id", "acme")
+	_, err = laptopClient.GetLaptopByID(crossCtx, &pb.GetLaptopByIDRequest{Id: laptop.GetId()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// anonymous callers pick the storefront with the x-tenant-id metadata.
+	anonymousCtx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+	_, err = laptopClient.GetLaptopByID(anonymousCtx, &pb.GetLaptopByIDRequest{Id: laptop.GetId()})
+	require.NoError(t, err)
+
+	stream, err := laptopClient.SearchLaptop(context.Background(), &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 1e9}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	invalidCtx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "../acme")
+	_, err = laptopClient.GetLaptopByID(invalidCtx, &pb.GetLaptopByIDRequest{Id: laptop.GetId()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the same laptop ID can be used by another tenant.
+	_, err = laptopClient.CreateLaptop(defaultCtx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+}
+
+// startTestAuthLaptopServer starts a laptop server guarded by the given auth interceptor,
+// and returns the network address string of the server.
+func startTestAuthLaptopServer(t *testing.T, interceptor *service.AuthInterceptor, laptopStore service.LaptopStore, ratingStore service.RatingStore) string {
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore)
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return listener.Addr().String()
+}
+
+func TestAuthInterceptorCertIdentities(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+
+	user, err := service.NewUser("user1", "secret", "user")
+	require.NoError(t, err)
+	userToken, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+
+	spiffeID, err := url.Parse("spiffe://ecommerce/order-service")
+	require.NoError(t, err)
+
+	mappedCert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "order-service.internal"},
+		URIs:    []*url.URL{spiffeID},
+	}
+	unmappedCert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "unknown.internal"},
+	}
+	// the common name is only the identity of a certificate without SANs.
+	legacyCert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "legacy.internal"},
+	}
+	sanCert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "legacy.internal"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+
+	config := service.CertIdentityConfig{
+		Roles: map[string]string{
+			"spiffe://ecommerce/order-service": "admin",
+			"legacy.internal":                  "admin",
+		},
+	}
+
+	const method = "/ecommerce.LaptopService/CreateLaptop"
+
+	testCases := []struct {
+		name       string
+		precedence service.CredentialPrecedence
+		cert       *x509.Certificate
+		token      string
+		code       codes.Code
+		username   string
+	}{
+		{
+			name:     "cert_only",
+			cert:     mappedCert,
+			code:     codes.OK,
+			username: "spiffe://ecommerce/order-service",
+		},
+		{
+			name: "unmapped_cert",
+			cert: unmappedCert,
+			code: codes.Unauthenticated,
+		},
+		{
+			name:     "common_name_without_sans",
+			cert:     legacyCert,
+			code:     codes.OK,
+			username: "legacy.internal",
+		},
+		{
+			name: "common_name_with_sans",
+			cert: sanCert,
+			code: codes.Unauthenticated,
+		},
+		{
+			name:       "jwt_takes_precedence",
+			precedence: service.PreferJWT,
+			cert:       mappedCert,
+			token:      userToken,
+			code:       codes.PermissionDenied,
+		},
+		{
+			name:       "cert_takes_precedence",
+			precedence: service.PreferCertificate,
+			cert:       mappedCert,
+			token:      userToken,
+			code:       codes.OK,
+			username:   "spiffe://ecommerce/order-service",
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := config
+			config.Precedence = tc.precedence
+			interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles(), service.WithCertIdentities(config))
+
+			ctx := peer.NewContext(context.Background(), &peer.Peer{
+				AuthInfo: credentials.TLSInfo{
+					State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.cert}}},
+				},
+			})
+			md := metadata.MD{}
+			if tc.token != "" {
+				md.Set("authorization", tc.token)
+			}
+			ctx = metadata.NewIncomingContext(ctx, md)
+
+			var username string
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				claims, ok := service.ClaimsFromContext(ctx)
+				require.True(t, ok)
+				username = claims.Username
+				return nil, nil
+			}
+
+			_, err := interceptor.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+			require.Equal(t, tc.code, status.Code(err))
+			require.Equal(t, tc.username, username)
+		})
+	}
+}
+
+func TestAuthInterceptorCertTenants(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles(), service.WithCertIdentities(service.CertIdentityConfig{
+		Roles: map[string]string{
+			"importer.acme.internal":  "admin",
+			"importer.other.internal": "admin",
+		},
+		Tenants: map[string]string{"importer.acme.internal": "acme"},
+	}))
+
+	call := func(method string, commonName string, requestedTenant string) (string, error) {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{
+				State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+					{Subject: pkix.Name{CommonName: commonName}},
+				}}},
+			},
+		})
+		md := metadata.MD{}
+		if requestedTenant != "" {
+			md.Set("x-tenant-id", requestedTenant)
+		}
+		ctx = metadata.NewIncomingContext(ctx, md)
+
+		var tenant string
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			tenant = service.TenantFromContext(ctx)
+			return nil, nil
+		}
+
+		_, err := interceptor.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return tenant, err
+	}
+
+	const createLaptop = "/ecommerce.LaptopService/CreateLaptop"
+	const getLaptop = "/ecommerce.LaptopService/GetLaptopByID"
+
+	// a certificate acts in the tenant of its identity, or in the default one.
+	tenant, err := call(createLaptop, "importer.acme.internal", "")
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant)
+
+	tenant, err = call(createLaptop, "importer.acme.internal", "acme")
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant)
+
+	tenant, err = call(createLaptop, "importer.other.internal", "")
+	require.NoError(t, err)
+	require.Equal(t, service.DefaultTenant, tenant)
+
+	// it cannot ask for another tenant, even on a public RPC.
+	_, err = call(createLaptop, "importer.acme.internal", service.DefaultTenant)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call(createLaptop, "importer.other.internal", "acme")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = call(getLaptop, "importer.other.internal", "acme")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the tenants of the config must be valid, and belong to an identity with a role.
+	for _, content := range []string{
+		`{"roles": {"a.internal": "admin"}, "tenants": {"a.internal": "../acme"}}`,
+		`{"roles": {"a.internal": "admin"}, "tenants": {"b.internal": "acme"}}`,
+	} {
+		_, err := service.LoadCertIdentityConfig(writeServerConfig(t, "cert-roles.json", content))
+		require.Error(t, err, content)
+	}
+	config, err := service.LoadCertIdentityConfig(writeServerConfig(t, "cert-roles.json",
+		`{"roles": {"a.internal": "admin"}, "tenants": {"a.internal": "acme"}}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"a.internal": "acme"}, config.Tenants)
+}
+
+func TestAuthInterceptorAPIKey(t *testing.T) {
+	t.Parallel()
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	apiKeyStore := service.NewInMemoryAPIKeyStore()
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles(), service.WithAPIKeys(apiKeyStore))
+
+	serverAddress := startTestAuthLaptopServer(t, interceptor, service.NewInMemoryLaptopStore(), service.NewInMemoryRatingStore())
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	const laptopServicePath = "/ecommerce.LaptopService/"
+	expiresAt := time.Now().Add(time.Hour)
+
+	importerKey, importerSecret, err := service.NewAPIKey("importer", "admin", []string{laptopServicePath + "CreateLaptop"}, expiresAt)
+	require.NoError(t, err)
+	require.NoError(t, apiKeyStore.Save(importerKey))
+	require.NotContains(t, importerKey.HashedSecret, importerSecret)
+
+	raterKey, raterSecret, err := service.NewAPIKey("rater", "admin", []string{laptopServicePath + "RateLaptop"}, expiresAt)
+	require.NoError(t, err)
+	require.NoError(t, apiKeyStore.Save(raterKey))
+
+	createLaptop := func(apiKey string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", apiKey)
+		_, err := laptopClient.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: sampledata.NewLaptop()})
+		return err
+	}
+
+	require.NoError(t, createLaptop(importerSecret))
+	require.Equal(t, codes.PermissionDenied, status.Code(createLaptop(raterSecret)))
+	require.Equal(t, codes.Unauthenticated, status.Code(createLaptop(importerKey.ID+".wrong-secret")))
+
+	require.NoError(t, apiKeyStore.Revoke(importerKey.ID))
+	require.Equal(t, codes.Unauthenticated, status.Code(createLaptop(importerSecret)))
+}
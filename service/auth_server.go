@@ -2,31 +2,93 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	pb "gRPC-Playground/ecommerce"
+	"log"
+	"net"
+	"time"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type AuthServer struct {
 	pb.UnimplementedAuthServiceServer
-	userStore  UserStore
-	jwtManager *JWTManager
+	userStore    UserStore
+	jwtManager   *JWTManager
+	loginLimiter *LoginLimiter
+	auditLog     AuditLog
+	// requiredTOTPRoles are the roles whose users must login with a second factor.
+	requiredTOTPRoles map[string]bool
+	challenges        *secondFactorChallenges
+	// now returns the current time, used to check the TOTP codes.
+	now func() time.Time
+}
+
+// AuthServerOption configures optional behaviour of an AuthServer.
+type AuthServerOption func(server *AuthServer)
+
+// WithRequiredTOTPRoles forces the users of the given roles to login with a
+// second factor. Until they enroll one, their token only gives access to the
+// enrollment RPCs.
+func WithRequiredTOTPRoles(roles ...string) AuthServerOption {
+	return func(server *AuthServer) {
+		for _, role := range roles {
+			server.requiredTOTPRoles[role] = true
+		}
+	}
+}
+
+// WithAuthClock replaces the clock used to check the TOTP codes.
+func WithAuthClock(now func() time.Time) AuthServerOption {
+	return func(server *AuthServer) {
+		server.now = now
+	}
 }
 
 // NewAuthServer builds and returns a new AuthServer object
-func NewAuthServer(userStore UserStore, jwtManager *JWTManager) *AuthServer {
-	return &AuthServer{
-		pb.UnimplementedAuthServiceServer{},
-		userStore,
-		jwtManager,
+func NewAuthServer(userStore UserStore, jwtManager *JWTManager, loginLimiter *LoginLimiter, auditLog AuditLog, opts ...AuthServerOption) *AuthServer {
+	server := &AuthServer{
+		userStore:         userStore,
+		jwtManager:        jwtManager,
+		loginLimiter:      loginLimiter,
+		auditLog:          auditLog,
+		requiredTOTPRoles: make(map[string]bool),
+		challenges:        newSecondFactorChallenges(),
+		now:               time.Now,
 	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
 }
 
 func (server *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-	// First we call userStore.Find() to find the user by username
+	// The user logs in to the tenant picked by the auth interceptor from the
+	// x-tenant-id metadata. The same username in two tenants is two different
+	// users, so the lockouts are per tenant as well.
+	tenant := TenantFromContext(ctx)
+	limiterKey := tenantUsername(tenant, req.GetUsername())
+
+	// Before even looking at the password, we refuse the attempt if the username
+	// or the client address is locked out after too many failed logins.
+	clientAddress := clientIP(ctx)
+	if retryAfter := server.loginLimiter.RetryAfter(limiterKey, clientAddress); retryAfter > 0 {
+		server.audit(ctx, AuditLoginFailure, req.GetUsername(), "locked out")
+		return nil, lockedOutError(retryAfter)
+	}
+
+	// First we call userStore.Find() to find the user of the tenant by username
 	// using the req.GetUsername().
-	user, err := server.userStore.Find(req.GetUsername())
+	user, err := server.userStore.Find(tenant, req.GetUsername())
 
 	// If there’s an error, just return it with an Internal error code.
 	if err != nil {
@@ -37,22 +99,341 @@ func (server *AuthServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.
 	// then we return status code NotFound with a message saying
 	// the username or password is incorrect.
 	if user == nil || !user.IsCorrectPassword(req.GetPassword()) {
+		// The failure counts against both the username and the client address.
+		// If it is one too many, the caller learns about the lockout right away.
+		if lockout := server.loginLimiter.RecordFailure(limiterKey, clientAddress); lockout > 0 {
+			log.Printf("locked out login of %q from %s for %v", req.GetUsername(), clientAddress, lockout)
+			server.audit(ctx, AuditLoginFailure, req.GetUsername(), "incorrect username/password, locked out for "+lockout.String())
+			return nil, lockedOutError(lockout)
+		}
+		server.audit(ctx, AuditLoginFailure, req.GetUsername(), "incorrect username/password")
 		return nil, status.Errorf(codes.NotFound, "incorrect username/password")
 	}
 
+	// A client that logs in again while presenting its still valid token is refreshing it.
+	presented := server.presentedClaims(ctx, user)
+	refresh := presented != nil
+
+	// A user with a second factor only gets a challenge for now, that is answered
+	// with VerifySecondFactor. The failure counters are only reset once it is answered.
+	// Only a token that was itself issued after the second factor skips it.
+	secondFactor := refresh && presented.SecondFactor
+	if user.HasTOTP() && !secondFactor {
+		challengeID, err := server.challenges.open(tenant, user.Username, server.now())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot open second factor challenge: %v", err)
+		}
+
+		server.audit(ctx, AuditSecondFactorRequired, user.Username, "")
+		return &pb.LoginResponse{ChallengeId: challengeID}, nil
+	}
+
+	server.loginLimiter.RecordSuccess(limiterKey)
+	server.audit(ctx, AuditLoginSuccess, user.Username, "")
+
+	// A user whose role requires a second factor that is not enrolled yet
+	// only gets a token to enroll one.
+	if server.requiredTOTPRoles[user.Role] && !user.HasTOTP() {
+		token, err := server.jwtManager.GenerateTOTPEnrollment(user)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot generate access token")
+		}
+
+		server.audit(ctx, AuditTokenIssued, user.Username, "role "+user.Role+", totp enrollment only")
+		return &pb.LoginResponse{AccessToken: token, TotpEnrollmentRequired: true}, nil
+	}
+
+	return server.issueToken(ctx, user, refresh, secondFactor && user.HasTOTP())
+}
+
+// VerifySecondFactor is a unary RPC that completes the login of a user with a
+// second factor, by checking a TOTP code or a recovery code against the challenge
+// returned by Login.
+func (server *AuthServer) VerifySecondFactor(ctx context.Context, req *pb.VerifySecondFactorRequest) (*pb.LoginResponse, error) {
+	now := server.now()
+
+	challenge, ok := server.challenges.attempt(req.GetChallengeId(), now)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "second factor challenge is invalid or expired")
+	}
+
+	// the call is audited in the tenant of the challenge.
+	ctx = ContextWithTenant(ctx, challenge.tenant)
+	limiterKey := tenantUsername(challenge.tenant, challenge.username)
+	clientAddress := clientIP(ctx)
+
+	// The guesses of a second factor are limited like the guesses of a password.
+	if retryAfter := server.loginLimiter.RetryAfter(limiterKey, clientAddress); retryAfter > 0 {
+		server.audit(ctx, AuditLoginFailure, challenge.username, "locked out")
+		return nil, lockedOutError(retryAfter)
+	}
+
+	// the code is checked and consumed in a single update of the user,
+	// so that it cannot be used by two concurrent logins.
+	var user *User
+	usedRecoveryCode := false
+	err := server.userStore.Update(challenge.tenant, challenge.username, func(u *User) error {
+		used, err := u.UseSecondFactor(req.GetTotpCode(), req.GetRecoveryCode(), now)
+		user, usedRecoveryCode = u, used
+		return err
+	})
+
+	if errors.Is(err, ErrIncorrectSecondFactor) {
+		if lockout := server.loginLimiter.RecordFailure(limiterKey, clientAddress); lockout > 0 {
+			server.audit(ctx, AuditLoginFailure, challenge.username, "incorrect second factor, locked out for "+lockout.String())
+			return nil, lockedOutError(lockout)
+		}
+		server.audit(ctx, AuditLoginFailure, challenge.username, "incorrect second factor")
+		return nil, status.Errorf(codes.Unauthenticated, "incorrect second factor")
+	}
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot check second factor: %v", err)
+	}
+
+	server.challenges.close(req.GetChallengeId())
+	server.loginLimiter.RecordSuccess(limiterKey)
+
+	if usedRecoveryCode {
+		server.audit(ctx, AuditRecoveryCodeUsed, user.Username, fmt.Sprintf("%d recovery codes left", len(user.RecoveryCodeHashes)))
+	}
+	server.audit(ctx, AuditLoginSuccess, user.Username, "second factor")
+
+	return server.issueToken(ctx, user, false, true)
+}
+
+// issueToken() function generates a new access token for the user, and returns it in a login response.
+// The token records whether the user has passed its second factor.
+func (server *AuthServer) issueToken(ctx context.Context, user *User, refresh bool, secondFactor bool) (*pb.LoginResponse, error) {
 	// If the user is found and the password is correct, we call jwtManager.Generate()
 	// to generate a new access token.
-	token, err := server.jwtManager.Generate(user)
+	generate := server.jwtManager.Generate
+	if secondFactor {
+		generate = server.jwtManager.GenerateWithSecondFactor
+	}
+	token, err := generate(user)
 
 	// If an error occurs, we return it with Internal status code.
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot generate access token")
 	}
 
+	event := AuditTokenIssued
+	if refresh {
+		event = AuditTokenRefreshed
+	}
+	server.audit(ctx, event, user.Username, "role "+user.Role)
+
 	// Otherwise, we create a new login response object with the generated access token, and return it to the client.
 	res := &pb.LoginResponse{
 		AccessToken: token,
 	}
 	return res, nil
+}
+
+// EnrollTOTP is a unary RPC that generates a new TOTP secret for the calling user.
+// The secret stays pending until a code generated from it is confirmed with ConfirmTOTP.
+func (server *AuthServer) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "login required")
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	err = server.updateUser(ctx, claims.Username, func(user *User) error {
+		if user.HasTOTP() {
+			return status.Errorf(codes.FailedPrecondition, "second factor is already enrolled")
+		}
+		user.TOTPPendingSecret = secret
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.EnrollTOTPResponse{
+		Secret: secret,
+		Uri:    TOTPURI(claims.Username, secret),
+	}
+	return res, nil
+}
+
+// ConfirmTOTP is a unary RPC that activates the pending TOTP secret of the calling
+// user, given a code generated from it. It returns the recovery codes, which are
+// only stored hashed.
+func (server *AuthServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "login required")
+	}
+
+	recoveryCodes, recoveryCodeHashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	err = server.updateUser(ctx, claims.Username, func(user *User) error {
+		if user.TOTPPendingSecret == "" {
+			return status.Errorf(codes.FailedPrecondition, "no pending second factor enrollment")
+		}
+
+		step, ok := ValidateTOTP(user.TOTPPendingSecret, req.GetTotpCode(), server.now())
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "incorrect totp code")
+		}
+
+		user.TOTPSecret = user.TOTPPendingSecret
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = step
+		user.RecoveryCodeHashes = recoveryCodeHashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	server.audit(ctx, AuditTOTPEnrolled, claims.Username, "")
+
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTOTP is a unary RPC that removes the second factor of the calling user,
+// given a valid TOTP code or recovery code. Users whose role requires a second
+// factor cannot remove it.
+func (server *AuthServer) DisableTOTP(ctx context.Context, req *pb.DisableTOTPRequest) (*pb.DisableTOTPResponse, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "login required")
+	}
+
+	if server.requiredTOTPRoles[claims.Role] {
+		return nil, status.Errorf(codes.FailedPrecondition, "role %s requires a second factor", claims.Role)
+	}
+
+	err := server.updateUser(ctx, claims.Username, func(user *User) error {
+		_, err := user.UseSecondFactor(req.GetTotpCode(), req.GetRecoveryCode(), server.now())
+		if err != nil {
+			return status.Errorf(codes.PermissionDenied, "%v", err)
+		}
+
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodeHashes = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	server.audit(ctx, AuditTOTPDisabled, claims.Username, "")
+
+	return &pb.DisableTOTPResponse{}, nil
+}
+
+// updateUser() function updates the calling user in the user store.
+// Status errors returned by update are passed on to the client as is.
+func (server *AuthServer) updateUser(ctx context.Context, username string, update func(user *User) error) error {
+	err := server.userStore.Update(TenantFromContext(ctx), username, update)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	// API keys and certificate identities are not users of the store.
+	if errors.Is(err, ErrNotFound) {
+		return status.Errorf(codes.NotFound, "user %s not found", username)
+	}
+
+	return status.Errorf(codes.Internal, "cannot update user: %v", err)
+}
+
+// UnlockUser is a unary RPC that lets an admin lift the lockout of a username
+// and/or a client address.
+func (server *AuthServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	if req.GetUsername() == "" && req.GetClientAddress() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "username or client address is required")
+	}
+
+	// An admin can only unlock the users of its own tenant.
+	username := ""
+	if req.GetUsername() != "" {
+		username = tenantUsername(TenantFromContext(ctx), req.GetUsername())
+	}
+
+	if server.loginLimiter.Unlock(username, req.GetClientAddress()) {
+		log.Printf("unlocked login of %q from %q", username, req.GetClientAddress())
+	}
+
+	admin := ""
+	if claims, ok := ClaimsFromContext(ctx); ok {
+		admin = claims.Username
+	}
+	server.audit(ctx, AuditAccountUnlock, admin, fmt.Sprintf("username %q, client address %q", req.GetUsername(), req.GetClientAddress()))
+
+	return &pb.UnlockUserResponse{}, nil
+}
+
+// tenantUsername returns the key of a user across all tenants.
+func tenantUsername(tenant, username string) string {
+	return tenant + "/" + username
+}
+
+// lockedOutError returns a ResourceExhausted status telling the client how long
+// to wait before trying to login again.
+func lockedOutError(retryAfter time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "too many failed login attempts, retry in %v", retryAfter.Round(time.Second))
+
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// clientIP returns the IP address of the caller, or an empty string if unknown.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+// audit records a security decision of the auth server in the audit log.
+func (server *AuthServer) audit(ctx context.Context, event AuditEvent, principal, reason string) {
+	method, _ := grpc.Method(ctx)
+	recordAudit(server.auditLog, ctx, event, method, principal, reason)
+}
+
+// presentedClaims returns the claims of the valid access token of the same user
+// carried in the authorization metadata of the login request, or nil if there
+// is none, in which case the login is not a refresh.
+func (server *AuthServer) presentedClaims(ctx context.Context, user *User) *UserClaims {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md["authorization"]) == 0 {
+		return nil
+	}
+
+	claims, err := server.jwtManager.Verify(md["authorization"][0])
+	if err != nil || claims.TOTPEnrollment || claims.Username != user.Username || claims.Tenant != user.Tenant {
+		return nil
+	}
 
+	return claims
 }
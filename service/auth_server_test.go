@@ -0,0 +1,276 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClock is a clock that only moves when the test advances it.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+func TestAuthServerLoginLockout(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, service.SeedUsers(userStore))
+
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BaseLockout: 10 * time.Second,
+		MaxLockout:  30 * time.Second,
+	}, clock.Now)
+
+	server := service.NewAuthServer(userStore, service.NewJWTManager("secret", time.Minute), limiter, nil)
+
+	clientContext := func(ip string) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000},
+		})
+	}
+	login := func(ip, username, password string) error {
+		_, err := server.Login(clientContext(ip), &pb.LoginRequest{Username: username, Password: password})
+		return err
+	}
+	requireLockedOut := func(err error, retryDelay time.Duration) {
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		require.Equal(t, codes.ResourceExhausted, st.Code())
+		require.Len(t, st.Details(), 1)
+		retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		require.Equal(t, retryDelay, retryInfo.GetRetryDelay().AsDuration())
+	}
+
+	// failures that slide out of the window are forgotten.
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.1", "admin1", "wrong")))
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.1", "admin1", "wrong")))
+	clock.Advance(2 * time.Minute)
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.1", "admin1", "wrong")))
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.1", "admin1", "wrong")))
+
+	// the third failure within the window locks the user out, even from another
+	// address and with the correct password.
+	requireLockedOut(login("10.0.0.1", "admin1", "wrong"), 10*time.Second)
+	clock.Advance(4 * time.Second)
+	requireLockedOut(login("10.0.0.2", "admin1", "secret"), 6*time.Second)
+
+	// the next lockout doubles.
+	clock.Advance(6 * time.Second)
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.3", "admin1", "wrong")))
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.4", "admin1", "wrong")))
+	requireLockedOut(login("10.0.0.5", "admin1", "wrong"), 20*time.Second)
+
+	// a client guessing the passwords of many users is locked out for all of them.
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.9", "alice", "guess")))
+	require.Equal(t, codes.NotFound, status.Code(login("10.0.0.9", "bob", "guess")))
+	requireLockedOut(login("10.0.0.9", "carol", "guess"), 10*time.Second)
+	requireLockedOut(login("10.0.0.9", "user1", "secret"), 10*time.Second)
+	require.NoError(t, login("10.0.0.8", "user1", "secret"))
+
+	// an admin can lift both lockouts.
+	_, err := server.UnlockUser(context.Background(), &pb.UnlockUserRequest{Username: "admin1", ClientAddress: "10.0.0.9"})
+	require.NoError(t, err)
+	require.NoError(t, login("10.0.0.9", "admin1", "secret"))
+	require.NoError(t, login("10.0.0.9", "user1", "secret"))
+}
+
+func TestLoginLimiterPrune(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := service.NewLoginLimiter(service.LoginLimiterConfig{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BaseLockout: 10 * time.Second,
+		MaxLockout:  30 * time.Second,
+	}, clock.Now)
+
+	// a client guessing many usernames is locked out, up to MaxLockout.
+	for i := 0; i < 100; i++ {
+		limiter.RecordFailure(fmt.Sprintf("user%d", i), "10.0.0.1")
+	}
+	require.Equal(t, 101, limiter.Tracked())
+
+	clock.Advance(45 * time.Second)
+	require.Zero(t, limiter.RecordFailure("admin1", "10.0.0.2"))
+	require.Equal(t, 103, limiter.Tracked())
+
+	// the usernames whose failures slid out of the window are forgotten, and
+	// so is the client once MaxLockout has passed since the end of its lockout.
+	clock.Advance(30 * time.Second)
+	require.Zero(t, limiter.RecordFailure("admin1", "10.0.0.2"))
+	require.Equal(t, 2, limiter.Tracked())
+	require.Zero(t, limiter.RetryAfter("user1", "10.0.0.1"))
+
+	// the failures within the window are kept.
+	require.Equal(t, 10*time.Second, limiter.RecordFailure("admin1", "10.0.0.3"))
+}
+
+func TestAuthServerLoginTenant(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, service.SeedUsers(userStore))
+
+	// the same username in another tenant is another user.
+	acmeAdmin, err := service.NewUser("admin1", "acme-secret", "admin")
+	require.NoError(t, err)
+	acmeAdmin.Tenant = "acme"
+	require.NoError(t, userStore.Save(acmeAdmin))
+
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	limiter := service.NewLoginLimiter(service.DefaultLoginLimiterConfig(), nil)
+	server := service.NewAuthServer(userStore, jwtManager, limiter, nil)
+
+	acmeCtx := service.ContextWithTenant(context.Background(), "acme")
+
+	res, err := server.Login(acmeCtx, &pb.LoginRequest{Username: "admin1", Password: "acme-secret"})
+	require.NoError(t, err)
+	claims, err := jwtManager.Verify(res.GetAccessToken())
+	require.NoError(t, err)
+	require.Equal(t, "acme", claims.Tenant)
+
+	_, err = server.Login(acmeCtx, &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "acme-secret"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAuthServerSecondFactor(t *testing.T) {
+	t.Parallel()
+
+	userStore := service.NewInMemoryUserStore()
+	require.NoError(t, service.SeedUsers(userStore))
+
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	limiter := service.NewLoginLimiter(service.DefaultLoginLimiterConfig(), clock.Now)
+	server := service.NewAuthServer(userStore, jwtManager, limiter, nil,
+		service.WithRequiredTOTPRoles("admin"),
+		service.WithAuthClock(clock.Now),
+	)
+
+	// an admin without a second factor only gets a token to enroll one.
+	res, err := server.Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "secret"})
+	require.NoError(t, err)
+	require.True(t, res.GetTotpEnrollmentRequired())
+
+	claims, err := jwtManager.Verify(res.GetAccessToken())
+	require.NoError(t, err)
+	require.True(t, claims.TOTPEnrollment)
+
+	interceptor := service.NewAuthInterceptor(jwtManager, service.AccessibleRoles())
+	call := func(token, method string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+		_, err := interceptor.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+		return err
+	}
+	require.NoError(t, call(res.GetAccessToken(), "/ecommerce.AuthService/EnrollTOTP"))
+	require.Equal(t, codes.PermissionDenied, status.Code(call(res.GetAccessToken(), "/ecommerce.LaptopService/CreateLaptop")))
+
+	// enroll the authenticator app.
+	adminCtx := service.ContextWithClaims(context.Background(), claims)
+	enrollRes, err := server.EnrollTOTP(adminCtx, &pb.EnrollTOTPRequest{})
+	require.NoError(t, err)
+	require.Contains(t, enrollRes.GetUri(), "otpauth://totp/")
+
+	_, err = server.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{TotpCode: "000000"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	code, err := service.TOTPCode(enrollRes.GetSecret(), clock.Now())
+	require.NoError(t, err)
+	confirmRes, err := server.ConfirmTOTP(adminCtx, &pb.ConfirmTOTPRequest{TotpCode: code})
+	require.NoError(t, err)
+	require.Len(t, confirmRes.GetRecoveryCodes(), 10)
+
+	// only hashes of the recovery codes are stored.
+	admin, err := userStore.Find(service.DefaultTenant, "admin1")
+	require.NoError(t, err)
+	require.Len(t, admin.RecoveryCodeHashes, 10)
+	require.NotContains(t, admin.RecoveryCodeHashes, confirmRes.GetRecoveryCodes()[0])
+
+	// the login is now a two-step challenge.
+	login := func() string {
+		res, err := server.Login(context.Background(), &pb.LoginRequest{Username: "admin1", Password: "secret"})
+		require.NoError(t, err)
+		require.Empty(t, res.GetAccessToken())
+		require.NotEmpty(t, res.GetChallengeId())
+		return res.GetChallengeId()
+	}
+
+	// the code used to confirm the enrollment cannot be used again.
+	challengeID := login()
+	_, err = server.VerifySecondFactor(context.Background(), &pb.VerifySecondFactorRequest{ChallengeId: challengeID, TotpCode: code})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	clock.Advance(30 * time.Second)
+	code, err = service.TOTPCode(enrollRes.GetSecret(), clock.Now())
+	require.NoError(t, err)
+	res, err = server.VerifySecondFactor(context.Background(), &pb.VerifySecondFactorRequest{ChallengeId: challengeID, TotpCode: code})
+	require.NoError(t, err)
+	require.NoError(t, call(res.GetAccessToken(), "/ecommerce.LaptopService/CreateLaptop"))
+
+	// an answered challenge is closed.
+	_, err = server.VerifySecondFactor(context.Background(), &pb.VerifySecondFactorRequest{ChallengeId: challengeID, TotpCode: code})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// a token issued after the second factor is refreshed without it, but any
+	// other valid token of the user still leads to a challenge.
+	refresh := func(token string) *pb.LoginResponse {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+		res, err := server.Login(ctx, &pb.LoginRequest{Username: "admin1", Password: "secret"})
+		require.NoError(t, err)
+		return res
+	}
+
+	refreshed := refresh(res.GetAccessToken())
+	require.NotEmpty(t, refreshed.GetAccessToken())
+	claims, err = jwtManager.Verify(refreshed.GetAccessToken())
+	require.NoError(t, err)
+	require.True(t, claims.SecondFactor)
+	require.NotEmpty(t, refresh(refreshed.GetAccessToken()).GetAccessToken())
+
+	plainToken, err := jwtManager.Generate(admin)
+	require.NoError(t, err)
+	challenged := refresh(plainToken)
+	require.Empty(t, challenged.GetAccessToken())
+	require.NotEmpty(t, challenged.GetChallengeId())
+
+	// each recovery code can be used once.
+	recoveryCode := confirmRes.GetRecoveryCodes()[3]
+	_, err = server.VerifySecondFactor(context.Background(), &pb.VerifySecondFactorRequest{ChallengeId: login(), RecoveryCode: recoveryCode})
+	require.NoError(t, err)
+	_, err = server.VerifySecondFactor(context.Background(), &pb.VerifySecondFactorRequest{ChallengeId: login(), RecoveryCode: recoveryCode})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// admins cannot remove their second factor.
+	_, err = server.DisableTOTP(adminCtx, &pb.DisableTOTPRequest{RecoveryCode: confirmRes.GetRecoveryCodes()[4]})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultItemWeightKg is the weight of an item whose weight is not known.
+const defaultItemWeightKg = 1.0
+
+// ErrNoCarrier is returned when no carrier rule applies to a shipment.
+var ErrNoCarrier = errors.New("no carrier rule applies to the shipment")
+
+// CarrierRule assigns a carrier to the combined shipments it applies to.
+type CarrierRule interface {
+	// Assign returns the carrier of the shipment and the number of business
+	// days the carrier takes to deliver it, or false if the rule does not apply.
+	Assign(shipment *pb.CombinedShipment) (carrier string, transitDays int, ok bool)
+}
+
+// ShipmentRule is a CarrierRule that applies to the shipments by region, weight
+// and value. The criteria left empty apply to every shipment.
+type ShipmentRule struct {
+	Carrier     string `json:"carrier"`
+	TransitDays int    `json:"transit_days"`
+	// Countries and Regions are the codes of the destinations.
+	Countries []string `json:"countries,omitempty"`
+	Regions   []string `json:"regions,omitempty"`
+	// MinWeightKg and MinValue are inclusive, MaxWeightKg and MaxValue are
+	// exclusive, and a zero maximum has no limit.
+	MinWeightKg float64 `json:"min_weight_kg,omitempty"`
+	MaxWeightKg float64 `json:"max_weight_kg,omitempty"`
+	MinValue    float64 `json:"min_value,omitempty"`
+	MaxValue    float64 `json:"max_value,omitempty"`
+}
+
+// Assign returns the carrier of the rule if the shipment matches all its criteria
+func (rule *ShipmentRule) Assign(shipment *pb.CombinedShipment) (string, int, bool) {
+	destination := shipment.GetDestination()
+	if len(rule.Countries) > 0 && !containsFoldString(rule.Countries, destination.GetCountry()) {
+		return "", 0, false
+	}
+	if len(rule.Regions) > 0 && !containsFoldString(rule.Regions, destination.GetRegion()) {
+		return "", 0, false
+	}
+
+	if !inRange(shipment.GetWeightKg(), rule.MinWeightKg, rule.MaxWeightKg) ||
+		!inRange(shipment.GetValue(), rule.MinValue, rule.MaxValue) {
+		return "", 0, false
+	}
+
+	return rule.Carrier, rule.TransitDays, true
+}
+
+func inRange(value, min, max float64) bool {
+	return value >= min && (max == 0 || value < max)
+}
+
+func containsFoldString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DefaultCarrierRules returns the carrier rules used when the server has none:
+// heavy shipments go by freight, valuable ones by courier, the west coast has
+// its own carrier, and everything else goes by ground.
+func DefaultCarrierRules() []CarrierRule {
+	return []CarrierRule{
+		&ShipmentRule{Carrier: "freight", TransitDays: 7, MinWeightKg: 30},
+		&ShipmentRule{Carrier: "secure-courier", TransitDays: 2, MinValue: 5000},
+		&ShipmentRule{Carrier: "west-coast-express", TransitDays: 2, Countries: []string{"US"}, Regions: []string{"CA", "OR", "WA"}},
+		&ShipmentRule{Carrier: "ground", TransitDays: 5},
+	}
+}
+
+// LoadCarrierRules reads carrier rules from a JSON file holding a list of ShipmentRule.
+func LoadCarrierRules(path string) ([]CarrierRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read carrier rules: %w", err)
+	}
+
+	var shipmentRules []*ShipmentRule
+	err = json.Unmarshal(data, &shipmentRules)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse carrier rules: %w", err)
+	}
+
+	rules := make([]CarrierRule, 0, len(shipmentRules))
+	for i, rule := range shipmentRules {
+		if rule.Carrier == "" || rule.TransitDays < 0 {
+			return nil, fmt.Errorf("carrier rule %d needs a carrier and a transit time", i)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// CarrierRouter assigns the carriers to the combined shipments with the first
+// of its rules that applies.
+type CarrierRouter struct {
+	rules []CarrierRule
+}
+
+// NewCarrierRouter returns a new CarrierRouter
+func NewCarrierRouter(rules ...CarrierRule) *CarrierRouter {
+	return &CarrierRouter{
+		rules: rules,
+	}
+}
+
+// Route sets the weight, the value, the carrier and the estimated delivery date
+// of a shipment sent now. It returns ErrNoCarrier if no rule applies.
+func (router *CarrierRouter) Route(shipment *pb.CombinedShipment, now time.Time) error {
+	shipment.WeightKg = 0
+	shipment.Value = 0
+
+	// the amounts of the orders are added exactly, so the value does not drift.
+	value := &pb.Money{CurrencyCode: defaultCurrency}
+	for _, order := range shipment.GetOrdersList() {
+		shipment.WeightKg += orderWeightKg(order)
+
+		var err error
+		value, err = money.Add(value, orderPaid(order))
+		if err != nil {
+			return fmt.Errorf("cannot add the amount of order %s: %w", order.GetId(), err)
+		}
+	}
+	shipment.Value = money.ToFloat(value)
+
+	for _, rule := range router.rules {
+		carrier, transitDays, ok := rule.Assign(shipment)
+		if !ok {
+			continue
+		}
+
+		shipment.Carrier = carrier
+		shipment.EstimatedDelivery = timestamppb.New(addBusinessDays(now, transitDays))
+		return nil
+	}
+
+	return ErrNoCarrier
+}
+
+// orderWeightKg() function returns the weight of an order, counting the items
+// whose weight is not known as defaultItemWeightKg each.
+func orderWeightKg(order *pb.Order) float64 {
+	if len(order.GetLineItems()) == 0 {
+		return defaultItemWeightKg * float64(len(order.GetItems()))
+	}
+
+	weight := 0.0
+	for _, item := range order.GetLineItems() {
+		unitWeight := item.GetWeightKg()
+		if unitWeight == 0 {
+			unitWeight = defaultItemWeightKg
+		}
+		weight += unitWeight * float64(item.GetQuantity())
+	}
+
+	return weight
+}
+
+// addBusinessDays() function returns the day that comes the given number of
+// business days after now, skipping the weekends.
+func addBusinessDays(now time.Time, days int) time.Time {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for days > 0 {
+		day = day.AddDate(0, 0, 1)
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			days--
+		}
+	}
+
+	return day
+}
@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseAddress(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		destination string
+		address     *pb.Address
+	}{
+		{"San Jose, CA", &pb.Address{City: "San Jose", Region: "CA", Country: "US"}},
+		{"San Jose,CA", &pb.Address{City: "San Jose", Region: "CA", Country: "US"}},
+		{"  San   Jose ,  california ", &pb.Address{City: "San Jose", Region: "CA", Country: "US"}},
+		{"1 Infinite Loop, Cupertino, California 95014, USA", &pb.Address{
+			Street: "1 Infinite Loop", City: "Cupertino", Region: "CA", PostalCode: "95014", Country: "US"}},
+		{"New York, New York 10001", &pb.Address{City: "New York", Region: "NY", PostalCode: "10001", Country: "US"}},
+		{"Toronto, ON, Canada", &pb.Address{City: "Toronto", Region: "ON", Country: "CA"}},
+		{"Springfield", &pb.Address{City: "Springfield", Country: "US"}},
+	}
+
+	for _, tc := range testCases {
+		address, err := service.ParseAddress(tc.destination)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(tc.address, address), "%q: got %v", tc.destination, address)
+	}
+
+	_, err := service.ParseAddress(" , ")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCarrierRouter(t *testing.T) {
+	t.Parallel()
+
+	// a Friday, so that the delivery dates skip the weekend.
+	now := time.Date(2022, time.June, 10, 15, 0, 0, 0, time.UTC)
+
+	shipment := func(region string, orders ...*pb.Order) *pb.CombinedShipment {
+		return &pb.CombinedShipment{
+			Destination: &pb.Address{City: "City", Region: region, Country: "US"},
+			OrdersList:  orders,
+		}
+	}
+	laptops := func(quantity uint32, weightKg float64, total float64) *pb.Order {
+		return &pb.Order{
+			LineItems: []*pb.OrderItem{{Product: &pb.OrderItem_LaptopId{LaptopId: "laptop"}, Quantity: quantity, WeightKg: weightKg}},
+			Total:     total,
+		}
+	}
+
+	router := service.NewCarrierRouter(service.DefaultCarrierRules()...)
+	testCases := []struct {
+		shipment *pb.CombinedShipment
+		carrier  string
+		delivery time.Time
+	}{
+		{shipment("TX", &pb.Order{Items: []string{"Kindle"}, Price: 90}), "ground", time.Date(2022, time.June, 17, 0, 0, 0, 0, time.UTC)},
+		{shipment("CA", &pb.Order{Items: []string{"Kindle"}, Price: 90}), "west-coast-express", time.Date(2022, time.June, 14, 0, 0, 0, 0, time.UTC)},
+		{shipment("CA", laptops(2, 2.5, 3000), laptops(1, 2.5, 2500)), "secure-courier", time.Date(2022, time.June, 14, 0, 0, 0, 0, time.UTC)},
+		{shipment("TX", laptops(20, 2, 20000)), "freight", time.Date(2022, time.June, 21, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, router.Route(tc.shipment, now))
+		require.Equal(t, tc.carrier, tc.shipment.GetCarrier())
+		require.Equal(t, tc.delivery, tc.shipment.GetEstimatedDelivery().AsTime())
+	}
+
+	// the weight and the value of the shipment are known once it is routed.
+	routed := shipment("CA", laptops(2, 2.5, 3000), laptops(1, 0, 2500))
+	require.NoError(t, router.Route(routed, now))
+	require.InDelta(t, 6, routed.GetWeightKg(), 1e-9)
+	require.InDelta(t, 5500, routed.GetValue(), 1e-9)
+
+	// the rules can be loaded from a file.
+	path := filepath.Join(t.TempDir(), "carriers.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"carrier": "local", "transit_days": 1, "regions": ["tx"], "max_weight_kg": 10}
+	]`), 0o600))
+	rules, err := service.LoadCarrierRules(path)
+	require.NoError(t, err)
+	router = service.NewCarrierRouter(rules...)
+
+	local := shipment("TX", &pb.Order{Items: []string{"Kindle"}, Price: 90})
+	require.NoError(t, router.Route(local, now))
+	require.Equal(t, "local", local.GetCarrier())
+	require.ErrorIs(t, router.Route(shipment("CA", &pb.Order{Items: []string{"Kindle"}, Price: 90}), now), service.ErrNoCarrier)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"transit_days": 1}]`), 0o600))
+	_, err = service.LoadCarrierRules(path)
+	require.Error(t, err)
+}
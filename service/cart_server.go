@@ -0,0 +1,332 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"log"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// priceChangedViolation is the type of the precondition violations of a checkout
+// whose cart has a price that changed since the item was added.
+const priceChangedViolation = "PRICE_CHANGED"
+
+// CartServer is the server that provides the shopping carts. The carts are
+// checked out into orders of the OrderManagementServer.
+type CartServer struct {
+	pb.UnimplementedCartServiceServer
+	cartStore   CartStore
+	orderServer *OrderManagementServer
+
+	mutex sync.Mutex
+	// checkouts are the carts being checked out, by tenant and username, so
+	// that a cart is not checked out twice at the same time.
+	checkouts map[string]bool
+}
+
+// NewCartServer returns a new CartServer. The order server must price the
+// orders, since the carts take their prices from the catalogs.
+func NewCartServer(cartStore CartStore, orderServer *OrderManagementServer) *CartServer {
+	return &CartServer{
+		cartStore:   cartStore,
+		orderServer: orderServer,
+		checkouts:   make(map[string]bool),
+	}
+}
+
+// AddItem is a unary RPC that adds a product to the cart of the caller, with a
+// snapshot of its catalog price.
+func (server *CartServer) AddItem(ctx context.Context, req *pb.AddCartItemRequest) (*pb.Cart, error) {
+	username, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if server.orderServer.pricer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "this server does not price orders, carts are not supported")
+	}
+
+	// the item is priced like the line of an order.
+	item := proto.Clone(req.GetItem()).(*pb.OrderItem)
+	err = server.orderServer.pricer.Price(ctx, &pb.Order{LineItems: []*pb.OrderItem{item}})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("adding %d x %s to the cart of %s", item.GetQuantity(), cartItemKey(item), username)
+
+	return server.cartStore.Update(ctx, username, func(cart *pb.Cart) error {
+		line := findCartItem(cart, cartItemKey(item))
+		if line == nil {
+			cart.Items = append(cart.Items, item)
+		} else {
+			if line.GetQuantity()+item.GetQuantity() > maxItemQuantity {
+				return status.Errorf(codes.InvalidArgument, "the cart cannot have more than %d of %s", maxItemQuantity, item.GetName())
+			}
+
+			// the whole line takes the price the user has just seen.
+			item.Quantity += line.GetQuantity()
+			proto.Reset(line)
+			proto.Merge(line, item)
+		}
+
+		return updateCartTotals(cart)
+	})
+}
+
+// RemoveItem is a unary RPC that removes a quantity of a product from the cart of the caller.
+func (server *CartServer) RemoveItem(ctx context.Context, req *pb.RemoveCartItemRequest) (*pb.Cart, error) {
+	username, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cartItemKey(req.GetItem())
+	if key == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "a product ID or a laptop ID is required")
+	}
+
+	return server.cartStore.Update(ctx, username, func(cart *pb.Cart) error {
+		if findCartItem(cart, key) == nil {
+			return status.Errorf(codes.NotFound, "%s is not in the cart", key)
+		}
+
+		removeCartItem(cart, key, req.GetItem().GetQuantity())
+		return updateCartTotals(cart)
+	})
+}
+
+// GetCart is a unary RPC that returns the cart of the caller.
+func (server *CartServer) GetCart(ctx context.Context, req *pb.GetCartRequest) (*pb.Cart, error) {
+	username, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cart, err := server.cartStore.Find(ctx, username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find cart: %v", err)
+	}
+
+	return cart, nil
+}
+
+// Checkout is a unary RPC that places an order with the items of the cart of
+// the caller. The order is priced and its stock reserved by the order server;
+// it is only placed if no price changed since the items were added.
+func (server *CartServer) Checkout(ctx context.Context, req *pb.CheckoutRequest) (*pb.CheckoutResponse, error) {
+	username, err := cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	checkout := TenantFromContext(ctx) + "/" + username
+	server.mutex.Lock()
+	if server.checkouts[checkout] {
+		server.mutex.Unlock()
+		return nil, status.Errorf(codes.Aborted, "the cart is already being checked out")
+	}
+	server.checkouts[checkout] = true
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.checkouts, checkout)
+		server.mutex.Unlock()
+	}()
+
+	cart, err := server.cartStore.Find(ctx, username)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find cart: %v", err)
+	}
+
+	if len(cart.GetItems()) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "the cart is empty")
+	}
+
+	// the order only references the products, the order server prices them.
+	order := &pb.Order{
+		Destination: req.GetDestination(),
+		Description: req.GetDescription(),
+	}
+	for _, item := range cart.GetItems() {
+		line := proto.Clone(item).(*pb.OrderItem)
+		line.Name, line.UnitPrice, line.LineTotal, line.WeightKg, line.Brand = "", 0, 0, 0, ""
+		line.UnitAmount, line.LineAmount = nil, nil
+		order.LineItems = append(order.LineItems, line)
+	}
+
+	err = server.orderServer.placeOrder(ctx, order, func(order *pb.Order) error {
+		return server.checkPrices(ctx, username, cart, order)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("checked out the cart of %s into order %s", username, order.GetId())
+
+	// the items added to the cart during the checkout stay in the cart.
+	_, err = server.cartStore.Update(ctx, username, func(current *pb.Cart) error {
+		for _, item := range cart.GetItems() {
+			removeCartItem(current, cartItemKey(item), item.GetQuantity())
+		}
+
+		return updateCartTotals(current)
+	})
+	if err != nil {
+		log.Printf("cannot empty the cart of %s: %v", username, err)
+	}
+
+	return &pb.CheckoutResponse{Order: order}, nil
+}
+
+// checkPrices() function compares the prices of the order with the prices of
+// the cart. When some changed, the cart is updated to the new prices, and a
+// FailedPrecondition error lists the changes.
+func (server *CartServer) checkPrices(ctx context.Context, username string, cart *pb.Cart, order *pb.Order) error {
+	var violations []*errdetails.PreconditionFailure_Violation
+	prices := make(map[string]*pb.Money)
+
+	for i, item := range cart.GetItems() {
+		price := order.GetLineItems()[i].GetUnitAmount()
+		if proto.Equal(price, cartUnitAmount(item)) {
+			continue
+		}
+
+		prices[cartItemKey(item)] = price
+		violations = append(violations, &errdetails.PreconditionFailure_Violation{
+			Type:        priceChangedViolation,
+			Subject:     fmt.Sprintf("items[%d]", i),
+			Description: fmt.Sprintf("the price of %s changed from %.2f to %.2f", item.GetName(), item.GetUnitPrice(), usdToFloat(price)),
+		})
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	_, err := server.cartStore.Update(ctx, username, func(current *pb.Cart) error {
+		for key, price := range prices {
+			if item := findCartItem(current, key); item != nil {
+				item.UnitAmount = price
+			}
+		}
+
+		return updateCartTotals(current)
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot update cart prices: %v", err)
+	}
+
+	st := status.Newf(codes.FailedPrecondition, "%d price(s) of the cart changed, first: %s",
+		len(violations), violations[0].GetDescription())
+
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{Violations: violations})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// cartOwner() function returns the username of the caller, who owns the cart.
+func cartOwner(ctx context.Context) (string, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Username == "" {
+		return "", status.Errorf(codes.Unauthenticated, "the cart belongs to an authenticated user")
+	}
+
+	return claims.Username, nil
+}
+
+// cartItemKey() function returns the catalog reference of a cart item, or an
+// empty string if it has none.
+func cartItemKey(item *pb.OrderItem) string {
+	switch product := item.GetProduct().(type) {
+	case *pb.OrderItem_ProductId:
+		if product.ProductId != "" {
+			return "product/" + product.ProductId
+		}
+	case *pb.OrderItem_LaptopId:
+		if product.LaptopId != "" {
+			return "laptop/" + product.LaptopId
+		}
+	}
+
+	return ""
+}
+
+// findCartItem() function returns the line of the cart with the product, or nil.
+func findCartItem(cart *pb.Cart, key string) *pb.OrderItem {
+	for _, item := range cart.GetItems() {
+		if cartItemKey(item) == key {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// removeCartItem() function removes a quantity of a product from the cart, or
+// the whole line when the quantity is 0.
+func removeCartItem(cart *pb.Cart, key string, quantity uint32) {
+	items := cart.Items[:0]
+	for _, item := range cart.GetItems() {
+		if cartItemKey(item) == key {
+			if quantity == 0 || quantity >= item.GetQuantity() {
+				continue
+			}
+			item.Quantity -= quantity
+		}
+		items = append(items, item)
+	}
+
+	cart.Items = items
+}
+
+// cartUnitAmount() function returns the unit amount of a cart item. The items
+// added before the unit amounts existed only have a unit price.
+func cartUnitAmount(item *pb.OrderItem) *pb.Money {
+	if item.GetUnitAmount() != nil {
+		return item.GetUnitAmount()
+	}
+
+	return usdFromFloat(item.GetUnitPrice(), 64)
+}
+
+// updateCartTotals() function computes the line totals and the subtotal of the
+// cart from the unit amounts of its items, and derives their legacy doubles.
+func updateCartTotals(cart *pb.Cart) error {
+	subtotal := &pb.Money{CurrencyCode: defaultCurrency}
+	for _, item := range cart.GetItems() {
+		item.UnitAmount = cartUnitAmount(item)
+
+		line, err := money.Multiply(item.GetUnitAmount(), int64(item.GetQuantity()))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot price the cart: %v", err)
+		}
+
+		subtotal, err = money.Add(subtotal, line)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot price the cart: %v", err)
+		}
+
+		item.LineAmount = line
+		item.UnitPrice = usdToFloat(item.GetUnitAmount())
+		item.LineTotal = usdToFloat(line)
+	}
+
+	cart.SubtotalAmount = subtotal
+	cart.Subtotal = usdToFloat(subtotal)
+	cart.UpdatedAt = timestamppb.Now()
+
+	return nil
+}
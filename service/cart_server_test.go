@@ -0,0 +1,152 @@
+package service_test
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"net"
+	"testing"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestCartServer(t *testing.T) {
+	t.Parallel()
+
+	productStore := service.NewInMemoryProductStore()
+	require.NoError(t, productStore.Save(context.Background(), &pb.Product{Id: "echo", Name: "Amazon Echo", Price: 29.99}))
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sampledata.NewLaptop()
+	laptop.Price = usd(t, "999")
+	laptop.Stock = &wrapper.UInt32Value{Value: 2}
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+
+	catalogServer := grpc.NewServer()
+	pb.RegisterProductInfoServer(catalogServer, service.NewProductInfoServer(productStore))
+	pb.RegisterLaptopServiceServer(catalogServer, service.NewLaptopServer(laptopStore, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go catalogServer.Serve(listener)
+	t.Cleanup(catalogServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	stockReservations := service.NewInMemoryStockReservations(service.WithLaptopStock(laptopStore))
+
+	orderStore := service.NewInMemoryOrderStore()
+	pricer := service.NewOrderPricer(pb.NewProductInfoClient(conn), pb.NewLaptopServiceClient(conn), 0)
+	orderServer := service.NewOrderManagementServer(orderStore, service.WithOrderPricing(pricer), service.WithStockReservations(stockReservations))
+	cartServer := service.NewCartServer(service.NewInMemoryCartStore(), orderServer)
+
+	ctx := service.ContextWithClaims(context.Background(), &service.UserClaims{Username: "user1", Role: "user"})
+	echo := &pb.OrderItem{Product: &pb.OrderItem_ProductId{ProductId: "echo"}, Quantity: 2}
+	laptopItem := &pb.OrderItem{Product: &pb.OrderItem_LaptopId{LaptopId: laptop.GetId()}, Quantity: 3}
+
+	// the carts belong to authenticated users.
+	_, err = cartServer.GetCart(context.Background(), &pb.GetCartRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// the items are added with a snapshot of their price.
+	_, err = cartServer.AddItem(ctx, &pb.AddCartItemRequest{Item: echo})
+	require.NoError(t, err)
+	_, err = cartServer.AddItem(ctx, &pb.AddCartItemRequest{Item: echo})
+	require.NoError(t, err)
+	cart, err := cartServer.AddItem(ctx, &pb.AddCartItemRequest{Item: laptopItem})
+	require.NoError(t, err)
+	require.Len(t, cart.GetItems(), 2)
+	require.Equal(t, uint32(4), cart.GetItems()[0].GetQuantity())
+	require.Equal(t, 29.99, cart.GetItems()[0].GetUnitPrice())
+	require.Equal(t, 3116.96, cart.GetSubtotal())
+
+	_, err = cartServer.AddItem(ctx, &pb.AddCartItemRequest{Item: &pb.OrderItem{Product: &pb.OrderItem_ProductId{ProductId: "unknown"}, Quantity: 1}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// another user has a cart of their own.
+	otherCtx := service.ContextWithClaims(context.Background(), &service.UserClaims{Username: "user2", Role: "user"})
+	other, err := cartServer.GetCart(otherCtx, &pb.GetCartRequest{})
+	require.NoError(t, err)
+	require.Empty(t, other.GetItems())
+
+	// there are only 2 laptops in stock, so the checkout reserves nothing.
+	_, err = cartServer.Checkout(ctx, &pb.CheckoutRequest{Destination: "San Jose, CA"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Zero(t, stockReservations.Reserved(context.Background(), laptop.GetId()))
+
+	cart, err = cartServer.RemoveItem(ctx, &pb.RemoveCartItemRequest{Item: &pb.OrderItem{Product: laptopItem.GetProduct(), Quantity: 1}})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), cart.GetItems()[1].GetQuantity())
+
+	// a price that changed since the item was added fails the checkout, and
+	// updates the cart for the user to review.
+	require.NoError(t, productStore.Update(context.Background(), &pb.Product{Id: "echo", Name: "Amazon Echo", Price: 24.99}))
+	_, err = cartServer.Checkout(ctx, &pb.CheckoutRequest{Destination: "San Jose, CA"})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Len(t, st.Details(), 1)
+	violations := st.Details()[0].(*errdetails.PreconditionFailure).GetViolations()
+	require.Len(t, violations, 1)
+	require.Equal(t, "items[0]", violations[0].GetSubject())
+
+	cart, err = cartServer.GetCart(ctx, &pb.GetCartRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 24.99, cart.GetItems()[0].GetUnitPrice())
+	require.Equal(t, 2097.96, cart.GetSubtotal())
+	orders := 0
+	require.NoError(t, orderStore.Search(context.Background(), &pb.OrderQuery{}, func(order *pb.Order) error {
+		orders++
+		return nil
+	}))
+	require.Zero(t, orders)
+
+	// the checkout places the order, reserves the stock and empties the cart.
+	res, err := cartServer.Checkout(ctx, &pb.CheckoutRequest{Destination: "San Jose, CA"})
+	require.NoError(t, err)
+	require.Equal(t, "user1", res.GetOrder().GetCustomer())
+	require.Equal(t, 2097.96, res.GetOrder().GetTotal())
+	require.Equal(t, uint32(2), stockReservations.Reserved(context.Background(), laptop.GetId()))
+
+	order, err := orderStore.Find(context.Background(), res.GetOrder().GetId())
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_PENDING, order.GetStatus())
+
+	cart, err = cartServer.GetCart(ctx, &pb.GetCartRequest{})
+	require.NoError(t, err)
+	require.Empty(t, cart.GetItems())
+
+	_, err = cartServer.Checkout(ctx, &pb.CheckoutRequest{Destination: "San Jose, CA"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// new line items are reserved in place of the old ones, all of them or none.
+	updateLineItems := func(quantity uint32) pb.UpdateOrderResult_Outcome {
+		stream, err := newTestOrderClient(t, orderServer).BatchUpdateOrders(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&pb.UpdateOrderRequest{
+			Order:      &pb.Order{Id: order.GetId(), LineItems: []*pb.OrderItem{echo, {Product: laptopItem.GetProduct(), Quantity: quantity}}},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"line_items"}},
+		}))
+		summary, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		return summary.GetResults()[0].GetOutcome()
+	}
+
+	require.Equal(t, pb.UpdateOrderResult_INVALID, updateLineItems(3))
+	require.Equal(t, uint32(2), stockReservations.Reserved(context.Background(), laptop.GetId()))
+	order, err = orderStore.Find(context.Background(), order.GetId())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), order.GetLineItems()[1].GetQuantity())
+
+	require.Equal(t, pb.UpdateOrderResult_UPDATED, updateLineItems(1))
+	require.Equal(t, uint32(1), stockReservations.Reserved(context.Background(), laptop.GetId()))
+}
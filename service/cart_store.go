@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// CartStore is an interface to store the shopping carts, keyed by the username
+// of their owner. Like the LaptopStore, carts are kept per tenant.
+type CartStore interface {
+	// Find returns the cart of a user, which is empty if the user has none.
+	Find(ctx context.Context, username string) (*pb.Cart, error)
+
+	// Update applies the update to the cart of a user atomically, and returns
+	// the updated cart. The cart is left unchanged if the update returns an error.
+	Update(ctx context.Context, username string, update func(cart *pb.Cart) error) (*pb.Cart, error)
+}
+
+// InMemoryCartStore stores carts in memory
+type InMemoryCartStore struct {
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the username,
+	// and the value is the cart object.
+	data map[string]map[string]*pb.Cart
+}
+
+// NewInMemoryCartStore returns a new InMemoryCartStore
+func NewInMemoryCartStore() *InMemoryCartStore {
+	return &InMemoryCartStore{
+		data: make(map[string]map[string]*pb.Cart),
+	}
+}
+
+// Find finds the cart of a user
+func (store *InMemoryCartStore) Find(ctx context.Context, username string) (*pb.Cart, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	cart := store.data[TenantFromContext(ctx)][username]
+	if cart == nil {
+		return &pb.Cart{Username: username}, nil
+	}
+
+	return proto.Clone(cart).(*pb.Cart), nil
+}
+
+// Update updates the cart of a user
+func (store *InMemoryCartStore) Update(ctx context.Context, username string, update func(cart *pb.Cart) error) (*pb.Cart, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tenant := TenantFromContext(ctx)
+	carts := store.data[tenant]
+	if carts == nil {
+		carts = make(map[string]*pb.Cart)
+		store.data[tenant] = carts
+	}
+
+	// the update works on a copy, so that a failed update changes nothing.
+	cart := &pb.Cart{Username: username}
+	if carts[username] != nil {
+		cart = proto.Clone(carts[username]).(*pb.Cart)
+	}
+
+	err := update(cart)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty cart is not kept.
+	if len(cart.GetItems()) == 0 {
+		delete(carts, username)
+	} else {
+		carts[username] = proto.Clone(cart).(*pb.Cart)
+	}
+
+	return cart, nil
+}
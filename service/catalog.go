@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"math"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The ProductInfo catalog of a tenant holds the laptops of that tenant: a
+// laptop is a product whose spec is the laptop, and whose ID is the laptop ID,
+// so the orders, ratings and images of a laptop all use the same identifier.
+// Like the laptops, the products are kept per tenant, so the admins of a
+// tenant only ever change the catalog of their own storefront.
+
+// productFromLaptop() function returns the catalog product of a laptop.
+func productFromLaptop(laptop *pb.Laptop) *pb.Product {
+	product := &pb.Product{
+		Id:        laptop.GetId(),
+		Name:      strings.TrimSpace(laptop.GetBrand() + " " + laptop.GetName()),
+		ListPrice: proto.Clone(laptopPrice(laptop)).(*pb.Money),
+		Spec:      &pb.Product_Laptop{Laptop: proto.Clone(laptop).(*pb.Laptop)},
+	}
+	product.Price = float32(usdToFloat(product.GetListPrice()))
+
+	return product
+}
+
+// linkLaptop() function saves the product of a laptop to the catalog of the
+// tenant carried by the context. A laptop that is already linked is left as
+// is, and so is a laptop whose product was deleted from the catalog.
+func linkLaptop(ctx context.Context, productStore ProductStore, laptop *pb.Laptop) (bool, error) {
+	err := productStore.Save(ctx, productFromLaptop(laptop))
+	if errors.Is(err, ErrAlreadyExists) || errors.Is(err, ErrDeleted) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MigrateLaptops() function links the laptops of the default storefront that
+// were created before the catalog was, and returns how many it linked. It is
+// meant to run once at startup, before the ProductInfo service is served;
+// the laptops of the other tenants are linked when they are created.
+func MigrateLaptops(ctx context.Context, laptopStore LaptopStore, productStore ProductStore) (int, error) {
+	// the laptops created before the tenants are those of the default storefront.
+	ctx = ContextWithTenant(ctx, DefaultTenant)
+
+	// an infinite max price lets every laptop through.
+	filter := &pb.Filter{MaxPriceUsd: math.Inf(1)}
+
+	migrated := 0
+	err := laptopStore.Search(ctx, filter, func(laptop *pb.Laptop) error {
+		linked, err := linkLaptop(ctx, productStore, laptop)
+		if linked {
+			migrated++
+		}
+		return err
+	})
+	if err != nil {
+		return migrated, err
+	}
+
+	// the store stops searching without an error when the context is done.
+	return migrated, ctx.Err()
+}
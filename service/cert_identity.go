@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// CredentialPrecedence tells the AuthInterceptor which credential wins when a
+// request carries both a verified client certificate and a JWT access token.
+type CredentialPrecedence string
+
+const (
+	// PreferJWT authenticates with the access token when one is sent, and only
+	// falls back to the client certificate otherwise. This is the default.
+	PreferJWT CredentialPrecedence = "jwt"
+	// PreferCertificate authenticates with the client certificate when it maps
+	// to a role, and ignores any access token sent along with it.
+	PreferCertificate CredentialPrecedence = "certificate"
+)
+
+// CertIdentityConfig maps the identities found in mutual-TLS client certificates
+// to roles, so that service-to-service callers can authenticate without a JWT.
+type CertIdentityConfig struct {
+	// Precedence decides between a certificate and an access token sent together.
+	Precedence CredentialPrecedence `json:"precedence"`
+	// Roles maps a certificate identity to a role. An identity is either a URI SAN
+	// (such as a SPIFFE ID "spiffe://ecommerce/order-service"), a DNS SAN,
+	// or the subject common name of a certificate without SANs.
+	Roles map[string]string `json:"roles"`
+	// Tenants maps a certificate identity to the tenant it acts in, the
+	// identities that are not listed act in the DefaultTenant. Like for a user,
+	// a caller asking for another tenant in the x-tenant-id metadata is denied.
+	Tenants map[string]string `json:"tenants"`
+}
+
+// LoadCertIdentityConfig reads a CertIdentityConfig from a JSON file.
+func LoadCertIdentityConfig(filename string) (CertIdentityConfig, error) {
+	config := CertIdentityConfig{}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return config, fmt.Errorf("cannot read cert identity config: %w", err)
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return config, fmt.Errorf("cannot parse cert identity config: %w", err)
+	}
+
+	switch config.Precedence {
+	case "":
+		config.Precedence = PreferJWT
+	case PreferJWT, PreferCertificate:
+	default:
+		return config, fmt.Errorf("unknown credential precedence %q", config.Precedence)
+	}
+
+	for identity, tenant := range config.Tenants {
+		if _, ok := config.Roles[identity]; !ok {
+			return config, fmt.Errorf("cert identity %q has a tenant but no role", identity)
+		}
+
+		err = ValidateTenant(tenant)
+		if err != nil {
+			return config, fmt.Errorf("cert identity %q: %w", identity, err)
+		}
+	}
+
+	return config, nil
+}
+
+// WithCertIdentities makes the interceptor accept verified client certificates
+// whose identity is mapped to a role in the given config.
+func WithCertIdentities(config CertIdentityConfig) AuthInterceptorOption {
+	return func(interceptor *AuthInterceptor) {
+		if config.Precedence == "" {
+			config.Precedence = PreferJWT
+		}
+		interceptor.certIdentities = &config
+	}
+}
+
+// certificateClaims returns the claims of the caller identified by its verified
+// client certificate, in the tenant of its identity, or nil if there is no such
+// certificate or its identity is not mapped to any role.
+func (config *CertIdentityConfig) certificateClaims(ctx context.Context) *UserClaims {
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return nil
+	}
+
+	for _, identity := range certIdentities(cert) {
+		role, ok := config.Roles[identity]
+		if ok {
+			tenant := config.Tenants[identity]
+			if tenant == "" {
+				tenant = DefaultTenant
+			}
+
+			return &UserClaims{
+				Username: identity,
+				Role:     role,
+				Tenant:   tenant,
+			}
+		}
+	}
+
+	return nil
+}
+
+// peerCertificate returns the leaf certificate of the caller, but only when the
+// TLS handshake has verified it against the trusted client CAs.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+
+	return chains[0][0]
+}
+
+// certIdentities lists the identities of a certificate from the most to the
+// least specific: URI SANs first, then DNS SANs. The subject common name is
+// only an identity of a certificate without any SAN, since the SANs replace
+// it, and a certificate issued for them can carry any common name.
+func certIdentities(cert *x509.Certificate) []string {
+	identities := []string{}
+
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	identities = append(identities, cert.DNSNames...)
+
+	hasSANs := len(cert.URIs) > 0 || len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 || len(cert.EmailAddresses) > 0
+	if !hasSANs && cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	return identities
+}
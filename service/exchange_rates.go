@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"math/big"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrUnknownCurrency is returned when there is no exchange rate for a currency.
+var ErrUnknownCurrency = errors.New("unknown currency")
+
+// RateProvider is an interface to get the exchange rates used to convert the prices.
+// We might want to get them from a bank or a rates API later, so it is
+// defined as an interface.
+type RateProvider interface {
+	// Rate returns how many units of the to currency one unit of the from
+	// currency is worth. It returns ErrUnknownCurrency if it has no rate for one
+	// of the currencies.
+	Rate(ctx context.Context, from string, to string) (*big.Rat, error)
+}
+
+// FileRateProvider provides the exchange rates of a JSON file, such as
+//
+//	{"base": "USD", "rates": {"EUR": 0.92, "GBP": 0.79}}
+//
+// where each rate is how many units of the currency one unit of the base
+// currency is worth. The rates are read as the decimals they are written as.
+type FileRateProvider struct {
+	base string
+	// key is the currency code, and the value is the rate from the base currency.
+	rates map[string]*big.Rat
+}
+
+// rateFile is the content of a file read by the FileRateProvider.
+type rateFile struct {
+	Base  string                 `json:"base"`
+	Rates map[string]json.Number `json:"rates"`
+}
+
+// NewFileRateProvider reads the exchange rates of a file, and returns a new FileRateProvider
+func NewFileRateProvider(path string) (*FileRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read exchange rates: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var file rateFile
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse exchange rates %s: %w", path, err)
+	}
+
+	if !money.ValidCurrencyCode(file.Base) {
+		return nil, fmt.Errorf("exchange rates %s: base currency %q is not a 3-letter ISO 4217 code", path, file.Base)
+	}
+
+	provider := &FileRateProvider{
+		base:  file.Base,
+		rates: map[string]*big.Rat{file.Base: big.NewRat(1, 1)},
+	}
+
+	for code, number := range file.Rates {
+		rate, ok := new(big.Rat).SetString(number.String())
+		if !money.ValidCurrencyCode(code) || !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("exchange rates %s: invalid rate %s for %q", path, number, code)
+		}
+		provider.rates[code] = rate
+	}
+
+	return provider, nil
+}
+
+// Rate returns the exchange rate between two currencies, through the base currency
+func (provider *FileRateProvider) Rate(ctx context.Context, from string, to string) (*big.Rat, error) {
+	fromRate, toRate := provider.rates[from], provider.rates[to]
+	if fromRate == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCurrency, from)
+	}
+	if toRate == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCurrency, to)
+	}
+
+	return new(big.Rat).Quo(toRate, fromRate), nil
+}
+
+// CurrencyConverter converts the prices to other currencies, with the rates of its provider.
+type CurrencyConverter struct {
+	provider RateProvider
+}
+
+// NewCurrencyConverter returns a new CurrencyConverter
+func NewCurrencyConverter(provider RateProvider) *CurrencyConverter {
+	return &CurrencyConverter{
+		provider: provider,
+	}
+}
+
+// Convert converts an amount to a currency. The converted amount is rounded to
+// the cent, half away from zero. An amount already in the currency is returned
+// as is.
+func (converter *CurrencyConverter) Convert(ctx context.Context, amount *pb.Money, currencyCode string) (*pb.Money, error) {
+	err := money.Validate(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if amount.GetCurrencyCode() == currencyCode {
+		return proto.Clone(amount).(*pb.Money), nil
+	}
+
+	rate, err := converter.provider.Rate(ctx, amount.GetCurrencyCode(), currencyCode)
+	if err != nil {
+		return nil, err
+	}
+
+	converted, err := money.Scale(amount, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	converted.CurrencyCode = currencyCode
+	return converted, money.Validate(converted)
+}
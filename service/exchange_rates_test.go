@@ -0,0 +1,124 @@
+package service_test
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestRateProvider returns a FileRateProvider reading the given rates.
+func newTestRateProvider(t *testing.T, rates string) *service.FileRateProvider {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(rates), 0o600))
+
+	provider, err := service.NewFileRateProvider(path)
+	require.NoError(t, err)
+	return provider
+}
+
+func TestCurrencyConverter(t *testing.T) {
+	t.Parallel()
+
+	converter := service.NewCurrencyConverter(newTestRateProvider(t, `{"base": "USD", "rates": {"EUR": 0.92, "GBP": 0.79}}`))
+	ctx := context.Background()
+
+	convert := func(amount *pb.Money, currencyCode string) string {
+		converted, err := converter.Convert(ctx, amount, currencyCode)
+		require.NoError(t, err)
+		return money.Format(converted)
+	}
+
+	// the converted prices are rounded to the cent, and the cross rates go through the base currency.
+	require.Equal(t, "1839.99 EUR", convert(usd(t, "1999.99"), "EUR"))
+	require.Equal(t, "85.87 GBP", convert(&pb.Money{CurrencyCode: "EUR", Units: 100}, "GBP"))
+	require.Equal(t, "0.123456789 USD", convert(usd(t, "0.123456789"), "USD"))
+
+	_, err := converter.Convert(ctx, usd(t, "1"), "JPY")
+	require.ErrorIs(t, err, service.ErrUnknownCurrency)
+
+	for _, rates := range []string{`{"base": "usd"}`, `{"base": "USD", "rates": {"EUR": 0}}`, `{"base": "USD", "rates": {"EUR": "x"}}`} {
+		path := filepath.Join(t.TempDir(), "rates.json")
+		require.NoError(t, os.WriteFile(path, []byte(rates), 0o600))
+		_, err := service.NewFileRateProvider(path)
+		require.Error(t, err, rates)
+	}
+}
+
+func TestLaptopPricesInCurrency(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ctx := context.Background()
+	save := func(price *pb.Money) string {
+		laptop := sampledata.NewLaptop()
+		laptop.Price = price
+		require.NoError(t, laptopStore.Save(ctx, laptop))
+		return laptop.GetId()
+	}
+	cheap := save(usd(t, "1000"))
+	save(usd(t, "2000"))
+	euro := save(&pb.Money{CurrencyCode: "EUR", Units: 900})
+
+	converter := service.NewCurrencyConverter(newTestRateProvider(t, `{"base": "USD", "rates": {"EUR": 0.92, "GBP": 0.79}}`))
+	grpcServer := grpc.NewServer()
+	pb.RegisterLaptopServiceServer(grpcServer, service.NewLaptopServer(laptopStore, nil, nil, service.WithCurrencyConverter(converter)))
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	laptopClient := newTestLaptopClient(t, listener.Addr().String())
+
+	// the price is converted, and price_usd is kept.
+	res, err := laptopClient.GetLaptopByID(ctx, &pb.GetLaptopByIDRequest{Id: cheap, CurrencyCode: "EUR"})
+	require.NoError(t, err)
+	require.Equal(t, "920.00 EUR", money.Format(res.GetLaptop().GetPrice()))
+	require.Equal(t, 1000.0, res.GetLaptop().GetPriceUsd())
+
+	_, err = laptopClient.GetLaptopByID(ctx, &pb.GetLaptopByIDRequest{Id: cheap, CurrencyCode: "JPY"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	search := func(req *pb.SearchLaptopRequest) map[string]string {
+		stream, err := laptopClient.SearchLaptop(ctx, req)
+		require.NoError(t, err)
+
+		prices := make(map[string]string)
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return prices
+			}
+			require.NoError(t, err)
+			prices[res.GetLaptop().GetId()] = money.Format(res.GetLaptop().GetPrice())
+		}
+	}
+
+	// the max price is compared with the prices converted to the currency asked for.
+	require.Equal(t, map[string]string{cheap: "920.00 EUR", euro: "900.00 EUR"}, search(&pb.SearchLaptopRequest{
+		Filter:       &pb.Filter{MaxPrice: &pb.Money{CurrencyCode: "EUR", Units: 1000}},
+		CurrencyCode: "EUR",
+	}))
+	require.Equal(t, map[string]string{cheap: "790.00 GBP", euro: "772.83 GBP"}, search(&pb.SearchLaptopRequest{
+		Filter:       &pb.Filter{MaxPrice: &pb.Money{CurrencyCode: "EUR", Units: 1000}},
+		CurrencyCode: "GBP",
+	}))
+	require.Equal(t, map[string]string{cheap: "1000.00 USD"}, search(&pb.SearchLaptopRequest{
+		Filter: &pb.Filter{MaxPrice: usd(t, "1500")},
+	}))
+
+	// a server without converter does not take a currency.
+	plainClient := newTestLaptopClient(t, startTestLaptopServer(t, laptopStore, nil, nil))
+	_, err = plainClient.GetLaptopByID(ctx, &pb.GetLaptopByIDRequest{Id: cheap, CurrencyCode: "EUR"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
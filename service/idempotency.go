@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// idempotencyKeyMetadataKey is the metadata header carrying the idempotency key of a request.
+	idempotencyKeyMetadataKey = "idempotency-key"
+	// maxIdempotencyKeyLength is the longest idempotency key accepted.
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotentMethods returns the methods whose requests can carry an idempotency key.
+func IdempotentMethods() []string {
+	return []string{
+		"/ecommerce.LaptopService/CreateLaptop",
+		"/ecommerce.OrderManagement/addOrder",
+	}
+}
+
+// IdempotencyInterceptor is a server interceptor that makes the retries of a
+// request carrying an idempotency key return the response of the first attempt,
+// instead of running the request again.
+// It must run after the AuthInterceptor, since the keys are scoped to the caller.
+type IdempotencyInterceptor struct {
+	// ttl is how long the response of a request is kept for its retries.
+	ttl time.Duration
+	// methods are the full method names the interceptor handles.
+	methods map[string]bool
+
+	mutex sync.Mutex
+	// key is the scoped idempotency key, see idempotencyScope().
+	records map[string]*idempotencyRecord
+}
+
+// idempotencyRecord is a request seen with an idempotency key, and its response once it is done.
+type idempotencyRecord struct {
+	requestHash [sha256.Size]byte
+	// done is closed when the first attempt has finished.
+	done      chan struct{}
+	response  proto.Message
+	expiresAt time.Time
+}
+
+// NewIdempotencyInterceptor returns a new IdempotencyInterceptor for the given methods.
+func NewIdempotencyInterceptor(ttl time.Duration, methods ...string) *IdempotencyInterceptor {
+	interceptor := &IdempotencyInterceptor{
+		ttl:     ttl,
+		methods: make(map[string]bool),
+		records: make(map[string]*idempotencyRecord),
+	}
+
+	for _, method := range methods {
+		interceptor.methods[method] = true
+	}
+
+	return interceptor
+}
+
+// Unary() function returns a server interceptor function to handle idempotency keys of unary RPCs.
+//
+// A request whose key is seen for the first time runs normally, and its response
+// is kept for the TTL. A retry with the same key and the same payload gets that
+// response back, or waits for it if the first attempt is still running.
+// The same key with a different payload is rejected with InvalidArgument.
+// Failed requests are not kept, so that they can be retried with the same key.
+func (interceptor *IdempotencyInterceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if !interceptor.methods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		key, err := idempotencyKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			return handler(ctx, req)
+		}
+
+		message, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		// the hash is computed before the handler runs, since handlers may change the request.
+		payload, err := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot hash request: %v", err)
+		}
+		requestHash := sha256.Sum256(payload)
+
+		scope, err := idempotencyScope(ctx, info.FullMethod, key)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			record, first := interceptor.begin(scope, requestHash)
+			if record.requestHash != requestHash {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"idempotency key %q was already used with a different request", key)
+			}
+
+			if first {
+				return interceptor.run(ctx, req, handler, scope, record)
+			}
+
+			select {
+			case <-record.done:
+			case <-ctx.Done():
+				return nil, contextError(ctx)
+			}
+
+			// a failed first attempt leaves no response, and the retry runs again.
+			if record.response != nil {
+				log.Printf("replaying the response of %s for idempotency key %q", info.FullMethod, key)
+				return proto.Clone(record.response), nil
+			}
+		}
+	}
+}
+
+// begin() function returns the record of the scoped key, and whether it has
+// just been created for this request. It also forgets the expired records.
+func (interceptor *IdempotencyInterceptor) begin(scope string, requestHash [sha256.Size]byte) (*idempotencyRecord, bool) {
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
+	now := time.Now()
+	for recordScope, record := range interceptor.records {
+		if record.response != nil && !now.Before(record.expiresAt) {
+			delete(interceptor.records, recordScope)
+		}
+	}
+
+	record := interceptor.records[scope]
+	if record != nil {
+		return record, false
+	}
+
+	record = &idempotencyRecord{
+		requestHash: requestHash,
+		done:        make(chan struct{}),
+	}
+	interceptor.records[scope] = record
+	return record, true
+}
+
+// run() function runs the first attempt of a request, and keeps its response
+// for the TTL if it succeeds.
+func (interceptor *IdempotencyInterceptor) run(
+	ctx context.Context,
+	req interface{},
+	handler grpc.UnaryHandler,
+	scope string,
+	record *idempotencyRecord,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+
+	interceptor.mutex.Lock()
+	defer interceptor.mutex.Unlock()
+
+	response, ok := res.(proto.Message)
+	if err != nil || !ok {
+		delete(interceptor.records, scope)
+	} else {
+		record.response = proto.Clone(response)
+		record.expiresAt = time.Now().Add(interceptor.ttl)
+	}
+
+	close(record.done)
+	return res, err
+}
+
+// idempotencyKey() function returns the idempotency key sent in the metadata,
+// or an empty string if there is none.
+func idempotencyKey(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+
+	values := md[idempotencyKeyMetadataKey]
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	if len(values) > 1 {
+		return "", status.Errorf(codes.InvalidArgument, "only one idempotency key can be sent")
+	}
+
+	key := values[0]
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return "", status.Errorf(codes.InvalidArgument, "idempotency key must have 1 to %d characters", maxIdempotencyKeyLength)
+	}
+
+	return key, nil
+}
+
+// idempotencyScope() function scopes an idempotency key to the tenant, the
+// authenticated caller and the method, so that different callers cannot see
+// each other's responses. Anonymous callers would all share the same keys, so
+// their idempotency keys are refused.
+func idempotencyScope(ctx context.Context, method string, key string) (string, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Username == "" {
+		return "", status.Errorf(codes.Unauthenticated, "idempotency keys are only accepted from an authenticated caller")
+	}
+
+	return TenantFromContext(ctx) + "\x00" + claims.Username + "\x00" + method + "\x00" + key, nil
+}
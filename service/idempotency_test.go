@@ -0,0 +1,151 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestIdempotencyInterceptorAddOrder(t *testing.T) {
+	t.Parallel()
+
+	const method = "/ecommerce.OrderManagement/addOrder"
+
+	orderStore := service.NewInMemoryOrderStore()
+	server := service.NewOrderManagementServer(orderStore)
+	interceptor := service.NewIdempotencyInterceptor(time.Hour, service.IdempotentMethods()...)
+
+	var calls int32
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return server.AddOrder(ctx, req.(*pb.Order))
+	}
+
+	addOrder := func(ctx context.Context, key string, order *pb.Order) (string, error) {
+		if key != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("idempotency-key", key))
+		}
+
+		res, err := interceptor.Unary()(ctx, order, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		if err != nil {
+			return "", err
+		}
+		return res.(*wrapper.StringValue).GetValue(), nil
+	}
+	newOrder := func() *pb.Order {
+		return &pb.Order{Items: []string{"Amazon Echo"}, Price: 30, Destination: "San Jose, CA"}
+	}
+
+	userCtx := userContext("user1", "user")
+
+	// without a key, every call adds an order.
+	id1, err := addOrder(userCtx, "", newOrder())
+	require.NoError(t, err)
+	id2, err := addOrder(userCtx, "", newOrder())
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id2)
+
+	// a retry with the same key gets the first response back.
+	id1, err = addOrder(userCtx, "key-1", newOrder())
+	require.NoError(t, err)
+	id2, err = addOrder(userCtx, "key-1", newOrder())
+	require.NoError(t, err)
+	require.Equal(t, id1, id2)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// the same key with a different payload is rejected.
+	changed := newOrder()
+	changed.Price = 40
+	_, err = addOrder(userCtx, "key-1", changed)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the keys of another caller are separate.
+	id3, err := addOrder(userContext("user2", "user"), "key-1", newOrder())
+	require.NoError(t, err)
+	require.NotEqual(t, id1, id3)
+
+	// a failed request is not kept, and can be retried with the same key.
+	invalid := newOrder()
+	invalid.Destination = ""
+	_, err = addOrder(userCtx, "key-2", invalid)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = addOrder(userCtx, "key-2", invalid)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, int32(6), atomic.LoadInt32(&calls))
+
+	_, err = addOrder(userCtx, string(make([]byte, 256)), newOrder())
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// anonymous callers would share their keys, so they cannot send one.
+	_, err = addOrder(context.Background(), "key-3", newOrder())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotencyInterceptorConcurrentAndTTL(t *testing.T) {
+	t.Parallel()
+
+	const method = "/ecommerce.LaptopService/CreateLaptop"
+	interceptor := service.NewIdempotencyInterceptor(100*time.Millisecond, method)
+
+	var calls int32
+	fail := int32(1)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+
+		// the first attempt fails, and one of the waiting retries runs instead.
+		if atomic.CompareAndSwapInt32(&fail, 1, 0) {
+			return nil, errors.New("temporary failure")
+		}
+		return &pb.CreateLaptopResponse{Id: string(rune('a' + n))}, nil
+	}
+
+	createLaptop := func() (string, error) {
+		ctx := metadata.NewIncomingContext(userContext("vendor1", "vendor"), metadata.Pairs("idempotency-key", "laptop-1"))
+		res, err := interceptor.Unary()(ctx, &pb.CreateLaptopRequest{}, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		if err != nil {
+			return "", err
+		}
+		return res.(*pb.CreateLaptopResponse).GetId(), nil
+	}
+
+	// concurrent retries wait for the running attempt instead of running again.
+	wg := sync.WaitGroup{}
+	ids := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, _ := createLaptop()
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	succeeded := map[string]int{}
+	for id := range ids {
+		succeeded[id]++
+	}
+	require.Equal(t, 9, succeeded["c"])
+
+	// once the TTL has passed, the key is forgotten.
+	time.Sleep(150 * time.Millisecond)
+	id, err := createLaptop()
+	require.NoError(t, err)
+	require.Equal(t, "d", id)
+}
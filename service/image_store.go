@@ -2,16 +2,19 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 
 	"github.com/google/uuid"
 )
 
 // ImageStore saves the uploaded image file somewhere on the server or on the cloud
+// The image belongs to the tenant carried by the context.
 type ImageStore interface {
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (string, error)
 }
 
 // ImageInfo contains an extra field Path since we 
@@ -24,23 +27,37 @@ type ImageInfo struct {
 
 // DiskImageStore, implements the ImageStore interface.
 // It saves image files to the disk, and store its information in memory.
+// Each tenant gets its own sub folder of the image folder.
 type DiskImageStore struct {
 	mutex       sync.RWMutex // mutex to handle concurrency
 	imageFolder string       // path of the folder to save laptop images
-	// map with the key is image ID and the value is some information of the image.
-	images map[string]*ImageInfo
+	// map with the first key is the tenant, the second key is image ID
+	// and the value is some information of the image.
+	images map[string]map[string]*ImageInfo
 }
 
 // NewDiskImageStore returns a new instance of DiskImageStore
 func NewDiskImageStore(imageFolder string) *DiskImageStore {
 	return &DiskImageStore{
 		imageFolder: imageFolder,
-		images:      make(map[string]*ImageInfo),
+		images:      make(map[string]map[string]*ImageInfo),
 	}
 }
 
 // implement the Save() function, which is required by the ImageStore interface.
-func (store *DiskImageStore) Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+func (store *DiskImageStore) Save(ctx context.Context, laptopID string, imageType string, imageData bytes.Buffer) (string, error) {
+	// the tenant is part of the image path, so we make sure it cannot escape the image folder.
+	tenant := TenantFromContext(ctx)
+	err := ValidateTenant(tenant)
+	if err != nil {
+		return "", err
+	}
+
+	tenantFolder := filepath.Join(store.imageFolder, tenant)
+	err = os.MkdirAll(tenantFolder, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("cannot create tenant image folder: %w", err)
+	}
 
 	// generate a new random UUID for the image
 	imageID, err := uuid.NewRandom()
@@ -49,8 +66,8 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
 		return "", fmt.Errorf("cannot generate image id: %w", err)
 	}
 
-	// make the path to store the image by joining the image folder, image ID, and image type.
-	imagePath := fmt.Sprintf("%s/%s%s", store.imageFolder, imageID, imageType)
+	// make the path to store the image by joining the tenant image folder, image ID, and image type.
+	imagePath := fmt.Sprintf("%s/%s%s", tenantFolder, imageID, imageType)
 
 	// call os.Create() to create the file
 	file, err := os.Create(imagePath)
@@ -71,8 +88,12 @@ func (store *DiskImageStore) Save(laptopID string, imageType string, imageData b
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	// save the image information to the map with key is the ID of the image
-	store.images[imageID.String()] = &ImageInfo{
+	if store.images[tenant] == nil {
+		store.images[tenant] = make(map[string]*ImageInfo)
+	}
+
+	// save the image information to the tenant's map with key is the ID of the image
+	store.images[tenant][imageID.String()] = &ImageInfo{
 		LaptopID: laptopID,
 		Type:     imageType,
 		Path:     imagePath,
@@ -27,10 +27,34 @@ type UserClaims struct {
 	jwt.RegisteredClaims
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	Brand    string `json:"brand,omitempty"`
+	// Tenant is the storefront whose data the token gives access to.
+	Tenant string `json:"tenant,omitempty"`
+	// TOTPEnrollment marks a token that can only be used to enroll a second
+	// factor, given to users whose role requires one they do not have yet.
+	TOTPEnrollment bool `json:"totp_enrollment,omitempty"`
+	// SecondFactor marks a token issued once the user has passed its second
+	// factor. Refreshing such a token does not ask for the second factor again.
+	SecondFactor bool `json:"second_factor,omitempty"`
 }
 
 // Generate generate and sign a new access token for a specific user.
 func (manager *JWTManager) Generate(user *User) (string, error) {
+	return manager.generate(user, false, false)
+}
+
+// GenerateWithSecondFactor generates a token for a user who has passed its second factor.
+func (manager *JWTManager) GenerateWithSecondFactor(user *User) (string, error) {
+	return manager.generate(user, false, true)
+}
+
+// GenerateTOTPEnrollment generates a token that only gives access to the
+// TOTP enrollment RPCs.
+func (manager *JWTManager) GenerateTOTPEnrollment(user *User) (string, error) {
+	return manager.generate(user, true, false)
+}
+
+func (manager *JWTManager) generate(user *User, totpEnrollment bool, secondFactor bool) (string, error) {
 	claims := UserClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: &jwt.NumericDate{
@@ -39,6 +63,11 @@ func (manager *JWTManager) Generate(user *User) (string, error) {
 		},
 		Username: user.Username,
 		Role:     user.Role,
+		Brand:    user.Brand,
+		Tenant:   user.Tenant,
+
+		TOTPEnrollment: totpEnrollment,
+		SecondFactor:   secondFactor,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
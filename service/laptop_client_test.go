@@ -45,7 +45,7 @@ func TestClientCreateLaptop(t *testing.T) {
 	require.Equal(t, expectedID, res.Id)
 
 	// check that the laptop is saved to the store
-	laptopCopy, err := laptopStore.Find(res.Id)
+	laptopCopy, err := laptopStore.Find(context.Background(), res.Id)
 	require.NoError(t, err)
 	require.NotNil(t, laptopCopy)
 
@@ -90,7 +90,7 @@ func TestClientSearchLaptop(t *testing.T) {
 
 		switch i {
 		case 0:
-			laptop.PriceUsd = 2500
+			laptop.Price = usd(t, "2500")
 		case 1:
 			laptop.Cpu.NumberCores = 2
 		case 2:
@@ -98,14 +98,14 @@ func TestClientSearchLaptop(t *testing.T) {
 		case 3:
 			laptop.Ram = &pb.Memory{Value: 4096, Unit: pb.Memory_MEGABYTE}
 		case 4:
-			laptop.PriceUsd = 1999
+			laptop.Price = usd(t, "1999")
 			laptop.Cpu.NumberCores = 4
 			laptop.Cpu.MinGhz = 2.5
 			laptop.Cpu.MaxGhz = laptop.Cpu.MinGhz + 2.0
 			laptop.Ram = &pb.Memory{Value: 16, Unit: pb.Memory_GIGABYTE}
 			expectedIDs[laptop.Id] = true
 		case 5:
-			laptop.PriceUsd = 2000
+			laptop.Price = usd(t, "2000")
 			laptop.Cpu.NumberCores = 6
 			laptop.Cpu.MinGhz = 2.8
 			laptop.Cpu.MaxGhz = laptop.Cpu.MinGhz + 2.0
@@ -115,7 +115,7 @@ func TestClientSearchLaptop(t *testing.T) {
 
 		// call store.Save() to save the laptop to the store, and require that
 		// there’s no error returned.
-		err := store.Save(laptop)
+		err := store.Save(context.Background(), laptop)
 		require.NoError(t, err)
 
 		// Next we have to add this store to the test laptop server.
@@ -225,7 +225,7 @@ func TestClientUploadImage(t *testing.T) {
 
 	// generate a sample laptop, and save it to the laptop store.
 	laptop := sampledata.NewLaptop()
-	err := laptopStore.Save(laptop)
+	err := laptopStore.Save(context.Background(), laptop)
 	require.NoError(t, err)
 
 	// start the test server and make a new laptop client.
@@ -294,9 +294,9 @@ func TestClientUploadImage(t *testing.T) {
 	require.EqualValues(t, size, res.GetSize())
 
 	// check that the image is saved to the correct folder on the server.
-	// It should be inside the test image folder, with file name is the image ID
-	// and file extension is the image type.
-	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
+	// It should be inside the default tenant's sub folder of the test image folder,
+	// with file name is the image ID and file extension is the image type.
+	savedImagePath := fmt.Sprintf("%s/%s/%s%s", testImageFolder, service.DefaultTenant, res.GetId(), imageType)
 	require.FileExists(t, savedImagePath)
 	// remove the file at the end of the test.
 	require.NoError(t, os.Remove(savedImagePath))
@@ -315,7 +315,7 @@ func TestClientRateLaptop(t *testing.T) {
 	laptop := sampledata.NewLaptop()
 
 	// save it to the store.
-	err := laptopStore.Save(laptop)
+	err := laptopStore.Save(context.Background(), laptop)
 	require.NoError(t, err)
 
 	// start the test laptop server to get the server adress, and use it
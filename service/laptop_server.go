@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
 	"io"
 	"log"
+	"math"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const maxImageSize = 1 << 20
@@ -22,15 +25,44 @@ type LaptopServer struct {
 	laptopStore LaptopStore
 	imageStore  ImageStore
 	ratingStore RatingStore
+	// productStore is the ProductInfo catalog the laptops are linked to, if any.
+	productStore ProductStore
+	// converter converts the prices to the currencies asked for, if any.
+	converter *CurrencyConverter
+}
+
+// LaptopServerOption configures an optional feature of the LaptopServer.
+type LaptopServerOption func(server *LaptopServer)
+
+// WithProductCatalog links the laptops created by the server to the products
+// of the ProductInfo catalog. See linkLaptop() for the details.
+func WithProductCatalog(productStore ProductStore) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.productStore = productStore
+	}
+}
+
+// WithCurrencyConverter lets the clients ask for the prices of the laptops in
+// another currency, converted by the converter.
+func WithCurrencyConverter(converter *CurrencyConverter) LaptopServerOption {
+	return func(server *LaptopServer) {
+		server.converter = converter
+	}
 }
 
 // NewLaptopServer returns a new LaptopServer
-func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{
+func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore, opts ...LaptopServerOption) *LaptopServer {
+	server := &LaptopServer{
 		laptopStore: laptopStore,
 		imageStore:  imageStore,
 		ratingStore: ratingStore,
 	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
 }
 
 // CreateLaptop is a unary RPC to create a new laptop
@@ -66,6 +98,12 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 
 	}
 
+	// the price is set from the legacy price_usd when the client only sends it.
+	err := migrateLaptopPrice(laptop)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptop price is invalid: %v", err)
+	}
+
 	//  check if the request is timeout or cancelled by the client or not,
 	// because if it is then there's no reason to continue processing the request.
 
@@ -81,7 +119,7 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 	}
 
 	// call server.Store.Save() to save the input laptop to the store
-	err := server.laptopStore.Save(laptop)
+	err = server.laptopStore.Save(ctx, laptop)
 
 	// If there's an error, return codes.Internal with the error to the client.
 	if err != nil {
@@ -98,6 +136,15 @@ func (server *LaptopServer) CreateLaptop(ctx context.Context, req *pb.CreateLapt
 
 	log.Printf("saved laptop with id: %s", laptop.Id)
 
+	// The laptop is saved at this point, so a failure to link it is only logged:
+	// MigrateLaptops() links the laptops of the default storefront at the next startup.
+	if server.productStore != nil {
+		_, err = linkLaptop(ctx, server.productStore, laptop)
+		if err != nil {
+			log.Printf("cannot link laptop %s to the product catalog: %v", laptop.Id, err)
+		}
+	}
+
 	// Finally, if no errors occur, we can create a new response object with the laptop ID
 	// and return it to the caller.
 	res := &pb.CreateLaptopResponse{
@@ -116,12 +163,53 @@ func (server *LaptopServer) SearchLaptop(req *pb.SearchLaptopRequest,
 	filter := req.GetFilter()
 	log.Printf("receive a search-laptop request with filter: %v", filter)
 
+	if filter.GetMaxPrice() != nil {
+		err := money.Validate(filter.GetMaxPrice())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "max price is invalid: %v", err)
+		}
+	}
+
+	// When the client asks for another currency, the prices are compared once
+	// converted to it, so the store does not compare them.
+	currencyCode := req.GetCurrencyCode()
+	storeFilter := filter
+	var maxPrice *pb.Money
+	if currencyCode != "" {
+		var err error
+		maxPrice, err = server.convertedMaxPrice(stream.Context(), filter, currencyCode)
+		if err != nil {
+			return err
+		}
+
+		storeFilter = &pb.Filter{}
+		if filter != nil {
+			storeFilter = proto.Clone(filter).(*pb.Filter)
+		}
+		storeFilter.MaxPrice = nil
+		storeFilter.MaxPriceUsd = math.Inf(1)
+	}
+
 	// Then we call server.Store.Search(), pass in the stream context, the filter,
 	// and the callback function.
 	err := server.laptopStore.Search(
 		stream.Context(),
-		filter,
+		storeFilter,
 		func(laptop *pb.Laptop) error {
+			if currencyCode != "" {
+				err := server.convertLaptopPrice(stream.Context(), laptop, currencyCode)
+				if err != nil {
+					// a laptop priced in a currency without rate cannot be compared.
+					log.Printf("skipped laptop %s: %v", laptop.GetId(), err)
+					return nil
+				}
+
+				if cmp, err := money.Compare(laptop.GetPrice(), maxPrice); maxPrice != nil && (err != nil || cmp > 0) {
+					return nil
+				}
+			}
+
+
 			// create a new response object with that laptop and send it to the
 			// client by calling stream.Send().
 			res := &pb.SearchLaptopResponse{Laptop: laptop}
@@ -150,13 +238,26 @@ func (server *LaptopServer) GetLaptopByID(ctx context.Context, reqID *pb.GetLapt
 	fmt.Println("Received a get laptop by id. ID: ", laptopID)
 
 	// use the store.Find function to search for the given laptop id
-	laptop, err := server.laptopStore.Find(laptopID)
+	laptop, err := server.laptopStore.Find(ctx, laptopID)
 
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "Laptop with ID: %s not Ffound.", laptopID)
 
 	}
 
+	// convert the price of the laptop when the client asks for another currency.
+	if reqID.GetCurrencyCode() != "" {
+		err = server.checkCurrency(ctx, reqID.GetCurrencyCode())
+		if err != nil {
+			return nil, err
+		}
+
+		err = server.convertLaptopPrice(ctx, laptop, reqID.GetCurrencyCode())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot convert the price of laptop %s: %v", laptopID, err)
+		}
+	}
+
 	// create a new response object with that laptop
 	res := &pb.GetLaptopByIDResponse{
 		Laptop: laptop,
@@ -173,7 +274,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 
 	// If there’s an error, we write a log and return the status code Unknown to the client.
 	if err != nil {
-		return logError(status.Errorf(codes.Unknown, "cannot receive image info"))
+		return logError(recvError("cannot receive image info", err))
 	}
 
 	// Next we can get the laptop ID and the image type from the request.
@@ -186,7 +287,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 
 	// Before saving the laptop image, we have to make sure that the laptop ID really exists.
 	// So we call server.laptopStore.Find() to find the laptop by ID.
-	laptop, err := server.laptopStore.Find(laptopID)
+	laptop, err := server.laptopStore.Find(stream.Context(), laptopID)
 
 	// If we get an error, just log and return it with the Internal status code.
 	if err != nil {
@@ -227,7 +328,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 		// Else, if the error is still not nil, we return it with Unknown
 		// status code to the client.
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err))
+			return logError(recvError("cannot receive chunk data", err))
 		}
 
 		// Otherwise, if there’s no error, we can get the chunk data from the request.
@@ -261,7 +362,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	}
 
 	//call imageStore.Save() to save the image data to the store and get back the image ID:
-	imageID, err := server.imageStore.Save(laptopID, imageType, imageData)
+	imageID, err := server.imageStore.Save(stream.Context(), laptopID, imageType, imageData)
 
 	if err != nil {
 		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
@@ -270,7 +371,7 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	// If the image is saved successfully, we create a response object with the
 	// image ID and image size.
 	res := &pb.UploadImageResponse{
-		Id:   laptopID,
+		Id:   imageID,
 		Size: uint32(imageSize),
 	}
 
@@ -311,7 +412,7 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 		// Else if error is not nil, we log it and return the error with status
 		// code unknown to the client.
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot receive stream request: %v", err))
+			return logError(recvError("cannot receive stream request", err))
 		}
 
 		// Otherwise, we can get the laptop ID and the score from the request.
@@ -322,7 +423,7 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 		log.Printf("received a rate-laptop request: id = %s, score = %.2f", laptopID, score)
 
 		// check if this laptop ID really exists or not by using the laptopStore.Find() function.
-		found, err := server.laptopStore.Find(laptopID)
+		found, err := server.laptopStore.Find(stream.Context(), laptopID)
 
 		// If an error occurs, we return it with the status code Internal
 		if err != nil {
@@ -336,7 +437,7 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 
 		// If everything goes well, we call ratingStore.Add() to add the new laptop score 
 		// to the store and get back the updated rating object.
-		rating, err := server.ratingStore.Add(laptopID, score)
+		rating, err := server.ratingStore.Add(stream.Context(), laptopID, score)
 		// If there’s an error, we return Internal status code.
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
@@ -371,6 +472,17 @@ func logError(err error) error {
 	return err
 }
 
+// recvError wraps an error returned by stream.Recv() with the Unknown status code.
+// Errors that already carry a more precise status code, such as a PermissionDenied
+// returned by an ownership rule of the auth interceptor, keep their code.
+func recvError(message string, err error) error {
+	code := codes.Unknown
+	if st, ok := status.FromError(err); ok && st.Code() != codes.OK {
+		code = st.Code()
+	}
+	return status.Errorf(code, "%s: %v", message, err)
+}
+
 //contexError is extracted from the RPC
 func contextError(ctx context.Context) error {
 	switch ctx.Err() {
@@ -387,3 +499,57 @@ func contextError(ctx context.Context) error {
 		return nil
 	}
 }
+
+// checkCurrency() function checks that the server can convert the prices to a
+// currency asked for by a client.
+func (server *LaptopServer) checkCurrency(ctx context.Context, currencyCode string) error {
+	if server.converter == nil {
+		return status.Errorf(codes.FailedPrecondition, "this server does not convert prices, currency %q is not supported", currencyCode)
+	}
+
+	_, err := server.converter.provider.Rate(ctx, currencyCode, currencyCode)
+	if errors.Is(err, ErrUnknownCurrency) || !money.ValidCurrencyCode(currencyCode) {
+		return status.Errorf(codes.InvalidArgument, "currency %q is not supported", currencyCode)
+	}
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot get the exchange rates: %v", err)
+	}
+
+	return nil
+}
+
+// convertedMaxPrice() function returns the max price of a filter converted to
+// a currency asked for by a client, or nil when the filter has no limit.
+func (server *LaptopServer) convertedMaxPrice(ctx context.Context, filter *pb.Filter, currencyCode string) (*pb.Money, error) {
+	err := server.checkCurrency(ctx, currencyCode)
+	if err != nil {
+		return nil, err
+	}
+
+	maxPrice := filter.GetMaxPrice()
+	if maxPrice == nil {
+		if math.IsInf(filter.GetMaxPriceUsd(), 1) {
+			return nil, nil
+		}
+		maxPrice = usdFromFloat(filter.GetMaxPriceUsd(), 64)
+	}
+
+	converted, err := server.converter.Convert(ctx, maxPrice, currencyCode)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot convert the max price to %s: %v", currencyCode, err)
+	}
+
+	return converted, nil
+}
+
+// convertLaptopPrice() function converts the price of a laptop to a currency.
+// The laptop keeps its price_usd.
+func (server *LaptopServer) convertLaptopPrice(ctx context.Context, laptop *pb.Laptop, currencyCode string) error {
+	price, err := server.converter.Convert(ctx, laptopPrice(laptop), currencyCode)
+	if err != nil {
+		return err
+	}
+
+	laptop.Price = price
+	return nil
+}
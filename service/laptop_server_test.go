@@ -25,8 +25,8 @@ func TestCreateLaptopServer(t *testing.T) {
 
 	laptopDuplicateID := sampledata.NewLaptop()
 	storeDuplicateID := service.NewInMemoryLaptopStore()
-	//err := storeDuplicateID.Save(laptopDuplicateID)
-	//require.Nil(t, err)
+	err := storeDuplicateID.Save(context.Background(), laptopDuplicateID)
+	require.Nil(t, err)
 
 	testCases := []struct {
 		name   string
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
 	"log"
+	"math"
 	"sync"
 
 	"github.com/jinzhu/copier"
@@ -16,18 +18,26 @@ import (
 // ErrAlreadyExists is returned when a record with the same ID already exists in the store
 var ErrAlreadyExists = errors.New("record already exists")
 
+// ErrNotFound is returned when a record with the given ID does not exist in the store
+var ErrNotFound = errors.New("record not found")
+
 // LaptopStore is an interface to store laptop
 // As we might have different types of store, define
 // LaptopStore as an interface.
 // It has a Save() function to save a laptop to the store.
 // Note: we can always implement another DBLaptopStore to save
 // laptop to a database
+// Every method works on the laptops of the tenant carried by the context
+// (see TenantFromContext), so one tenant can never see another tenant's laptops.
 type LaptopStore interface {
 	// Save saves the laptop to the store
-	Save(laptop *pb.Laptop) error
+	Save(ctx context.Context, laptop *pb.Laptop) error
 
 	// Find finds a laptop by ID
-	Find(id string) (*pb.Laptop, error)
+	Find(ctx context.Context, id string) (*pb.Laptop, error)
+
+	// Update replaces a laptop. It returns ErrNotFound if there is no such laptop.
+	Update(ctx context.Context, laptop *pb.Laptop) error
 
 	// Search() function takes a filter as input, and also a callback function to
 	// report whenever a laptop is found.
@@ -41,13 +51,15 @@ type InMemoryLaptopStore struct {
 	// Use the read-write mutex to handle the multiple concurrent
 	// requests to save laptops.
 	mutex sync.RWMutex
-	// key is the laptop ID, and the value is the laptop object.
-	data map[string]*pb.Laptop
+	// the first key is the tenant, the second key is the laptop ID,
+	// and the value is the laptop object.
+	data map[string]map[string]*pb.Laptop
 }
 
 // RatingStore interface saves the laptop ratings.
+// Like the LaptopStore, ratings are kept per tenant.
 type RatingStore interface{
-	Add(laptopID string, score float64) (*Rating, error)
+	Add(ctx context.Context, laptopID string, score float64) (*Rating, error)
 } 
 
 // Rating struct
@@ -63,38 +75,46 @@ type Rating struct {
 type InMemoryRatingStore struct {
 	// mutex to handle concurrent access.
 	mutex sync.RWMutex
-	// rating map with key is the laptop ID, and value is the rating object.
-	rating map[string]*Rating
+	// rating map with the first key is the tenant, the second key is
+	// the laptop ID, and value is the rating object.
+	rating map[string]map[string]*Rating
 }
 
 // NewInMemoryLaptopStore returns a new InMemoryLaptopStore
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data: make(map[string]map[string]*pb.Laptop),
 	}
 }
 
 // NewInMemoryRatingStore() returns a new InMemoryRatingStore
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		rating: make(map[string]*Rating),
+		rating: make(map[string]map[string]*Rating),
 	}
 }
 
 // implement the Save laptop function as required by the interface.
 // Save saves the laptop to the store
-func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
+func (store *InMemoryLaptopStore) Save(ctx context.Context, laptop *pb.Laptop) error {
 	// First we need to acquire a write lock before adding new objects
 	store.mutex.Lock()
 
 	// defer the unlock command.
 	defer store.mutex.Unlock()
 
+	// get the laptops of the caller's tenant, creating its partition on first use.
+	tenant := TenantFromContext(ctx)
+	laptops := store.data[tenant]
+	if laptops == nil {
+		laptops = make(map[string]*pb.Laptop)
+		store.data[tenant] = laptops
+	}
+
 	// check if the laptop ID already exists in the map or not.
 	// If it does, just return an error to the caller.
-	if store.data[laptop.Id] != nil {
-		log.Println(ErrAlreadyExists)
-
+	if laptops[laptop.Id] != nil {
+		return ErrAlreadyExists
 	}
 
 	// If the laptop doesn't exist, we can save it to the store.
@@ -104,19 +124,25 @@ func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
 		log.Fatal("failed to do a deepCopy: ", err)
 	}
 
-	store.data[laptopCopy.Id] = laptopCopy
+	// a laptop saved with only the legacy price_usd is stored with its Money price.
+	err = migrateLaptopPrice(laptopCopy)
+	if err != nil {
+		return err
+	}
+
+	laptops[laptopCopy.Id] = laptopCopy
 
 	return nil
 
 }
 
 // Find finds a laptop by ID
-func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
+func (store *InMemoryLaptopStore) Find(ctx context.Context, id string) (*pb.Laptop, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	// get the laptop from the store.data map by its id.
-	laptop, exist := store.data[id]
+	// get the laptop from the tenant's partition of the store.data map by its id.
+	laptop, exist := store.data[TenantFromContext(ctx)][id]
 	
 	if exist {
 		
@@ -128,6 +154,30 @@ func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
 
 }
 
+// Update replaces an existing laptop of the caller's tenant
+func (store *InMemoryLaptopStore) Update(ctx context.Context, laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	laptops := store.data[TenantFromContext(ctx)]
+	if laptops[laptop.GetId()] == nil {
+		return ErrNotFound
+	}
+
+	laptopCopy, err := deepCopy(laptop)
+	if err != nil {
+		return err
+	}
+
+	err = migrateLaptopPrice(laptopCopy)
+	if err != nil {
+		return err
+	}
+
+	laptops[laptopCopy.Id] = laptopCopy
+	return nil
+}
+
 func deepCopy(laptop *pb.Laptop) (*pb.Laptop, error) {
 	laptopCopy := &pb.Laptop{}
 
@@ -147,8 +197,8 @@ func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	// iterate through all laptops in the store, and check which one is qualified to the filter.
-	for _, laptop := range store.data {
+	// iterate through all laptops of the tenant, and check which one is qualified to the filter.
+	for _, laptop := range store.data[TenantFromContext(ctx)] {
 		// before checking if a laptop is qualified or not, we check if the context error is
 		// Cancelled or DeadlineExceeded or not.
 		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
@@ -181,13 +231,21 @@ func (store *InMemoryLaptopStore) Search(ctx context.Context, filter *pb.Filter,
 }
 
 // Implement the Add method
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+func (store *InMemoryRatingStore) Add(ctx context.Context, laptopID string, score float64) (*Rating, error) {
 	// Acquire write lock
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	// get the ratings of the caller's tenant, creating its partition on first use.
+	tenant := TenantFromContext(ctx)
+	ratings := store.rating[tenant]
+	if ratings == nil {
+		ratings = make(map[string]*Rating)
+		store.rating[tenant] = ratings
+	}
+
 	// get the rating of the laptop ID from the map. 
-	rating := store.rating[laptopID]
+	rating := ratings[laptopID]
 
 	// If the rating is not found, we just create a new object with count is 1 
 	// and sum is the input score. Else, we increase the rating count by 1 
@@ -203,7 +261,7 @@ func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating,
 	}
 
 	// put the updated rating back to the map 
-	store.rating[laptopID] = rating
+	ratings[laptopID] = rating
 
 	// and return it to the caller. 
 	return rating, nil
@@ -213,7 +271,7 @@ func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating,
 // isQualified() function takes a filter and a laptop as input, and returns true if the
 // laptop satisfies the filter.
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
-	if laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
+	if !priceQualified(filter, laptop) {
 		return false
 	}
 
@@ -232,6 +290,24 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 	return true
 }
 
+// priceQualified() function compares the price of a laptop with the max price
+// of a filter, exactly. The legacy max_price_usd is used when the filter has
+// no max_price, and like before a zero max_price_usd only lets free laptops
+// through, while an infinite one has no limit. A laptop priced in another
+// currency than the max price does not qualify.
+func priceQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
+	maxPrice := filter.GetMaxPrice()
+	if maxPrice == nil {
+		if math.IsInf(filter.GetMaxPriceUsd(), 1) {
+			return true
+		}
+		maxPrice = usdFromFloat(filter.GetMaxPriceUsd(), 64)
+	}
+
+	cmp, err := money.Compare(laptopPrice(laptop), maxPrice)
+	return err == nil && cmp <= 0
+}
+
 func toBit(memory *pb.Memory) uint64 {
 	value := memory.GetValue()
 
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLimiterConfig configures the brute-force protection of the Login RPC.
+type LoginLimiterConfig struct {
+	// MaxFailures is the number of failed logins allowed within Window,
+	// for one username or one client address, before it gets locked out.
+	MaxFailures int
+	// Window is the length of the sliding window failures are counted in.
+	Window time.Duration
+	// BaseLockout is the duration of the first lockout. Each following lockout
+	// doubles it, up to MaxLockout.
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+// DefaultLoginLimiterConfig returns the login limits used by the server.
+func DefaultLoginLimiterConfig() LoginLimiterConfig {
+	return LoginLimiterConfig{
+		MaxFailures: 5,
+		Window:      5 * time.Minute,
+		BaseLockout: 30 * time.Second,
+		MaxLockout:  30 * time.Minute,
+	}
+}
+
+// LoginLimiter keeps track of failed logins per username and per client address,
+// and locks them out temporarily with exponential backoff when they fail too often.
+// A username or a client address is forgotten once its failures have slid out
+// of the window, and MaxLockout has passed since the end of its last lockout,
+// so that the failures of every username ever tried are not kept forever.
+type LoginLimiter struct {
+	mutex  sync.Mutex
+	config LoginLimiterConfig
+	// now returns the current time. It is injectable so tests can move the clock.
+	now     func() time.Time
+	users   map[string]*loginAttempts
+	clients map[string]*loginAttempts
+	// nextPrune is when the expired usernames and client addresses are removed next.
+	nextPrune time.Time
+}
+
+// loginAttempts holds the failed logins of one username or one client address.
+type loginAttempts struct {
+	// failures are the times of the failed logins within the sliding window.
+	failures []time.Time
+	// lockouts counts the lockouts since the last successful login.
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// NewLoginLimiter returns a new LoginLimiter. If now is nil, time.Now is used.
+func NewLoginLimiter(config LoginLimiterConfig, now func() time.Time) *LoginLimiter {
+	if now == nil {
+		now = time.Now
+	}
+
+	return &LoginLimiter{
+		config:  config,
+		now:     now,
+		users:   make(map[string]*loginAttempts),
+		clients: make(map[string]*loginAttempts),
+	}
+}
+
+// RetryAfter returns how long the username or the client address is still
+// locked out for, or zero if a login attempt is allowed right now.
+func (limiter *LoginLimiter) RetryAfter(username, clientAddress string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	retryAfter := remainingLockout(limiter.users[username], now)
+
+	if clientAddress != "" {
+		clientRetryAfter := remainingLockout(limiter.clients[clientAddress], now)
+		if clientRetryAfter > retryAfter {
+			retryAfter = clientRetryAfter
+		}
+	}
+
+	return retryAfter
+}
+
+// RecordFailure records a failed login, and returns the lockout it triggered
+// for the username or the client address, or zero if none was triggered.
+func (limiter *LoginLimiter) RecordFailure(username, clientAddress string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	limiter.prune(now)
+	lockout := limiter.recordFailure(limiter.attempts(limiter.users, username), now)
+
+	if clientAddress != "" {
+		clientLockout := limiter.recordFailure(limiter.attempts(limiter.clients, clientAddress), now)
+		if clientLockout > lockout {
+			lockout = clientLockout
+		}
+	}
+
+	return lockout
+}
+
+// RecordSuccess clears the failed logins and the lockout backoff of a username.
+// The client address is left alone, so one valid account cannot be used to
+// reset the counter of a client guessing the passwords of other accounts.
+func (limiter *LoginLimiter) RecordSuccess(username string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	delete(limiter.users, username)
+}
+
+// Tracked returns the number of usernames and client addresses with failed
+// logins or a lockout backoff.
+func (limiter *LoginLimiter) Tracked() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return len(limiter.users) + len(limiter.clients)
+}
+
+// Unlock lifts the lockout of a username and/or a client address, and resets
+// their failed logins. It reports whether anything was locked out.
+func (limiter *LoginLimiter) Unlock(username, clientAddress string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	wasLocked := false
+
+	if username != "" {
+		wasLocked = remainingLockout(limiter.users[username], now) > 0
+		delete(limiter.users, username)
+	}
+
+	if clientAddress != "" {
+		wasLocked = remainingLockout(limiter.clients[clientAddress], now) > 0 || wasLocked
+		delete(limiter.clients, clientAddress)
+	}
+
+	return wasLocked
+}
+
+func (limiter *LoginLimiter) attempts(attemptsMap map[string]*loginAttempts, key string) *loginAttempts {
+	attempts := attemptsMap[key]
+	if attempts == nil {
+		attempts = &loginAttempts{}
+		attemptsMap[key] = attempts
+	}
+
+	return attempts
+}
+
+// prune() function removes the expired usernames and client addresses, at most
+// once per window, so that the failed logins do not scan the maps every time.
+func (limiter *LoginLimiter) prune(now time.Time) {
+	if now.Before(limiter.nextPrune) {
+		return
+	}
+
+	for _, attemptsMap := range []map[string]*loginAttempts{limiter.users, limiter.clients} {
+		for key, attempts := range attemptsMap {
+			if limiter.expired(attempts, now) {
+				delete(attemptsMap, key)
+			}
+		}
+	}
+
+	limiter.nextPrune = now.Add(limiter.config.Window)
+}
+
+// expired() function reports whether the failures of a username or a client
+// address have slid out of the window, and its lockout backoff has ended too.
+func (limiter *LoginLimiter) expired(attempts *loginAttempts, now time.Time) bool {
+	// the failures are in time order, so the last one is the latest.
+	if len(attempts.failures) > 0 && attempts.failures[len(attempts.failures)-1].After(now.Add(-limiter.config.Window)) {
+		return false
+	}
+
+	return !now.Before(attempts.lockedUntil.Add(limiter.config.MaxLockout))
+}
+
+func (limiter *LoginLimiter) recordFailure(attempts *loginAttempts, now time.Time) time.Duration {
+	// drop the failures that have slid out of the window.
+	windowStart := now.Add(-limiter.config.Window)
+	kept := attempts.failures[:0]
+	for _, failure := range attempts.failures {
+		if failure.After(windowStart) {
+			kept = append(kept, failure)
+		}
+	}
+	attempts.failures = append(kept, now)
+
+	if len(attempts.failures) < limiter.config.MaxFailures {
+		return 0
+	}
+
+	// Too many failures: lock out for BaseLockout * 2^lockouts, capped at MaxLockout.
+	lockout := limiter.config.BaseLockout
+	for i := 0; i < attempts.lockouts && lockout < limiter.config.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > limiter.config.MaxLockout {
+		lockout = limiter.config.MaxLockout
+	}
+
+	attempts.lockouts++
+	attempts.lockedUntil = now.Add(lockout)
+	attempts.failures = nil
+
+	return lockout
+}
+
+func remainingLockout(attempts *loginAttempts, now time.Time) time.Duration {
+	if attempts == nil || !now.Before(attempts.lockedUntil) {
+		return 0
+	}
+
+	return attempts.lockedUntil.Sub(now)
+}
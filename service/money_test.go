@@ -0,0 +1,96 @@
+package service_test
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// usd returns an amount in USD.
+func usd(t *testing.T, amount string) *pb.Money {
+	price, err := money.Parse("USD", amount)
+	require.NoError(t, err)
+	return price
+}
+
+func TestMoneyFilter(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	ctx := context.Background()
+
+	save := func(price *pb.Money) string {
+		laptop := sampledata.NewLaptop()
+		laptop.Price = price
+		require.NoError(t, store.Save(ctx, laptop))
+		return laptop.GetId()
+	}
+	legacy := sampledata.NewLaptop()
+	legacy.Price = nil
+	legacy.PriceUsd = 1999.99
+	require.NoError(t, store.Save(ctx, legacy))
+
+	cheap := save(usd(t, "2000"))
+	save(usd(t, "2000.000000001"))
+	save(&pb.Money{CurrencyCode: "EUR", Units: 1000})
+
+	search := func(filter *pb.Filter) []string {
+		var ids []string
+		require.NoError(t, store.Search(ctx, filter, func(laptop *pb.Laptop) error {
+			ids = append(ids, laptop.GetId())
+			return nil
+		}))
+		return ids
+	}
+
+	// the prices are compared exactly, and only with the prices in the same currency.
+	require.ElementsMatch(t, []string{legacy.GetId(), cheap}, search(&pb.Filter{MaxPrice: usd(t, "2000")}))
+	require.ElementsMatch(t, []string{legacy.GetId(), cheap}, search(&pb.Filter{MaxPriceUsd: 2000}))
+	require.ElementsMatch(t, []string{legacy.GetId()}, search(&pb.Filter{MaxPrice: usd(t, "1999.99")}))
+	require.Len(t, search(&pb.Filter{MaxPrice: &pb.Money{CurrencyCode: "EUR", Units: 5000}}), 1)
+
+	// the laptops saved with only price_usd get their Money price.
+	found, err := store.Find(ctx, legacy.GetId())
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "1999.99"), found.GetPrice()))
+}
+
+func TestMigratePrices(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+
+	migrated, err := service.MigrateOrderAmounts(orderStore)
+	require.NoError(t, err)
+	require.Equal(t, 5, migrated)
+
+	order, err := orderStore.Find(context.Background(), "102")
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "1800"), order.GetAmount()))
+	require.EqualValues(t, 1800, order.GetPrice())
+
+	// the migrated orders are not migrated again.
+	migrated, err = service.MigrateOrderAmounts(orderStore)
+	require.NoError(t, err)
+	require.Zero(t, migrated)
+
+	productStore := service.NewInMemoryProductStore()
+	ctx := context.Background()
+	require.NoError(t, productStore.Save(ctx, &pb.Product{Id: "echo", Name: "Amazon Echo", Price: 29.99}))
+	require.NoError(t, productStore.Save(ctx, &pb.Product{Id: "dot", Name: "Echo Dot", ListPrice: &pb.Money{CurrencyCode: "EUR", Units: 45}}))
+
+	migrated, err = service.MigrateProductPrices(ctx, productStore)
+	require.NoError(t, err)
+	require.Equal(t, 1, migrated)
+
+	product, err := productStore.Find(ctx, "echo")
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "29.99"), product.GetListPrice()))
+}
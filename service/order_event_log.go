@@ -0,0 +1,365 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultOrderEventLogSize is the number of events the order event log keeps by default.
+const defaultOrderEventLogSize = 10000
+
+// ErrEventsTruncated is returned when the events asked for are no longer in the log.
+var ErrEventsTruncated = errors.New("events are no longer kept")
+
+// ErrUnknownEventSeq is returned when the events asked for come after the last
+// event of the log, which happens when the log has been lost.
+var ErrUnknownEventSeq = errors.New("unknown event sequence number")
+
+// OrderEventLog keeps the latest order events, in sequence order.
+type OrderEventLog interface {
+	// Append sets the sequence number and the time of the event, and appends it to the log.
+	Append(event *pb.OrderEvent) error
+	// Read returns at most limit events whose sequence number is greater than
+	// afterSeq. It returns ErrEventsTruncated if some of these events have
+	// already been dropped from the log, and ErrUnknownEventSeq if afterSeq is
+	// greater than the last sequence number.
+	Read(afterSeq uint64, limit int) ([]*pb.OrderEvent, error)
+	// LastSeq returns the sequence number of the last event, 0 if there is none.
+	LastSeq() uint64
+	// Changed returns a channel that is closed when the next event is appended.
+	Changed() <-chan struct{}
+}
+
+// orderEventBuffer keeps the latest events in memory. It is shared by the
+// in-memory and the file event logs, which must hold its lock.
+type orderEventBuffer struct {
+	mutex     sync.Mutex
+	maxEvents int
+	events    []*pb.OrderEvent
+	lastSeq   uint64
+	changed   chan struct{}
+}
+
+func newOrderEventBuffer(maxEvents int) *orderEventBuffer {
+	return &orderEventBuffer{
+		maxEvents: maxEvents,
+		changed:   make(chan struct{}),
+	}
+}
+
+// next() function sets the sequence number and the time of a new event.
+func (buffer *orderEventBuffer) next(event *pb.OrderEvent) {
+	event.Seq = buffer.lastSeq + 1
+	event.Time = timestamppb.Now()
+}
+
+// add() function adds an event, drops the oldest one if the buffer is full,
+// and wakes up the watchers.
+func (buffer *orderEventBuffer) add(event *pb.OrderEvent) {
+	buffer.events = append(buffer.events, proto.Clone(event).(*pb.OrderEvent))
+	if len(buffer.events) > buffer.maxEvents {
+		buffer.events = append([]*pb.OrderEvent(nil), buffer.events[len(buffer.events)-buffer.maxEvents:]...)
+	}
+	buffer.lastSeq = event.GetSeq()
+
+	close(buffer.changed)
+	buffer.changed = make(chan struct{})
+}
+
+func (buffer *orderEventBuffer) Read(afterSeq uint64, limit int) ([]*pb.OrderEvent, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if afterSeq > buffer.lastSeq {
+		return nil, fmt.Errorf("%w: the last event is %d", ErrUnknownEventSeq, buffer.lastSeq)
+	}
+
+	if afterSeq == buffer.lastSeq {
+		return nil, nil
+	}
+
+	// the events of the buffer have consecutive sequence numbers.
+	firstSeq := buffer.lastSeq - uint64(len(buffer.events)) + 1
+	if afterSeq+1 < firstSeq {
+		return nil, fmt.Errorf("%w: the oldest event kept is %d", ErrEventsTruncated, firstSeq)
+	}
+
+	start := int(afterSeq + 1 - firstSeq)
+	end := len(buffer.events)
+	if end-start > limit {
+		end = start + limit
+	}
+
+	events := make([]*pb.OrderEvent, 0, end-start)
+	for _, event := range buffer.events[start:end] {
+		events = append(events, proto.Clone(event).(*pb.OrderEvent))
+	}
+
+	return events, nil
+}
+
+func (buffer *orderEventBuffer) LastSeq() uint64 {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.lastSeq
+}
+
+func (buffer *orderEventBuffer) Changed() <-chan struct{} {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.changed
+}
+
+// InMemoryOrderEventLog keeps the order events in memory. They are lost on restart.
+type InMemoryOrderEventLog struct {
+	*orderEventBuffer
+}
+
+// NewInMemoryOrderEventLog returns a new InMemoryOrderEventLog keeping at most maxEvents events.
+func NewInMemoryOrderEventLog(maxEvents int) *InMemoryOrderEventLog {
+	return &InMemoryOrderEventLog{newOrderEventBuffer(maxEvents)}
+}
+
+func (eventLog *InMemoryOrderEventLog) Append(event *pb.OrderEvent) error {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+
+	eventLog.next(event)
+	eventLog.add(event)
+	return nil
+}
+
+// FileOrderEventLog writes the order events as JSON lines into a file, so that
+// the consumers can catch up with the events that happened while the server was down.
+// Once the file has twice as many events as the log keeps, it is rewritten with
+// the events kept only, so that it stays bounded.
+type FileOrderEventLog struct {
+	*orderEventBuffer
+	path string
+	file *os.File
+	// lines is the number of events in the file.
+	lines int
+}
+
+// NewFileOrderEventLog opens the event log file, creating it if needed, and
+// loads the latest maxEvents events from it.
+func NewFileOrderEventLog(path string, maxEvents int) (*FileOrderEventLog, error) {
+	eventLog := &FileOrderEventLog{
+		orderEventBuffer: newOrderEventBuffer(maxEvents),
+		path:             path,
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create event log folder: %w", err)
+	}
+
+	err = eventLog.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = eventLog.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return eventLog, nil
+}
+
+// load() function reads the events of the file. A last line cut short by a
+// crash is ignored, since its event was never acknowledged.
+func (eventLog *FileOrderEventLog) load() error {
+	file, err := os.Open(eventLog.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open event log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	var invalidLine int
+	for line := 1; scanner.Scan(); line++ {
+		if invalidLine > 0 {
+			return fmt.Errorf("event log line %d is invalid", invalidLine)
+		}
+
+		event := &pb.OrderEvent{}
+		if protojson.Unmarshal(scanner.Bytes(), event) != nil {
+			invalidLine = line
+			continue
+		}
+
+		eventLog.add(event)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("cannot read event log: %w", err)
+	}
+
+	if invalidLine > 0 {
+		log.Printf("ignoring the incomplete last line of the event log")
+	}
+
+	return nil
+}
+
+// compact() function rewrites the file with the events kept in memory, and
+// reopens it for appending. The new file replaces the old one atomically, and
+// the old one stays open if anything fails.
+func (eventLog *FileOrderEventLog) compact() error {
+	tmpPath := eventLog.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot create event log: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, event := range eventLog.events {
+		line, err := protojson.Marshal(event)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("cannot marshal event: %w", err)
+		}
+
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write event log: %w", err)
+	}
+
+	err = os.Rename(tmpPath, eventLog.path)
+	if err != nil {
+		return fmt.Errorf("cannot replace event log: %w", err)
+	}
+
+	newFile, err := os.OpenFile(eventLog.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot open event log: %w", err)
+	}
+
+	if eventLog.file != nil {
+		eventLog.file.Close()
+	}
+	eventLog.file = newFile
+	eventLog.lines = len(eventLog.events)
+
+	return nil
+}
+
+func (eventLog *FileOrderEventLog) Append(event *pb.OrderEvent) error {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+
+	eventLog.next(event)
+
+	// protojson.Marshal writes the event on a single line.
+	line, err := protojson.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("cannot marshal event: %w", err)
+	}
+
+	_, err = eventLog.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write event: %w", err)
+	}
+
+	err = eventLog.file.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot sync event log: %w", err)
+	}
+
+	eventLog.add(event)
+	eventLog.lines++
+
+	if eventLog.lines >= 2*eventLog.maxEvents {
+		err = eventLog.compact()
+		if err != nil {
+			log.Printf("cannot compact event log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the log file.
+func (eventLog *FileOrderEventLog) Close() error {
+	eventLog.mutex.Lock()
+	defer eventLog.mutex.Unlock()
+
+	if eventLog.file == nil {
+		return nil
+	}
+
+	return eventLog.file.Close()
+}
+
+// orderEventOutbox holds the order events queued under the order store lock,
+// in the order of the changes. They are appended to the event log once the
+// lock is released, so that a slow append does not hold the lock, and a failed
+// one does not undo a change that is already made.
+type orderEventOutbox struct {
+	mutex  sync.Mutex
+	events []*pb.OrderEvent
+	// drainMutex lets a single drain append the events at a time, so that
+	// they reach the event log in the order they were queued.
+	drainMutex sync.Mutex
+}
+
+// add() function queues an event.
+func (outbox *orderEventOutbox) add(event *pb.OrderEvent) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	outbox.events = append(outbox.events, event)
+}
+
+// drain() function appends the queued events to the event log. An event that
+// cannot be appended is logged and dropped.
+func (outbox *orderEventOutbox) drain(eventLog OrderEventLog) {
+	outbox.drainMutex.Lock()
+	defer outbox.drainMutex.Unlock()
+
+	for {
+		outbox.mutex.Lock()
+		events := outbox.events
+		outbox.events = nil
+		outbox.mutex.Unlock()
+
+		if len(events) == 0 {
+			return
+		}
+
+		for _, event := range events {
+			err := eventLog.Append(event)
+			if err != nil {
+				log.Printf("cannot record %s order event: %v", event.GetType(), err)
+			}
+		}
+	}
+}
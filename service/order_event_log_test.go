@@ -0,0 +1,217 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWatchOrders(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	server := service.NewOrderManagementServer(
+		orderStore,
+		service.WithShipmentBatching(1, time.Hour),
+		service.WithOrderEventLog(service.NewInMemoryOrderEventLog(100)),
+	)
+	orderClient := newTestOrderClient(t, server)
+
+	watch := func(req *pb.WatchOrdersRequest) pb.OrderManagement_WatchOrdersClient {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		stream, err := orderClient.WatchOrders(ctx, req)
+		require.NoError(t, err)
+		return stream
+	}
+	recvEvent := func(stream pb.OrderManagement_WatchOrdersClient, seq uint64, eventType pb.OrderEvent_Type) *pb.OrderEvent {
+		event, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, seq, event.GetSeq())
+		require.Equal(t, eventType, event.GetType())
+		return event
+	}
+
+	stream := watch(&pb.WatchOrdersRequest{})
+
+	// every change of an order is an event, in the order it happened.
+	res, err := orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Kindle"}, Price: 90, Destination: "Austin, TX"})
+	require.NoError(t, err)
+	orderID := res.GetValue()
+
+	_, err = orderClient.TransitionOrder(context.Background(), &pb.TransitionOrderRequest{OrderId: orderID, Status: pb.Order_PAID})
+	require.NoError(t, err)
+
+	updateStream, err := orderClient.BatchUpdateOrders(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, updateStream.Send(&pb.UpdateOrderRequest{
+		Order: &pb.Order{Id: orderID, Items: []string{"Kindle Paperwhite"}, Price: 140, Destination: "Austin, TX"},
+	}))
+	_, err = updateStream.CloseAndRecv()
+	require.NoError(t, err)
+
+	processStream, err := orderClient.ProcessOrders(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, processStream.Send(&wrapper.StringValue{Value: orderID}))
+	_, err = processStream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, processStream.CloseSend())
+
+	require.Equal(t, orderID, recvEvent(stream, 1, pb.OrderEvent_CREATED).GetOrder().GetId())
+	require.Equal(t, pb.Order_PAID, recvEvent(stream, 2, pb.OrderEvent_STATUS_CHANGED).GetOrder().GetStatus())
+	require.Equal(t, []string{"Kindle Paperwhite"}, recvEvent(stream, 3, pb.OrderEvent_UPDATED).GetOrder().GetItems())
+	shipment := recvEvent(stream, 4, pb.OrderEvent_SHIPMENT_FORMED).GetShipment()
+	require.Equal(t, orderID, shipment.GetOrdersList()[0].GetId())
+
+	// a consumer resumes after the last event it has seen.
+	resumed := watch(&pb.WatchOrdersRequest{AfterSeq: 2})
+	recvEvent(resumed, 3, pb.OrderEvent_UPDATED)
+	recvEvent(resumed, 4, pb.OrderEvent_SHIPMENT_FORMED)
+
+	// or only watches the new events.
+	latest := watch(&pb.WatchOrdersRequest{AfterSeq: 1, FromLatest: true})
+	_, err = latest.Header()
+	require.NoError(t, err)
+	_, err = orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: orderID})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_CANCELLED, recvEvent(latest, 5, pb.OrderEvent_STATUS_CHANGED).GetOrder().GetStatus())
+	recvEvent(latest, 6, pb.OrderEvent_STATUS_CHANGED)
+	recvEvent(stream, 5, pb.OrderEvent_STATUS_CHANGED)
+
+	// the events of the other tenants are not sent.
+	acmeCtx := service.ContextWithTenant(adminContext(), "acme")
+	_, err = server.AddOrder(acmeCtx, &pb.Order{Items: []string{"Kindle"}, Price: 90, Destination: "Austin, TX"})
+	require.NoError(t, err)
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Echo"}, Price: 30, Destination: "Austin, TX"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Echo"}, recvEvent(latest, 8, pb.OrderEvent_CREATED).GetOrder().GetItems())
+
+	// a consumer ahead of the log has lost track of it.
+	_, err = watch(&pb.WatchOrdersRequest{AfterSeq: 100}).Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// failingOrderEventLog is an event log that cannot append events while failing is set.
+type failingOrderEventLog struct {
+	service.OrderEventLog
+	failing int32
+}
+
+func (eventLog *failingOrderEventLog) Append(event *pb.OrderEvent) error {
+	if atomic.LoadInt32(&eventLog.failing) == 1 {
+		return errors.New("disk full")
+	}
+
+	return eventLog.OrderEventLog.Append(event)
+}
+
+func TestOrderEventAppendFailure(t *testing.T) {
+	t.Parallel()
+
+	eventLog := &failingOrderEventLog{OrderEventLog: service.NewInMemoryOrderEventLog(100), failing: 1}
+	server := service.NewOrderManagementServer(service.NewInMemoryOrderStore(), service.WithOrderEventLog(eventLog))
+	orderClient := newTestOrderClient(t, server)
+
+	// the changes are made even though their events cannot be recorded.
+	res, err := orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Kindle"}, Price: 90, Destination: "Austin, TX"})
+	require.NoError(t, err)
+	orderID := res.GetValue()
+
+	_, err = orderClient.TransitionOrder(context.Background(), &pb.TransitionOrderRequest{OrderId: orderID, Status: pb.Order_PAID})
+	require.NoError(t, err)
+
+	updateStream, err := orderClient.BatchUpdateOrders(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, updateStream.Send(&pb.UpdateOrderRequest{
+		Order: &pb.Order{Id: orderID, Items: []string{"Kindle Paperwhite"}, Price: 140, Destination: "Austin, TX"},
+	}))
+	summary, err := updateStream.CloseAndRecv()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, summary.GetUpdated())
+
+	_, err = orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: orderID})
+	require.NoError(t, err)
+
+	order, err := orderClient.GetOrder(context.Background(), &wrapper.StringValue{Value: orderID})
+	require.NoError(t, err)
+	require.Equal(t, []string{"Kindle Paperwhite"}, order.GetItems())
+	require.Equal(t, pb.Order_REFUNDED, order.GetStatus())
+	require.Zero(t, eventLog.LastSeq())
+
+	// the events of the next changes are recorded once the log works again.
+	atomic.StoreInt32(&eventLog.failing, 0)
+	res, err = orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Echo"}, Price: 30, Destination: "Austin, TX"})
+	require.NoError(t, err)
+
+	events, err := eventLog.Read(0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, res.GetValue(), events[0].GetOrder().GetId())
+}
+
+func TestFileOrderEventLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "events", "orders.jsonl")
+	eventLog, err := service.NewFileOrderEventLog(path, 3)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, eventLog.Append(&pb.OrderEvent{Type: pb.OrderEvent_CREATED, Order: &pb.Order{Id: "order"}}))
+	}
+
+	// only the latest events are kept.
+	_, err = eventLog.Read(0, 10)
+	require.ErrorIs(t, err, service.ErrEventsTruncated)
+
+	events, err := eventLog.Read(2, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	require.EqualValues(t, 3, events[0].GetSeq())
+
+	events, err = eventLog.Read(2, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	// the events survive a restart, and the sequence goes on.
+	require.NoError(t, eventLog.Close())
+	eventLog, err = service.NewFileOrderEventLog(path, 3)
+	require.NoError(t, err)
+	t.Cleanup(func() { eventLog.Close() })
+	require.EqualValues(t, 5, eventLog.LastSeq())
+
+	changed := eventLog.Changed()
+	require.NoError(t, eventLog.Append(&pb.OrderEvent{Type: pb.OrderEvent_UPDATED, Order: &pb.Order{Id: "order"}}))
+	<-changed
+
+	events, err = eventLog.Read(5, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.EqualValues(t, 6, events[0].GetSeq())
+	require.Equal(t, "order", events[0].GetOrder().GetId())
+
+	_, err = eventLog.Read(7, 10)
+	require.ErrorIs(t, err, service.ErrUnknownEventSeq)
+
+	// the file stays bounded.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, eventLog.Append(&pb.OrderEvent{Type: pb.OrderEvent_UPDATED}))
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Less(t, strings.Count(string(data), "\n"), 6)
+}
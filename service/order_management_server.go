@@ -0,0 +1,938 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// defaultShipmentBatchSize is the number of orders that makes a combined shipment full.
+	defaultShipmentBatchSize = 3
+	// defaultShipmentWindow is how long a combined shipment waits for more orders.
+	defaultShipmentWindow = 5 * time.Second
+)
+
+// OrderManagementServer is the server that provides the order management services
+type OrderManagementServer struct {
+	pb.UnimplementedOrderManagementServer
+	orderStore OrderStore
+	// shipmentBatchSize and shipmentWindow control how ProcessOrders combines orders.
+	shipmentBatchSize int
+	shipmentWindow    time.Duration
+	// pricer prices the orders against the product catalogs, nil when the
+	// server accepts the prices sent by the clients.
+	pricer *OrderPricer
+	// shipments are the combined shipments being filled by the ProcessOrders streams.
+	shipments *pendingShipments
+
+	// stockReservations, refundLedger and sagaLog are used by the cancel and refund sagas.
+	stockReservations StockReservations
+	refundLedger      RefundLedger
+	sagaLog           SagaLog
+	sagaMutex         sync.Mutex
+	// key is the tenant and ID of an order (see orderKey()), and the value is the
+	// ID of the saga running for it.
+	activeSagas map[string]string
+	// eventLog keeps the events sent by WatchOrders. The events of the changes
+	// made under the order store lock wait in eventOutbox until it is released.
+	eventLog    OrderEventLog
+	eventOutbox *orderEventOutbox
+	// carrierRouter assigns the carriers of the shipments, which are kept in shipmentStore.
+	carrierRouter *CarrierRouter
+	shipmentStore ShipmentStore
+	// legacyUpdateOrders is true when the deprecated UpdateOrders RPC is served.
+	legacyUpdateOrders bool
+	// promotionStore holds the promotions applied to the orders priced by the server, if any.
+	promotionStore PromotionStore
+}
+
+// OrderServerOption configures optional behaviour of an OrderManagementServer.
+type OrderServerOption func(server *OrderManagementServer)
+
+// WithShipmentBatching sets the number of orders that makes a combined shipment
+// full, and how long a combined shipment waits for more orders before it is sent.
+func WithShipmentBatching(size int, window time.Duration) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.shipmentBatchSize = size
+		server.shipmentWindow = window
+	}
+}
+
+// WithOrderPricing makes the server price the orders with the pricer. The
+// orders must then reference catalog products with their line items.
+func WithOrderPricing(pricer *OrderPricer) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.pricer = pricer
+	}
+}
+
+// WithStockReservations sets where the laptop stock reserved for the orders is kept.
+func WithStockReservations(stockReservations StockReservations) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.stockReservations = stockReservations
+	}
+}
+
+// WithRefundLedger sets where the refunds of the orders are recorded.
+func WithRefundLedger(refundLedger RefundLedger) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.refundLedger = refundLedger
+	}
+}
+
+// WithSagaLog sets where the cancel and refund sagas record their progress.
+// The default in-memory log does not let the sagas resume after a restart.
+func WithSagaLog(sagaLog SagaLog) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.sagaLog = sagaLog
+	}
+}
+
+// WithOrderEventLog sets where the order events are kept for WatchOrders.
+// The default in-memory log keeps the latest 10000 events until a restart.
+func WithOrderEventLog(eventLog OrderEventLog) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.eventLog = eventLog
+	}
+}
+
+// WithCarrierRules sets the rules assigning the carriers of the shipments.
+// The first rule that applies to a shipment is used.
+func WithCarrierRules(rules ...CarrierRule) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.carrierRouter = NewCarrierRouter(rules...)
+	}
+}
+
+// WithShipmentStore sets where the shipments sent by ProcessOrders are kept.
+func WithShipmentStore(shipmentStore ShipmentStore) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.shipmentStore = shipmentStore
+	}
+}
+
+// WithLegacyUpdateOrders makes the server serve the deprecated UpdateOrders
+// RPC, which responds with a string instead of the outcome of every order.
+func WithLegacyUpdateOrders() OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.legacyUpdateOrders = true
+	}
+}
+
+// WithPromotions makes the server apply the promotions of the store to the
+// orders it prices. See applyPromotions() for how they are evaluated.
+func WithPromotions(promotionStore PromotionStore) OrderServerOption {
+	return func(server *OrderManagementServer) {
+		server.promotionStore = promotionStore
+	}
+}
+
+// NewOrderManagementServer returns a new OrderManagementServer
+func NewOrderManagementServer(orderStore OrderStore, opts ...OrderServerOption) *OrderManagementServer {
+	server := &OrderManagementServer{
+		orderStore:        orderStore,
+		shipmentBatchSize: defaultShipmentBatchSize,
+		shipmentWindow:    defaultShipmentWindow,
+		shipments:         newPendingShipments(),
+		stockReservations: NewInMemoryStockReservations(),
+		refundLedger:      NewInMemoryRefundLedger(),
+		sagaLog:           NewInMemorySagaLog(),
+		activeSagas:       make(map[string]string),
+		eventLog:          NewInMemoryOrderEventLog(defaultOrderEventLogSize),
+		eventOutbox:       &orderEventOutbox{},
+		carrierRouter:     NewCarrierRouter(DefaultCarrierRules()...),
+		shipmentStore:     NewInMemoryShipmentStore(),
+	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
+}
+
+// AddOrder is a unary RPC to add a new order. It returns the ID of the order.
+func (server *OrderManagementServer) AddOrder(ctx context.Context, order *pb.Order) (*wrapper.StringValue, error) {
+	log.Printf("received an add-order request with id: %s", order.GetId())
+
+	err := server.placeOrder(ctx, order, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wrapper.StringValue{Value: order.GetId()}, nil
+}
+
+// placeOrder() function validates, prices and saves a new order, and reserves
+// its stock. The check, if any, is called once the order is priced, and the
+// order is not placed if it returns an error.
+func (server *OrderManagementServer) placeOrder(ctx context.Context, order *pb.Order, check func(order *pb.Order) error) error {
+	err := validateOrder(order)
+	if err != nil {
+		return err
+	}
+
+	// The order ID is generated below, so that a client cannot take the ID of
+	// another order. A client retrying an order sends the same idempotency key.
+	if order.GetId() != "" {
+		return status.Errorf(codes.InvalidArgument, "the order ID is generated by the server, retries are made with an idempotency key")
+	}
+
+	// The status of an order only changes through its lifecycle, which always starts as pending.
+	if order.GetStatus() != pb.Order_UNKNOWN || len(order.GetHistory()) > 0 || order.GetCreatedAt() != nil || order.GetVersion() != 0 {
+		return status.Errorf(codes.InvalidArgument, "order status, history, version and creation time are managed by the server")
+	}
+
+	if order.GetDiscount() != 0 || order.GetDiscountAmount() != nil || len(order.GetPromotions()) > 0 {
+		return status.Errorf(codes.InvalidArgument, "the discount and promotions of an order are set by the server")
+	}
+
+	// A user always places orders for themselves, the customer is never taken from the client.
+	customer, err := orderActor(ctx)
+	if err != nil {
+		return err
+	}
+	if order.GetCustomer() != "" && order.GetCustomer() != customer {
+		return status.Errorf(codes.PermissionDenied, "cannot place an order for another customer")
+	}
+	order.Customer = customer
+
+	err = setOrderAddress(order)
+	if err != nil {
+		return err
+	}
+
+	err = server.priceOrder(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	promotions, err := server.runningPromotions(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	err = server.promoteOrder(order, promotions)
+	if err != nil {
+		return err
+	}
+
+	if check != nil {
+		err = check(order)
+		if err != nil {
+			return err
+		}
+	}
+
+	order.CreatedAt = timestamppb.New(now)
+	recordOrderTransition(order, pb.Order_PENDING, customer, "order placed", order.GetCreatedAt().AsTime())
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot generate a new order ID: %v", err)
+	}
+	order.Id = id.String()
+
+	err = contextError(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = server.redeemPromotions(ctx, order)
+	if err != nil {
+		return err
+	}
+
+	reserved, err := server.reserveStock(ctx, order)
+	if err != nil {
+		server.unredeemPromotions(ctx, order)
+		return err
+	}
+
+	err = server.orderStore.Save(ctx, order)
+	if err != nil {
+		server.unredeemPromotions(ctx, order)
+		// the reservations of an order with the same ID are not ours to release.
+		if reserved {
+			server.stockReservations.Release(ctx, order.GetId())
+		}
+
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExists) {
+			code = codes.AlreadyExists
+		}
+		return status.Errorf(code, "cannot save order to the store: %v", err)
+	}
+
+	log.Printf("saved order with id: %s", order.GetId())
+
+	// the order is saved, so a failure to record its event does not fail the call.
+	server.appendOrderEvent(ctx, pb.OrderEvent_CREATED, order, nil)
+
+	return nil
+}
+
+// reserveStock() function reserves the laptops of the order, all of them or
+// none. It reports whether anything was reserved.
+func (server *OrderManagementServer) reserveStock(ctx context.Context, order *pb.Order) (bool, error) {
+	quantities := orderQuantities(order)
+	if len(quantities) == 0 {
+		return false, nil
+	}
+
+	err := server.stockReservations.ReserveOrder(ctx, order.GetId(), quantities)
+	if errors.Is(err, ErrAlreadyExists) {
+		return false, status.Errorf(codes.AlreadyExists, "order %s already exists", order.GetId())
+	}
+	if err != nil {
+		return false, stockReservationError(err)
+	}
+
+	return true, nil
+}
+
+// orderQuantities() function returns the quantity of each laptop of the line items of an order.
+func orderQuantities(order *pb.Order) map[string]uint32 {
+	quantities := make(map[string]uint32)
+	for _, item := range order.GetLineItems() {
+		if item.GetLaptopId() != "" {
+			quantities[item.GetLaptopId()] += item.GetQuantity()
+		}
+	}
+
+	return quantities
+}
+
+// stockReservationError() function converts an error of the StockReservations to a status error.
+func stockReservationError(err error) error {
+	if errors.Is(err, ErrOutOfStock) || errors.Is(err, ErrNotFound) {
+		return status.Errorf(codes.FailedPrecondition, "cannot reserve the laptops of the order: %v", err)
+	}
+
+	return status.Errorf(codes.Internal, "cannot reserve the laptops of the order: %v", err)
+}
+
+// validateOrder() function checks the fields of an order sent by a client,
+// and returns an InvalidArgument error describing the first invalid one.
+func validateOrder(order *pb.Order) error {
+	// the items and the prices of an order with line items are computed by the server.
+	if len(order.GetLineItems()) > 0 {
+		if len(order.GetItems()) > 0 || order.GetPrice() != 0 || order.GetAmount() != nil || hasOrderTotals(order) {
+			return status.Errorf(codes.InvalidArgument, "the items and prices of an order with line items are set by the server")
+		}
+	} else if len(order.GetItems()) == 0 {
+		return status.Errorf(codes.InvalidArgument, "order must have at least one item")
+	}
+
+	for i, item := range order.GetItems() {
+		if strings.TrimSpace(item) == "" {
+			return status.Errorf(codes.InvalidArgument, "order item %d is empty", i)
+		}
+	}
+
+	price := float64(order.GetPrice())
+	if math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+		return status.Errorf(codes.InvalidArgument, "order price %v is invalid", order.GetPrice())
+	}
+
+	if order.GetAmount() != nil {
+		err := money.Validate(order.GetAmount())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "order amount is invalid: %v", err)
+		}
+		if order.GetAmount().GetUnits() < 0 || order.GetAmount().GetNanos() < 0 {
+			return status.Errorf(codes.InvalidArgument, "order amount cannot be negative")
+		}
+	}
+
+	if strings.TrimSpace(order.GetDestination()) == "" {
+		return status.Errorf(codes.InvalidArgument, "order destination is required")
+	}
+
+	return nil
+}
+
+// priceOrder() function prices an order that has line items. When the server
+// prices the orders, an order without line items is rejected, since its price
+// would be whatever the client sent. Otherwise, the amount of the order is set
+// from the legacy price when the client only sends it.
+func (server *OrderManagementServer) priceOrder(ctx context.Context, order *pb.Order) error {
+	if len(order.GetLineItems()) == 0 {
+		if server.pricer != nil {
+			return status.Errorf(codes.InvalidArgument, "order items must reference catalog products with line items")
+		}
+
+		err := migrateOrderAmount(order)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		return nil
+	}
+
+	if server.pricer == nil {
+		return status.Errorf(codes.FailedPrecondition, "this server does not price orders, line items are not supported")
+	}
+
+	return server.pricer.Price(ctx, order)
+}
+
+// GetOrder is a unary RPC to get an order by ID
+func (server *OrderManagementServer) GetOrder(ctx context.Context, orderID *wrapper.StringValue) (*pb.Order, error) {
+	order, err := server.orderStore.Find(ctx, orderID.GetValue())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find order: %v", err)
+	}
+
+	if order == nil {
+		return nil, status.Errorf(codes.NotFound, "Order with %s not found.", orderID.GetValue())
+	}
+
+	return order, nil
+}
+
+// SearchOrders is a server-streaming RPC that sends the orders with an item
+// containing the search query one by one, in order of ID.
+// It is kept for the existing clients, QueryOrders supports more criteria.
+func (server *OrderManagementServer) SearchOrders(searchQuery *wrapper.StringValue, stream pb.OrderManagement_SearchOrdersServer) error {
+	err := server.orderStore.Search(
+		stream.Context(),
+		&pb.OrderQuery{Item: searchQuery.GetValue()},
+		func(order *pb.Order) error {
+			// Send the matching orders in a stream using the Send() method
+			err := stream.Send(order)
+			if err != nil {
+				return err
+			}
+
+			log.Print("Matching order found: " + order.GetId())
+			return nil
+		},
+	)
+
+	if err != nil {
+		return status.Errorf(codes.Internal, "error sending message through the stream: %v", err)
+	}
+
+	return nil
+}
+
+// QueryOrders is a unary RPC that returns a page of the orders matching the query.
+// The page token holds the position of the last order of the previous page, so
+// that the orders added or removed meanwhile do not shift the next pages.
+func (server *OrderManagementServer) QueryOrders(ctx context.Context, query *pb.OrderQuery) (*pb.QueryOrdersResponse, error) {
+	err := validateOrderQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := decodeOrderPageToken(query)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := orderPageSize(query)
+	res := &pb.QueryOrdersResponse{}
+	more := false
+
+	err = server.orderStore.Search(ctx, query, func(order *pb.Order) error {
+		if after != nil && compareOrderCursors(newOrderCursor(order), *after, query.GetSortBy(), query.GetDescending()) <= 0 {
+			return nil
+		}
+
+		// one more order than the page size tells whether there is a next page.
+		if len(res.Orders) == pageSize {
+			more = true
+			return errStopSearch
+		}
+
+		res.Orders = append(res.Orders, order)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopSearch) {
+		return nil, status.Errorf(codes.Internal, "cannot search orders: %v", err)
+	}
+
+	err = contextError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if more {
+		res.NextPageToken, err = encodeOrderPageToken(query, res.Orders[len(res.Orders)-1])
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot build page token: %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+// errStopSearch is returned by a search callback to stop the search once it has enough orders.
+var errStopSearch = errors.New("stop search")
+
+// UpdateOrders is a client-streaming RPC that updates the orders received
+// from the stream, and responds with the IDs of the updated orders once
+// the client closes the stream. The stream fails on the first order that
+// cannot be updated.
+// It is replaced by BatchUpdateOrders, and only served by the servers created
+// with WithLegacyUpdateOrders, for the clients that have not moved yet.
+func (server *OrderManagementServer) UpdateOrders(stream pb.OrderManagement_UpdateOrdersServer) error {
+	if !server.legacyUpdateOrders {
+		return status.Errorf(codes.Unimplemented, "updateOrders is replaced by batchUpdateOrders")
+	}
+
+	ordersStr := "Updated Orders IDs: "
+
+	for {
+		// read incoming message stream from the client.
+		order, err := stream.Recv()
+
+		// Check for end of stream.
+		if err == io.EOF {
+			// The service marks the end of the stream for server-side messages.
+			// by calling the SendAndClose method of the OrderManagement_UpdateOrdersServer object
+			return stream.SendAndClose(
+				&wrapper.StringValue{
+					Value: "Orders Processed: " + ordersStr + "\n",
+				},
+			)
+		}
+
+		if err != nil {
+			return logError(recvError("cannot receive order", err))
+		}
+
+		// the whole order is updated, whatever its version.
+		_, err = server.updateOrder(stream.Context(), &pb.UpdateOrderRequest{Order: order})
+		if err != nil {
+			return logError(err)
+		}
+
+		ordersStr += order.GetId() + ", "
+	}
+}
+
+// orderUpdateError() function converts an error returned by OrderStore.Update()
+// to a status error. Status errors returned by the update function are kept as is.
+func orderUpdateError(orderID string, err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return status.Errorf(codes.NotFound, "order %s not found", orderID)
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Errorf(codes.Internal, "cannot update order %s: %v", orderID, err)
+}
+
+// TransitionOrder is a unary RPC that moves an order to a new status, if the
+// order lifecycle allows it. The transition is recorded in the order history,
+// along with the user who made it.
+func (server *OrderManagementServer) TransitionOrder(ctx context.Context, req *pb.TransitionOrderRequest) (*pb.Order, error) {
+	log.Printf("received a transition-order request: id = %s, status = %s", req.GetOrderId(), req.GetStatus())
+
+	actor, err := orderActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated *pb.Order
+	err = server.orderStore.Update(ctx, req.GetOrderId(), func(order *pb.Order) error {
+		err := transitionOrder(order, req.GetStatus(), actor, req.GetReason(), time.Now())
+		if err != nil {
+			return err
+		}
+
+		// the event is appended once the store is unlocked, and a failure to
+		// append it does not undo the transition.
+		server.queueOrderEvent(ctx, pb.OrderEvent_STATUS_CHANGED, order, nil)
+
+		updated = deepCopyOrder(order)
+		return nil
+	})
+	server.flushOrderEvents()
+	if err != nil {
+		return nil, orderUpdateError(req.GetOrderId(), err)
+	}
+
+	log.Printf("order %s is now %s", req.GetOrderId(), updated.GetStatus())
+
+	return updated, nil
+}
+
+// ProcessOrders is a bidirectional-streaming RPC. The client streams the IDs of
+// the orders to process, and the server combines them into shipments by destination.
+// A shipment is sent back as soon as it has shipmentBatchSize orders, when it
+// has waited for shipmentWindow, or when the client closes its stream.
+// Order IDs that cannot be processed get an error response, and the stream goes on.
+// The shipments being combined belong to the stream, so concurrent streams do not share them.
+func (server *OrderManagementServer) ProcessOrders(stream pb.OrderManagement_ProcessOrdersServer) error {
+	ctx := stream.Context()
+	batcher := newShipmentBatcher(TenantFromContext(ctx), server.shipmentBatchSize, server.shipmentWindow)
+
+	// the cancelled orders are removed from the shipments of all the streams.
+	server.shipments.register(batcher)
+	defer server.shipments.unregister(batcher)
+
+	// The order IDs are received in their own goroutine, so that we can send the
+	// shipments whose window has expired while waiting for the next order ID.
+	requests := make(chan processOrdersRequest)
+	go receiveProcessOrdersRequests(stream, requests)
+
+	// the timer fires when the oldest shipment has waited for the whole window.
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	for {
+		var timeout <-chan time.Time
+		if deadline, ok := batcher.nextDeadline(); ok {
+			timer.Reset(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+
+		case <-timeout:
+			err := server.sendShipments(stream, batcher.expired(time.Now()))
+			if err != nil {
+				return err
+			}
+
+		case req := <-requests:
+			// When the end of the stream is found send all the
+			// remaining combined shipments to the client.
+			if req.err == io.EOF {
+				log.Print("no more data")
+				return server.sendShipments(stream, batcher.flush())
+			}
+
+			if req.err != nil {
+				return logError(recvError("cannot receive stream request", req.err))
+			}
+
+			err := server.processOrder(stream, batcher, req.orderID)
+			if err != nil {
+				return err
+			}
+		}
+
+		stopTimer(timer)
+	}
+}
+
+// stopTimer() function stops the timer and drains its channel, so that it can be reset.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// processOrdersRequest is an order ID received from a ProcessOrders stream, or the receive error.
+type processOrdersRequest struct {
+	orderID string
+	err     error
+}
+
+// receiveProcessOrdersRequests() function forwards the received order IDs to
+// the requests channel until the stream ends.
+func receiveProcessOrdersRequests(stream pb.OrderManagement_ProcessOrdersServer, requests chan<- processOrdersRequest) {
+	for {
+		req, err := stream.Recv()
+
+		select {
+		case requests <- processOrdersRequest{orderID: req.GetValue(), err: err}:
+		case <-stream.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// processOrder() function adds an order to its shipment, and sends the shipment
+// if it is full. An order that cannot be found gets an error response.
+func (server *OrderManagementServer) processOrder(
+	stream pb.OrderManagement_ProcessOrdersServer,
+	batcher *shipmentBatcher,
+	orderID string,
+) error {
+	log.Printf("Reading process order : %s", orderID)
+
+	shipment, rejection, err := server.batchOrder(stream.Context(), batcher, orderID)
+	if err != nil {
+		return logError(err)
+	}
+
+	if rejection != "" {
+		log.Printf("cannot process order %s: %s", orderID, rejection)
+		return stream.Send(&pb.ProcessOrdersResponse{
+			Result: &pb.ProcessOrdersResponse_Error{
+				Error: &pb.ProcessOrderError{OrderId: orderID, Message: rejection},
+			},
+		})
+	}
+
+	if shipment == nil {
+		return nil
+	}
+
+	return server.sendShipments(stream, []*pb.CombinedShipment{shipment})
+}
+
+// batchOrder() function adds an order to its shipment, and returns the shipment
+// if it is full. It returns why the order is rejected if it cannot be shipped.
+func (server *OrderManagementServer) batchOrder(ctx context.Context, batcher *shipmentBatcher, orderID string) (*pb.CombinedShipment, string, error) {
+	server.shipments.mutex.Lock()
+	defer server.shipments.mutex.Unlock()
+
+	order, err := server.orderStore.Find(ctx, orderID)
+	if err != nil {
+		return nil, "", status.Errorf(codes.Internal, "cannot find order: %v", err)
+	}
+
+	if order == nil {
+		return nil, "order not found", nil
+	}
+
+	if order.GetStatus() == pb.Order_CANCELLED || order.GetStatus() == pb.Order_REFUNDED {
+		return nil, "order is " + order.GetStatus().String(), nil
+	}
+
+	address, err := orderAddress(order)
+	if err != nil {
+		return nil, "order destination is invalid", nil
+	}
+
+	shipment, err := batcher.add(order, address, time.Now())
+	if err != nil {
+		return nil, "", status.Errorf(codes.Internal, "%v", err)
+	}
+
+	return shipment, "", nil
+}
+
+// sendShipments() function assigns the carriers of the combined shipments,
+// saves them, and sends them to the client.
+// Every shipment is also recorded as a SHIPMENT_FORMED event.
+func (server *OrderManagementServer) sendShipments(stream pb.OrderManagement_ProcessOrdersServer, shipments []*pb.CombinedShipment) error {
+	for _, shipment := range shipments {
+		now := time.Now()
+		shipment.CreatedAt = timestamppb.New(now)
+
+		// a shipment without carrier is still sent, it is routed by hand.
+		err := server.carrierRouter.Route(shipment, now)
+		if err != nil {
+			log.Printf("cannot route shipment %s: %v", shipment.GetId(), err)
+		}
+
+		log.Printf("Shipping : %v -> %v by %s", shipment.GetId(), len(shipment.GetOrdersList()), shipment.GetCarrier())
+
+		err = server.shipmentStore.Save(stream.Context(), shipment)
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot save shipment: %v", err))
+		}
+
+		server.appendOrderEvent(stream.Context(), pb.OrderEvent_SHIPMENT_FORMED, nil, shipment)
+
+		err = stream.Send(&pb.ProcessOrdersResponse{
+			Result: &pb.ProcessOrdersResponse_Shipment{Shipment: shipment},
+		})
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot send shipment: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// GetShipment is a unary RPC to get a combined shipment by ID
+func (server *OrderManagementServer) GetShipment(ctx context.Context, shipmentID *wrapper.StringValue) (*pb.CombinedShipment, error) {
+	shipment, err := server.shipmentStore.Find(ctx, shipmentID.GetValue())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find shipment: %v", err)
+	}
+
+	if shipment == nil {
+		return nil, status.Errorf(codes.NotFound, "shipment %s not found", shipmentID.GetValue())
+	}
+
+	return shipment, nil
+}
+
+// ListShipments is a unary RPC that returns one page of the combined shipments
+// matching the filters of the request, oldest first.
+func (server *OrderManagementServer) ListShipments(ctx context.Context, req *pb.ListShipmentsRequest) (*pb.ListShipmentsResponse, error) {
+	pageSize, err := shipmentPageSize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	afterID, err := decodeShipmentPageToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListShipmentsResponse{}
+	more := false
+	skipping := afterID != ""
+
+	err = server.shipmentStore.Search(ctx, req, func(shipment *pb.CombinedShipment) error {
+		if skipping {
+			skipping = shipment.GetId() != afterID
+			return nil
+		}
+
+		// one more shipment than the page size tells whether there is a next page.
+		if len(res.Shipments) == pageSize {
+			more = true
+			return errStopSearch
+		}
+
+		res.Shipments = append(res.Shipments, shipment)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopSearch) && contextError(ctx) == nil {
+		return nil, status.Errorf(codes.Internal, "cannot search shipments: %v", err)
+	}
+
+	err = contextError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if more {
+		res.NextPageToken, err = encodeShipmentPageToken(req, res.Shipments[len(res.Shipments)-1])
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot build page token: %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+// watchOrdersBatchSize is the number of events WatchOrders reads from the log at once.
+const watchOrdersBatchSize = 100
+
+// WatchOrders is a server-streaming RPC that sends the order events after the
+// requested sequence number, then waits for the new events and sends them as
+// they are appended, until the client cancels the stream. Only the events of
+// the caller's tenant are sent, the sequence numbers of the others are skipped.
+// A consumer too slow to keep up with the log gets an OutOfRange error once
+// the events it has not read yet are dropped.
+func (server *OrderManagementServer) WatchOrders(req *pb.WatchOrdersRequest, stream pb.OrderManagement_WatchOrdersServer) error {
+	ctx := stream.Context()
+
+	afterSeq := req.GetAfterSeq()
+	if req.GetFromLatest() {
+		afterSeq = server.eventLog.LastSeq()
+	}
+
+	log.Printf("received a watch-orders request after seq %d", afterSeq)
+
+	// the header tells the consumer that the stream starts after afterSeq,
+	// so that it knows when the changes it makes next will be watched.
+	err := stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send header: %v", err))
+	}
+
+	for {
+		// the channel is taken before reading, so that no event appended in
+		// between can be missed.
+		changed := server.eventLog.Changed()
+
+		events, err := server.eventLog.Read(afterSeq, watchOrdersBatchSize)
+		if errors.Is(err, ErrEventsTruncated) || errors.Is(err, ErrUnknownEventSeq) {
+			return status.Errorf(codes.OutOfRange, "cannot resume after seq %d: %v", afterSeq, err)
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot read order events: %v", err))
+		}
+
+		for _, event := range events {
+			afterSeq = event.GetSeq()
+
+			// the events logged before orders had tenants are those of the default tenant.
+			tenant := event.GetTenant()
+			if tenant == "" {
+				tenant = DefaultTenant
+			}
+			if tenant != TenantFromContext(ctx) {
+				continue
+			}
+
+			err := stream.Send(event)
+			if err != nil {
+				return logError(status.Errorf(codes.Unknown, "cannot send order event: %v", err))
+			}
+		}
+
+		if len(events) == watchOrdersBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-changed:
+		}
+	}
+}
+
+// appendOrderEvent() function appends an event about an order or a shipment
+// of the tenant carried by the context to the event log, after the events
+// already queued. A failure to append it is logged, since the change it is
+// about is already made.
+func (server *OrderManagementServer) appendOrderEvent(ctx context.Context, eventType pb.OrderEvent_Type, order *pb.Order, shipment *pb.CombinedShipment) {
+	server.queueOrderEvent(ctx, eventType, order, shipment)
+	server.flushOrderEvents()
+}
+
+// queueOrderEvent() function queues an event about an order or a shipment of
+// the tenant carried by the context, without appending it to the event log.
+// It is called under the order store lock, so that the events are queued in
+// the order of the changes, which flushOrderEvents() then appends once the
+// lock is released.
+func (server *OrderManagementServer) queueOrderEvent(ctx context.Context, eventType pb.OrderEvent_Type, order *pb.Order, shipment *pb.CombinedShipment) {
+	// the order is copied, since the store may change it once unlocked.
+	if order != nil {
+		order = deepCopyOrder(order)
+	}
+
+	server.eventOutbox.add(&pb.OrderEvent{
+		Type:     eventType,
+		Order:    order,
+		Shipment: shipment,
+		Tenant:   TenantFromContext(ctx),
+	})
+}
+
+// flushOrderEvents() function appends the queued events to the event log.
+func (server *OrderManagementServer) flushOrderEvents() {
+	server.eventOutbox.drain(server.eventLog)
+}
@@ -0,0 +1,888 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAddOrderServer(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	server := service.NewOrderManagementServer(orderStore)
+
+	newOrder := func() *pb.Order {
+		return &pb.Order{Items: []string{"Amazon Echo"}, Price: 30, Destination: "San Jose, CA"}
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(order *pb.Order)
+		code   codes.Code
+	}{
+		{name: "success_no_id", modify: func(order *pb.Order) {}, code: codes.OK},
+		{name: "failure_client_id", modify: func(order *pb.Order) { order.Id = "200" }, code: codes.InvalidArgument},
+		{name: "failure_existing_id", modify: func(order *pb.Order) { order.Id = "102" }, code: codes.InvalidArgument},
+		{name: "failure_no_items", modify: func(order *pb.Order) { order.Items = nil }, code: codes.InvalidArgument},
+		{name: "failure_empty_item", modify: func(order *pb.Order) { order.Items = append(order.Items, " ") }, code: codes.InvalidArgument},
+		{name: "failure_negative_price", modify: func(order *pb.Order) { order.Price = -1 }, code: codes.InvalidArgument},
+		{name: "failure_no_destination", modify: func(order *pb.Order) { order.Destination = "" }, code: codes.InvalidArgument},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			order := newOrder()
+			tc.modify(order)
+
+			res, err := server.AddOrder(adminContext(), order)
+			require.Equal(t, tc.code, status.Code(err))
+			if tc.code != codes.OK {
+				return
+			}
+
+			require.NotEmpty(t, res.GetValue())
+			saved, err := server.GetOrder(context.Background(), &wrapper.StringValue{Value: res.GetValue()})
+			require.NoError(t, err)
+			require.Equal(t, order.GetItems(), saved.GetItems())
+			require.Equal(t, "admin1", saved.GetCustomer())
+		})
+	}
+
+	// the customer is the authenticated user, never the one the client sends.
+	_, err := server.AddOrder(context.Background(), newOrder())
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	order := newOrder()
+	order.Customer = "alice"
+	_, err = server.AddOrder(userContext("bob", "user"), order)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestInMemoryOrderStoreConcurrent(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+
+	// concurrent writers and readers must not race (run the tests with -race).
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 60)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			order := &pb.Order{Id: fmt.Sprint(1000 + i), Items: []string{"Google Home Mini"}, Destination: "Mountain View, CA"}
+			errs <- orderStore.Save(context.Background(), order)
+
+			// the store keeps its own copy of the order.
+			order.Items[0] = "changed"
+
+			errs <- orderStore.Update(context.Background(), "102", func(order *pb.Order) error {
+				order.Price = float32(i)
+				return nil
+			})
+
+			_, err := orderStore.Find(context.Background(), "102")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	count := 0
+	err := orderStore.Search(context.Background(), &pb.OrderQuery{Item: "Google Home Mini"}, func(order *pb.Order) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 21, count)
+
+	require.ErrorIs(t, orderStore.Update(context.Background(), "unknown", func(order *pb.Order) error { return nil }), service.ErrNotFound)
+}
+
+func TestTransitionOrderServer(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	server := service.NewOrderManagementServer(orderStore, service.WithLegacyUpdateOrders())
+	orderClient := newTestOrderClient(t, server)
+
+	transition := func(id string, to pb.Order_Status) (*pb.Order, error) {
+		return server.TransitionOrder(adminContext(), &pb.TransitionOrderRequest{OrderId: id, Status: to, Reason: "test"})
+	}
+
+	addOrder := func() string {
+		res, err := server.AddOrder(adminContext(), &pb.Order{Items: []string{"Amazon Echo"}, Price: 30, Destination: "San Jose, CA"})
+		require.NoError(t, err)
+		return res.GetValue()
+	}
+
+	// a new order is pending.
+	id := addOrder()
+	order, err := server.GetOrder(context.Background(), &wrapper.StringValue{Value: id})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_PENDING, order.GetStatus())
+	require.Len(t, order.GetHistory(), 1)
+
+	// the client cannot choose the status of a new order.
+	_, err = server.AddOrder(adminContext(), &pb.Order{Items: []string{"Amazon Echo"}, Destination: "San Jose, CA", Status: pb.Order_DELIVERED})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// every transition is made by an authenticated user.
+	_, err = server.TransitionOrder(context.Background(), &pb.TransitionOrderRequest{OrderId: id, Status: pb.Order_PAID})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = server.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: id})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// steps of the lifecycle cannot be skipped.
+	_, err = transition(id, pb.Order_SHIPPED)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	order, err = transition(id, pb.Order_PAID)
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_PAID, order.GetStatus())
+
+	// UpdateOrders cannot change the status.
+	updateOrder := func(order *pb.Order) error {
+		stream, err := orderClient.UpdateOrders(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(order))
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+	order.Status = pb.Order_DELIVERED
+	require.Equal(t, codes.FailedPrecondition, status.Code(updateOrder(order)))
+
+	order.Status = pb.Order_PAID
+	order.Price = 25
+	require.NoError(t, updateOrder(order))
+
+	// nor update a packed order.
+	order, err = transition(id, pb.Order_PACKED)
+	require.NoError(t, err)
+	require.Equal(t, codes.FailedPrecondition, status.Code(updateOrder(order)))
+
+	_, err = transition(id, pb.Order_SHIPPED)
+	require.NoError(t, err)
+	_, err = transition(id, pb.Order_CANCELLED)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = transition(id, pb.Order_DELIVERED)
+	require.NoError(t, err)
+	order, err = transition(id, pb.Order_REFUNDED)
+	require.NoError(t, err)
+
+	// every transition is in the history, with its actor.
+	require.Len(t, order.GetHistory(), 6)
+	last := order.GetHistory()[5]
+	require.Equal(t, pb.Order_DELIVERED, last.GetFrom())
+	require.Equal(t, pb.Order_REFUNDED, last.GetTo())
+	require.Equal(t, "admin1", last.GetActor())
+	require.NotNil(t, last.GetTime())
+	require.EqualValues(t, 25, order.GetPrice())
+	require.True(t, proto.Equal(usd(t, "25"), order.GetAmount()))
+
+	// a cancelled order can only be refunded if it was paid.
+	unpaidID := addOrder()
+	_, err = transition(unpaidID, pb.Order_CANCELLED)
+	require.NoError(t, err)
+	_, err = transition(unpaidID, pb.Order_REFUNDED)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = transition("unknown", pb.Order_PAID)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestBatchUpdateOrdersServer(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	orderClient := newTestOrderClient(t, service.NewOrderManagementServer(orderStore))
+
+	updateOrders := func(reqs ...*pb.UpdateOrderRequest) *pb.UpdateOrdersSummary {
+		stream, err := orderClient.BatchUpdateOrders(context.Background())
+		require.NoError(t, err)
+		for _, req := range reqs {
+			require.NoError(t, stream.Send(req))
+		}
+		summary, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		require.Len(t, summary.GetResults(), len(reqs))
+		return summary
+	}
+	mask := func(paths ...string) *fieldmaskpb.FieldMask {
+		return &fieldmaskpb.FieldMask{Paths: paths}
+	}
+
+	_, err := orderClient.TransitionOrder(context.Background(), &pb.TransitionOrderRequest{OrderId: "105", Status: pb.Order_PAID})
+	require.NoError(t, err)
+	_, err = orderClient.TransitionOrder(context.Background(), &pb.TransitionOrderRequest{OrderId: "105", Status: pb.Order_PACKED})
+	require.NoError(t, err)
+
+	// every order has its own outcome, and the stream goes on.
+	summary := updateOrders(
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "102", Items: []string{"Google Pixel 3A"}, Price: 400, Destination: "Austin, TX"}},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "unknown", Items: []string{"Kindle"}, Destination: "Austin, TX"}},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "103", Destination: "Austin, TX"}, UpdateMask: mask("destination"), ExpectedVersion: 1},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "104", Description: "gift"}, UpdateMask: mask("description"), ExpectedVersion: 7},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "104", Destination: " "}, UpdateMask: mask("destination")},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "104", Status: pb.Order_SHIPPED}, UpdateMask: mask("description")},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "104"}, UpdateMask: mask("status")},
+		&pb.UpdateOrderRequest{Order: &pb.Order{Id: "105", Description: "late"}, UpdateMask: mask("description")},
+	)
+	require.EqualValues(t, 2, summary.GetUpdated())
+	require.EqualValues(t, 1, summary.GetNotFound())
+	require.EqualValues(t, 1, summary.GetConflicts())
+	require.EqualValues(t, 4, summary.GetInvalid())
+
+	outcomes := make([]pb.UpdateOrderResult_Outcome, 0, len(summary.GetResults()))
+	for _, result := range summary.GetResults() {
+		outcomes = append(outcomes, result.GetOutcome())
+	}
+	require.Equal(t, []pb.UpdateOrderResult_Outcome{
+		pb.UpdateOrderResult_UPDATED,
+		pb.UpdateOrderResult_NOT_FOUND,
+		pb.UpdateOrderResult_UPDATED,
+		pb.UpdateOrderResult_CONFLICT,
+		pb.UpdateOrderResult_INVALID,
+		pb.UpdateOrderResult_INVALID,
+		pb.UpdateOrderResult_INVALID,
+		pb.UpdateOrderResult_INVALID,
+	}, outcomes)
+	require.EqualValues(t, 2, summary.GetResults()[0].GetVersion())
+	require.EqualValues(t, 1, summary.GetResults()[3].GetVersion(), "a conflict reports the current version")
+	require.NotEmpty(t, summary.GetResults()[3].GetMessage())
+
+	// the update mask keeps the other fields.
+	order, err := orderClient.GetOrder(context.Background(), &wrapper.StringValue{Value: "103"})
+	require.NoError(t, err)
+	require.Equal(t, "Austin, TX", order.GetDestination())
+	require.Equal(t, []string{"Apple Watch S4"}, order.GetItems())
+	require.EqualValues(t, 400, order.GetPrice())
+	require.EqualValues(t, 2, order.GetVersion())
+
+	// the unknown order was not created.
+	_, err = orderClient.GetOrder(context.Background(), &wrapper.StringValue{Value: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// a conditional update succeeds with the current version only, once.
+	conditional := &pb.UpdateOrderRequest{Order: &pb.Order{Id: "103", Description: "gift"}, UpdateMask: mask("description"), ExpectedVersion: 2}
+	summary = updateOrders(conditional, conditional)
+	require.Equal(t, pb.UpdateOrderResult_UPDATED, summary.GetResults()[0].GetOutcome())
+	require.Equal(t, pb.UpdateOrderResult_CONFLICT, summary.GetResults()[1].GetOutcome())
+	require.EqualValues(t, 3, summary.GetResults()[1].GetVersion())
+
+	// the deprecated RPC is only served by the servers that keep it.
+	legacyStream, err := orderClient.UpdateOrders(context.Background())
+	require.NoError(t, err)
+	_, err = legacyStream.CloseAndRecv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+// newTestOrderClient starts a gRPC server for the order management server,
+// and returns a client connected to it.
+// userContext returns a context authenticated as the given user, as the AuthInterceptor leaves it.
+func userContext(username string, role string) context.Context {
+	return service.ContextWithClaims(context.Background(), &service.UserClaims{Username: username, Role: role})
+}
+
+// adminContext returns a context authenticated as an admin.
+func adminContext() context.Context {
+	return userContext("admin1", "admin")
+}
+
+// adminServerStream is a server stream authenticated as an admin.
+type adminServerStream struct {
+	grpc.ServerStream
+}
+
+func (stream adminServerStream) Context() context.Context {
+	return service.ContextWithClaims(stream.ServerStream.Context(), &service.UserClaims{Username: "admin1", Role: "admin"})
+}
+
+// newTestOrderClient returns a client of the order server, whose calls are authenticated as an admin.
+func newTestOrderClient(t *testing.T, server *service.OrderManagementServer) pb.OrderManagementClient {
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(service.ContextWithClaims(ctx, &service.UserClaims{Username: "admin1", Role: "admin"}), req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, adminServerStream{stream})
+		}),
+	)
+	pb.RegisterOrderManagementServer(grpcServer, server)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewOrderManagementClient(conn)
+}
+
+func TestProcessOrdersServer(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+
+	recvShipment := func(stream pb.OrderManagement_ProcessOrdersClient) *pb.CombinedShipment {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.NotNil(t, res.GetShipment(), "got %v", res)
+		return res.GetShipment()
+	}
+	orderIDs := func(shipment *pb.CombinedShipment) []string {
+		var ids []string
+		for _, order := range shipment.GetOrdersList() {
+			ids = append(ids, order.GetId())
+		}
+		return ids
+	}
+
+	t.Run("batch_size_and_eof", func(t *testing.T) {
+		t.Parallel()
+
+		server := service.NewOrderManagementServer(orderStore, service.WithShipmentBatching(2, time.Hour))
+		stream, err := newTestOrderClient(t, server).ProcessOrders(context.Background())
+		require.NoError(t, err)
+
+		// the shipment of a destination is sent as soon as it is full.
+		for _, id := range []string{"102", "103", "104"} {
+			require.NoError(t, stream.Send(&wrapper.StringValue{Value: id}))
+		}
+		require.Equal(t, []string{"102", "104"}, orderIDs(recvShipment(stream)))
+
+		// an unknown order gets an error, and the stream goes on.
+		require.NoError(t, stream.Send(&wrapper.StringValue{Value: "999"}))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "999", res.GetError().GetOrderId())
+
+		// the end of the stream flushes the remaining shipments.
+		require.NoError(t, stream.Send(&wrapper.StringValue{Value: "106"}))
+		require.NoError(t, stream.CloseSend())
+		require.Equal(t, []string{"106"}, orderIDs(recvShipment(stream)))
+		require.Equal(t, []string{"103"}, orderIDs(recvShipment(stream)))
+
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("time_window", func(t *testing.T) {
+		t.Parallel()
+
+		server := service.NewOrderManagementServer(orderStore, service.WithShipmentBatching(10, 100*time.Millisecond))
+		stream, err := newTestOrderClient(t, server).ProcessOrders(context.Background())
+		require.NoError(t, err)
+
+		// the shipment is sent once its window expires, without closing the stream.
+		start := time.Now()
+		require.NoError(t, stream.Send(&wrapper.StringValue{Value: "105"}))
+		require.Equal(t, []string{"105"}, orderIDs(recvShipment(stream)))
+		require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("concurrent_streams", func(t *testing.T) {
+		t.Parallel()
+
+		server := service.NewOrderManagementServer(orderStore, service.WithShipmentBatching(2, 10*time.Millisecond))
+		orderClient := newTestOrderClient(t, server)
+
+		// every stream gets back all of its own orders, and only them.
+		wg := sync.WaitGroup{}
+		counts := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				stream, err := orderClient.ProcessOrders(context.Background())
+				if err != nil {
+					counts <- -1
+					return
+				}
+				for _, id := range []string{"102", "103", "104", "105", "106"} {
+					stream.Send(&wrapper.StringValue{Value: id})
+				}
+				stream.CloseSend()
+
+				count := 0
+				for {
+					res, err := stream.Recv()
+					if err != nil {
+						break
+					}
+					count += len(res.GetShipment().GetOrdersList())
+				}
+				counts <- count
+			}()
+		}
+		wg.Wait()
+		close(counts)
+
+		for count := range counts {
+			require.Equal(t, 5, count)
+		}
+	})
+
+	t.Run("routing", func(t *testing.T) {
+		t.Parallel()
+
+		server := service.NewOrderManagementServer(service.NewInMemoryOrderStore(), service.WithShipmentBatching(3, time.Hour))
+		orderClient := newTestOrderClient(t, server)
+
+		var ids []string
+		for _, destination := range []string{"San Jose, CA", "San Jose,CA", "san jose, California 95134", "Austin, Texas"} {
+			res, err := orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Kindle"}, Price: 90, Destination: destination})
+			require.NoError(t, err)
+			ids = append(ids, res.GetValue())
+		}
+
+		order, err := orderClient.GetOrder(context.Background(), &wrapper.StringValue{Value: ids[1]})
+		require.NoError(t, err)
+		require.Equal(t, "San Jose, CA", order.GetDestination())
+		require.Equal(t, "CA", order.GetAddress().GetRegion())
+
+		// the same city written differently makes a single shipment.
+		stream, err := orderClient.ProcessOrders(context.Background())
+		require.NoError(t, err)
+		for _, id := range ids {
+			require.NoError(t, stream.Send(&wrapper.StringValue{Value: id}))
+		}
+		sanJose := recvShipment(stream)
+		require.Equal(t, ids[:3], orderIDs(sanJose))
+		require.Equal(t, "San Jose", sanJose.GetDestination().GetCity())
+		require.Equal(t, "west-coast-express", sanJose.GetCarrier())
+		require.NotNil(t, sanJose.GetEstimatedDelivery())
+		require.True(t, sanJose.GetEstimatedDelivery().AsTime().After(sanJose.GetCreatedAt().AsTime()))
+
+		require.NoError(t, stream.CloseSend())
+		austin := recvShipment(stream)
+		require.Equal(t, "ground", austin.GetCarrier())
+		require.Equal(t, "TX", austin.GetDestination().GetRegion())
+
+		// the shipments sent are kept.
+		shipment, err := orderClient.GetShipment(context.Background(), &wrapper.StringValue{Value: sanJose.GetId()})
+		require.NoError(t, err)
+		require.Equal(t, sanJose.GetCarrier(), shipment.GetCarrier())
+		require.Len(t, shipment.GetOrdersList(), 3)
+
+		_, err = orderClient.GetShipment(context.Background(), &wrapper.StringValue{Value: "unknown"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		list, err := orderClient.ListShipments(context.Background(), &pb.ListShipmentsRequest{Region: "tx"})
+		require.NoError(t, err)
+		require.Len(t, list.GetShipments(), 1)
+		require.Equal(t, austin.GetId(), list.GetShipments()[0].GetId())
+		require.Empty(t, list.GetNextPageToken())
+
+		list, err = orderClient.ListShipments(context.Background(), &pb.ListShipmentsRequest{OrderId: ids[2]})
+		require.NoError(t, err)
+		require.Len(t, list.GetShipments(), 1)
+		require.Equal(t, sanJose.GetId(), list.GetShipments()[0].GetId())
+
+		// the shipments are listed oldest first, page by page.
+		list, err = orderClient.ListShipments(context.Background(), &pb.ListShipmentsRequest{PageSize: 1})
+		require.NoError(t, err)
+		require.Equal(t, sanJose.GetId(), list.GetShipments()[0].GetId())
+		require.NotEmpty(t, list.GetNextPageToken())
+
+		_, err = orderClient.ListShipments(context.Background(), &pb.ListShipmentsRequest{PageSize: 1, Carrier: "ground", PageToken: list.GetNextPageToken()})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		list, err = orderClient.ListShipments(context.Background(), &pb.ListShipmentsRequest{PageSize: 1, PageToken: list.GetNextPageToken()})
+		require.NoError(t, err)
+		require.Equal(t, austin.GetId(), list.GetShipments()[0].GetId())
+		require.Empty(t, list.GetNextPageToken())
+	})
+}
+
+// testProductInfoServer is a ProductInfo catalog with fixed products.
+type testProductInfoServer struct {
+	pb.UnimplementedProductInfoServer
+	products map[string]*pb.Product
+}
+
+func (server *testProductInfoServer) GetProduct(ctx context.Context, productID *pb.ProductID) (*pb.Product, error) {
+	product := server.products[productID.GetValue()]
+	if product == nil {
+		return nil, status.Errorf(codes.NotFound, "product %s not found", productID.GetValue())
+	}
+
+	return product, nil
+}
+
+func TestAddOrderPricing(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sampledata.NewLaptop()
+	laptop.Price = usd(t, "1299.99")
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+
+	// the catalogs are served over gRPC, like in production.
+	catalogServer := grpc.NewServer()
+	pb.RegisterProductInfoServer(catalogServer, &testProductInfoServer{products: map[string]*pb.Product{
+		"echo":    {Id: "echo", Name: "Amazon Echo", Price: 29.99},
+		"sticker": {Id: "sticker", Name: "Gopher Sticker", ListPrice: usd(t, "0.35")},
+	}})
+	pb.RegisterLaptopServiceServer(catalogServer, service.NewLaptopServer(laptopStore, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go catalogServer.Serve(listener)
+	t.Cleanup(catalogServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	pricer := service.NewOrderPricer(pb.NewProductInfoClient(conn), pb.NewLaptopServiceClient(conn), 0.1)
+	server := service.NewOrderManagementServer(service.NewInMemoryOrderStore(), service.WithOrderPricing(pricer))
+	orderClient := newTestOrderClient(t, server)
+
+	productItem := func(id string, quantity uint32) *pb.OrderItem {
+		return &pb.OrderItem{Product: &pb.OrderItem_ProductId{ProductId: id}, Quantity: quantity}
+	}
+	laptopItem := func(id string, quantity uint32) *pb.OrderItem {
+		return &pb.OrderItem{Product: &pb.OrderItem_LaptopId{LaptopId: id}, Quantity: quantity}
+	}
+
+	// the server computes the prices from the catalogs.
+	res, err := orderClient.AddOrder(context.Background(), &pb.Order{
+		LineItems:   []*pb.OrderItem{productItem("echo", 3), laptopItem(laptop.GetId(), 1)},
+		Destination: "San Jose, CA",
+	})
+	require.NoError(t, err)
+
+	order, err := orderClient.GetOrder(context.Background(), res)
+	require.NoError(t, err)
+	require.Equal(t, []string{"Amazon Echo", laptop.GetBrand() + " " + laptop.GetName()}, order.GetItems())
+	require.Equal(t, 29.99, order.GetLineItems()[0].GetUnitPrice())
+	require.Equal(t, 89.97, order.GetLineItems()[0].GetLineTotal())
+	require.Equal(t, 1389.96, order.GetSubtotal())
+	require.Equal(t, 139.0, order.GetTax())
+	require.Equal(t, 1528.96, order.GetTotal())
+	require.Equal(t, float32(1528.96), order.GetPrice())
+	require.True(t, proto.Equal(usd(t, "1528.96"), order.GetAmount()))
+
+	// the doubles are derived from the exact amounts.
+	require.True(t, proto.Equal(usd(t, "29.99"), order.GetLineItems()[0].GetUnitAmount()))
+	require.True(t, proto.Equal(usd(t, "89.97"), order.GetLineItems()[0].GetLineAmount()))
+	require.True(t, proto.Equal(usd(t, "1389.96"), order.GetSubtotalAmount()))
+	require.True(t, proto.Equal(usd(t, "139"), order.GetTaxAmount()))
+	require.True(t, proto.Equal(usd(t, "0"), order.GetDiscountAmount()))
+	require.True(t, proto.Equal(usd(t, "1528.96"), order.GetTotalAmount()))
+
+	// the tax is rounded from its exact value, 0.035, where the float product
+	// of 0.35 and 0.1 is 0.034999999999999996.
+	res, err = orderClient.AddOrder(context.Background(), &pb.Order{
+		LineItems:   []*pb.OrderItem{productItem("sticker", 1)},
+		Destination: "San Jose, CA",
+	})
+	require.NoError(t, err)
+
+	order, err = orderClient.GetOrder(context.Background(), res)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "0.04"), order.GetTaxAmount()))
+	require.True(t, proto.Equal(usd(t, "0.39"), order.GetTotalAmount()))
+	require.Equal(t, 0.39, order.GetTotal())
+
+	// every invalid line gets its own field violation.
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{
+		LineItems:   []*pb.OrderItem{productItem("echo", 1), productItem("unknown", 1), laptopItem("unknown", 0), {Quantity: 1}},
+		Destination: "San Jose, CA",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		for _, violation := range detail.(*errdetails.BadRequest).GetFieldViolations() {
+			fields = append(fields, violation.GetField())
+		}
+	}
+	require.Equal(t, []string{
+		"line_items[1].product_id",
+		"line_items[2].quantity",
+		"line_items[2].laptop_id",
+		"line_items[3]",
+	}, fields)
+
+	// the client cannot set the prices, or send free-text items.
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{
+		LineItems:   []*pb.OrderItem{productItem("echo", 1)},
+		Total:       1,
+		Destination: "San Jose, CA",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{
+		LineItems:      []*pb.OrderItem{productItem("echo", 1)},
+		SubtotalAmount: usd(t, "1"),
+		Destination:    "San Jose, CA",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	item := productItem("echo", 1)
+	item.UnitAmount = usd(t, "1")
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{LineItems: []*pb.OrderItem{item}, Destination: "San Jose, CA"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = orderClient.AddOrder(context.Background(), &pb.Order{Items: []string{"Amazon Echo"}, Price: 1, Destination: "San Jose, CA"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a server without pricing does not accept line items.
+	_, err = service.NewOrderManagementServer(service.NewInMemoryOrderStore()).AddOrder(adminContext(), &pb.Order{
+		LineItems:   []*pb.OrderItem{productItem("echo", 1)},
+		Destination: "San Jose, CA",
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the catalogs being down is not the client's fault.
+	catalogServer.Stop()
+	ctx, cancel := context.WithTimeout(adminContext(), time.Second)
+	defer cancel()
+	_, err = server.AddOrder(ctx, &pb.Order{LineItems: []*pb.OrderItem{productItem("echo", 1)}, Destination: "San Jose, CA"})
+	require.Contains(t, []codes.Code{codes.Unavailable, codes.DeadlineExceeded}, status.Code(err))
+}
+
+func TestAddOrderLocalCatalogs(t *testing.T) {
+	t.Parallel()
+
+	aliceCtx := userContext("alice", "user")
+	acmeCtx := service.ContextWithTenant(aliceCtx, "acme")
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sampledata.NewLaptop()
+	laptop.Price = usd(t, "999")
+	require.NoError(t, laptopStore.Save(acmeCtx, laptop))
+
+	// the catalogs hosted by the same server are called without a connection or an API key.
+	pricer := service.NewOrderPricer(
+		service.LocalProductCatalog(service.NewProductInfoServer(service.NewInMemoryProductStore())),
+		service.LocalLaptopCatalog(service.NewLaptopServer(laptopStore, nil, nil)),
+		0.1,
+	)
+	server := service.NewOrderManagementServer(service.NewInMemoryOrderStore(), service.WithOrderPricing(pricer))
+
+	order := &pb.Order{
+		LineItems:   []*pb.OrderItem{{Product: &pb.OrderItem_LaptopId{LaptopId: laptop.GetId()}, Quantity: 1}},
+		Destination: "San Jose, CA",
+	}
+	_, err := server.AddOrder(acmeCtx, order)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "1098.9"), order.GetTotalAmount()))
+
+	// the laptop is looked up in the tenant of the order.
+	order = &pb.Order{
+		LineItems:   []*pb.OrderItem{{Product: &pb.OrderItem_LaptopId{LaptopId: laptop.GetId()}, Quantity: 1}},
+		Destination: "San Jose, CA",
+	}
+	_, err = server.AddOrder(aliceCtx, order)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestOrderTenants(t *testing.T) {
+	t.Parallel()
+
+	aliceCtx := userContext("alice", "user")
+	acmeCtx := service.ContextWithTenant(aliceCtx, "acme")
+
+	// the laptop only exists in the acme storefront.
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sampledata.NewLaptop()
+	laptop.Price = usd(t, "999")
+	laptop.Stock = &wrapper.UInt32Value{Value: 1}
+	require.NoError(t, laptopStore.Save(acmeCtx, laptop))
+
+	// the catalogs find the tenant of the calls like in production.
+	interceptor := service.NewAuthInterceptor(service.NewJWTManager("secret", time.Minute), service.AccessibleRoles())
+	catalogServer := grpc.NewServer(grpc.UnaryInterceptor(interceptor.Unary()))
+	pb.RegisterProductInfoServer(catalogServer, &testProductInfoServer{})
+	pb.RegisterLaptopServiceServer(catalogServer, service.NewLaptopServer(laptopStore, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go catalogServer.Serve(listener)
+	t.Cleanup(catalogServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	stockReservations := service.NewInMemoryStockReservations(service.WithLaptopStock(laptopStore))
+	pricer := service.NewOrderPricer(pb.NewProductInfoClient(conn), pb.NewLaptopServiceClient(conn), 0)
+	server := service.NewOrderManagementServer(orderStore, service.WithOrderPricing(pricer), service.WithStockReservations(stockReservations))
+
+	laptopOrder := func() *pb.Order {
+		return &pb.Order{
+			LineItems:   []*pb.OrderItem{{Product: &pb.OrderItem_LaptopId{LaptopId: laptop.GetId()}, Quantity: 1}},
+			Destination: "San Jose, CA",
+		}
+	}
+
+	// the laptops are priced and reserved in the tenant of the order.
+	res, err := server.AddOrder(acmeCtx, laptopOrder())
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), stockReservations.Reserved(acmeCtx, laptop.GetId()))
+	require.Zero(t, stockReservations.Reserved(aliceCtx, laptop.GetId()))
+
+	_, err = server.AddOrder(aliceCtx, laptopOrder())
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the orders of a tenant are not visible to the others.
+	_, err = server.GetOrder(acmeCtx, res)
+	require.NoError(t, err)
+	_, err = server.GetOrder(aliceCtx, res)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// cancelling the order releases the stock of its tenant.
+	_, err = server.CancelOrder(acmeCtx, &pb.CancelOrderRequest{OrderId: res.GetValue()})
+	require.NoError(t, err)
+	require.Zero(t, stockReservations.Reserved(acmeCtx, laptop.GetId()))
+
+	// the same order ID can be used by another tenant.
+	reused := laptopOrder()
+	reused.Id = "102"
+	require.NoError(t, orderStore.Save(acmeCtx, reused))
+	order, err := server.GetOrder(acmeCtx, &wrapper.StringValue{Value: "102"})
+	require.NoError(t, err)
+	require.Len(t, order.GetLineItems(), 1)
+	order, err = orderStore.Find(context.Background(), "102")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Google Pixel 3A", "Mac Book Pro"}, order.GetItems())
+}
+
+func TestQueryOrdersServer(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	server := service.NewOrderManagementServer(orderStore)
+	orderClient := newTestOrderClient(t, server)
+
+	seededAt := time.Now()
+	addOrder := func(customer string, item string, price float32) string {
+		res, err := server.AddOrder(userContext(customer, "user"), &pb.Order{Items: []string{item}, Price: price, Destination: "Austin, TX"})
+		require.NoError(t, err)
+		return res.GetValue()
+	}
+	aliceOrder := addOrder("alice", "Kindle", 90)
+	bobOrder := addOrder("bob", "Amazon Echo Dot", 50)
+
+	query := func(query *pb.OrderQuery) []string {
+		res, err := orderClient.QueryOrders(context.Background(), query)
+		require.NoError(t, err)
+
+		ids := []string{}
+		for _, order := range res.GetOrders() {
+			ids = append(ids, order.GetId())
+		}
+		return ids
+	}
+
+	require.ElementsMatch(t, []string{"105", "106", bobOrder}, query(&pb.OrderQuery{Item: "amazon echo"}))
+	require.Equal(t, []string{"102", "104"}, query(&pb.OrderQuery{
+		Destination: "mountain view",
+		MinPrice:    &wrapper.DoubleValue{Value: 350},
+		MaxPrice:    &wrapper.DoubleValue{Value: 1800},
+	}))
+	require.Equal(t, []string{aliceOrder}, query(&pb.OrderQuery{Customer: "alice"}))
+	require.ElementsMatch(t, []string{aliceOrder, bobOrder}, query(&pb.OrderQuery{CreatedAfter: timestamppb.New(seededAt)}))
+	require.Equal(t, []string{"102", "103", "104", "105", "106"}, query(&pb.OrderQuery{CreatedBefore: timestamppb.New(seededAt)}))
+
+	_, err := server.TransitionOrder(adminContext(), &pb.TransitionOrderRequest{OrderId: "103", Status: pb.Order_PAID})
+	require.NoError(t, err)
+	require.Equal(t, []string{"103"}, query(&pb.OrderQuery{Statuses: []pb.Order_Status{pb.Order_PAID, pb.Order_SHIPPED}}))
+
+	// the pages follow each other, even when an order is added between them.
+	byPrice := &pb.OrderQuery{SortBy: pb.OrderQuery_PRICE, Descending: true, PageSize: 3}
+	res, err := orderClient.QueryOrders(context.Background(), byPrice)
+	require.NoError(t, err)
+	require.NotEmpty(t, res.GetNextPageToken())
+
+	ids := []string{}
+	for _, order := range res.GetOrders() {
+		ids = append(ids, order.GetId())
+	}
+
+	lateOrder := addOrder("alice", "Echo Buds", 10)
+	for res.GetNextPageToken() != "" {
+		byPrice.PageToken = res.GetNextPageToken()
+		res, err = orderClient.QueryOrders(context.Background(), byPrice)
+		require.NoError(t, err)
+
+		for _, order := range res.GetOrders() {
+			ids = append(ids, order.GetId())
+		}
+	}
+	require.Equal(t, []string{"102", "104", "103", "106", aliceOrder, bobOrder, "105", lateOrder}, ids)
+
+	// a page token only works with the query it was issued for.
+	byPrice.PageToken = "not-a-token"
+	_, err = orderClient.QueryOrders(context.Background(), byPrice)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	first, err := orderClient.QueryOrders(context.Background(), &pb.OrderQuery{PageSize: 1})
+	require.NoError(t, err)
+	_, err = orderClient.QueryOrders(context.Background(), &pb.OrderQuery{Item: "echo", PageToken: first.GetNextPageToken()})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = orderClient.QueryOrders(context.Background(), &pb.OrderQuery{MinPrice: &wrapper.DoubleValue{Value: 10}, MaxPrice: &wrapper.DoubleValue{Value: 5}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the search form of the existing clients still works.
+	stream, err := orderClient.SearchOrders(context.Background(), &wrapper.StringValue{Value: "Amazon Echo"})
+	require.NoError(t, err)
+
+	ids = []string{}
+	for {
+		order, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		ids = append(ids, order.GetId())
+	}
+	require.ElementsMatch(t, []string{"105", "106", bobOrder}, ids)
+	require.True(t, sort.StringsAreSorted(ids))
+}
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"log"
+	"math/big"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxItemQuantity is the largest quantity of one order line.
+const maxItemQuantity = 1000
+
+// ProductCatalog is the call an OrderPricer makes to the ProductInfo catalog.
+// A pb.ProductInfoClient is one, and LocalProductCatalog() returns one.
+type ProductCatalog interface {
+	GetProduct(ctx context.Context, in *pb.ProductID, opts ...grpc.CallOption) (*pb.Product, error)
+}
+
+// LaptopCatalog is the call an OrderPricer makes to the LaptopService catalog.
+// A pb.LaptopServiceClient is one, and LocalLaptopCatalog() returns one.
+type LaptopCatalog interface {
+	GetLaptopByID(ctx context.Context, in *pb.GetLaptopByIDRequest, opts ...grpc.CallOption) (*pb.GetLaptopByIDResponse, error)
+}
+
+// OrderPricer computes the prices of an order from the current prices of the
+// ProductInfo and LaptopService catalogs, which it calls over gRPC, or
+// directly when they are hosted by the same server.
+type OrderPricer struct {
+	productClient ProductCatalog
+	laptopClient  LaptopCatalog
+	// taxRate is the tax added to the subtotal of the orders, 0.08 for 8%.
+	taxRate float64
+}
+
+// NewOrderPricer returns a new OrderPricer
+func NewOrderPricer(productClient ProductCatalog, laptopClient LaptopCatalog, taxRate float64) *OrderPricer {
+	return &OrderPricer{
+		productClient: productClient,
+		laptopClient:  laptopClient,
+		taxRate:       taxRate,
+	}
+}
+
+// DialProductCatalog() function connects to the ProductInfo catalog hosted by
+// another server.
+func DialProductCatalog(address string, creds credentials.TransportCredentials) (ProductCatalog, error) {
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewProductInfoClient(conn), nil
+}
+
+// DialLaptopCatalog() function connects to the LaptopService catalog hosted by
+// another server. The LaptopService requires authentication, so the API key,
+// when there is one, is sent with every call.
+func DialLaptopCatalog(address string, creds credentials.TransportCredentials, apiKey string) (LaptopCatalog, error) {
+	conn, err := grpc.Dial(
+		address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{},
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if apiKey != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", apiKey)
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return pb.NewLaptopServiceClient(conn), nil
+}
+
+// localProductCatalog calls a ProductInfo server hosted by the same server.
+type localProductCatalog struct {
+	server pb.ProductInfoServer
+}
+
+// LocalProductCatalog() function returns the ProductCatalog of a ProductInfo
+// server hosted by the same server, which is called without a connection.
+func LocalProductCatalog(server pb.ProductInfoServer) ProductCatalog {
+	return &localProductCatalog{server: server}
+}
+
+// GetProduct() function calls the ProductInfo server directly.
+func (catalog *localProductCatalog) GetProduct(ctx context.Context, in *pb.ProductID, _ ...grpc.CallOption) (*pb.Product, error) {
+	return catalog.server.GetProduct(ctx, in)
+}
+
+// localLaptopCatalog calls a LaptopService server hosted by the same server.
+type localLaptopCatalog struct {
+	server pb.LaptopServiceServer
+}
+
+// LocalLaptopCatalog() function returns the LaptopCatalog of a LaptopService
+// server hosted by the same server. It is called without a connection, so
+// with the tenant of the order in the context and without an API key.
+func LocalLaptopCatalog(server pb.LaptopServiceServer) LaptopCatalog {
+	return &localLaptopCatalog{server: server}
+}
+
+// GetLaptopByID() function calls the LaptopService server directly.
+func (catalog *localLaptopCatalog) GetLaptopByID(ctx context.Context, in *pb.GetLaptopByIDRequest, _ ...grpc.CallOption) (*pb.GetLaptopByIDResponse, error) {
+	return catalog.server.GetLaptopByID(ctx, in)
+}
+
+// catalogProduct is the name and the current unit price of a product.
+type catalogProduct struct {
+	name string
+	// price is the exact catalog price, the orders are priced in USD.
+	price *pb.Money
+	// weightKg is 0 when the catalog does not know the weight.
+	weightKg float64
+	// brand is the brand of a laptop, empty for the other products.
+	brand string
+}
+
+// Price() function resolves the line items of the order against the catalogs,
+// and sets the line totals, the subtotal, the tax and the total of the order.
+// The prices are exact Money amounts in whole cents, and the legacy doubles
+// are derived from them.
+// Invalid lines and unknown products are reported together, as an InvalidArgument
+// error with a field violation for each of them.
+// The laptops are those of the tenant carried by the context, which is sent
+// to the catalogs in the x-tenant-id metadata.
+func (pricer *OrderPricer) Price(ctx context.Context, order *pb.Order) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, tenantMetadataKey, TenantFromContext(ctx))
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	}
+
+	// the same product can appear on several lines, we look it up only once.
+	products := make(map[string]*catalogProduct)
+
+	for i, item := range order.GetLineItems() {
+		field := fmt.Sprintf("line_items[%d]", i)
+
+		if item.GetName() != "" || item.GetUnitPrice() != 0 || item.GetLineTotal() != 0 || item.GetWeightKg() != 0 || item.GetBrand() != "" ||
+			item.GetUnitAmount() != nil || item.GetLineAmount() != nil {
+			violation(field, "name, unit price, line total, weight and brand are set by the server")
+		}
+
+		if item.GetQuantity() < 1 || item.GetQuantity() > maxItemQuantity {
+			violation(field+".quantity", fmt.Sprintf("quantity must be between 1 and %d", maxItemQuantity))
+		}
+
+		key, field, err := pricer.lookup(ctx, item, field, products)
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			violation(field, "a product ID or a laptop ID is required")
+			continue
+		}
+
+		product := products[key]
+		if product == nil {
+			violation(field, key+" not found in the catalog")
+			continue
+		}
+
+		if currency := product.price.GetCurrencyCode(); currency != defaultCurrency {
+			violation(field, fmt.Sprintf("%s is priced in %q, orders are priced in %s", key, currency, defaultCurrency))
+			continue
+		}
+
+		unit, err := money.Scale(product.price, big.NewRat(1, 1))
+		if err != nil {
+			violation(field, fmt.Sprintf("cannot price %s: %v", key, err))
+			continue
+		}
+
+		line, err := money.Multiply(unit, int64(item.GetQuantity()))
+		if err != nil {
+			violation(field, fmt.Sprintf("cannot price %s: %v", key, err))
+			continue
+		}
+
+		item.Name = product.name
+		item.UnitAmount = unit
+		item.LineAmount = line
+		item.UnitPrice = usdToFloat(unit)
+		item.LineTotal = usdToFloat(line)
+		item.WeightKg = product.weightKg
+		item.Brand = product.brand
+	}
+
+	if len(violations) > 0 {
+		return invalidOrderFields(violations)
+	}
+
+	order.Items = nil
+	for _, item := range order.GetLineItems() {
+		order.Items = append(order.Items, item.GetName())
+	}
+
+	return setOrderTotals(order, &pb.Money{CurrencyCode: defaultCurrency}, pricer.taxRate)
+}
+
+// lookup() function finds the product of an order line in its catalog, and
+// caches it in products under the returned key. A product that does not exist
+// is cached as nil. The returned field is the one that references the product.
+func (pricer *OrderPricer) lookup(
+	ctx context.Context,
+	item *pb.OrderItem,
+	field string,
+	products map[string]*catalogProduct,
+) (string, string, error) {
+	switch product := item.GetProduct().(type) {
+	case *pb.OrderItem_ProductId:
+		key := "product/" + product.ProductId
+		if _, ok := products[key]; ok {
+			return key, field + ".product_id", nil
+		}
+
+		res, err := pricer.productClient.GetProduct(ctx, &pb.ProductID{Value: product.ProductId})
+		if status.Code(err) == codes.NotFound {
+			products[key] = nil
+			return key, field + ".product_id", nil
+		}
+		if err != nil {
+			return "", "", catalogError("ProductInfo", err)
+		}
+
+		products[key] = &catalogProduct{
+			name:  res.GetName(),
+			price: productPrice(res),
+			// a product linked to a laptop has its brand.
+			brand: res.GetLaptop().GetBrand(),
+		}
+		return key, field + ".product_id", nil
+
+	case *pb.OrderItem_LaptopId:
+		key := "laptop/" + product.LaptopId
+		if _, ok := products[key]; ok {
+			return key, field + ".laptop_id", nil
+		}
+
+		res, err := pricer.laptopClient.GetLaptopByID(ctx, &pb.GetLaptopByIDRequest{Id: product.LaptopId})
+		if status.Code(err) == codes.NotFound {
+			products[key] = nil
+			return key, field + ".laptop_id", nil
+		}
+		if err != nil {
+			return "", "", catalogError("LaptopService", err)
+		}
+
+		laptop := res.GetLaptop()
+		products[key] = &catalogProduct{
+			name:     laptop.GetBrand() + " " + laptop.GetName(),
+			price:    laptopPrice(laptop),
+			weightKg: laptopWeightKg(laptop),
+			brand:    laptop.GetBrand(),
+		}
+		return key, field + ".laptop_id", nil
+	}
+
+	return "", field, nil
+}
+
+// laptopWeightKg() function returns the weight of a laptop in kilograms.
+func laptopWeightKg(laptop *pb.Laptop) float64 {
+	if laptop.GetWeightLb() != 0 {
+		return laptop.GetWeightLb() * 0.45359237
+	}
+
+	return laptop.GetWeightKg()
+}
+
+// catalogError() function converts an error of a catalog call to the error of
+// the order request. The client sees which catalog failed, but not its details.
+func catalogError(catalog string, err error) error {
+	log.Printf("cannot call %s catalog: %v", catalog, err)
+
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return status.Error(status.Code(err), "the order request was cancelled")
+	}
+
+	return status.Errorf(codes.Unavailable, "cannot price the order: %s catalog is unavailable", catalog)
+}
+
+// invalidOrderFields() function returns an InvalidArgument error carrying the
+// field violations as a google.rpc.BadRequest detail.
+func invalidOrderFields(violations []*errdetails.BadRequest_FieldViolation) error {
+	st := status.Newf(codes.InvalidArgument, "order has %d invalid field(s), first: %s: %s",
+		len(violations), violations[0].GetField(), violations[0].GetDescription())
+
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// hasOrderTotals() function reports whether an order has a subtotal, a tax
+// or a total, which are computed by the server.
+func hasOrderTotals(order *pb.Order) bool {
+	return order.GetSubtotal() != 0 || order.GetTax() != 0 || order.GetTotal() != 0 ||
+		order.GetSubtotalAmount() != nil || order.GetTaxAmount() != nil || order.GetTotalAmount() != nil
+}
+
+// clearOrderTotals() function clears the subtotal, the tax and the total of an order.
+func clearOrderTotals(order *pb.Order) {
+	order.Subtotal, order.SubtotalAmount = 0, nil
+	order.Tax, order.TaxAmount = 0, nil
+	order.Total, order.TotalAmount = 0, nil
+}
+
+// setOrderTotals() function sets the subtotal of an order priced by the
+// server to the sum of its line amounts, the tax to the tax rate of the
+// subtotal minus the discount, rounded to the cent, and the total and the
+// amount to the taxed subtotal. The legacy doubles and price are derived from
+// the exact amounts.
+func setOrderTotals(order *pb.Order, discount *pb.Money, taxRate float64) error {
+	subtotal := &pb.Money{CurrencyCode: defaultCurrency}
+	for _, item := range order.GetLineItems() {
+		var err error
+		subtotal, err = money.Add(subtotal, item.GetLineAmount())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot price the order: %v", err)
+		}
+	}
+
+	taxable, err := money.Subtract(subtotal, discount)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot price the order: %v", err)
+	}
+
+	tax, err := money.Scale(taxable, ratFromFloat(taxRate))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot price the order: %v", err)
+	}
+
+	total, err := money.Add(taxable, tax)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "cannot price the order: %v", err)
+	}
+
+	order.SubtotalAmount = subtotal
+	order.DiscountAmount = discount
+	order.TaxAmount = tax
+	order.TotalAmount = total
+	order.Amount = proto.Clone(total).(*pb.Money)
+
+	order.Subtotal = usdToFloat(subtotal)
+	order.Discount = usdToFloat(discount)
+	order.Tax = usdToFloat(tax)
+	order.Total = usdToFloat(total)
+	order.Price = float32(order.GetTotal())
+
+	return nil
+}
+
+// ratFromFloat() function returns the decimal value of a float, which is 0.0825
+// for a tax rate of 0.0825, rather than its binary approximation. It returns 0
+// when the float is not finite.
+func ratFromFloat(value float64) *big.Rat {
+	rate, ok := new(big.Rat).SetString(strconv.FormatFloat(value, 'f', -1, 64))
+	if !ok {
+		return new(big.Rat)
+	}
+
+	return rate
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// runningPromotions() function returns the promotions that can be applied to
+// a new order placed at the given time.
+func (server *OrderManagementServer) runningPromotions(ctx context.Context, at time.Time) ([]*pb.Promotion, error) {
+	if server.promotionStore == nil {
+		return nil, nil
+	}
+
+	var promotions []*pb.Promotion
+	err := server.promotionStore.List(ctx, func(promotion *pb.Promotion) error {
+		if promotionRunning(promotion, at) {
+			promotions = append(promotions, promotion)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list promotions: %v", err)
+	}
+
+	return promotions, nil
+}
+
+// appliedPromotions() function returns the promotions applied to an order,
+// whether they are still running or not.
+func (server *OrderManagementServer) appliedPromotions(ctx context.Context, order *pb.Order) ([]*pb.Promotion, error) {
+	if server.promotionStore == nil {
+		return nil, nil
+	}
+
+	var promotions []*pb.Promotion
+	for _, applied := range order.GetPromotions() {
+		promotion, err := server.promotionStore.Find(ctx, applied.GetPromotionId())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot find promotion: %v", err)
+		}
+		if promotion != nil {
+			promotions = append(promotions, promotion)
+		}
+	}
+
+	return promotions, nil
+}
+
+// promoteOrder() function applies the promotions to an order priced by the server.
+func (server *OrderManagementServer) promoteOrder(order *pb.Order, promotions []*pb.Promotion) error {
+	if server.pricer == nil || server.promotionStore == nil || len(order.GetLineItems()) == 0 {
+		return nil
+	}
+
+	return applyPromotions(order, promotions, server.pricer.taxRate)
+}
+
+// redeemPromotions() function counts a use of the promotions applied to a new order.
+func (server *OrderManagementServer) redeemPromotions(ctx context.Context, order *pb.Order) error {
+	if len(order.GetPromotions()) == 0 {
+		return nil
+	}
+
+	err := server.promotionStore.Redeem(ctx, promotionIDs(order))
+	if errors.Is(err, ErrUsageLimitReached) {
+		return status.Errorf(codes.Aborted, "a promotion of the order reached its usage limit, the order must be placed again")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "cannot redeem the promotions of the order: %v", err)
+	}
+
+	return nil
+}
+
+// unredeemPromotions() function takes back the uses of the promotions of an
+// order that could not be placed.
+func (server *OrderManagementServer) unredeemPromotions(ctx context.Context, order *pb.Order) {
+	if len(order.GetPromotions()) == 0 {
+		return
+	}
+
+	err := server.promotionStore.Unredeem(ctx, promotionIDs(order))
+	if err != nil {
+		log.Printf("cannot unredeem the promotions of order %s: %v", order.GetId(), err)
+	}
+}
+
+func promotionIDs(order *pb.Order) []string {
+	ids := make([]string, 0, len(order.GetPromotions()))
+	for _, applied := range order.GetPromotions() {
+		ids = append(ids, applied.GetPromotionId())
+	}
+
+	return ids
+}
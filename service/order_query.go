@@ -0,0 +1,274 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"strings"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// defaultOrderPageSize is the number of orders of a page when the query does not say.
+	defaultOrderPageSize = 50
+	// maxOrderPageSize is the largest number of orders of a page.
+	maxOrderPageSize = 500
+)
+
+// validateOrderQuery() function checks the criteria of a query, and returns an
+// InvalidArgument error describing the first invalid one.
+func validateOrderQuery(query *pb.OrderQuery) error {
+	for _, bound := range []*wrapper.DoubleValue{query.GetMinPrice(), query.GetMaxPrice()} {
+		if bound != nil && usdFromFloat(bound.GetValue(), 64) == nil {
+			return status.Errorf(codes.InvalidArgument, "price bound %v is invalid", bound.GetValue())
+		}
+	}
+
+	if query.GetMinPrice() != nil && query.GetMaxPrice() != nil &&
+		query.GetMinPrice().GetValue() > query.GetMaxPrice().GetValue() {
+		return status.Errorf(codes.InvalidArgument, "min price is greater than max price")
+	}
+
+	if query.GetCreatedAfter() != nil && query.GetCreatedBefore() != nil &&
+		!query.GetCreatedAfter().AsTime().Before(query.GetCreatedBefore().AsTime()) {
+		return status.Errorf(codes.InvalidArgument, "created after must be before created before")
+	}
+
+	if query.GetPageSize() < 0 {
+		return status.Errorf(codes.InvalidArgument, "page size cannot be negative")
+	}
+
+	if _, ok := pb.OrderQuery_SortField_name[int32(query.GetSortBy())]; !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown sort field %d", query.GetSortBy())
+	}
+
+	return nil
+}
+
+// orderPageSize() function returns the page size of the query.
+func orderPageSize(query *pb.OrderQuery) int {
+	size := int(query.GetPageSize())
+	if size == 0 {
+		return defaultOrderPageSize
+	}
+
+	if size > maxOrderPageSize {
+		return maxOrderPageSize
+	}
+
+	return size
+}
+
+// compareOrderAmount() function compares the amount of an order with a price
+// bound of a query, exactly. ok is false when they cannot be compared, such as
+// when the order is not in USD.
+func compareOrderAmount(order *pb.Order, bound *wrapper.DoubleValue) (int, bool) {
+	cmp, err := money.Compare(orderMoney(order), usdFromFloat(bound.GetValue(), 64))
+	return cmp, err == nil
+}
+
+// orderMatches() function reports whether the order matches every criterion of the query.
+func orderMatches(order *pb.Order, query *pb.OrderQuery) bool {
+	if query.GetItem() != "" && !hasItem(order, query.GetItem()) {
+		return false
+	}
+
+	if query.GetDestination() != "" && !containsFold(order.GetDestination(), query.GetDestination()) {
+		return false
+	}
+
+	if query.GetMinPrice() != nil {
+		if cmp, ok := compareOrderAmount(order, query.GetMinPrice()); !ok || cmp < 0 {
+			return false
+		}
+	}
+	if query.GetMaxPrice() != nil {
+		if cmp, ok := compareOrderAmount(order, query.GetMaxPrice()); !ok || cmp > 0 {
+			return false
+		}
+	}
+
+	if len(query.GetStatuses()) > 0 && !hasStatus(query.GetStatuses(), order.GetStatus()) {
+		return false
+	}
+
+	createdAt := order.GetCreatedAt().AsTime()
+	if query.GetCreatedAfter() != nil && createdAt.Before(query.GetCreatedAfter().AsTime()) {
+		return false
+	}
+	if query.GetCreatedBefore() != nil && !createdAt.Before(query.GetCreatedBefore().AsTime()) {
+		return false
+	}
+
+	if query.GetCustomer() != "" && order.GetCustomer() != query.GetCustomer() {
+		return false
+	}
+
+	return true
+}
+
+// hasItem() function reports whether one of the items of the order contains the text, ignoring case.
+func hasItem(order *pb.Order, text string) bool {
+	for _, item := range order.GetItems() {
+		if containsFold(item, text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasStatus(statuses []pb.Order_Status, orderStatus pb.Order_Status) bool {
+	for _, s := range statuses {
+		if s == orderStatus {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// orderCursor is the position of an order in the sort order of a query.
+// Page tokens carry the cursor of the last order of the page.
+type orderCursor struct {
+	ID        string    `json:"id"`
+	CreatedAt int64     `json:"created_at,omitempty"`
+	Amount    *pb.Money `json:"amount,omitempty"`
+}
+
+func newOrderCursor(order *pb.Order) orderCursor {
+	return orderCursor{
+		ID:        order.GetId(),
+		CreatedAt: order.GetCreatedAt().AsTime().UnixNano(),
+		Amount:    orderMoney(order),
+	}
+}
+
+// compareOrderCursors() function returns -1, 0 or 1 when a sorts before, with, or after b.
+func compareOrderCursors(a, b orderCursor, sortBy pb.OrderQuery_SortField, descending bool) int {
+	result := 0
+
+	switch sortBy {
+	case pb.OrderQuery_CREATED_AT:
+		result = compareValues(a.CreatedAt < b.CreatedAt, a.CreatedAt > b.CreatedAt)
+	case pb.OrderQuery_PRICE:
+		result = compareAmounts(a.Amount, b.Amount)
+	}
+
+	// orders with the same sort value are sorted by ID, so that the order is total.
+	if result == 0 {
+		result = compareValues(a.ID < b.ID, a.ID > b.ID)
+	}
+
+	if descending {
+		return -result
+	}
+
+	return result
+}
+
+// compareAmounts() function compares two order amounts exactly. The amounts
+// of different currencies cannot be compared, they are sorted by currency.
+func compareAmounts(a, b *pb.Money) int {
+	if a.GetCurrencyCode() != b.GetCurrencyCode() {
+		return strings.Compare(a.GetCurrencyCode(), b.GetCurrencyCode())
+	}
+
+	cmp, _ := money.Compare(a, b)
+	return cmp
+}
+
+func compareValues(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+
+	return 0
+}
+
+// lessOrders() function returns the less function sorting orders as the query asks.
+func lessOrders(query *pb.OrderQuery) func(a, b *pb.Order) bool {
+	return func(a, b *pb.Order) bool {
+		return compareOrderCursors(newOrderCursor(a), newOrderCursor(b), query.GetSortBy(), query.GetDescending()) < 0
+	}
+}
+
+// orderPageToken is the content of a page token. It is tied to the criteria
+// of the query, so that it cannot be used with another query.
+type orderPageToken struct {
+	QueryHash string      `json:"query_hash"`
+	After     orderCursor `json:"after"`
+}
+
+// queryHash() function hashes the criteria and the sort of a query, without its pagination.
+func queryHash(query *pb.OrderQuery) (string, error) {
+	criteria := proto.Clone(query).(*pb.OrderQuery)
+	criteria.PageSize = 0
+	criteria.PageToken = ""
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(criteria)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(hash[:12]), nil
+}
+
+// encodeOrderPageToken() function returns the token of the page following the order.
+func encodeOrderPageToken(query *pb.OrderQuery, last *pb.Order) (string, error) {
+	hash, err := queryHash(query)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(orderPageToken{QueryHash: hash, After: newOrderCursor(last)})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeOrderPageToken() function returns the cursor of the page token of the
+// query, or nil if the query asks for the first page.
+func decodeOrderPageToken(query *pb.OrderQuery) (*orderCursor, error) {
+	if query.GetPageToken() == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(query.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+
+	token := orderPageToken{}
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+
+	hash, err := queryHash(query)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot hash query: %v", err)
+	}
+
+	if token.QueryHash != hash {
+		return nil, status.Errorf(codes.InvalidArgument, "page token was issued for a different query")
+	}
+
+	return &token.After, nil
+}
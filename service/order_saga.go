@@ -0,0 +1,525 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	cancelOrderSaga = "cancel_order"
+	refundOrderSaga = "refund_order"
+)
+
+// orderSaga is a cancellation or a refund of an order, run as a list of steps.
+// Every step is recorded in the saga log once it is done, so that the saga can
+// be resumed after a crash. Every step can run again safely.
+type orderSaga struct {
+	id   string
+	kind string
+	// tenant is the tenant of the order, whose context the steps run in.
+	tenant  string
+	orderID string
+	actor   string
+	reason  string
+	// amount is what the order is refunded, if it was paid.
+	amount *pb.Money
+	paid   bool
+	// done is the names of the steps that are done.
+	done map[string]bool
+}
+
+// sagaStep is one step of a saga.
+type sagaStep struct {
+	name string
+	run  func(ctx context.Context) error
+	// compensate undoes the step when the saga is rolled back. It is nil for
+	// the steps with nothing to undo.
+	compensate func(ctx context.Context) error
+	// pivot is set on the step after which the saga can no longer be rolled
+	// back. Once it is done, the saga must go forward until it completes.
+	pivot bool
+}
+
+// CancelOrder is a unary RPC that cancels an order with a saga: the order is
+// cancelled, its reserved stock is released, it is removed from the shipments
+// being combined, and it is refunded if it was paid.
+func (server *OrderManagementServer) CancelOrder(ctx context.Context, req *pb.CancelOrderRequest) (*pb.CancelOrderResponse, error) {
+	log.Printf("received a cancel-order request: id = %s", req.GetOrderId())
+
+	saga, err := server.startOrderSaga(ctx, cancelOrderSaga, req.GetOrderId(), req.GetReason())
+	if err != nil {
+		return nil, err
+	}
+
+	order, refund, err := server.finishOrderSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.CancelOrderResponse{Order: order, Refund: refund}, nil
+}
+
+// RefundOrder is a unary RPC that refunds a delivered order, or a paid order
+// that was cancelled without being refunded. The refund is recorded before the
+// order becomes refunded, and voided if the order cannot become refunded.
+func (server *OrderManagementServer) RefundOrder(ctx context.Context, req *pb.RefundOrderRequest) (*pb.RefundOrderResponse, error) {
+	log.Printf("received a refund-order request: id = %s", req.GetOrderId())
+
+	saga, err := server.startOrderSaga(ctx, refundOrderSaga, req.GetOrderId(), req.GetReason())
+	if err != nil {
+		return nil, err
+	}
+
+	order, refund, err := server.finishOrderSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RefundOrderResponse{Order: order, Refund: refund}, nil
+}
+
+// startOrderSaga() function checks that the order can be cancelled or refunded,
+// and records the start of the saga. Only one saga can run for an order at a time.
+func (server *OrderManagementServer) startOrderSaga(ctx context.Context, kind, orderID, reason string) (*orderSaga, error) {
+	actor, err := orderActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := server.orderStore.Find(ctx, orderID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find order: %v", err)
+	}
+	if order == nil {
+		return nil, status.Errorf(codes.NotFound, "order %s not found", orderID)
+	}
+
+	to := pb.Order_CANCELLED
+	if kind == refundOrderSaga {
+		to = pb.Order_REFUNDED
+	}
+
+	err = canTransitionOrder(order, to)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate saga id: %v", err)
+	}
+
+	saga := &orderSaga{
+		id:      id.String(),
+		kind:    kind,
+		tenant:  TenantFromContext(ctx),
+		orderID: orderID,
+		actor:   actor,
+		reason:  reason,
+		amount:  orderPaid(order),
+		paid:    wasOrderPaid(order),
+		done:    make(map[string]bool),
+	}
+
+	if !server.lockOrderSaga(saga) {
+		return nil, status.Errorf(codes.Aborted, "order %s is already being cancelled or refunded", orderID)
+	}
+
+	err = server.sagaLog.Append(&SagaRecord{
+		SagaID:       saga.id,
+		Event:        SagaStarted,
+		Kind:         saga.kind,
+		Tenant:       saga.tenant,
+		OrderID:      saga.orderID,
+		Actor:        saga.actor,
+		Reason:       saga.reason,
+		Amount:       money.ToFloat(saga.amount),
+		RefundAmount: saga.amount,
+		Paid:         saga.paid,
+	})
+	if err != nil {
+		server.unlockOrderSaga(saga)
+		return nil, status.Errorf(codes.Internal, "cannot record saga: %v", err)
+	}
+
+	return saga, nil
+}
+
+// finishOrderSaga() function runs the saga, and returns the order and its refund.
+func (server *OrderManagementServer) finishOrderSaga(ctx context.Context, saga *orderSaga) (*pb.Order, *pb.Refund, error) {
+	defer server.unlockOrderSaga(saga)
+
+	err := server.runOrderSaga(ctx, saga)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := server.orderStore.Find(ContextWithTenant(ctx, saga.tenant), saga.orderID)
+	if err != nil || order == nil {
+		return nil, nil, status.Errorf(codes.Internal, "cannot find order %s: %v", saga.orderID, err)
+	}
+
+	var refund *pb.Refund
+	if saga.refunds() {
+		refund, err = server.refundLedger.Find(saga.id)
+		if err != nil {
+			return nil, nil, status.Errorf(codes.Internal, "cannot find refund: %v", err)
+		}
+	}
+
+	return order, refund, nil
+}
+
+// lockOrderSaga() function marks the order of the saga as having a saga running.
+// It returns false if another saga is already running for the order.
+func (server *OrderManagementServer) lockOrderSaga(saga *orderSaga) bool {
+	server.sagaMutex.Lock()
+	defer server.sagaMutex.Unlock()
+
+	if _, ok := server.activeSagas[saga.orderKey()]; ok {
+		return false
+	}
+
+	server.activeSagas[saga.orderKey()] = saga.id
+	return true
+}
+
+func (server *OrderManagementServer) unlockOrderSaga(saga *orderSaga) {
+	server.sagaMutex.Lock()
+	defer server.sagaMutex.Unlock()
+
+	if server.activeSagas[saga.orderKey()] == saga.id {
+		delete(server.activeSagas, saga.orderKey())
+	}
+}
+
+// orderKey() function returns the key of the order of the saga, which is only
+// unique within its tenant.
+func (saga *orderSaga) orderKey() string {
+	return saga.tenant + "/" + saga.orderID
+}
+
+// refunds() function reports whether the saga refunds the order.
+func (saga *orderSaga) refunds() bool {
+	return saga.kind == refundOrderSaga || saga.paid
+}
+
+// orderSagaSteps() function returns the steps of the saga.
+//
+// A cancellation moves the order to cancelled first, which is its pivot, since
+// a cancelled order cannot go back. The other steps can then always be retried.
+// A refund records the refund first, which is voided if the order cannot be
+// moved to refunded, its pivot.
+func (server *OrderManagementServer) orderSagaSteps(saga *orderSaga) []sagaStep {
+	recordRefund := sagaStep{
+		name: "record_refund",
+		run: func(ctx context.Context) error {
+			return server.refundLedger.Record(&pb.Refund{
+				Id:           saga.id,
+				OrderId:      saga.orderID,
+				Amount:       money.ToFloat(saga.amount),
+				RefundAmount: saga.amount,
+				Time:         timestamppb.Now(),
+				Reason:       saga.reason,
+			})
+		},
+		compensate: func(ctx context.Context) error {
+			return server.refundLedger.Void(saga.id)
+		},
+	}
+	markRefunded := sagaStep{
+		name: "mark_refunded",
+		run: func(ctx context.Context) error {
+			return server.sagaTransition(ctx, saga, pb.Order_REFUNDED)
+		},
+	}
+
+	if saga.kind == refundOrderSaga {
+		markRefunded.pivot = true
+		return []sagaStep{recordRefund, markRefunded}
+	}
+
+	steps := []sagaStep{
+		{
+			name: "cancel_order",
+			run: func(ctx context.Context) error {
+				return server.sagaTransition(ctx, saga, pb.Order_CANCELLED)
+			},
+			pivot: true,
+		},
+		{
+			name: "release_stock",
+			run: func(ctx context.Context) error {
+				return server.stockReservations.Release(ctx, saga.orderID)
+			},
+		},
+		{
+			name: "remove_from_shipments",
+			run: func(ctx context.Context) error {
+				removed := server.shipments.removeOrder(saga.tenant, saga.orderID)
+				log.Printf("order %s removed from %d pending shipment(s)", saga.orderID, removed)
+				return nil
+			},
+		},
+	}
+
+	if saga.paid {
+		// after the pivot, there is no need to void the refund.
+		recordRefund.compensate = nil
+		steps = append(steps, recordRefund, markRefunded)
+	}
+
+	return steps
+}
+
+// sagaTransition() function moves the order of the saga to the given status.
+// A transition the saga has already made is not made again.
+func (server *OrderManagementServer) sagaTransition(ctx context.Context, saga *orderSaga, to pb.Order_Status) error {
+	err := server.orderStore.Update(ctx, saga.orderID, func(order *pb.Order) error {
+		for _, transition := range order.GetHistory() {
+			if transition.GetSagaId() == saga.id && transition.GetTo() == to {
+				return nil
+			}
+		}
+
+		err := transitionOrder(order, to, saga.actor, saga.reason, time.Now())
+		if err != nil {
+			return err
+		}
+
+		order.History[len(order.History)-1].SagaId = saga.id
+		server.queueOrderEvent(ctx, pb.OrderEvent_STATUS_CHANGED, order, nil)
+		return nil
+	})
+	server.flushOrderEvents()
+
+	return err
+}
+
+// runOrderSaga() function runs the steps of the saga that are not done yet.
+//
+// If a step fails before the pivot is done, the steps already done are
+// compensated in reverse order, and the saga is rolled back. If a step fails
+// after the pivot, the saga stays unfinished so that it is resumed later,
+// unless the error shows that retrying cannot help.
+func (server *OrderManagementServer) runOrderSaga(ctx context.Context, saga *orderSaga) error {
+	// a resumed saga has no caller, so the steps run in the tenant of the order.
+	ctx = ContextWithTenant(ctx, saga.tenant)
+	steps := server.orderSagaSteps(saga)
+
+	pivotDone := false
+	for _, step := range steps {
+		if step.pivot && saga.done[step.name] {
+			pivotDone = true
+		}
+	}
+
+	for i, step := range steps {
+		if saga.done[step.name] {
+			continue
+		}
+
+		err := step.run(ctx)
+		if err != nil {
+			err = orderUpdateError(saga.orderID, err)
+			log.Printf("saga %s: step %s failed: %v", saga.id, step.name, err)
+
+			if !pivotDone {
+				return server.rollBackOrderSaga(ctx, saga, steps[:i], err)
+			}
+
+			if retryableSagaError(err) {
+				return status.Errorf(codes.Unavailable, "the %s of order %s will be resumed: %v", saga.kind, saga.orderID, err)
+			}
+
+			server.appendSagaRecord(&SagaRecord{SagaID: saga.id, Event: SagaFailed, Step: step.name, Error: err.Error()})
+			return err
+		}
+
+		saga.done[step.name] = true
+		err = server.sagaLog.Append(&SagaRecord{SagaID: saga.id, Event: SagaStepDone, Step: step.name})
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "cannot record saga step, it will be resumed: %v", err)
+		}
+
+		if step.pivot {
+			pivotDone = true
+		}
+	}
+
+	err := server.sagaLog.Append(&SagaRecord{SagaID: saga.id, Event: SagaCompleted})
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot record saga completion, it will be resumed: %v", err)
+	}
+
+	log.Printf("saga %s: %s of order %s completed", saga.id, saga.kind, saga.orderID)
+	return nil
+}
+
+// rollBackOrderSaga() function compensates the steps that are done, in reverse
+// order, and returns the error that made the saga roll back.
+func (server *OrderManagementServer) rollBackOrderSaga(ctx context.Context, saga *orderSaga, steps []sagaStep, cause error) error {
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if !saga.done[step.name] || step.compensate == nil {
+			continue
+		}
+
+		err := step.compensate(ctx)
+		if err != nil {
+			log.Printf("saga %s: cannot compensate step %s: %v", saga.id, step.name, err)
+			return status.Errorf(codes.Unavailable, "the %s of order %s will be rolled back later: %v", saga.kind, saga.orderID, cause)
+		}
+
+		delete(saga.done, step.name)
+		server.appendSagaRecord(&SagaRecord{SagaID: saga.id, Event: SagaStepCompensated, Step: step.name})
+	}
+
+	server.appendSagaRecord(&SagaRecord{SagaID: saga.id, Event: SagaRolledBack, Error: cause.Error()})
+	log.Printf("saga %s: %s of order %s rolled back", saga.id, saga.kind, saga.orderID)
+	return cause
+}
+
+// appendSagaRecord() function appends a record whose loss is harmless, since
+// the saga would only be resumed or rolled back again.
+func (server *OrderManagementServer) appendSagaRecord(record *SagaRecord) {
+	err := server.sagaLog.Append(record)
+	if err != nil {
+		log.Printf("cannot record saga %s %s: %v", record.SagaID, record.Event, err)
+	}
+}
+
+// retryableSagaError() function reports whether a failed step may succeed later.
+func retryableSagaError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.DeadlineExceeded, codes.Canceled, codes.Aborted, codes.Unknown:
+		return true
+	}
+
+	return false
+}
+
+// ResumeOrderSagas resumes the sagas the saga log has as unfinished, which were
+// interrupted by a crash. It is called when the server starts, if its orders
+// and refunds outlived the crash (see AbandonOrderSagas). Every saga is
+// resumed from its last recorded step, or rolled back if its pivot was not done
+// and a step fails. It returns the errors of the sagas that are still unfinished.
+func (server *OrderManagementServer) ResumeOrderSagas(ctx context.Context) error {
+	unfinished, err := server.sagaLog.Unfinished()
+	if err != nil {
+		return fmt.Errorf("cannot read saga log: %w", err)
+	}
+
+	var errs []error
+	for _, records := range unfinished {
+		saga := orderSagaFromRecords(records)
+		log.Printf("resuming saga %s: %s of order %s", saga.id, saga.kind, saga.orderID)
+
+		if !server.lockOrderSaga(saga) {
+			continue
+		}
+
+		err := server.runOrderSaga(ctx, saga)
+		server.unlockOrderSaga(saga)
+
+		if retryableSagaError(err) {
+			errs = append(errs, fmt.Errorf("saga %s: %w", saga.id, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d saga(s) still unfinished, first: %w", len(errs), errs[0])
+	}
+
+	return nil
+}
+
+// AbandonOrderSagas records the sagas the saga log has as unfinished as
+// failed, without running them, and returns how many it abandoned. It is
+// called when the server starts, instead of ResumeOrderSagas, when the orders
+// and the refunds were lost with the previous process, as with the in-memory
+// stores: resuming the sagas would change the new orders that reuse the IDs
+// of the lost ones, or mark an order refunded without its refund.
+func (server *OrderManagementServer) AbandonOrderSagas() (int, error) {
+	unfinished, err := server.sagaLog.Unfinished()
+	if err != nil {
+		return 0, fmt.Errorf("cannot read saga log: %w", err)
+	}
+
+	for i, records := range unfinished {
+		saga := orderSagaFromRecords(records)
+		log.Printf("abandoning saga %s: %s of order %s", saga.id, saga.kind, saga.orderID)
+
+		err := server.sagaLog.Append(&SagaRecord{
+			SagaID: saga.id,
+			Event:  SagaFailed,
+			Error:  "abandoned at startup: the orders and refunds of the saga were not kept",
+		})
+		if err != nil {
+			return i, fmt.Errorf("cannot record saga %s: %w", saga.id, err)
+		}
+	}
+
+	return len(unfinished), nil
+}
+
+// orderSagaFromRecords() function rebuilds a saga from its records in the saga log.
+func orderSagaFromRecords(records []*SagaRecord) *orderSaga {
+	started := records[0]
+	saga := &orderSaga{
+		id:      started.SagaID,
+		kind:    started.Kind,
+		tenant:  started.Tenant,
+		orderID: started.OrderID,
+		actor:   started.Actor,
+		reason:  started.Reason,
+		amount:  started.RefundAmount,
+		paid:    started.Paid,
+		done:    make(map[string]bool),
+	}
+
+	// the sagas recorded before orders had tenants are those of the default tenant.
+	if saga.tenant == "" {
+		saga.tenant = DefaultTenant
+	}
+
+	// the sagas recorded before the exact amounts only have the amount in USD.
+	if saga.amount == nil && started.Amount != 0 {
+		saga.amount = usdFromFloat(started.Amount, 64)
+	}
+
+	for _, record := range records[1:] {
+		switch record.Event {
+		case SagaStepDone:
+			saga.done[record.Step] = true
+		case SagaStepCompensated:
+			delete(saga.done, record.Step)
+		}
+	}
+
+	return saga
+}
+
+// orderPaid() function returns the exact amount paid for an order, which is
+// the total of an order priced by the server.
+func orderPaid(order *pb.Order) *pb.Money {
+	if order.GetTotalAmount() != nil {
+		return order.GetTotalAmount()
+	}
+
+	// the orders priced before the exact amounts only have a total in USD.
+	if order.GetTotal() != 0 {
+		return usdFromFloat(order.GetTotal(), 64)
+	}
+
+	return orderMoney(order)
+}
@@ -0,0 +1,246 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCancelAndRefundOrder(t *testing.T) {
+	t.Parallel()
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	stockReservations := service.NewInMemoryStockReservations()
+	refundLedger := service.NewInMemoryRefundLedger()
+	server := service.NewOrderManagementServer(
+		orderStore,
+		service.WithShipmentBatching(10, time.Hour),
+		service.WithStockReservations(stockReservations),
+		service.WithRefundLedger(refundLedger),
+	)
+	orderClient := newTestOrderClient(t, server)
+
+	transition := func(id string, statuses ...pb.Order_Status) {
+		for _, to := range statuses {
+			_, err := server.TransitionOrder(adminContext(), &pb.TransitionOrderRequest{OrderId: id, Status: to})
+			require.NoError(t, err)
+		}
+	}
+
+	// a pending order is removed from the shipment being filled, and its stock is released.
+	require.NoError(t, stockReservations.Reserve(context.Background(), "102", "laptop-1", 2))
+
+	stream, err := orderClient.ProcessOrders(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&wrapper.StringValue{Value: "102"}))
+	require.NoError(t, stream.Send(&wrapper.StringValue{Value: "104"}))
+
+	// the orders are in the shipment once ProcessOrders has answered the next order ID.
+	require.NoError(t, stream.Send(&wrapper.StringValue{Value: "999"}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "999", res.GetError().GetOrderId())
+
+	cancelled, err := orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: "102", Reason: "changed my mind"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_CANCELLED, cancelled.GetOrder().GetStatus())
+	require.Nil(t, cancelled.GetRefund())
+	require.Zero(t, stockReservations.Reserved(context.Background(), "laptop-1"))
+
+	// a cancelled order cannot be processed again.
+	require.NoError(t, stream.Send(&wrapper.StringValue{Value: "102"}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "order is CANCELLED", res.GetError().GetMessage())
+
+	require.NoError(t, stream.CloseSend())
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.GetShipment().GetOrdersList(), 1)
+	require.Equal(t, "104", res.GetShipment().GetOrdersList()[0].GetId())
+
+	// a paid order is cancelled and refunded.
+	transition("103", pb.Order_PAID, pb.Order_PACKED)
+	cancelled, err = orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: "103"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_REFUNDED, cancelled.GetOrder().GetStatus())
+	require.Equal(t, 400.0, cancelled.GetRefund().GetAmount())
+	require.True(t, proto.Equal(usd(t, "400"), cancelled.GetRefund().GetRefundAmount()))
+
+	// every transition of the saga is tagged with its ID.
+	history := cancelled.GetOrder().GetHistory()
+	require.Equal(t, cancelled.GetRefund().GetId(), history[len(history)-1].GetSagaId())
+	require.Equal(t, cancelled.GetRefund().GetId(), history[len(history)-2].GetSagaId())
+
+	// a shipped order cannot be cancelled, but it can be refunded once delivered.
+	transition("105", pb.Order_PAID, pb.Order_PACKED, pb.Order_SHIPPED)
+	_, err = orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: "105"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = orderClient.RefundOrder(context.Background(), &pb.RefundOrderRequest{OrderId: "105"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	transition("105", pb.Order_DELIVERED)
+	refunded, err := orderClient.RefundOrder(context.Background(), &pb.RefundOrderRequest{OrderId: "105", Reason: "broken"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_REFUNDED, refunded.GetOrder().GetStatus())
+	require.Equal(t, "broken", refunded.GetRefund().GetReason())
+
+	_, err = orderClient.RefundOrder(context.Background(), &pb.RefundOrderRequest{OrderId: "105"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	refunds, err := refundLedger.FindByOrder("105")
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+
+	_, err = orderClient.CancelOrder(context.Background(), &pb.CancelOrderRequest{OrderId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// crashingSagaLog stops recording once a given step is done, like a server crashing.
+type crashingSagaLog struct {
+	service.SagaLog
+	crashAfter string
+	crashed    bool
+}
+
+func (sagaLog *crashingSagaLog) Append(record *service.SagaRecord) error {
+	if sagaLog.crashed {
+		return errors.New("crashed")
+	}
+
+	err := sagaLog.SagaLog.Append(record)
+	if record.Event == service.SagaStepDone && record.Step == sagaLog.crashAfter {
+		sagaLog.crashed = true
+	}
+	return err
+}
+
+func TestResumeOrderSagas(t *testing.T) {
+	t.Parallel()
+
+	sagaLogPath := filepath.Join(t.TempDir(), "saga", "orders.jsonl")
+	openSagaLog := func() *service.FileSagaLog {
+		sagaLog, err := service.NewFileSagaLog(sagaLogPath)
+		require.NoError(t, err)
+		t.Cleanup(func() { sagaLog.Close() })
+		return sagaLog
+	}
+
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	refundLedger := service.NewInMemoryRefundLedger()
+
+	transition := func(server *service.OrderManagementServer, id string, statuses ...pb.Order_Status) {
+		for _, to := range statuses {
+			_, err := server.TransitionOrder(adminContext(), &pb.TransitionOrderRequest{OrderId: id, Status: to})
+			require.NoError(t, err)
+		}
+	}
+
+	// the server crashes in the middle of a cancellation, after its pivot.
+	sagaLog := &crashingSagaLog{SagaLog: openSagaLog(), crashAfter: "cancel_order"}
+	server := service.NewOrderManagementServer(orderStore, service.WithSagaLog(sagaLog), service.WithRefundLedger(refundLedger))
+	transition(server, "102", pb.Order_PAID)
+
+	_, err := server.CancelOrder(adminContext(), &pb.CancelOrderRequest{OrderId: "102"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	order, err := server.GetOrder(context.Background(), &wrapper.StringValue{Value: "102"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_CANCELLED, order.GetStatus())
+
+	// and in the middle of a refund, before its pivot is recorded.
+	sagaLog.crashed = false
+	sagaLog.crashAfter = "record_refund"
+	transition(server, "103", pb.Order_PAID, pb.Order_PACKED, pb.Order_SHIPPED, pb.Order_DELIVERED)
+	_, err = server.RefundOrder(adminContext(), &pb.RefundOrderRequest{OrderId: "103"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// meanwhile, order 103 is lost, so its refund cannot go on.
+	restartedStore := service.NewInMemoryOrderStore()
+	order102, err := orderStore.Find(context.Background(), "102")
+	require.NoError(t, err)
+	require.NoError(t, restartedStore.Save(context.Background(), order102))
+
+	// after the restart, the cancellation completes and the refund rolls back.
+	server = service.NewOrderManagementServer(restartedStore, service.WithSagaLog(openSagaLog()), service.WithRefundLedger(refundLedger))
+	require.NoError(t, server.ResumeOrderSagas(context.Background()))
+
+	order, err = server.GetOrder(context.Background(), &wrapper.StringValue{Value: "102"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_REFUNDED, order.GetStatus())
+
+	refunds, err := refundLedger.FindByOrder("102")
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.False(t, refunds[0].GetVoided())
+
+	refunds, err = refundLedger.FindByOrder("103")
+	require.NoError(t, err)
+	require.Len(t, refunds, 1)
+	require.True(t, refunds[0].GetVoided())
+
+	// both sagas are finished, so the compacted log is empty on the next start.
+	openSagaLog()
+	data, err := os.ReadFile(sagaLogPath)
+	require.NoError(t, err)
+	require.Empty(t, data)
+}
+
+func TestAbandonOrderSagas(t *testing.T) {
+	t.Parallel()
+
+	sagaLogPath := filepath.Join(t.TempDir(), "saga", "orders.jsonl")
+	openSagaLog := func() *service.FileSagaLog {
+		sagaLog, err := service.NewFileSagaLog(sagaLogPath)
+		require.NoError(t, err)
+		t.Cleanup(func() { sagaLog.Close() })
+		return sagaLog
+	}
+
+	// the server crashes in the middle of a cancellation, after its pivot.
+	orderStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(orderStore))
+	sagaLog := &crashingSagaLog{SagaLog: openSagaLog(), crashAfter: "cancel_order"}
+	server := service.NewOrderManagementServer(orderStore, service.WithSagaLog(sagaLog))
+	_, err := server.TransitionOrder(adminContext(), &pb.TransitionOrderRequest{OrderId: "102", Status: pb.Order_PAID})
+	require.NoError(t, err)
+	_, err = server.CancelOrder(adminContext(), &pb.CancelOrderRequest{OrderId: "102"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the in-memory orders are lost with the process, and seeded again.
+	restartedStore := service.NewInMemoryOrderStore()
+	require.NoError(t, service.SeedOrders(restartedStore))
+	refundLedger := service.NewInMemoryRefundLedger()
+	server = service.NewOrderManagementServer(restartedStore, service.WithSagaLog(openSagaLog()), service.WithRefundLedger(refundLedger))
+
+	abandoned, err := server.AbandonOrderSagas()
+	require.NoError(t, err)
+	require.Equal(t, 1, abandoned)
+
+	// the new order 102 is left alone, and nothing is refunded.
+	order, err := server.GetOrder(context.Background(), &wrapper.StringValue{Value: "102"})
+	require.NoError(t, err)
+	require.Equal(t, pb.Order_PENDING, order.GetStatus())
+
+	refunds, err := refundLedger.FindByOrder("102")
+	require.NoError(t, err)
+	require.Empty(t, refunds)
+
+	// the abandoned saga is finished, so it is not resumed on the next start.
+	unfinished, err := openSagaLog().Unfinished()
+	require.NoError(t, err)
+	require.Empty(t, unfinished)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// orderTransitions lists, for each status of the order lifecycle, the statuses
+// an order can move to from there.
+var orderTransitions = map[pb.Order_Status][]pb.Order_Status{
+	pb.Order_PENDING:   {pb.Order_PAID, pb.Order_CANCELLED},
+	pb.Order_PAID:      {pb.Order_PACKED, pb.Order_CANCELLED},
+	pb.Order_PACKED:    {pb.Order_SHIPPED, pb.Order_CANCELLED},
+	pb.Order_SHIPPED:   {pb.Order_DELIVERED},
+	pb.Order_DELIVERED: {pb.Order_REFUNDED},
+	// only a cancelled order that was paid can be refunded, see canTransitionOrder().
+	pb.Order_CANCELLED: {pb.Order_REFUNDED},
+}
+
+// canTransitionOrder() function returns a FailedPrecondition error if the order
+// cannot move to the given status.
+func canTransitionOrder(order *pb.Order, to pb.Order_Status) error {
+	from := order.GetStatus()
+
+	allowed := false
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return status.Errorf(codes.FailedPrecondition, "order %s cannot go from %s to %s", order.GetId(), from, to)
+	}
+
+	if from == pb.Order_CANCELLED && to == pb.Order_REFUNDED && !wasOrderPaid(order) {
+		return status.Errorf(codes.FailedPrecondition, "order %s was cancelled before being paid, there is nothing to refund", order.GetId())
+	}
+
+	return nil
+}
+
+// wasOrderPaid() function reports whether the order has ever been paid.
+func wasOrderPaid(order *pb.Order) bool {
+	for _, transition := range order.GetHistory() {
+		if transition.GetTo() == pb.Order_PAID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transitionOrder() function moves the order to the given status, and records
+// the transition in its history.
+func transitionOrder(order *pb.Order, to pb.Order_Status, actor, reason string, now time.Time) error {
+	err := canTransitionOrder(order, to)
+	if err != nil {
+		return err
+	}
+
+	recordOrderTransition(order, to, actor, reason, now)
+	return nil
+}
+
+func recordOrderTransition(order *pb.Order, to pb.Order_Status, actor, reason string, now time.Time) {
+	order.History = append(order.History, &pb.OrderTransition{
+		From:   order.GetStatus(),
+		To:     to,
+		Time:   timestamppb.New(now),
+		Actor:  actor,
+		Reason: reason,
+	})
+	order.Status = to
+	order.Version++
+}
+
+// orderActor() function returns the name recorded as the actor of an order
+// change, which is always the authenticated user. The orders are never changed
+// anonymously, so it returns an Unauthenticated error without a user.
+func orderActor(ctx context.Context) (string, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok || claims.Username == "" {
+		return "", status.Errorf(codes.Unauthenticated, "orders are only changed by an authenticated user")
+	}
+
+	return claims.Username, nil
+}
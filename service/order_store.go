@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// OrderStore is an interface to store orders.
+// Like the LaptopStore, we might want to store orders in a database later,
+// so it is defined as an interface.
+// Every method works on the orders of the tenant carried by the context
+// (see TenantFromContext), so one tenant can never see another tenant's orders.
+type OrderStore interface {
+	// Save saves a new order to the store
+	Save(ctx context.Context, order *pb.Order) error
+
+	// Find finds an order by ID, it returns nil if the order is not found
+	Find(ctx context.Context, id string) (*pb.Order, error)
+
+	// Update calls update with a copy of the order with the given ID, and saves
+	// the copy if update returns nil. It returns ErrNotFound if there is no such
+	// order. Concurrent updates of the same order are serialized, so that a
+	// status transition is always checked against the current status.
+	Update(ctx context.Context, id string, update func(order *pb.Order) error) error
+
+	// Search() function finds the orders matching the criteria of the query,
+	// and reports them one by one, in the sort order of the query, via the found
+	// callback. The pagination fields of the query are ignored.
+	Search(ctx context.Context, query *pb.OrderQuery, found func(order *pb.Order) error) error
+}
+
+// InMemoryOrderStore stores orders in memory
+type InMemoryOrderStore struct {
+	// the read-write mutex lets many streams read the orders concurrently.
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the order ID,
+	// and the value is the order object.
+	data map[string]map[string]*pb.Order
+}
+
+// NewInMemoryOrderStore returns a new InMemoryOrderStore
+func NewInMemoryOrderStore() *InMemoryOrderStore {
+	return &InMemoryOrderStore{
+		data: make(map[string]map[string]*pb.Order),
+	}
+}
+
+// Save saves the order to the store
+func (store *InMemoryOrderStore) Save(ctx context.Context, order *pb.Order) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// get the orders of the caller's tenant, creating its partition on first use.
+	tenant := TenantFromContext(ctx)
+	orders := store.data[tenant]
+	if orders == nil {
+		orders = make(map[string]*pb.Order)
+		store.data[tenant] = orders
+	}
+
+	if orders[order.Id] != nil {
+		return ErrAlreadyExists
+	}
+
+	// the caller keeps its order object, so we save a deep copy of it.
+	orders[order.Id] = deepCopyOrder(order)
+	return nil
+}
+
+// Find finds an order by ID
+func (store *InMemoryOrderStore) Find(ctx context.Context, id string) (*pb.Order, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	order := store.data[TenantFromContext(ctx)][id]
+	if order == nil {
+		return nil, nil
+	}
+
+	return deepCopyOrder(order), nil
+}
+
+// Update updates an existing order
+func (store *InMemoryOrderStore) Update(ctx context.Context, id string, update func(order *pb.Order) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	orders := store.data[TenantFromContext(ctx)]
+	order := orders[id]
+	if order == nil {
+		return ErrNotFound
+	}
+
+	orderCopy := deepCopyOrder(order)
+	err := update(orderCopy)
+	if err != nil {
+		return err
+	}
+
+	// the ID is the key of the order, so it cannot change.
+	orderCopy.Id = id
+	orders[id] = orderCopy
+	return nil
+}
+
+// Search searches for orders matching the query
+func (store *InMemoryOrderStore) Search(ctx context.Context, query *pb.OrderQuery, found func(order *pb.Order) error) error {
+	// the matching orders are copied under the read lock, and reported once it
+	// is released, so that a slow client does not block the writers.
+	matches := store.matchingOrders(ctx, query)
+	for _, order := range matches {
+		err := found(order)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *InMemoryOrderStore) matchingOrders(ctx context.Context, query *pb.OrderQuery) []*pb.Order {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var matches []*pb.Order
+	for _, order := range store.data[TenantFromContext(ctx)] {
+		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
+			log.Print("context is cancelled")
+			return nil
+		}
+
+		if !orderMatches(order, query) {
+			continue
+		}
+
+		matches = append(matches, deepCopyOrder(order))
+	}
+
+	less := lessOrders(query)
+	sort.Slice(matches, func(i, j int) bool {
+		return less(matches[i], matches[j])
+	})
+
+	return matches
+}
+
+// deepCopyOrder() function copies an order with proto.Clone, which unlike
+// copier.Copy also copies the items slice.
+func deepCopyOrder(order *pb.Order) *pb.Order {
+	return proto.Clone(order).(*pb.Order)
+}
+
+// SeedOrders saves the sample orders used by the order management examples.
+// They are all pending, placed now, and belong to the default tenant.
+func SeedOrders(orderStore OrderStore) error {
+	orders := []*pb.Order{
+		{Id: "102", Items: []string{"Google Pixel 3A", "Mac Book Pro"}, Destination: "Mountain View, CA", Price: 1800.00},
+		{Id: "103", Items: []string{"Apple Watch S4"}, Destination: "San Jose, CA", Price: 400.00},
+		{Id: "104", Items: []string{"Google Home Mini", "Google Nest Hub"}, Destination: "Mountain View, CA", Price: 400.00},
+		{Id: "105", Items: []string{"Amazon Echo"}, Destination: "San Jose, CA", Price: 30.00},
+		{Id: "106", Items: []string{"Amazon Echo", "Apple iPhone XS"}, Destination: "Mountain View, CA", Price: 300.00},
+	}
+
+	for _, order := range orders {
+		err := setOrderAddress(order)
+		if err != nil {
+			return err
+		}
+
+		order.CreatedAt = timestamppb.Now()
+		recordOrderTransition(order, pb.Order_PENDING, "system", "sample order", order.GetCreatedAt().AsTime())
+
+		err = orderStore.Save(context.Background(), order)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"io"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// maxOrderUpdateAttempts is how many times an unconditional update is tried
+// when the order keeps changing while it is priced.
+const maxOrderUpdateAttempts = 3
+
+// updatableOrderFields are the paths of the update masks.
+var updatableOrderFields = []string{"items", "line_items", "description", "price", "amount", "destination"}
+
+// errOrderChanged is returned by the update function when the order is no
+// longer the one the update was prepared from.
+var errOrderChanged = errors.New("order changed")
+
+// BatchUpdateOrders is a client-streaming RPC that updates the orders received
+// from the stream, and responds with the outcome of every order once the client
+// closes the stream. An order that cannot be updated does not stop the stream,
+// only errors of the server do.
+func (server *OrderManagementServer) BatchUpdateOrders(stream pb.OrderManagement_BatchUpdateOrdersServer) error {
+	summary := &pb.UpdateOrdersSummary{}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log.Printf("updated %d orders, %d not found, %d conflicts, %d invalid",
+				summary.GetUpdated(), summary.GetNotFound(), summary.GetConflicts(), summary.GetInvalid())
+			return stream.SendAndClose(summary)
+		}
+		if err != nil {
+			return logError(recvError("cannot receive order update", err))
+		}
+
+		version, err := server.updateOrder(stream.Context(), req)
+		result, err := orderUpdateResult(req.GetOrder().GetId(), version, err)
+		if err != nil {
+			return logError(err)
+		}
+
+		switch result.GetOutcome() {
+		case pb.UpdateOrderResult_UPDATED:
+			summary.Updated++
+		case pb.UpdateOrderResult_NOT_FOUND:
+			summary.NotFound++
+		case pb.UpdateOrderResult_CONFLICT:
+			summary.Conflicts++
+		case pb.UpdateOrderResult_INVALID:
+			summary.Invalid++
+		}
+
+		summary.Results = append(summary.Results, result)
+	}
+}
+
+// orderUpdateResult() function converts the error returned by updateOrder() to
+// the outcome of the update. Errors that are not about the order are returned,
+// since they stop the stream.
+func orderUpdateResult(orderID string, version uint64, err error) (*pb.UpdateOrderResult, error) {
+	result := &pb.UpdateOrderResult{
+		OrderId: orderID,
+		Message: status.Convert(err).Message(),
+	}
+
+	switch status.Code(err) {
+	case codes.OK:
+		result.Outcome = pb.UpdateOrderResult_UPDATED
+		result.Version = version
+	case codes.NotFound:
+		result.Outcome = pb.UpdateOrderResult_NOT_FOUND
+	case codes.Aborted:
+		result.Outcome = pb.UpdateOrderResult_CONFLICT
+		result.Version = version
+	case codes.InvalidArgument, codes.FailedPrecondition:
+		result.Outcome = pb.UpdateOrderResult_INVALID
+	default:
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// updateOrder() function updates the fields of the update mask of an order.
+// It returns the new version of the order, or its current version when the
+// update fails with Aborted because the order does not have the expected version.
+//
+// The updated order is prepared, and priced again when its line items change,
+// before the store is locked, since pricing calls the catalogs. The store only
+// saves it if the order has not changed in the meantime, otherwise an
+// unconditional update is prepared again. The laptops of new line items are
+// reserved in place of the old ones as part of that same conditional update.
+func (server *OrderManagementServer) updateOrder(ctx context.Context, req *pb.UpdateOrderRequest) (uint64, error) {
+	order := req.GetOrder()
+	if order.GetId() == "" {
+		return 0, status.Errorf(codes.InvalidArgument, "order ID is required")
+	}
+
+	paths, err := orderUpdatePaths(req.GetUpdateMask())
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		stored, err := server.orderStore.Find(ctx, order.GetId())
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "cannot find order %s: %v", order.GetId(), err)
+		}
+		if stored == nil {
+			return 0, status.Errorf(codes.NotFound, "order %s not found", order.GetId())
+		}
+
+		if req.GetExpectedVersion() != 0 && req.GetExpectedVersion() != stored.GetVersion() {
+			return stored.GetVersion(), status.Errorf(codes.Aborted,
+				"order %s has version %d, not %d", order.GetId(), stored.GetVersion(), req.GetExpectedVersion())
+		}
+
+		updated := deepCopyOrder(stored)
+		err = applyOrderUpdate(updated, order, paths)
+		if err != nil {
+			return 0, err
+		}
+
+		if paths["line_items"] {
+			err = server.priceOrder(ctx, updated)
+			if err != nil {
+				return 0, err
+			}
+
+			// the order keeps the promotions it was placed with, and gets no new one.
+			promotions, err := server.appliedPromotions(ctx, stored)
+			if err != nil {
+				return 0, err
+			}
+			err = server.promoteOrder(updated, promotions)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		err = server.orderStore.Update(ctx, order.GetId(), func(current *pb.Order) error {
+			if current.GetVersion() != stored.GetVersion() {
+				return errOrderChanged
+			}
+
+			updated.Version++
+			proto.Reset(current)
+			proto.Merge(current, updated)
+			if paths["line_items"] {
+				// the laptops of the new line items are reserved, and those of the
+				// old ones released, only when the order is saved.
+				_, err := server.stockReservations.ReplaceOrder(ctx, order.GetId(), orderQuantities(current))
+				if err != nil {
+					return stockReservationError(err)
+				}
+			}
+
+			server.queueOrderEvent(ctx, pb.OrderEvent_UPDATED, current, nil)
+			return nil
+		})
+		server.flushOrderEvents()
+		if errors.Is(err, errOrderChanged) {
+			if req.GetExpectedVersion() != 0 || attempt == maxOrderUpdateAttempts {
+				current, _ := server.orderStore.Find(ctx, order.GetId())
+				return current.GetVersion(), status.Errorf(codes.Aborted,
+					"order %s was changed by another request", order.GetId())
+			}
+			continue
+		}
+		if err != nil {
+			return 0, orderUpdateError(order.GetId(), err)
+		}
+
+		log.Printf("order %s is updated to version %d", order.GetId(), updated.GetVersion())
+		return updated.GetVersion(), nil
+	}
+}
+
+// orderUpdatePaths() function returns the set of fields of an update mask.
+// An empty mask updates all the fields.
+func orderUpdatePaths(mask *fieldmaskpb.FieldMask) (map[string]bool, error) {
+	paths := make(map[string]bool)
+
+	if len(mask.GetPaths()) == 0 {
+		for _, field := range updatableOrderFields {
+			paths[field] = true
+		}
+		return paths, nil
+	}
+
+	for _, path := range mask.GetPaths() {
+		if !containsString(updatableOrderFields, path) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"field %q cannot be updated, the update mask can only have %v", path, updatableOrderFields)
+		}
+		paths[path] = true
+	}
+
+	return paths, nil
+}
+
+// applyOrderUpdate() function copies the fields of the update mask from an
+// order sent by a client to the stored order, and validates the result.
+// When the line items change, the items and prices are cleared, so that the
+// order is priced again.
+func applyOrderUpdate(stored *pb.Order, order *pb.Order, paths map[string]bool) error {
+	if order.GetStatus() != pb.Order_UNKNOWN && order.GetStatus() != stored.GetStatus() {
+		return status.Errorf(codes.FailedPrecondition,
+			"order %s status can only be changed with transitionOrder", order.GetId())
+	}
+
+	if stored.GetStatus() != pb.Order_PENDING && stored.GetStatus() != pb.Order_PAID {
+		return status.Errorf(codes.FailedPrecondition,
+			"order %s is %s and can no longer be updated", order.GetId(), stored.GetStatus())
+	}
+
+	hasLineItems := len(stored.GetLineItems()) > 0
+	if paths["line_items"] {
+		hasLineItems = len(order.GetLineItems()) > 0
+	}
+
+	// the items and the prices of an order with line items are computed by the server.
+	if hasLineItems && (paths["items"] && len(order.GetItems()) > 0 || paths["price"] && order.GetPrice() != 0 ||
+		paths["amount"] && order.GetAmount() != nil || hasOrderTotals(order)) {
+		return status.Errorf(codes.InvalidArgument, "the items and prices of an order with line items are set by the server")
+	}
+
+	// The amount wins over the legacy price when both are updated, but a client
+	// that only knows the price sends back the amount it got unchanged, so a new
+	// price with the same amount is the one the client changed.
+	legacyPrice := paths["price"] && proto.Equal(order.GetAmount(), stored.GetAmount()) &&
+		order.GetPrice() != stored.GetPrice()
+
+	if paths["line_items"] {
+		stored.LineItems = order.GetLineItems()
+		stored.Items = nil
+		stored.Price = 0
+		stored.Amount = nil
+		clearOrderTotals(stored)
+		stored.Discount = 0
+		stored.DiscountAmount = nil
+		stored.Promotions = nil
+	}
+	if paths["items"] && !hasLineItems {
+		stored.Items = order.GetItems()
+	}
+	if paths["amount"] && order.GetAmount() != nil && !legacyPrice && !hasLineItems {
+		stored.Amount = order.GetAmount()
+	} else if paths["price"] && !hasLineItems {
+		stored.Price = order.GetPrice()
+		stored.Amount = nil
+	}
+	if paths["description"] {
+		stored.Description = order.GetDescription()
+	}
+	if paths["destination"] {
+		stored.Destination = order.GetDestination()
+		err := setOrderAddress(stored)
+		if err != nil {
+			return err
+		}
+	}
+
+	// validateOrder() rejects the items and prices that the server has set.
+	check := stored
+	if hasLineItems {
+		check = deepCopyOrder(stored)
+		check.Items = nil
+		check.Price = 0
+		check.Amount = nil
+		clearOrderTotals(check)
+	}
+
+	err := validateOrder(check)
+	if err != nil || hasLineItems {
+		return err
+	}
+
+	err = migrateOrderAmount(stored)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OwnershipRule is an attribute-based authorization check. The AuthInterceptor
+// runs it after the request message has been decoded, so unlike the role check
+// it can look at what the caller is asking for.
+// claims is nil when the method is publicly accessible and no token was sent.
+// For streaming RPCs the rule is called once for every received message.
+type OwnershipRule func(ctx context.Context, claims *UserClaims, req interface{}) error
+
+// OwnershipRules builds the list of RPC methods that have an ownership rule.
+// Methods that are not in the map are only checked against AccessibleRoles().
+// The rules of a nil store are left out, for a server that does not host its service.
+func OwnershipRules(laptopStore LaptopStore, orderStore OrderStore) map[string]OwnershipRule {
+	const laptopServicePath = "/ecommerce.LaptopService/"
+	const orderManagementPath = "/ecommerce.OrderManagement/"
+
+	rules := make(map[string]OwnershipRule)
+
+	if laptopStore != nil {
+		// Vendors may only create laptops of their own brand.
+		rules[laptopServicePath+"CreateLaptop"] = vendorCreatesOwnBrand
+		// Vendors may only upload images for laptops of their own brand.
+		rules[laptopServicePath+"UploadImage"] = vendorUploadsOwnBrand(laptopStore)
+		// Vendors may not rate laptops of their own brand.
+		rules[laptopServicePath+"RateLaptop"] = vendorRatesOtherBrand(laptopStore)
+	}
+
+	if orderStore != nil {
+		// Customers may only see, update and cancel their own orders, the admins
+		// manage all of them. The updates are checked for every message of the stream.
+		rules[orderManagementPath+"getOrder"] = customerOwnsOrder(orderStore, func(req interface{}) (string, bool) {
+			id, ok := req.(*wrapper.StringValue)
+			return id.GetValue(), ok
+		})
+		rules[orderManagementPath+"cancelOrder"] = customerOwnsOrder(orderStore, func(req interface{}) (string, bool) {
+			cancelReq, ok := req.(*pb.CancelOrderRequest)
+			return cancelReq.GetOrderId(), ok
+		})
+		rules[orderManagementPath+"updateOrders"] = customerOwnsOrder(orderStore, func(req interface{}) (string, bool) {
+			order, ok := req.(*pb.Order)
+			return order.GetId(), ok
+		})
+		rules[orderManagementPath+"batchUpdateOrders"] = customerOwnsOrder(orderStore, func(req interface{}) (string, bool) {
+			updateReq, ok := req.(*pb.UpdateOrderRequest)
+			return updateReq.GetOrder().GetId(), ok
+		})
+		// Customers may only query their own orders.
+		rules[orderManagementPath+"queryOrders"] = customerQueriesOwnOrders
+	}
+
+	return rules
+}
+
+func vendorCreatesOwnBrand(ctx context.Context, claims *UserClaims, req interface{}) error {
+	createReq, ok := req.(*pb.CreateLaptopRequest)
+	if !ok || !isVendor(claims) {
+		return nil
+	}
+
+	if createReq.GetLaptop().GetBrand() != claims.Brand {
+		return status.Errorf(codes.PermissionDenied, "vendor of %s cannot create a %s laptop",
+			claims.Brand, createReq.GetLaptop().GetBrand())
+	}
+
+	return nil
+}
+
+func vendorUploadsOwnBrand(laptopStore LaptopStore) OwnershipRule {
+	return func(ctx context.Context, claims *UserClaims, req interface{}) error {
+		uploadReq, ok := req.(*pb.UploadImageRequest)
+		// Only the first message of the stream carries the laptop ID,
+		// the chunk messages that follow have nothing to check.
+		if !ok || uploadReq.GetInfo() == nil || !isVendor(claims) {
+			return nil
+		}
+
+		brand := laptopBrand(ctx, laptopStore, uploadReq.GetInfo().GetLaptopId())
+		if brand != "" && brand != claims.Brand {
+			return status.Errorf(codes.PermissionDenied, "vendor of %s cannot upload images for a %s laptop",
+				claims.Brand, brand)
+		}
+
+		return nil
+	}
+}
+
+func vendorRatesOtherBrand(laptopStore LaptopStore) OwnershipRule {
+	return func(ctx context.Context, claims *UserClaims, req interface{}) error {
+		rateReq, ok := req.(*pb.RateLaptopRequest)
+		if !ok || !isVendor(claims) {
+			return nil
+		}
+
+		brand := laptopBrand(ctx, laptopStore, rateReq.GetLaptopId())
+		if brand != "" && brand == claims.Brand {
+			return status.Errorf(codes.PermissionDenied, "vendor of %s cannot rate its own laptops", claims.Brand)
+		}
+
+		return nil
+	}
+}
+
+func customerOwnsOrder(orderStore OrderStore, orderID func(req interface{}) (string, bool)) OwnershipRule {
+	return func(ctx context.Context, claims *UserClaims, req interface{}) error {
+		id, ok := orderID(req)
+		if !ok || isAdmin(claims) {
+			return nil
+		}
+
+		// an order without a customer, such as a seeded one, is only managed by the admins.
+		customer, found := orderCustomer(ctx, orderStore, id)
+		if found && (claims == nil || customer == "" || customer != claims.Username) {
+			return status.Errorf(codes.PermissionDenied, "order %s belongs to another customer", id)
+		}
+
+		return nil
+	}
+}
+
+func customerQueriesOwnOrders(ctx context.Context, claims *UserClaims, req interface{}) error {
+	query, ok := req.(*pb.OrderQuery)
+	if !ok || isAdmin(claims) {
+		return nil
+	}
+
+	if claims == nil || query.GetCustomer() != claims.Username {
+		return status.Errorf(codes.PermissionDenied, "customers can only query their own orders")
+	}
+
+	return nil
+}
+
+func isAdmin(claims *UserClaims) bool {
+	return claims != nil && claims.Role == "admin"
+}
+
+func isVendor(claims *UserClaims) bool {
+	return claims != nil && claims.Role == "vendor"
+}
+
+// laptopBrand returns the brand of the laptop with the given ID in the tenant
+// of ctx, or an empty string if it is not found. Unknown laptops are left to
+// the RPC handler, which reports them with a NotFound status code.
+func laptopBrand(ctx context.Context, laptopStore LaptopStore, laptopID string) string {
+	laptop, err := laptopStore.Find(ctx, laptopID)
+	if err != nil || laptop == nil {
+		return ""
+	}
+
+	return laptop.GetBrand()
+}
+
+// orderCustomer returns the customer of the order with the given ID, and
+// whether the order is found. Unknown orders are left to the RPC handler,
+// which reports them with a NotFound status code.
+func orderCustomer(ctx context.Context, orderStore OrderStore, orderID string) (string, bool) {
+	order, err := orderStore.Find(ctx, orderID)
+	if err != nil || order == nil {
+		return "", false
+	}
+
+	return order.GetCustomer(), true
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The Money fields replace the legacy float prices: laptop.price replaces
+// price_usd, product.list_price replaces price, and order.amount replaces
+// price. A Money field, when it is set, is authoritative and the legacy field
+// mirrors it; when it is not, it is read from the legacy field, in USD.
+
+// defaultCurrency is the currency of the legacy float prices, and of the
+// orders priced by the server.
+const defaultCurrency = "USD"
+
+// usdFromFloat() function converts a legacy float price, which is in USD, to
+// a Money. It returns nil when the float is not finite.
+func usdFromFloat(amount float64, bitSize int) *pb.Money {
+	price, err := money.FromFloat(defaultCurrency, amount, bitSize)
+	if err != nil {
+		return nil
+	}
+
+	return price
+}
+
+// usdToFloat() function returns the legacy float price of a Money, which is 0
+// when the Money is not in USD.
+func usdToFloat(price *pb.Money) float64 {
+	if price.GetCurrencyCode() != defaultCurrency {
+		return 0
+	}
+
+	return money.ToFloat(price)
+}
+
+// laptopPrice() function returns the price of a laptop, read from the legacy
+// price_usd when it has no Money price.
+func laptopPrice(laptop *pb.Laptop) *pb.Money {
+	if laptop.GetPrice() != nil {
+		return laptop.GetPrice()
+	}
+
+	return usdFromFloat(laptop.GetPriceUsd(), 64)
+}
+
+// productPrice() function returns the list price of a product, read from the
+// legacy price when it has no Money list price.
+func productPrice(product *pb.Product) *pb.Money {
+	if product.GetListPrice() != nil {
+		return product.GetListPrice()
+	}
+
+	return usdFromFloat(float64(product.GetPrice()), 32)
+}
+
+// orderMoney() function returns the amount of an order, read from the legacy
+// price when it has no Money amount.
+func orderMoney(order *pb.Order) *pb.Money {
+	if order.GetAmount() != nil {
+		return order.GetAmount()
+	}
+
+	return usdFromFloat(float64(order.GetPrice()), 32)
+}
+
+// migrateLaptopPrice() function sets the Money price of a laptop and mirrors
+// it to the legacy price_usd.
+func migrateLaptopPrice(laptop *pb.Laptop) error {
+	price := laptopPrice(laptop)
+	err := money.Validate(price)
+	if err != nil {
+		return fmt.Errorf("laptop %s price: %w", laptop.GetId(), err)
+	}
+
+	laptop.Price = price
+	laptop.PriceUsd = usdToFloat(price)
+	return nil
+}
+
+// migrateProductPrice() function sets the Money list price of a product and
+// mirrors it to the legacy price.
+func migrateProductPrice(product *pb.Product) error {
+	price := productPrice(product)
+	err := money.Validate(price)
+	if err != nil {
+		return fmt.Errorf("product %s price: %w", product.GetId(), err)
+	}
+
+	product.ListPrice = price
+	product.Price = float32(usdToFloat(price))
+	return nil
+}
+
+// migrateOrderAmount() function sets the Money amount of an order and mirrors
+// it to the legacy price.
+func migrateOrderAmount(order *pb.Order) error {
+	amount := orderMoney(order)
+	err := money.Validate(amount)
+	if err != nil {
+		return fmt.Errorf("order %s amount: %w", order.GetId(), err)
+	}
+
+	order.Amount = amount
+	order.Price = float32(usdToFloat(amount))
+	return nil
+}
+
+// MigrateOrderAmounts sets the Money amount of the stored orders that only
+// have a legacy float price. It returns the number of orders migrated.
+// Those orders predate the tenants, so they are all of the default tenant.
+func MigrateOrderAmounts(orderStore OrderStore) (int, error) {
+	ctx := ContextWithTenant(context.Background(), DefaultTenant)
+
+	var ids []string
+	err := orderStore.Search(ctx, &pb.OrderQuery{}, func(order *pb.Order) error {
+		if order.GetAmount() == nil {
+			ids = append(ids, order.GetId())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		err := orderStore.Update(ctx, id, migrateOrderAmount)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// MigrateProductPrices sets the Money list price of the stored products of
+// the tenant of the context that only have a legacy float price. It returns
+// the number of products migrated.
+func MigrateProductPrices(ctx context.Context, productStore ProductStore) (int, error) {
+	var legacy []*pb.Product
+	err := productStore.Search(ctx, &pb.ProductFilter{}, "", func(product *pb.Product) error {
+		if product.GetListPrice() == nil {
+			legacy = append(legacy, proto.Clone(product).(*pb.Product))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, product := range legacy {
+		err := migrateProductPrice(product)
+		if err != nil {
+			return 0, err
+		}
+
+		err = productStore.Update(ctx, product)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacy), nil
+}
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// defaultProductPageSize is the number of products of a page when the request does not say.
+	defaultProductPageSize = 50
+	// maxProductPageSize is the largest number of products of a page.
+	maxProductPageSize = 500
+)
+
+// ProductInfoServer is the server that provides the ProductInfo catalog
+type ProductInfoServer struct {
+	pb.UnimplementedProductInfoServer
+	productStore ProductStore
+	// laptopStore holds the laptops of the laptop products, if any.
+	laptopStore LaptopStore
+}
+
+// ProductServerOption configures an optional feature of the ProductInfoServer.
+type ProductServerOption func(server *ProductInfoServer)
+
+// WithLaptopCatalog writes the price updates of the laptop products through to
+// the laptops of the store, which the orders are priced with. The laptops that
+// existed before the catalog are linked to it by MigrateLaptops() at startup.
+func WithLaptopCatalog(laptopStore LaptopStore) ProductServerOption {
+	return func(server *ProductInfoServer) {
+		server.laptopStore = laptopStore
+	}
+}
+
+// NewProductInfoServer returns a new ProductInfoServer
+func NewProductInfoServer(productStore ProductStore, opts ...ProductServerOption) *ProductInfoServer {
+	server := &ProductInfoServer{
+		productStore: productStore,
+	}
+
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	return server
+}
+
+// AddProduct is a unary RPC to add a new product. It returns the ID generated for the product.
+func (server *ProductInfoServer) AddProduct(ctx context.Context, product *pb.Product) (*pb.ProductID, error) {
+	err := validateProduct(product)
+	if err != nil {
+		return nil, err
+	}
+
+	// a laptop product is linked to its laptop, so it can only be created with the laptop.
+	if product.GetLaptop() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptops are added with the LaptopService")
+	}
+
+	// the list price is set from the legacy price when the client only sends it.
+	err = migrateProductPrice(product)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	// generate the product id
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate a new product ID: %v", err)
+	}
+
+	// assign the generated id as the product id
+	product.Id = id.String()
+
+	err = server.productStore.Save(ctx, product)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrAlreadyExists) {
+			code = codes.AlreadyExists
+		}
+		return nil, status.Errorf(code, "cannot save product to the store: %v", err)
+	}
+
+	log.Printf("saved product with id: %s", product.GetId())
+
+	return &pb.ProductID{Value: product.GetId()}, nil
+}
+
+// GetProduct is a unary RPC to get a product by ID. A laptop product carries the laptop specs.
+func (server *ProductInfoServer) GetProduct(ctx context.Context, productID *pb.ProductID) (*pb.Product, error) {
+	product, err := server.productStore.Find(ctx, productID.GetValue())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find product: %v", err)
+	}
+
+	if product == nil {
+		return nil, status.Errorf(codes.NotFound, "product %s not found", productID.GetValue())
+	}
+
+	return product, nil
+}
+
+// ListProducts is a unary RPC that returns one page of the products, in order of ID
+func (server *ProductInfoServer) ListProducts(ctx context.Context, req *pb.ListProductsRequest) (*pb.ListProductsResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "page size cannot be negative")
+	}
+	if pageSize == 0 {
+		pageSize = defaultProductPageSize
+	}
+	if pageSize > maxProductPageSize {
+		pageSize = maxProductPageSize
+	}
+
+	// the page token is the ID of the last product of the previous page.
+	afterID, err := base64.RawURLEncoding.DecodeString(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+
+	res := &pb.ListProductsResponse{}
+	more := false
+
+	err = server.productStore.Search(ctx, nil, string(afterID), func(product *pb.Product) error {
+		// one more product than the page size tells whether there is a next page.
+		if len(res.Products) == pageSize {
+			more = true
+			return errStopSearch
+		}
+
+		res.Products = append(res.Products, product)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopSearch) && contextError(ctx) == nil {
+		return nil, status.Errorf(codes.Internal, "cannot list products: %v", err)
+	}
+
+	err = contextError(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if more {
+		last := res.Products[len(res.Products)-1]
+		res.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last.GetId()))
+	}
+
+	return res, nil
+}
+
+// UpdateProduct is a unary RPC that replaces the name, description and price
+// of a product. The spec of a product cannot change, and the price of a laptop
+// product is also the price of its spec.
+func (server *ProductInfoServer) UpdateProduct(ctx context.Context, req *pb.UpdateProductRequest) (*pb.UpdateProductResponse, error) {
+	product := proto.Clone(req.GetProduct()).(*pb.Product)
+
+	log.Printf("received an update-product request with id: %s", product.GetId())
+
+	if product.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "product ID is required")
+	}
+
+	err := validateProduct(product)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := server.productStore.Find(ctx, product.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find product: %v", err)
+	}
+
+	// a client that only knows the legacy price sends back the list price it
+	// got unchanged, so a new legacy price is the one the client changed.
+	if current != nil && proto.Equal(product.GetListPrice(), current.GetListPrice()) && product.GetPrice() != current.GetPrice() {
+		product.ListPrice = nil
+	}
+
+	err = migrateProductPrice(product)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	if current.GetLaptop() != nil {
+		laptop := proto.Clone(current.GetLaptop()).(*pb.Laptop)
+		laptop.Price = proto.Clone(product.GetListPrice()).(*pb.Money)
+		laptop.PriceUsd = usdToFloat(laptop.GetPrice())
+		product.Spec = &pb.Product_Laptop{Laptop: laptop}
+	} else if current != nil && product.GetLaptop() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "laptops are added with the LaptopService")
+	}
+
+	// the laptop is updated first, and put back if the product cannot be,
+	// so the catalog and the laptop never disagree on the price.
+	previous, err := server.updateLaptop(ctx, product.GetLaptop())
+	if err != nil {
+		return nil, err
+	}
+
+	err = server.productStore.Update(ctx, product)
+	if err != nil && previous != nil {
+		_, rollbackErr := server.updateLaptop(ctx, previous)
+		if rollbackErr != nil {
+			log.Printf("cannot restore laptop %s: %v", previous.GetId(), rollbackErr)
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "product %s not found", product.GetId())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot update product: %v", err)
+	}
+
+	return &pb.UpdateProductResponse{Product: product}, nil
+}
+
+// updateLaptop() function writes the laptop of a laptop product through to the
+// laptop store, and returns the laptop it replaced. It does nothing for other
+// products, or when the server has no laptop store. The laptop is the one of
+// the caller's tenant, like the product.
+func (server *ProductInfoServer) updateLaptop(ctx context.Context, laptop *pb.Laptop) (*pb.Laptop, error) {
+	if laptop == nil || server.laptopStore == nil {
+		return nil, nil
+	}
+
+	previous, err := server.laptopStore.Find(ctx, laptop.GetId())
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+
+	err = server.laptopStore.Update(ctx, laptop)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot update laptop: %v", err)
+	}
+
+	return previous, nil
+}
+
+// DeleteProduct is a unary RPC that removes a product from the catalog
+func (server *ProductInfoServer) DeleteProduct(ctx context.Context, req *pb.DeleteProductRequest) (*pb.DeleteProductResponse, error) {
+	log.Printf("received a delete-product request with id: %s", req.GetId())
+
+	err := server.productStore.Delete(ctx, req.GetId())
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "product %s not found", req.GetId())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot delete product: %v", err)
+	}
+
+	return &pb.DeleteProductResponse{}, nil
+}
+
+// SearchProducts is a server-streaming RPC to search for products
+func (server *ProductInfoServer) SearchProducts(req *pb.SearchProductsRequest, stream pb.ProductInfo_SearchProductsServer) error {
+	filter := req.GetFilter()
+	log.Printf("receive a search-products request with filter: %v", filter)
+
+	if filter.GetMaxPrice() != 0 && filter.GetMinPrice() > filter.GetMaxPrice() {
+		return status.Errorf(codes.InvalidArgument, "min price is greater than max price")
+	}
+
+	err := server.productStore.Search(stream.Context(), filter, "", func(product *pb.Product) error {
+		return stream.Send(&pb.SearchProductsResponse{Product: product})
+	})
+	if err != nil {
+		if ctxErr := contextError(stream.Context()); ctxErr != nil {
+			return ctxErr
+		}
+		return logError(status.Errorf(codes.Internal, "cannot search products: %v", err))
+	}
+
+	return nil
+}
+
+// validateProduct() function checks the fields of a product sent by a client.
+func validateProduct(product *pb.Product) error {
+	if strings.TrimSpace(product.GetName()) == "" {
+		return status.Errorf(codes.InvalidArgument, "product name is required")
+	}
+
+	price := float64(product.GetPrice())
+	if math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+		return status.Errorf(codes.InvalidArgument, "product price %v is invalid", product.GetPrice())
+	}
+
+	if product.GetListPrice() != nil {
+		err := money.Validate(product.GetListPrice())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "product list price is invalid: %v", err)
+		}
+		if product.GetListPrice().GetUnits() < 0 || product.GetListPrice().GetNanos() < 0 {
+			return status.Errorf(codes.InvalidArgument, "product list price cannot be negative")
+		}
+	}
+
+	return nil
+}
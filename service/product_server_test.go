@@ -0,0 +1,260 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestProductClient starts a gRPC server for the product info server,
+// and returns a client connected to it.
+func newTestProductClient(t *testing.T, server *service.ProductInfoServer) pb.ProductInfoClient {
+	grpcServer := grpc.NewServer()
+	pb.RegisterProductInfoServer(grpcServer, server)
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewProductInfoClient(conn)
+}
+
+func TestProductInfoServer(t *testing.T) {
+	t.Parallel()
+
+	productClient := newTestProductClient(t, service.NewProductInfoServer(service.NewInMemoryProductStore()))
+	ctx := context.Background()
+
+	// the products can be added concurrently.
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := productClient.AddProduct(ctx, &pb.Product{Name: fmt.Sprintf("Phone %02d", i), Price: float32(100 * (i + 1))})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	_, err := productClient.AddProduct(ctx, &pb.Product{Name: " ", Price: 10})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = productClient.AddProduct(ctx, &pb.Product{Name: "Phone", Price: -1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the products are listed page by page, each of them once.
+	var listed []*pb.Product
+	req := &pb.ListProductsRequest{PageSize: 7}
+	for pages := 1; ; pages++ {
+		page, err := productClient.ListProducts(ctx, req)
+		require.NoError(t, err)
+		listed = append(listed, page.GetProducts()...)
+
+		if page.GetNextPageToken() == "" {
+			require.Equal(t, 3, pages)
+			break
+		}
+		req.PageToken = page.GetNextPageToken()
+	}
+	require.Len(t, listed, 20)
+	for i := 1; i < len(listed); i++ {
+		require.Less(t, listed[i-1].GetId(), listed[i].GetId())
+	}
+
+	_, err = productClient.ListProducts(ctx, &pb.ListProductsRequest{PageToken: "not base64!"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the products are searched by name and price.
+	search := func(filter *pb.ProductFilter) []string {
+		stream, err := productClient.SearchProducts(ctx, &pb.SearchProductsRequest{Filter: filter})
+		require.NoError(t, err)
+
+		var names []string
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return names
+			}
+			require.NoError(t, err)
+			names = append(names, res.GetProduct().GetName())
+		}
+	}
+	require.ElementsMatch(t, []string{"Phone 10", "Phone 11", "Phone 12", "Phone 13", "Phone 14", "Phone 15", "Phone 16", "Phone 17", "Phone 18", "Phone 19"},
+		search(&pb.ProductFilter{Name: "PHONE 1"}))
+	require.ElementsMatch(t, []string{"Phone 02", "Phone 03"}, search(&pb.ProductFilter{Name: "phone", MinPrice: 250, MaxPrice: 400}))
+	require.Len(t, search(nil), 20)
+
+	stream, err := productClient.SearchProducts(ctx, &pb.SearchProductsRequest{Filter: &pb.ProductFilter{MinPrice: 10, MaxPrice: 5}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a product can be updated, then deleted.
+	product := listed[0]
+	product.Price = 42
+	res, err := productClient.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: product})
+	require.NoError(t, err)
+	require.EqualValues(t, 42, res.GetProduct().GetPrice())
+
+	found, err := productClient.GetProduct(ctx, &pb.ProductID{Value: product.GetId()})
+	require.NoError(t, err)
+	require.EqualValues(t, 42, found.GetPrice())
+
+	_, err = productClient.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: &pb.Product{Id: "unknown", Name: "Phone"}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = productClient.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: product.GetId()})
+	require.NoError(t, err)
+	_, err = productClient.GetProduct(ctx, &pb.ProductID{Value: product.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = productClient.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: product.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+}
+
+func TestProductCatalogLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	productStore := service.NewInMemoryProductStore()
+	ctx := context.Background()
+
+	// a laptop saved before the catalog existed, and one of another tenant.
+	oldLaptop := sampledata.NewLaptop()
+	require.NoError(t, laptopStore.Save(ctx, oldLaptop))
+	tenantLaptop := sampledata.NewLaptop()
+	require.NoError(t, laptopStore.Save(service.ContextWithTenant(ctx, "acme"), tenantLaptop))
+
+	laptopServer := service.NewLaptopServer(laptopStore, nil, nil, service.WithProductCatalog(productStore))
+	productClient := newTestProductClient(t, service.NewProductInfoServer(productStore, service.WithLaptopCatalog(laptopStore)))
+
+	// a new laptop is linked to the product with the same ID.
+	laptop := sampledata.NewLaptop()
+	res, err := laptopServer.CreateLaptop(ctx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	product, err := productClient.GetProduct(ctx, &pb.ProductID{Value: res.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, laptop.GetBrand()+" "+laptop.GetName(), product.GetName())
+	require.True(t, proto.Equal(laptop, product.GetLaptop()))
+
+	// an existing laptop is only part of the catalog once it is migrated.
+	_, err = productClient.GetProduct(ctx, &pb.ProductID{Value: oldLaptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	migrated, err := service.MigrateLaptops(ctx, laptopStore, productStore)
+	require.NoError(t, err)
+	require.Equal(t, 1, migrated)
+
+	product, err = productClient.GetProduct(ctx, &pb.ProductID{Value: oldLaptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, oldLaptop.GetId(), product.GetLaptop().GetId())
+
+	migrated, err = service.MigrateLaptops(ctx, laptopStore, productStore)
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+
+	// the laptops of the other tenants are not part of the catalog.
+	_, err = productClient.GetProduct(ctx, &pb.ProductID{Value: tenantLaptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the price of a laptop product is the price of its spec, and the spec cannot change.
+	product.Price = 999.5
+	product.Spec = nil
+	updated, err := productClient.UpdateProduct(ctx, &pb.UpdateProductRequest{Product: product})
+	require.NoError(t, err)
+	require.Equal(t, 999.5, updated.GetProduct().GetLaptop().GetPriceUsd())
+	require.Equal(t, oldLaptop.GetCpu().GetName(), updated.GetProduct().GetLaptop().GetCpu().GetName())
+
+	// the new price is written through to the laptop, which the orders are priced with.
+	stored, err := laptopStore.Find(ctx, oldLaptop.GetId())
+	require.NoError(t, err)
+	require.Equal(t, 999.5, stored.GetPriceUsd())
+	require.True(t, proto.Equal(updated.GetProduct().GetListPrice(), stored.GetPrice()))
+
+	// a deleted laptop product stays deleted, even though its laptop still exists.
+	_, err = productClient.DeleteProduct(ctx, &pb.DeleteProductRequest{Id: oldLaptop.GetId()})
+	require.NoError(t, err)
+
+	migrated, err = service.MigrateLaptops(ctx, laptopStore, productStore)
+	require.NoError(t, err)
+	require.Equal(t, 0, migrated)
+
+	_, err = productClient.GetProduct(ctx, &pb.ProductID{Value: oldLaptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = laptopStore.Find(ctx, oldLaptop.GetId())
+	require.NoError(t, err)
+
+	// laptops cannot be added as plain products.
+	_, err = productClient.AddProduct(ctx, &pb.Product{Name: "Laptop", Price: 1, Spec: &pb.Product_Laptop{Laptop: sampledata.NewLaptop()}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestProductCatalogTenants(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	productStore := service.NewInMemoryProductStore()
+	laptopServer := service.NewLaptopServer(laptopStore, nil, nil, service.WithProductCatalog(productStore))
+	productServer := service.NewProductInfoServer(productStore, service.WithLaptopCatalog(laptopStore))
+
+	acmeCtx := service.ContextWithTenant(adminContext(), "acme")
+	globexCtx := service.ContextWithTenant(adminContext(), "globex")
+
+	// a laptop of acme is linked to the catalog of acme only.
+	laptop := sampledata.NewLaptop()
+	laptop.Price = usd(t, "1299")
+	res, err := laptopServer.CreateLaptop(acmeCtx, &pb.CreateLaptopRequest{Laptop: laptop})
+	require.NoError(t, err)
+
+	product, err := productServer.GetProduct(acmeCtx, &pb.ProductID{Value: res.GetId()})
+	require.NoError(t, err)
+	_, err = productServer.GetProduct(globexCtx, &pb.ProductID{Value: res.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// an admin of globex can neither reprice nor delete it.
+	product.ListPrice = usd(t, "1")
+	_, err = productServer.UpdateProduct(globexCtx, &pb.UpdateProductRequest{Product: product})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = productServer.DeleteProduct(globexCtx, &pb.DeleteProductRequest{Id: res.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stored, err := laptopStore.Find(acmeCtx, res.GetId())
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "1299"), stored.GetPrice()))
+
+	product, err = productServer.GetProduct(acmeCtx, &pb.ProductID{Value: res.GetId()})
+	require.NoError(t, err)
+	require.True(t, proto.Equal(usd(t, "1299"), product.GetListPrice()))
+
+	// the products added by an admin are only in the catalog of their tenant.
+	id, err := productServer.AddProduct(globexCtx, &pb.Product{Name: "Mouse", ListPrice: usd(t, "25")})
+	require.NoError(t, err)
+	_, err = productServer.GetProduct(acmeCtx, id)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
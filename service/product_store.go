@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ProductStore is an interface to store the products of the ProductInfo catalog.
+// Like the LaptopStore, products are kept per tenant: every method works on the
+// products of the tenant carried by the context.
+type ProductStore interface {
+	// Save saves a new product to the store. It returns ErrDeleted if a
+	// product with the same ID was deleted, so a deleted product stays deleted.
+	Save(ctx context.Context, product *pb.Product) error
+
+	// Find finds a product by ID, it returns nil if the product is not found
+	Find(ctx context.Context, id string) (*pb.Product, error)
+
+	// Update replaces a product. It returns ErrNotFound if there is no such product.
+	Update(ctx context.Context, product *pb.Product) error
+
+	// Delete deletes a product. It returns ErrNotFound if there is no such product.
+	Delete(ctx context.Context, id string) error
+
+	// Search() function reports the products matching the filter one by one,
+	// in order of ID, via the found callback. A nil filter matches every
+	// product. The products whose ID is not greater than afterID are skipped.
+	Search(ctx context.Context, filter *pb.ProductFilter, afterID string, found func(product *pb.Product) error) error
+}
+
+// InMemoryProductStore stores products in memory
+type InMemoryProductStore struct {
+	// the read-write mutex lets many requests read the products concurrently.
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the product ID,
+	// and the value is the product object.
+	data map[string]map[string]*pb.Product
+	// deleted holds the IDs of the deleted products of each tenant, so they
+	// are never saved again.
+	deleted map[string]map[string]bool
+}
+
+// ErrDeleted is returned when a record with the same ID was deleted from the store
+var ErrDeleted = errors.New("record was deleted")
+
+// NewInMemoryProductStore returns a new InMemoryProductStore
+func NewInMemoryProductStore() *InMemoryProductStore {
+	return &InMemoryProductStore{
+		data:    make(map[string]map[string]*pb.Product),
+		deleted: make(map[string]map[string]bool),
+	}
+}
+
+// Save saves the product to the store
+func (store *InMemoryProductStore) Save(ctx context.Context, product *pb.Product) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tenant := TenantFromContext(ctx)
+	if store.data[tenant][product.GetId()] != nil {
+		return ErrAlreadyExists
+	}
+	if store.deleted[tenant][product.GetId()] {
+		return ErrDeleted
+	}
+
+	// get the products of the caller's tenant, creating its partition on first use.
+	products := store.data[tenant]
+	if products == nil {
+		products = make(map[string]*pb.Product)
+		store.data[tenant] = products
+	}
+
+	products[product.GetId()] = proto.Clone(product).(*pb.Product)
+	return nil
+}
+
+// Find finds a product by ID
+func (store *InMemoryProductStore) Find(ctx context.Context, id string) (*pb.Product, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	product := store.data[TenantFromContext(ctx)][id]
+	if product == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(product).(*pb.Product), nil
+}
+
+// Update replaces an existing product
+func (store *InMemoryProductStore) Update(ctx context.Context, product *pb.Product) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	products := store.data[TenantFromContext(ctx)]
+	if products[product.GetId()] == nil {
+		return ErrNotFound
+	}
+
+	products[product.GetId()] = proto.Clone(product).(*pb.Product)
+	return nil
+}
+
+// Delete deletes a product
+func (store *InMemoryProductStore) Delete(ctx context.Context, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tenant := TenantFromContext(ctx)
+	if store.data[tenant][id] == nil {
+		return ErrNotFound
+	}
+
+	delete(store.data[tenant], id)
+
+	deleted := store.deleted[tenant]
+	if deleted == nil {
+		deleted = make(map[string]bool)
+		store.deleted[tenant] = deleted
+	}
+	deleted[id] = true
+	return nil
+}
+
+// Search searches for products matching the filter
+func (store *InMemoryProductStore) Search(
+	ctx context.Context,
+	filter *pb.ProductFilter,
+	afterID string,
+	found func(product *pb.Product) error,
+) error {
+	// the matching products are copied under the read lock, and reported once
+	// it is released, so that a slow client does not block the writers.
+	for _, product := range store.matchingProducts(TenantFromContext(ctx), filter, afterID) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := found(product)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *InMemoryProductStore) matchingProducts(tenant string, filter *pb.ProductFilter, afterID string) []*pb.Product {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var matches []*pb.Product
+	for id, product := range store.data[tenant] {
+		if id > afterID && productMatches(filter, product) {
+			matches = append(matches, proto.Clone(product).(*pb.Product))
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].GetId() < matches[j].GetId()
+	})
+
+	return matches
+}
+
+// productMatches() function reports whether the product matches every criterion of the filter.
+func productMatches(filter *pb.ProductFilter, product *pb.Product) bool {
+	if filter.GetName() != "" && !containsFold(product.GetName(), filter.GetName()) {
+		return false
+	}
+
+	if filter.GetMinPrice() != 0 {
+		if cmp, ok := compareProductPrice(product, filter.GetMinPrice()); !ok || cmp < 0 {
+			return false
+		}
+	}
+
+	if filter.GetMaxPrice() != 0 {
+		if cmp, ok := compareProductPrice(product, filter.GetMaxPrice()); !ok || cmp > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareProductPrice() function compares the list price of a product with a
+// price bound of a filter, exactly. ok is false when they cannot be compared,
+// such as when the product is not priced in USD.
+func compareProductPrice(product *pb.Product, bound float32) (int, bool) {
+	cmp, err := money.Compare(productPrice(product), usdFromFloat(float64(bound), 32))
+	return cmp, err == nil
+}
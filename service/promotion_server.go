@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PromotionServer is the server that lets admins manage the promotions
+type PromotionServer struct {
+	pb.UnimplementedPromotionServiceServer
+	promotionStore PromotionStore
+}
+
+// NewPromotionServer returns a new PromotionServer
+func NewPromotionServer(promotionStore PromotionStore) *PromotionServer {
+	return &PromotionServer{
+		promotionStore: promotionStore,
+	}
+}
+
+// CreatePromotion is a unary RPC to create a new promotion, which is active right away
+func (server *PromotionServer) CreatePromotion(ctx context.Context, req *pb.CreatePromotionRequest) (*pb.Promotion, error) {
+	promotion := proto.Clone(req.GetPromotion()).(*pb.Promotion)
+
+	if invalid := validatePromotion(promotion); invalid != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", invalid)
+	}
+
+	if promotion.GetId() != "" || promotion.GetTimesUsed() != 0 || promotion.GetActive() || promotion.GetCreatedAt() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "promotion id, times used, active and creation time are set by the server")
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot generate a new promotion ID: %v", err)
+	}
+
+	promotion.Id = id.String()
+	promotion.Active = true
+	promotion.CreatedAt = timestamppb.Now()
+
+	err = server.promotionStore.Save(ctx, promotion)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot save promotion to the store: %v", err)
+	}
+
+	log.Printf("saved promotion %q with id: %s", promotion.GetName(), promotion.GetId())
+
+	return promotion, nil
+}
+
+// GetPromotion is a unary RPC to get a promotion by ID
+func (server *PromotionServer) GetPromotion(ctx context.Context, req *pb.GetPromotionRequest) (*pb.Promotion, error) {
+	promotion, err := server.promotionStore.Find(ctx, req.GetId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find promotion: %v", err)
+	}
+
+	if promotion == nil {
+		return nil, status.Errorf(codes.NotFound, "promotion %s not found", req.GetId())
+	}
+
+	return promotion, nil
+}
+
+// ListPromotions is a unary RPC that returns the promotions, in order of ID
+func (server *PromotionServer) ListPromotions(ctx context.Context, req *pb.ListPromotionsRequest) (*pb.ListPromotionsResponse, error) {
+	res := &pb.ListPromotionsResponse{}
+
+	err := server.promotionStore.List(ctx, func(promotion *pb.Promotion) error {
+		if promotion.GetActive() || req.GetIncludeInactive() {
+			res.Promotions = append(res.Promotions, promotion)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot list promotions: %v", err)
+	}
+
+	return res, nil
+}
+
+// DeactivatePromotion is a unary RPC that stops a promotion from being applied to new orders
+func (server *PromotionServer) DeactivatePromotion(ctx context.Context, req *pb.DeactivatePromotionRequest) (*pb.Promotion, error) {
+	var deactivated *pb.Promotion
+
+	err := server.promotionStore.Update(ctx, req.GetId(), func(promotion *pb.Promotion) error {
+		promotion.Active = false
+		deactivated = promotion
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "promotion %s not found", req.GetId())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot deactivate promotion: %v", err)
+	}
+
+	log.Printf("deactivated promotion with id: %s", req.GetId())
+
+	return proto.Clone(deactivated).(*pb.Promotion), nil
+}
@@ -0,0 +1,224 @@
+package service_test
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	sampledata "gRPC-Playground/sample-data"
+	"gRPC-Playground/service"
+	"net"
+	"testing"
+	"time"
+
+	wrapper "github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPromotionPricing(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sampledata.NewLaptop()
+	laptop.Brand = "Apple"
+	laptop.Price = usd(t, "1000")
+	require.NoError(t, laptopStore.Save(context.Background(), laptop))
+
+	catalogServer := grpc.NewServer()
+	pb.RegisterProductInfoServer(catalogServer, &testProductInfoServer{products: map[string]*pb.Product{
+		"echo": {Id: "echo", Name: "Amazon Echo", Price: 29.99},
+		"dot":  {Id: "dot", Name: "Echo Dot", Price: 50},
+	}})
+	pb.RegisterLaptopServiceServer(catalogServer, service.NewLaptopServer(laptopStore, nil, nil))
+
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go catalogServer.Serve(listener)
+	t.Cleanup(catalogServer.Stop)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	promotionStore := service.NewInMemoryPromotionStore()
+	promotionServer := service.NewPromotionServer(promotionStore)
+	pricer := service.NewOrderPricer(pb.NewProductInfoClient(conn), pb.NewLaptopServiceClient(conn), 0.1)
+	orderClient := newTestOrderClient(t, service.NewOrderManagementServer(service.NewInMemoryOrderStore(),
+		service.WithOrderPricing(pricer), service.WithPromotions(promotionStore)))
+	ctx := context.Background()
+
+	create := func(promotion *pb.Promotion) *pb.Promotion {
+		created, err := promotionServer.CreatePromotion(ctx, &pb.CreatePromotionRequest{Promotion: promotion})
+		require.NoError(t, err)
+		return created
+	}
+
+	now := time.Now()
+	brandWide := create(&pb.Promotion{
+		Name:     "10% off Apple",
+		Discount: &pb.Promotion_PercentageOff{PercentageOff: &pb.PercentageOff{Percent: 10}},
+		Scope:    &pb.PromotionScope{Brands: []string{"apple"}},
+		Priority: 1,
+	})
+	threeForTwo := create(&pb.Promotion{
+		Name:     "3 Echo for 2",
+		Discount: &pb.Promotion_BuyXGetY{BuyXGetY: &pb.BuyXGetY{Buy: 2, Get: 1}},
+		Scope:    &pb.PromotionScope{ProductIds: []string{"echo"}},
+	})
+	firstOrder := create(&pb.Promotion{
+		Name:       "$15 off the first order",
+		Discount:   &pb.Promotion_FixedAmountOff{FixedAmountOff: &pb.FixedAmountOff{Amount: 15}},
+		UsageLimit: 1,
+	})
+	create(&pb.Promotion{
+		Name:     "expired",
+		Discount: &pb.Promotion_PercentageOff{PercentageOff: &pb.PercentageOff{Percent: 50}},
+		EndsAt:   timestamppb.New(now.Add(-time.Hour)),
+	})
+	create(&pb.Promotion{
+		Name:     "upcoming",
+		Discount: &pb.Promotion_PercentageOff{PercentageOff: &pb.PercentageOff{Percent: 50}},
+		StartsAt: timestamppb.New(now.Add(time.Hour)),
+	})
+
+	_, err = promotionServer.CreatePromotion(ctx, &pb.CreatePromotionRequest{Promotion: &pb.Promotion{
+		Name:     "too much",
+		Discount: &pb.Promotion_PercentageOff{PercentageOff: &pb.PercentageOff{Percent: 150}},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	lineItems := func() []*pb.OrderItem {
+		return []*pb.OrderItem{
+			{Product: &pb.OrderItem_ProductId{ProductId: "echo"}, Quantity: 3},
+			{Product: &pb.OrderItem_LaptopId{LaptopId: laptop.GetId()}, Quantity: 1},
+			{Product: &pb.OrderItem_ProductId{ProductId: "dot"}, Quantity: 1},
+		}
+	}
+	placeOrder := func() *pb.Order {
+		res, err := orderClient.AddOrder(ctx, &pb.Order{LineItems: lineItems(), Destination: "San Jose, CA"})
+		require.NoError(t, err)
+
+		order, err := orderClient.GetOrder(ctx, res)
+		require.NoError(t, err)
+		return order
+	}
+	promotionIDs := func(order *pb.Order) []string {
+		var ids []string
+		for _, applied := range order.GetPromotions() {
+			ids = append(ids, applied.GetPromotionId())
+		}
+		return ids
+	}
+
+	// the running promotions are applied, the tax is computed after the discount.
+	order := placeOrder()
+	require.Equal(t, 1139.97, order.GetSubtotal())
+	require.Equal(t, 144.99, order.GetDiscount())
+	require.Equal(t, 99.5, order.GetTax())
+	require.Equal(t, 1094.48, order.GetTotal())
+	require.Equal(t, brandWide.GetId(), order.GetPromotions()[0].GetPromotionId())
+	require.Equal(t, 100.0, order.GetPromotions()[0].GetAmount())
+	require.True(t, proto.Equal(usd(t, "100"), order.GetPromotions()[0].GetDiscountAmount()))
+	require.True(t, proto.Equal(usd(t, "144.99"), order.GetDiscountAmount()))
+	require.True(t, proto.Equal(usd(t, "1094.48"), order.GetTotalAmount()))
+	require.ElementsMatch(t, []string{brandWide.GetId(), threeForTwo.GetId(), firstOrder.GetId()}, promotionIDs(order))
+
+	// the usage limit of a promotion is counted by order, and the same order prices the same.
+	redeemed, err := promotionServer.GetPromotion(ctx, &pb.GetPromotionRequest{Id: firstOrder.GetId()})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, redeemed.GetTimesUsed())
+
+	second := placeOrder()
+	require.Equal(t, 129.99, second.GetDiscount())
+	require.Equal(t, second.GetTotal(), placeOrder().GetTotal())
+
+	// a deactivated promotion is no longer applied to new orders...
+	_, err = promotionServer.DeactivatePromotion(ctx, &pb.DeactivatePromotionRequest{Id: brandWide.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, 29.99, placeOrder().GetDiscount())
+
+	// ...but the orders placed with it keep it when their line items change.
+	stream, err := orderClient.BatchUpdateOrders(ctx)
+	require.NoError(t, err)
+	items := lineItems()[:2]
+	require.NoError(t, stream.Send(&pb.UpdateOrderRequest{
+		Order:      &pb.Order{Id: order.GetId(), LineItems: items},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"line_items"}},
+	}))
+	summary, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, summary.GetUpdated())
+
+	updated, err := orderClient.GetOrder(ctx, &wrapper.StringValue{Value: order.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, 144.99, updated.GetDiscount())
+	require.ElementsMatch(t, promotionIDs(order), promotionIDs(updated))
+
+	// the discount and promotions of an order are set by the server.
+	_, err = orderClient.AddOrder(ctx, &pb.Order{LineItems: lineItems(), Destination: "San Jose, CA", Discount: 10})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPromotionTenants(t *testing.T) {
+	t.Parallel()
+
+	defaultCtx := userContext("alice", "user")
+	acmeCtx := service.ContextWithTenant(defaultCtx, "acme")
+	acmeAdminCtx := service.ContextWithTenant(adminContext(), "acme")
+
+	// both storefronts sell the same product.
+	productStore := service.NewInMemoryProductStore()
+	for _, ctx := range []context.Context{defaultCtx, acmeCtx} {
+		require.NoError(t, productStore.Save(ctx, &pb.Product{Id: "echo", Name: "Amazon Echo", ListPrice: usd(t, "50")}))
+	}
+
+	promotionStore := service.NewInMemoryPromotionStore()
+	promotionServer := service.NewPromotionServer(promotionStore)
+	pricer := service.NewOrderPricer(
+		service.LocalProductCatalog(service.NewProductInfoServer(productStore)),
+		service.LocalLaptopCatalog(service.NewLaptopServer(service.NewInMemoryLaptopStore(), nil, nil)),
+		0.1,
+	)
+	server := service.NewOrderManagementServer(service.NewInMemoryOrderStore(),
+		service.WithOrderPricing(pricer), service.WithPromotions(promotionStore))
+
+	// an admin of acme gives everything away, in acme only.
+	free, err := promotionServer.CreatePromotion(acmeAdminCtx, &pb.CreatePromotionRequest{Promotion: &pb.Promotion{
+		Name:     "everything free",
+		Discount: &pb.Promotion_PercentageOff{PercentageOff: &pb.PercentageOff{Percent: 100}},
+	}})
+	require.NoError(t, err)
+
+	placeOrder := func(ctx context.Context) *pb.Order {
+		order := &pb.Order{
+			LineItems:   []*pb.OrderItem{{Product: &pb.OrderItem_ProductId{ProductId: "echo"}, Quantity: 1}},
+			Destination: "San Jose, CA",
+		}
+		_, err := server.AddOrder(ctx, order)
+		require.NoError(t, err)
+		return order
+	}
+
+	order := placeOrder(defaultCtx)
+	require.Empty(t, order.GetPromotions())
+	require.True(t, proto.Equal(usd(t, "55"), order.GetTotalAmount()))
+
+	order = placeOrder(acmeCtx)
+	require.Len(t, order.GetPromotions(), 1)
+	require.True(t, proto.Equal(usd(t, "0"), order.GetTotalAmount()))
+
+	// the other tenants can neither see nor deactivate it.
+	_, err = promotionServer.GetPromotion(adminContext(), &pb.GetPromotionRequest{Id: free.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = promotionServer.DeactivatePromotion(adminContext(), &pb.DeactivatePromotionRequest{Id: free.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	listed, err := promotionServer.ListPromotions(adminContext(), &pb.ListPromotionsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, listed.GetPromotions())
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"errors"
+	pb "gRPC-Playground/ecommerce"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrUsageLimitReached is returned when a promotion has been applied to as many orders as its usage limit.
+var ErrUsageLimitReached = errors.New("promotion usage limit reached")
+
+// PromotionStore is an interface to store the promotions of the PromotionService.
+// Like the CartStore, promotions are kept per tenant: every method works on the
+// promotions of the tenant carried by the context, so the promotions of a
+// tenant are only applied to its own orders.
+type PromotionStore interface {
+	// Save saves a new promotion to the store
+	Save(ctx context.Context, promotion *pb.Promotion) error
+
+	// Find finds a promotion by ID, it returns nil if the promotion is not found
+	Find(ctx context.Context, id string) (*pb.Promotion, error)
+
+	// Update calls update with a copy of the promotion with the given ID, and
+	// saves the copy if update returns nil. It returns ErrNotFound if there is
+	// no such promotion.
+	Update(ctx context.Context, id string, update func(promotion *pb.Promotion) error) error
+
+	// List reports all the promotions one by one, in order of ID, via the found callback.
+	List(ctx context.Context, found func(promotion *pb.Promotion) error) error
+
+	// Redeem counts one more use of each of the promotions, all at once: if one
+	// of them has reached its usage limit, nothing is counted and
+	// ErrUsageLimitReached is returned.
+	Redeem(ctx context.Context, ids []string) error
+
+	// Unredeem takes back the uses counted by Redeem.
+	Unredeem(ctx context.Context, ids []string) error
+}
+
+// InMemoryPromotionStore stores promotions in memory
+type InMemoryPromotionStore struct {
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the promotion ID,
+	// and the value is the promotion object.
+	data map[string]map[string]*pb.Promotion
+}
+
+// NewInMemoryPromotionStore returns a new InMemoryPromotionStore
+func NewInMemoryPromotionStore() *InMemoryPromotionStore {
+	return &InMemoryPromotionStore{
+		data: make(map[string]map[string]*pb.Promotion),
+	}
+}
+
+// Save saves the promotion to the store
+func (store *InMemoryPromotionStore) Save(ctx context.Context, promotion *pb.Promotion) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// get the promotions of the caller's tenant, creating its partition on first use.
+	tenant := TenantFromContext(ctx)
+	promotions := store.data[tenant]
+	if promotions == nil {
+		promotions = make(map[string]*pb.Promotion)
+		store.data[tenant] = promotions
+	}
+
+	if promotions[promotion.GetId()] != nil {
+		return ErrAlreadyExists
+	}
+
+	promotions[promotion.GetId()] = proto.Clone(promotion).(*pb.Promotion)
+	return nil
+}
+
+// Find finds a promotion by ID
+func (store *InMemoryPromotionStore) Find(ctx context.Context, id string) (*pb.Promotion, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	promotion := store.data[TenantFromContext(ctx)][id]
+	if promotion == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(promotion).(*pb.Promotion), nil
+}
+
+// Update updates a promotion
+func (store *InMemoryPromotionStore) Update(ctx context.Context, id string, update func(promotion *pb.Promotion) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	promotions := store.data[TenantFromContext(ctx)]
+	promotion := promotions[id]
+	if promotion == nil {
+		return ErrNotFound
+	}
+
+	updated := proto.Clone(promotion).(*pb.Promotion)
+	err := update(updated)
+	if err != nil {
+		return err
+	}
+
+	promotions[id] = updated
+	return nil
+}
+
+// List lists the promotions
+func (store *InMemoryPromotionStore) List(ctx context.Context, found func(promotion *pb.Promotion) error) error {
+	store.mutex.RLock()
+	tenantPromotions := store.data[TenantFromContext(ctx)]
+	promotions := make([]*pb.Promotion, 0, len(tenantPromotions))
+	for _, promotion := range tenantPromotions {
+		promotions = append(promotions, proto.Clone(promotion).(*pb.Promotion))
+	}
+	store.mutex.RUnlock()
+
+	sort.Slice(promotions, func(i, j int) bool {
+		return promotions[i].GetId() < promotions[j].GetId()
+	})
+
+	for _, promotion := range promotions {
+		err := found(promotion)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Redeem counts a use of the promotions
+func (store *InMemoryPromotionStore) Redeem(ctx context.Context, ids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	promotions := store.data[TenantFromContext(ctx)]
+
+	// every promotion is checked before any use is counted.
+	for _, id := range ids {
+		promotion := promotions[id]
+		if promotion == nil {
+			return ErrNotFound
+		}
+		if promotion.GetUsageLimit() > 0 && promotion.GetTimesUsed() >= promotion.GetUsageLimit() {
+			return ErrUsageLimitReached
+		}
+	}
+
+	for _, id := range ids {
+		promotions[id].TimesUsed++
+	}
+
+	return nil
+}
+
+// Unredeem takes back a use of the promotions
+func (store *InMemoryPromotionStore) Unredeem(ctx context.Context, ids []string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	promotions := store.data[TenantFromContext(ctx)]
+	for _, id := range ids {
+		if promotion := promotions[id]; promotion != nil && promotion.GetTimesUsed() > 0 {
+			promotion.TimesUsed--
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	pb "gRPC-Playground/ecommerce"
+	"gRPC-Playground/money"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// promotionRunning() function reports whether a promotion can be applied to a
+// new order placed at the given time.
+func promotionRunning(promotion *pb.Promotion, at time.Time) bool {
+	if !promotion.GetActive() {
+		return false
+	}
+
+	if promotion.GetStartsAt() != nil && at.Before(promotion.GetStartsAt().AsTime()) {
+		return false
+	}
+
+	if promotion.GetEndsAt() != nil && !at.Before(promotion.GetEndsAt().AsTime()) {
+		return false
+	}
+
+	return promotion.GetUsageLimit() == 0 || promotion.GetTimesUsed() < promotion.GetUsageLimit()
+}
+
+// promotionCovers() function reports whether a line of an order is in the scope of a promotion.
+func promotionCovers(scope *pb.PromotionScope, item *pb.OrderItem) bool {
+	if len(scope.GetProductIds()) == 0 && len(scope.GetLaptopIds()) == 0 && len(scope.GetBrands()) == 0 {
+		return true
+	}
+
+	if item.GetProductId() != "" && containsString(scope.GetProductIds(), item.GetProductId()) {
+		return true
+	}
+
+	if item.GetLaptopId() != "" && containsString(scope.GetLaptopIds(), item.GetLaptopId()) {
+		return true
+	}
+
+	return item.GetBrand() != "" && containsFoldString(scope.GetBrands(), item.GetBrand())
+}
+
+// applyPromotions() function takes the discounts of the promotions off a
+// priced order, records the promotions that took something off, and computes
+// the tax and the total again.
+//
+// The promotions are applied in order of priority, highest first, then of ID.
+// Each one takes its discount off what the promotions before it left of the
+// lines it covers, so a line never gets more than its total off, and the same
+// order with the same promotions always gets the same price. The discounts are
+// exact Money amounts in whole cents, an amount that overflows is reported as
+// an InvalidArgument error.
+func applyPromotions(order *pb.Order, promotions []*pb.Promotion, taxRate float64) error {
+	promotions = append([]*pb.Promotion(nil), promotions...)
+	sort.Slice(promotions, func(i, j int) bool {
+		if promotions[i].GetPriority() != promotions[j].GetPriority() {
+			return promotions[i].GetPriority() > promotions[j].GetPriority()
+		}
+		return promotions[i].GetId() < promotions[j].GetId()
+	})
+
+	// remaining is what is left of each line after the promotions applied so far.
+	remaining := make([]*pb.Money, len(order.GetLineItems()))
+	for i, item := range order.GetLineItems() {
+		remaining[i] = item.GetLineAmount()
+	}
+
+	zero := &pb.Money{CurrencyCode: defaultCurrency}
+	discount := zero
+	order.Promotions = nil
+	for _, promotion := range promotions {
+		amount := zero
+		for i, item := range order.GetLineItems() {
+			if !promotionCovers(promotion.GetScope(), item) || money.Sign(remaining[i]) <= 0 {
+				continue
+			}
+
+			line, err := lineDiscount(promotion, item, remaining[i], amount)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "cannot apply promotion %s: %v", promotion.GetId(), err)
+			}
+			cmp, err := money.Compare(line, remaining[i])
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "cannot apply promotion %s: %v", promotion.GetId(), err)
+			}
+			if cmp > 0 {
+				line = remaining[i]
+			}
+
+			remaining[i], err = money.Subtract(remaining[i], line)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "cannot apply promotion %s: %v", promotion.GetId(), err)
+			}
+			amount, err = money.Add(amount, line)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "cannot apply promotion %s: %v", promotion.GetId(), err)
+			}
+		}
+
+		if money.Sign(amount) <= 0 {
+			continue
+		}
+
+		order.Promotions = append(order.Promotions, &pb.AppliedPromotion{
+			PromotionId:    promotion.GetId(),
+			Name:           promotion.GetName(),
+			Amount:         usdToFloat(amount),
+			DiscountAmount: amount,
+		})
+
+		var err error
+		discount, err = money.Add(discount, amount)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cannot apply promotion %s: %v", promotion.GetId(), err)
+		}
+	}
+
+	return setOrderTotals(order, discount, taxRate)
+}
+
+// lineDiscount() function returns what a promotion takes off a line, of which
+// remaining is left, rounded to the cent. taken is what the promotion has
+// already taken off the previous lines of the order.
+func lineDiscount(promotion *pb.Promotion, item *pb.OrderItem, remaining *pb.Money, taken *pb.Money) (*pb.Money, error) {
+	switch discount := promotion.GetDiscount().(type) {
+	case *pb.Promotion_PercentageOff:
+		percent := ratFromFloat(discount.PercentageOff.GetPercent())
+		return money.Scale(remaining, percent.Quo(percent, big.NewRat(100, 1)))
+
+	case *pb.Promotion_FixedAmountOff:
+		// the amount is taken off the lines one after the other.
+		fixed, err := money.FromFloat(defaultCurrency, discount.FixedAmountOff.GetAmount(), 64)
+		if err != nil {
+			return nil, err
+		}
+		fixed, err = money.Scale(fixed, big.NewRat(1, 1))
+		if err != nil {
+			return nil, err
+		}
+		left, err := money.Subtract(fixed, taken)
+		if err != nil || money.Sign(left) < 0 {
+			return &pb.Money{CurrencyCode: defaultCurrency}, err
+		}
+		return left, nil
+
+	case *pb.Promotion_BuyXGetY:
+		buy, get := discount.BuyXGetY.GetBuy(), discount.BuyXGetY.GetGet()
+		free := item.GetQuantity() / (buy + get) * get
+		return money.Multiply(item.GetUnitAmount(), int64(free))
+	}
+
+	return &pb.Money{CurrencyCode: defaultCurrency}, nil
+}
+
+// validatePromotion() function checks the fields of a promotion sent by an
+// admin, and returns a description of the first invalid one, or an empty string.
+func validatePromotion(promotion *pb.Promotion) string {
+	if strings.TrimSpace(promotion.GetName()) == "" {
+		return "promotion name is required"
+	}
+
+	switch discount := promotion.GetDiscount().(type) {
+	case *pb.Promotion_PercentageOff:
+		percent := discount.PercentageOff.GetPercent()
+		if !(percent > 0 && percent <= 100) {
+			return "percentage off must be greater than 0 and at most 100"
+		}
+	case *pb.Promotion_FixedAmountOff:
+		amount := discount.FixedAmountOff.GetAmount()
+		if !(amount > 0) || math.IsInf(amount, 0) {
+			return "fixed amount off must be greater than 0"
+		}
+	case *pb.Promotion_BuyXGetY:
+		if discount.BuyXGetY.GetBuy() < 1 || discount.BuyXGetY.GetGet() < 1 {
+			return "buy X get Y needs at least 1 unit to buy and 1 unit to get"
+		}
+	default:
+		return "promotion discount is required"
+	}
+
+	if promotion.GetStartsAt() != nil && promotion.GetEndsAt() != nil &&
+		!promotion.GetEndsAt().AsTime().After(promotion.GetStartsAt().AsTime()) {
+		return "promotion must end after it starts"
+	}
+
+	return ""
+}
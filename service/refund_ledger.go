@@ -0,0 +1,93 @@
+package service
+
+import (
+	pb "gRPC-Playground/ecommerce"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// RefundLedger records the refunds of the orders.
+type RefundLedger interface {
+	// Record records a refund. Recording a refund whose ID is already in the
+	// ledger does nothing, so that a resumed saga cannot refund twice.
+	Record(refund *pb.Refund) error
+	// Void marks a refund as voided. Voiding an unknown refund does nothing.
+	Void(id string) error
+	// Find finds a refund by ID, it returns nil if the refund is not found
+	Find(id string) (*pb.Refund, error)
+	// FindByOrder returns the refunds of an order, oldest first.
+	FindByOrder(orderID string) ([]*pb.Refund, error)
+}
+
+// InMemoryRefundLedger stores refunds in memory
+type InMemoryRefundLedger struct {
+	mutex sync.RWMutex
+	// key is the refund ID, and the value is the refund object.
+	refunds map[string]*pb.Refund
+}
+
+// NewInMemoryRefundLedger returns a new InMemoryRefundLedger
+func NewInMemoryRefundLedger() *InMemoryRefundLedger {
+	return &InMemoryRefundLedger{
+		refunds: make(map[string]*pb.Refund),
+	}
+}
+
+// Record records a refund
+func (ledger *InMemoryRefundLedger) Record(refund *pb.Refund) error {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	if ledger.refunds[refund.GetId()] != nil {
+		return nil
+	}
+
+	ledger.refunds[refund.GetId()] = proto.Clone(refund).(*pb.Refund)
+	return nil
+}
+
+// Void voids a refund
+func (ledger *InMemoryRefundLedger) Void(id string) error {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	if refund := ledger.refunds[id]; refund != nil {
+		refund.Voided = true
+	}
+
+	return nil
+}
+
+// Find finds a refund by ID
+func (ledger *InMemoryRefundLedger) Find(id string) (*pb.Refund, error) {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	refund := ledger.refunds[id]
+	if refund == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(refund).(*pb.Refund), nil
+}
+
+// FindByOrder returns the refunds of an order
+func (ledger *InMemoryRefundLedger) FindByOrder(orderID string) ([]*pb.Refund, error) {
+	ledger.mutex.RLock()
+	defer ledger.mutex.RUnlock()
+
+	var refunds []*pb.Refund
+	for _, refund := range ledger.refunds {
+		if refund.GetOrderId() == orderID {
+			refunds = append(refunds, proto.Clone(refund).(*pb.Refund))
+		}
+	}
+
+	sort.Slice(refunds, func(i, j int) bool {
+		return refunds[i].GetTime().AsTime().Before(refunds[j].GetTime().AsTime())
+	})
+
+	return refunds, nil
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SagaEvent is the kind of a saga log record.
+type SagaEvent string
+
+const (
+	SagaStarted         SagaEvent = "started"
+	SagaStepDone        SagaEvent = "step_done"
+	SagaStepCompensated SagaEvent = "step_compensated"
+	// SagaCompleted, SagaRolledBack and SagaFailed finish a saga. A failed saga
+	// could neither complete nor roll back, and needs an operator.
+	SagaCompleted  SagaEvent = "completed"
+	SagaRolledBack SagaEvent = "rolled_back"
+	SagaFailed     SagaEvent = "failed"
+)
+
+// SagaRecord is one line of the saga log.
+type SagaRecord struct {
+	SagaID string    `json:"saga_id"`
+	Event  SagaEvent `json:"event"`
+	Time   time.Time `json:"time"`
+	// Kind, Tenant, OrderID, Actor, Reason, RefundAmount and Paid describe the
+	// saga, they are only set on its started record. Amount is the legacy value
+	// of RefundAmount, the only one in the records written before it.
+	Kind         string    `json:"kind,omitempty"`
+	Tenant       string    `json:"tenant,omitempty"`
+	OrderID      string    `json:"order_id,omitempty"`
+	Actor        string    `json:"actor,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Amount       float64   `json:"amount,omitempty"`
+	RefundAmount *pb.Money `json:"refund_amount,omitempty"`
+	Paid         bool      `json:"paid,omitempty"`
+	// Step is the step of a step_done or step_compensated record.
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SagaLog records the progress of the sagas, so that the sagas interrupted by
+// a crash can be resumed or rolled back when the server starts again.
+type SagaLog interface {
+	// Append sets the time of the record, and appends it to the log.
+	// The record is durable when Append returns.
+	Append(record *SagaRecord) error
+	// Unfinished returns the records of the sagas that are not finished,
+	// saga by saga, in the order the sagas started.
+	Unfinished() ([][]*SagaRecord, error)
+}
+
+// sagaLogState keeps the records of the unfinished sagas.
+type sagaLogState struct {
+	// key is the saga ID, and the value is the records of the saga.
+	records map[string][]*SagaRecord
+	// started is the saga IDs in the order the sagas started.
+	started []string
+}
+
+func newSagaLogState() *sagaLogState {
+	return &sagaLogState{
+		records: make(map[string][]*SagaRecord),
+	}
+}
+
+func (state *sagaLogState) apply(record *SagaRecord) {
+	switch record.Event {
+	case SagaStarted:
+		state.started = append(state.started, record.SagaID)
+		state.records[record.SagaID] = []*SagaRecord{record}
+
+	case SagaCompleted, SagaRolledBack, SagaFailed:
+		delete(state.records, record.SagaID)
+
+	default:
+		if _, ok := state.records[record.SagaID]; ok {
+			state.records[record.SagaID] = append(state.records[record.SagaID], record)
+		}
+	}
+}
+
+func (state *sagaLogState) unfinished() [][]*SagaRecord {
+	var unfinished [][]*SagaRecord
+	started := state.started[:0]
+
+	for _, sagaID := range state.started {
+		records, ok := state.records[sagaID]
+		if !ok {
+			continue
+		}
+
+		started = append(started, sagaID)
+		unfinished = append(unfinished, append([]*SagaRecord(nil), records...))
+	}
+
+	// forget the finished sagas, so that started does not grow forever.
+	state.started = started
+	return unfinished
+}
+
+// InMemorySagaLog keeps the saga log in memory. It does not survive a restart.
+type InMemorySagaLog struct {
+	mutex sync.Mutex
+	state *sagaLogState
+}
+
+// NewInMemorySagaLog returns a new InMemorySagaLog
+func NewInMemorySagaLog() *InMemorySagaLog {
+	return &InMemorySagaLog{
+		state: newSagaLogState(),
+	}
+}
+
+func (sagaLog *InMemorySagaLog) Append(record *SagaRecord) error {
+	sagaLog.mutex.Lock()
+	defer sagaLog.mutex.Unlock()
+
+	record.Time = time.Now().UTC()
+	sagaLog.state.apply(record)
+	return nil
+}
+
+func (sagaLog *InMemorySagaLog) Unfinished() ([][]*SagaRecord, error) {
+	sagaLog.mutex.Lock()
+	defer sagaLog.mutex.Unlock()
+
+	return sagaLog.state.unfinished(), nil
+}
+
+// FileSagaLog writes the saga log as JSON lines into a file, and syncs the file
+// after every record. When it is opened, the file is compacted to the records
+// of the unfinished sagas.
+type FileSagaLog struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+	state *sagaLogState
+}
+
+// NewFileSagaLog opens the saga log file, creating it if needed, and loads the
+// unfinished sagas from it.
+func NewFileSagaLog(path string) (*FileSagaLog, error) {
+	sagaLog := &FileSagaLog{
+		path:  path,
+		state: newSagaLogState(),
+	}
+
+	err := sagaLog.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sagaLog.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	sagaLog.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open saga log: %w", err)
+	}
+
+	return sagaLog, nil
+}
+
+// load() function reads the records of the log file. A last line cut short by
+// a crash is ignored, since its record was never acknowledged.
+func (sagaLog *FileSagaLog) load() error {
+	file, err := os.Open(sagaLog.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open saga log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var invalidLine int
+	for line := 1; scanner.Scan(); line++ {
+		if invalidLine > 0 {
+			return fmt.Errorf("saga log line %d is invalid", invalidLine)
+		}
+
+		record := &SagaRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			invalidLine = line
+			continue
+		}
+
+		sagaLog.state.apply(record)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("cannot read saga log: %w", err)
+	}
+
+	if invalidLine > 0 {
+		log.Printf("ignoring the incomplete last line of the saga log")
+	}
+
+	return nil
+}
+
+// compact() function rewrites the log file with the records of the unfinished
+// sagas only. The new file replaces the old one atomically.
+func (sagaLog *FileSagaLog) compact() error {
+	tmpPath := sagaLog.path + ".tmp"
+
+	err := os.MkdirAll(filepath.Dir(sagaLog.path), 0o700)
+	if err != nil {
+		return fmt.Errorf("cannot create saga log folder: %w", err)
+	}
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot create saga log: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, records := range sagaLog.state.unfinished() {
+		for _, record := range records {
+			line, err := json.Marshal(record)
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("cannot marshal saga record: %w", err)
+			}
+
+			writer.Write(append(line, '\n'))
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write saga log: %w", err)
+	}
+
+	err = os.Rename(tmpPath, sagaLog.path)
+	if err != nil {
+		return fmt.Errorf("cannot replace saga log: %w", err)
+	}
+
+	return nil
+}
+
+func (sagaLog *FileSagaLog) Append(record *SagaRecord) error {
+	sagaLog.mutex.Lock()
+	defer sagaLog.mutex.Unlock()
+
+	record.Time = time.Now().UTC()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot marshal saga record: %w", err)
+	}
+
+	_, err = sagaLog.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("cannot write saga record: %w", err)
+	}
+
+	err = sagaLog.file.Sync()
+	if err != nil {
+		return fmt.Errorf("cannot sync saga log: %w", err)
+	}
+
+	sagaLog.state.apply(record)
+	return nil
+}
+
+func (sagaLog *FileSagaLog) Unfinished() ([][]*SagaRecord, error) {
+	sagaLog.mutex.Lock()
+	defer sagaLog.mutex.Unlock()
+
+	return sagaLog.state.unfinished(), nil
+}
+
+// Close closes the log file.
+func (sagaLog *FileSagaLog) Close() error {
+	sagaLog.mutex.Lock()
+	defer sagaLog.mutex.Unlock()
+
+	return sagaLog.file.Close()
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrIncorrectSecondFactor is returned when a TOTP code or a recovery code is wrong,
+// or when a TOTP code has already been used.
+var ErrIncorrectSecondFactor = errors.New("incorrect second factor")
+
+const (
+	// secondFactorChallengeTTL is how long the user has to answer a challenge
+	secondFactorChallengeTTL = 5 * time.Minute
+	// maxSecondFactorAttempts is the number of answers a challenge accepts.
+	// After that the user has to enter the password again.
+	maxSecondFactorAttempts = 3
+)
+
+// secondFactorChallenge is a login whose password was correct, waiting for the second factor.
+type secondFactorChallenge struct {
+	tenant    string
+	username  string
+	expiresAt time.Time
+	attempts  int
+}
+
+// secondFactorChallenges keeps the open login challenges in memory.
+type secondFactorChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]*secondFactorChallenge
+}
+
+func newSecondFactorChallenges() *secondFactorChallenges {
+	return &secondFactorChallenges{
+		challenges: make(map[string]*secondFactorChallenge),
+	}
+}
+
+// open() function opens a challenge for the user, and returns its random ID.
+func (challenges *secondFactorChallenges) open(tenant, username string, now time.Time) (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate challenge id: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(random)
+
+	challenges.mutex.Lock()
+	defer challenges.mutex.Unlock()
+
+	// forget the challenges nobody answered, so that they do not pile up.
+	for challengeID, challenge := range challenges.challenges {
+		if !now.Before(challenge.expiresAt) {
+			delete(challenges.challenges, challengeID)
+		}
+	}
+
+	challenges.challenges[id] = &secondFactorChallenge{
+		tenant:    tenant,
+		username:  username,
+		expiresAt: now.Add(secondFactorChallengeTTL),
+	}
+
+	return id, nil
+}
+
+// attempt() function counts an answer to the challenge, and returns a copy of it.
+// It returns false if the challenge is unknown, expired, or has no attempts left.
+func (challenges *secondFactorChallenges) attempt(id string, now time.Time) (secondFactorChallenge, bool) {
+	challenges.mutex.Lock()
+	defer challenges.mutex.Unlock()
+
+	challenge := challenges.challenges[id]
+	if challenge == nil {
+		return secondFactorChallenge{}, false
+	}
+
+	challenge.attempts++
+	if !now.Before(challenge.expiresAt) || challenge.attempts > maxSecondFactorAttempts {
+		delete(challenges.challenges, id)
+		return secondFactorChallenge{}, false
+	}
+
+	return *challenge, true
+}
+
+// close() function removes an answered challenge.
+func (challenges *secondFactorChallenges) close(id string) {
+	challenges.mutex.Lock()
+	defer challenges.mutex.Unlock()
+
+	delete(challenges.challenges, id)
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The services a server can host, as they are named in the services of a ServerConfig.
+const (
+	AuthServiceName      = "auth"
+	APIKeyServiceName    = "apikey"
+	LaptopServiceName    = "laptop"
+	ProductServiceName   = "product"
+	OrderServiceName     = "order"
+	PromotionServiceName = "promotion"
+	CartServiceName      = "cart"
+)
+
+// serverServices are the services a server can host.
+var serverServices = []string{
+	AuthServiceName, APIKeyServiceName, LaptopServiceName, ProductServiceName,
+	OrderServiceName, PromotionServiceName, CartServiceName,
+}
+
+// memoryStoreBackend is the only store backend for now, which keeps the records in memory.
+const memoryStoreBackend = "memory"
+
+// configEnvPrefix is the prefix of the environment variables overriding a ServerConfig.
+const configEnvPrefix = "SERVER"
+
+// exampleTokenSecret is the token secret of the examples, which anyone can
+// sign access tokens with, so no server accepts it.
+const exampleTokenSecret = "secret"
+
+// ServerConfig configures a server hosting some of the services. It is read
+// from a YAML or JSON file by LoadServerConfig, and each field can be
+// overridden by an environment variable named after its path, such as
+// SERVER_PORT for port or SERVER_AUTH_TOKEN_SECRET for auth.token_secret. A
+// list is a comma-separated environment variable.
+type ServerConfig struct {
+	// Services are the services the server hosts, among auth, apikey, laptop,
+	// product, order, promotion and cart.
+	Services []string `yaml:"services"`
+	// Port is the port the server listens on, 0 picks any free port.
+	Port  int         `yaml:"port"`
+	TLS   TLSConfig   `yaml:"tls"`
+	Auth  AuthConfig  `yaml:"auth"`
+	Store StoreConfig `yaml:"store"`
+	// Orders configures the order and cart services.
+	Orders OrderConfig `yaml:"orders"`
+	// ExchangeRates is the file of exchange rates the laptop prices are converted
+	// with. The prices are only in their own currency without it.
+	ExchangeRates string `yaml:"exchange_rates"`
+}
+
+// TLSConfig configures the mutual TLS of a server.
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CACert is the certificate of the CA that signed the client certificates.
+	CACert     string `yaml:"ca_cert"`
+	ServerCert string `yaml:"server_cert"`
+	ServerKey  string `yaml:"server_key"`
+	// CertRoles is the file mapping the client certificate identities to
+	// roles, see LoadCertIdentityConfig. It is only used with TLS.
+	CertRoles string `yaml:"cert_roles"`
+}
+
+// AuthConfig configures the access tokens and the login of a server.
+type AuthConfig struct {
+	// TokenSecret is the key the access tokens are signed with. It has no
+	// default, and is usually set with SERVER_AUTH_TOKEN_SECRET.
+	TokenSecret   string        `yaml:"token_secret"`
+	TokenDuration time.Duration `yaml:"token_duration"`
+	// RequireTOTP are the roles whose users must login with a TOTP second factor.
+	RequireTOTP []string `yaml:"require_totp"`
+	// AuditLog is the folder of the security audit log.
+	AuditLog string `yaml:"audit_log"`
+}
+
+// StoreConfig configures where a server keeps its records.
+type StoreConfig struct {
+	// Backend is the backend of the stores, only memory for now.
+	Backend string `yaml:"backend"`
+	// ImageFolder is the folder of the laptop images.
+	ImageFolder string `yaml:"image_folder"`
+}
+
+// OrderConfig configures the order and cart services of a server.
+type OrderConfig struct {
+	// ProductAddress and LaptopAddress are the addresses of the catalogs the
+	// orders are priced with, when they are hosted by another server. A
+	// catalog hosted by this server is called directly when its address is
+	// empty. The orders are priced when both catalogs are available.
+	ProductAddress string `yaml:"product_address"`
+	LaptopAddress  string `yaml:"laptop_address"`
+	// LaptopAPIKey is the API key used to call the LaptopService at LaptopAddress.
+	LaptopAPIKey string  `yaml:"laptop_api_key"`
+	TaxRate      float64 `yaml:"tax_rate"`
+	SagaLog      string  `yaml:"saga_log"`
+	EventLog     string  `yaml:"event_log"`
+	// EventLogSize is the number of order events kept for the consumers.
+	EventLogSize int `yaml:"event_log_size"`
+	// CarrierRules is the JSON file with the carrier rules, the default rules are used when empty.
+	CarrierRules       string `yaml:"carrier_rules"`
+	LegacyUpdateOrders bool   `yaml:"legacy_update_orders"`
+}
+
+// DefaultServerConfig returns the config of a server hosting the auth, apikey,
+// laptop and product services on any free port, without TLS. It has no token
+// secret, which must be set for the config to be valid.
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Services: []string{AuthServiceName, APIKeyServiceName, LaptopServiceName, ProductServiceName},
+		TLS: TLSConfig{
+			CACert:     "cert/ca-cert.pem",
+			ServerCert: "cert/server-cert.pem",
+			ServerKey:  "cert/server-key.pem",
+		},
+		Auth: AuthConfig{
+			TokenDuration: 15 * time.Minute,
+			AuditLog:      "audit",
+		},
+		Store: StoreConfig{
+			Backend:     memoryStoreBackend,
+			ImageFolder: "assets",
+		},
+		Orders: OrderConfig{
+			TaxRate:      0.08,
+			SagaLog:      "saga/orders.jsonl",
+			EventLog:     "events/orders.jsonl",
+			EventLogSize: 10000,
+		},
+	}
+}
+
+// LoadServerConfig reads a ServerConfig from a YAML or JSON file, on top of
+// the DefaultServerConfig, then applies the overrides of the environment
+// variables, given as "KEY=value" strings like os.Environ() returns them. The
+// file is optional: with an empty path, only the environment is read.
+func LoadServerConfig(path string, environ []string) (*ServerConfig, error) {
+	config := DefaultServerConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read server config: %w", err)
+		}
+
+		// a list in the file replaces the default one.
+		config.Services = nil
+		err = yaml.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse server config %s: %w", path, err)
+		}
+		if config.Services == nil {
+			config.Services = DefaultServerConfig().Services
+		}
+	}
+
+	env := make(map[string]string)
+	for _, entry := range environ {
+		if key, value, ok := strings.Cut(entry, "="); ok && strings.HasPrefix(key, configEnvPrefix+"_") {
+			env[key] = value
+		}
+	}
+
+	err := overrideFromEnv(reflect.ValueOf(config).Elem(), configEnvPrefix, env)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate checks that the config can start a server.
+func (config *ServerConfig) Validate() error {
+	if len(config.Services) == 0 {
+		return fmt.Errorf("server config has no service")
+	}
+	for _, name := range config.Services {
+		if !containsString(serverServices, name) {
+			return fmt.Errorf("unknown service %q, the services are %v", name, serverServices)
+		}
+	}
+
+	if config.Port < 0 || config.Port > math.MaxUint16 {
+		return fmt.Errorf("port %d is out of range", config.Port)
+	}
+
+	if config.TLS.Enabled && (config.TLS.CACert == "" || config.TLS.ServerCert == "" || config.TLS.ServerKey == "") {
+		return fmt.Errorf("tls needs the ca_cert, server_cert and server_key files")
+	}
+	if !config.TLS.Enabled && config.TLS.CertRoles != "" {
+		return fmt.Errorf("tls cert_roles is only used with tls")
+	}
+
+	err := ValidateTokenSecret(config.Auth.TokenSecret)
+	if err != nil {
+		return fmt.Errorf("auth token_secret: %w, set it with %s_AUTH_TOKEN_SECRET for example", err, configEnvPrefix)
+	}
+	if config.Auth.TokenDuration <= 0 {
+		return fmt.Errorf("auth token_duration must be positive")
+	}
+
+	if config.Store.Backend != memoryStoreBackend {
+		return fmt.Errorf("store backend %q is not supported, the only backend is %s", config.Store.Backend, memoryStoreBackend)
+	}
+
+	if config.HostsService(OrderServiceName) {
+		if !(config.Orders.TaxRate >= 0) || math.IsInf(config.Orders.TaxRate, 0) {
+			return fmt.Errorf("orders tax_rate %v is invalid", config.Orders.TaxRate)
+		}
+		if config.Orders.EventLogSize <= 0 {
+			return fmt.Errorf("orders event_log_size must be positive")
+		}
+	}
+
+	// the carts take their prices from the catalogs, and are checked out as orders.
+	if config.HostsService(CartServiceName) && (!config.HostsService(OrderServiceName) || !config.PricesOrders()) {
+		return fmt.Errorf("the cart service needs the order service, with the product and laptop catalogs hosted or at their product_address and laptop_address")
+	}
+
+	return nil
+}
+
+// ValidateTokenSecret checks that a secret can sign the access tokens: it is
+// required, and cannot be the secret of the examples.
+func ValidateTokenSecret(secret string) error {
+	if secret == "" {
+		return fmt.Errorf("the token secret is required")
+	}
+	if secret == exampleTokenSecret {
+		return fmt.Errorf("the token secret %q of the examples cannot be used", secret)
+	}
+
+	return nil
+}
+
+// Persistent reports whether the records of the stores outlive the server
+// process. The cancel and refund sagas are only resumed at startup when they
+// do, since the orders and refunds they change are lost otherwise.
+func (config StoreConfig) Persistent() bool {
+	return config.Backend != memoryStoreBackend
+}
+
+// HostsService reports whether the server hosts a service.
+func (config *ServerConfig) HostsService(name string) bool {
+	return containsString(config.Services, name)
+}
+
+// PricesOrders reports whether the orders are priced against the catalogs,
+// which are each hosted by this server or at their address.
+func (config *ServerConfig) PricesOrders() bool {
+	return (config.Orders.ProductAddress != "" || config.HostsService(ProductServiceName)) &&
+		(config.Orders.LaptopAddress != "" || config.HostsService(LaptopServiceName))
+}
+
+// overrideFromEnv() function sets the fields of a config struct from the
+// environment variables named after their path, under the given prefix.
+func overrideFromEnv(value reflect.Value, prefix string, env map[string]string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		key := prefix + "_" + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			err := overrideFromEnv(value.Field(i), key, env)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := env[key]
+		if !ok {
+			continue
+		}
+
+		err := setFromEnv(value.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// setFromEnv() function parses the value of an environment variable into a config field.
+func setFromEnv(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(value)
+	case reflect.Int:
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(value))
+	case reflect.Float64:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(value)
+	case reflect.Slice:
+		var values []string
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported config field of type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package service_test
+
+import (
+	"gRPC-Playground/service"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tokenSecretEnv sets the token secret that every valid config needs.
+const tokenSecretEnv = "SERVER_AUTH_TOKEN_SECRET=t0ps3cr3t"
+
+// writeServerConfig writes a server config file, and returns its path.
+func writeServerConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	t.Parallel()
+
+	// without a file, the server hosts the services it always did.
+	config, err := service.LoadServerConfig("", []string{tokenSecretEnv})
+	require.NoError(t, err)
+	expected := service.DefaultServerConfig()
+	expected.Auth.TokenSecret = "t0ps3cr3t"
+	require.Equal(t, expected, config)
+	require.True(t, config.HostsService(service.LaptopServiceName))
+	require.False(t, config.HostsService(service.OrderServiceName))
+
+	yamlPath := writeServerConfig(t, "server.yaml", `
+services: [order, promotion, cart]
+port: 50052
+auth:
+  token_secret: s3cr3t-from-file
+  token_duration: 1h
+orders:
+  product_address: localhost:50051
+  laptop_address: localhost:50051
+  tax_rate: 0.2
+`)
+	config, err = service.LoadServerConfig(yamlPath, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"order", "promotion", "cart"}, config.Services)
+	require.Equal(t, 50052, config.Port)
+	require.Equal(t, time.Hour, config.Auth.TokenDuration)
+	require.Equal(t, 0.2, config.Orders.TaxRate)
+	// the settings missing from the file keep their default.
+	require.Equal(t, "audit", config.Auth.AuditLog)
+	require.Equal(t, "cert/server-cert.pem", config.TLS.ServerCert)
+	require.Equal(t, 10000, config.Orders.EventLogSize)
+
+	jsonPath := writeServerConfig(t, "server.json", `{"services": ["product"], "port": 50053, "store": {"image_folder": "img"}}`)
+	config, err = service.LoadServerConfig(jsonPath, []string{tokenSecretEnv})
+	require.NoError(t, err)
+	require.Equal(t, []string{"product"}, config.Services)
+	require.Equal(t, 50053, config.Port)
+	require.Equal(t, "img", config.Store.ImageFolder)
+
+	// the environment overrides the file.
+	config, err = service.LoadServerConfig(yamlPath, []string{
+		"SERVER_PORT=50054",
+		"SERVER_SERVICES=auth, laptop",
+		"SERVER_TLS_ENABLED=true",
+		"SERVER_AUTH_TOKEN_SECRET=s3cr3t",
+		"SERVER_AUTH_TOKEN_DURATION=5m",
+		"SERVER_AUTH_REQUIRE_TOTP=admin",
+		"SERVER_ORDERS_TAX_RATE=0",
+		"OTHER_PORT=1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 50054, config.Port)
+	require.Equal(t, []string{"auth", "laptop"}, config.Services)
+	require.True(t, config.TLS.Enabled)
+	require.Equal(t, "s3cr3t", config.Auth.TokenSecret)
+	require.Equal(t, 5*time.Minute, config.Auth.TokenDuration)
+	require.Equal(t, []string{"admin"}, config.Auth.RequireTOTP)
+	require.Zero(t, config.Orders.TaxRate)
+
+	// the example config hosts every service, with the token secret of the environment.
+	config, err = service.LoadServerConfig("../cmd/server/server.yaml", []string{tokenSecretEnv})
+	require.NoError(t, err)
+	require.Equal(t, "t0ps3cr3t", config.Auth.TokenSecret)
+	require.Len(t, config.Services, 7)
+	// it prices the orders with the catalogs it hosts, without their addresses.
+	require.True(t, config.PricesOrders())
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, content := range []string{
+		`services: [inventory]`,
+		`services: []`,
+		`port: 70000`,
+		`tls: {enabled: true, server_key: ""}`,
+		`tls: {cert_roles: cert/cert-roles.json}`,
+		`auth: {token_duration: 0s}`,
+		`store: {backend: postgres}`,
+		`{services: [order], orders: {tax_rate: -0.1}}`,
+		`{services: [order], orders: {event_log_size: 0}}`,
+		// the carts need the order service, priced with the catalogs.
+		`services: [order, cart]`,
+		`port: [50051]`,
+	} {
+		_, err := service.LoadServerConfig(writeServerConfig(t, "server.yaml", content), []string{tokenSecretEnv})
+		require.Error(t, err, content)
+	}
+
+	for _, env := range []string{"SERVER_PORT=high", "SERVER_TLS_ENABLED=maybe", "SERVER_AUTH_TOKEN_DURATION=15", "SERVER_SERVICES=auth,inventory"} {
+		_, err := service.LoadServerConfig("", []string{tokenSecretEnv, env})
+		require.Error(t, err, env)
+	}
+
+	// a server does not start without a token secret, or with the one of the examples.
+	for _, content := range []string{`auth: {token_secret: ""}`, `auth: {token_secret: secret}`} {
+		_, err := service.LoadServerConfig(writeServerConfig(t, "server.yaml", content), nil)
+		require.Error(t, err, content)
+	}
+	_, err := service.LoadServerConfig("../cmd/server/server.yaml", nil)
+	require.Error(t, err)
+	_, err = service.LoadServerConfig("", []string{"SERVER_AUTH_TOKEN_SECRET=secret"})
+	require.Error(t, err)
+
+	_, err = service.LoadServerConfig(filepath.Join(t.TempDir(), "missing.yaml"), []string{tokenSecretEnv})
+	require.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"fmt"
+	pb "gRPC-Playground/ecommerce"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// shipmentBatcher combines the orders of one ProcessOrders stream into
+// shipments by destination. It belongs to a single stream, but cancelled orders
+// are removed from it by the cancel sagas, so it has a lock.
+type shipmentBatcher struct {
+	mutex sync.Mutex
+	// tenant is the tenant of the stream, whose orders are the only ones it gets.
+	tenant string
+	// size is the number of orders that makes a shipment full.
+	size int
+	// window is how long a shipment waits for more orders before it is sent.
+	window time.Duration
+	// key is the shipment key of the destination city, and the value is the shipment being filled.
+	batches map[string]*shipmentBatch
+}
+
+type shipmentBatch struct {
+	shipment *pb.CombinedShipment
+	openedAt time.Time
+}
+
+func newShipmentBatcher(tenant string, size int, window time.Duration) *shipmentBatcher {
+	return &shipmentBatcher{
+		tenant:  tenant,
+		size:    size,
+		window:  window,
+		batches: make(map[string]*shipmentBatch),
+	}
+}
+
+// add() function adds the order to the shipment of the city of its address,
+// and returns the shipment if it is now full.
+func (batcher *shipmentBatcher) add(order *pb.Order, address *pb.Address, now time.Time) (*pb.CombinedShipment, error) {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	key := shipmentKey(address)
+
+	batch := batcher.batches[key]
+	if batch == nil {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate shipment id: %w", err)
+		}
+
+		batch = &shipmentBatch{
+			shipment: &pb.CombinedShipment{
+				Id:     "cmb-" + id.String(),
+				Status: "Processed!",
+				Destination: &pb.Address{
+					City:    address.GetCity(),
+					Region:  address.GetRegion(),
+					Country: address.GetCountry(),
+				},
+			},
+			openedAt: now,
+		}
+		batcher.batches[key] = batch
+	}
+
+	batch.shipment.OrdersList = append(batch.shipment.OrdersList, order)
+
+	if len(batch.shipment.OrdersList) < batcher.size {
+		return nil, nil
+	}
+
+	delete(batcher.batches, key)
+	return batch.shipment, nil
+}
+
+// expired() function removes and returns the shipments that have waited for the whole window.
+func (batcher *shipmentBatcher) expired(now time.Time) []*pb.CombinedShipment {
+	return batcher.remove(func(batch *shipmentBatch) bool {
+		return !now.Before(batch.openedAt.Add(batcher.window))
+	})
+}
+
+// flush() function removes and returns all the shipments.
+func (batcher *shipmentBatcher) flush() []*pb.CombinedShipment {
+	return batcher.remove(func(batch *shipmentBatch) bool {
+		return true
+	})
+}
+
+// remove() function removes and returns the selected shipments, ordered by destination.
+func (batcher *shipmentBatcher) remove(selected func(batch *shipmentBatch) bool) []*pb.CombinedShipment {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	keys := make([]string, 0, len(batcher.batches))
+	for key, batch := range batcher.batches {
+		if selected(batch) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	shipments := make([]*pb.CombinedShipment, 0, len(keys))
+	for _, key := range keys {
+		shipments = append(shipments, batcher.batches[key].shipment)
+		delete(batcher.batches, key)
+	}
+
+	return shipments
+}
+
+// nextDeadline() function returns when the oldest shipment has to be sent.
+// It returns false when there is no shipment being filled.
+func (batcher *shipmentBatcher) nextDeadline() (time.Time, bool) {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	var deadline time.Time
+	found := false
+
+	for _, batch := range batcher.batches {
+		batchDeadline := batch.openedAt.Add(batcher.window)
+		if !found || batchDeadline.Before(deadline) {
+			deadline = batchDeadline
+			found = true
+		}
+	}
+
+	return deadline, found
+}
+
+// removeOrder() function removes an order from the shipment being filled for its
+// destination, and reports whether it was there. A shipment left empty is dropped.
+func (batcher *shipmentBatcher) removeOrder(orderID string) bool {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	for key, batch := range batcher.batches {
+		orders := batch.shipment.GetOrdersList()
+		for i, order := range orders {
+			if order.GetId() != orderID {
+				continue
+			}
+
+			batch.shipment.OrdersList = append(orders[:i:i], orders[i+1:]...)
+			if len(batch.shipment.GetOrdersList()) == 0 {
+				delete(batcher.batches, key)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// pendingShipments is the set of shipment batchers of the open ProcessOrders streams.
+// Its lock also serializes adding orders with removing them, so that an order
+// being cancelled is either seen as cancelled when it is added, or removed afterwards.
+type pendingShipments struct {
+	mutex    sync.Mutex
+	batchers map[*shipmentBatcher]bool
+}
+
+func newPendingShipments() *pendingShipments {
+	return &pendingShipments{
+		batchers: make(map[*shipmentBatcher]bool),
+	}
+}
+
+func (shipments *pendingShipments) register(batcher *shipmentBatcher) {
+	shipments.mutex.Lock()
+	defer shipments.mutex.Unlock()
+
+	shipments.batchers[batcher] = true
+}
+
+func (shipments *pendingShipments) unregister(batcher *shipmentBatcher) {
+	shipments.mutex.Lock()
+	defer shipments.mutex.Unlock()
+
+	delete(shipments.batchers, batcher)
+}
+
+// removeOrder() function removes an order of a tenant from all the shipments
+// being filled, and returns the number of shipments it was removed from.
+func (shipments *pendingShipments) removeOrder(tenant string, orderID string) int {
+	shipments.mutex.Lock()
+	defer shipments.mutex.Unlock()
+
+	removed := 0
+	for batcher := range shipments.batchers {
+		if batcher.tenant == tenant && batcher.removeOrder(orderID) {
+			removed++
+		}
+	}
+
+	return removed
+}
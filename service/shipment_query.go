@@ -0,0 +1,105 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	pb "gRPC-Playground/ecommerce"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// defaultShipmentPageSize is the number of shipments of a page when the request does not say.
+	defaultShipmentPageSize = 50
+	// maxShipmentPageSize is the largest number of shipments of a page.
+	maxShipmentPageSize = 500
+)
+
+// shipmentPageSize() function returns the page size of the request.
+func shipmentPageSize(req *pb.ListShipmentsRequest) (int, error) {
+	size := int(req.GetPageSize())
+	if size < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "page size cannot be negative")
+	}
+
+	if size == 0 {
+		return defaultShipmentPageSize, nil
+	}
+
+	if size > maxShipmentPageSize {
+		return maxShipmentPageSize, nil
+	}
+
+	return size, nil
+}
+
+// shipmentPageToken is the content of a page token of ListShipments. The
+// shipments are listed in the order they were saved, so the page starts after
+// the last shipment of the previous page.
+type shipmentPageToken struct {
+	FiltersHash string `json:"filters_hash"`
+	AfterID     string `json:"after_id"`
+}
+
+// shipmentFiltersHash() function hashes the filters of a request, without its pagination.
+func shipmentFiltersHash(req *pb.ListShipmentsRequest) (string, error) {
+	filters := proto.Clone(req).(*pb.ListShipmentsRequest)
+	filters.PageSize = 0
+	filters.PageToken = ""
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(filters)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(hash[:12]), nil
+}
+
+// encodeShipmentPageToken() function returns the token of the page following the shipment.
+func encodeShipmentPageToken(req *pb.ListShipmentsRequest, last *pb.CombinedShipment) (string, error) {
+	hash, err := shipmentFiltersHash(req)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(shipmentPageToken{FiltersHash: hash, AfterID: last.GetId()})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeShipmentPageToken() function returns the ID of the shipment the page
+// starts after, or an empty string if the request asks for the first page.
+func decodeShipmentPageToken(req *pb.ListShipmentsRequest) (string, error) {
+	if req.GetPageToken() == "" {
+		return "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(req.GetPageToken())
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+
+	token := shipmentPageToken{}
+	err = json.Unmarshal(data, &token)
+	if err != nil || token.AfterID == "" {
+		return "", status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+
+	hash, err := shipmentFiltersHash(req)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "cannot hash filters: %v", err)
+	}
+
+	if token.FiltersHash != hash {
+		return "", status.Errorf(codes.InvalidArgument, "page token was issued for different filters")
+	}
+
+	return token.AfterID, nil
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	pb "gRPC-Playground/ecommerce"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ShipmentStore is an interface to store the combined shipments sent by ProcessOrders.
+// Like the orders they combine, shipments are kept per tenant.
+type ShipmentStore interface {
+	// Save saves a new shipment to the store
+	Save(ctx context.Context, shipment *pb.CombinedShipment) error
+	// Find finds a shipment by ID, it returns nil if the shipment is not found
+	Find(ctx context.Context, id string) (*pb.CombinedShipment, error)
+	// Search reports the shipments matching the filters of the request via the
+	// found callback, in the order they were saved. The pagination fields of the
+	// request are ignored.
+	Search(ctx context.Context, req *pb.ListShipmentsRequest, found func(shipment *pb.CombinedShipment) error) error
+}
+
+// InMemoryShipmentStore stores shipments in memory
+type InMemoryShipmentStore struct {
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the shipment ID,
+	// and the value is the shipment object.
+	data map[string]map[string]*pb.CombinedShipment
+	// key is the tenant, and the value is its shipment IDs in the order they were saved.
+	ids map[string][]string
+}
+
+// NewInMemoryShipmentStore returns a new InMemoryShipmentStore
+func NewInMemoryShipmentStore() *InMemoryShipmentStore {
+	return &InMemoryShipmentStore{
+		data: make(map[string]map[string]*pb.CombinedShipment),
+		ids:  make(map[string][]string),
+	}
+}
+
+// Save saves the shipment to the store
+func (store *InMemoryShipmentStore) Save(ctx context.Context, shipment *pb.CombinedShipment) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	tenant := TenantFromContext(ctx)
+	shipments := store.data[tenant]
+	if shipments == nil {
+		shipments = make(map[string]*pb.CombinedShipment)
+		store.data[tenant] = shipments
+	}
+
+	if shipments[shipment.GetId()] != nil {
+		return ErrAlreadyExists
+	}
+
+	shipments[shipment.GetId()] = proto.Clone(shipment).(*pb.CombinedShipment)
+	store.ids[tenant] = append(store.ids[tenant], shipment.GetId())
+	return nil
+}
+
+// Find finds a shipment by ID
+func (store *InMemoryShipmentStore) Find(ctx context.Context, id string) (*pb.CombinedShipment, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	shipment := store.data[TenantFromContext(ctx)][id]
+	if shipment == nil {
+		return nil, nil
+	}
+
+	return proto.Clone(shipment).(*pb.CombinedShipment), nil
+}
+
+// Search searches for shipments matching the filters of the request
+func (store *InMemoryShipmentStore) Search(
+	ctx context.Context,
+	req *pb.ListShipmentsRequest,
+	found func(shipment *pb.CombinedShipment) error,
+) error {
+	for _, shipment := range store.matchingShipments(TenantFromContext(ctx), req) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := found(shipment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *InMemoryShipmentStore) matchingShipments(tenant string, req *pb.ListShipmentsRequest) []*pb.CombinedShipment {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var matches []*pb.CombinedShipment
+	for _, id := range store.ids[tenant] {
+		shipment := store.data[tenant][id]
+		if shipmentMatches(shipment, req) {
+			matches = append(matches, proto.Clone(shipment).(*pb.CombinedShipment))
+		}
+	}
+
+	return matches
+}
+
+// shipmentMatches() function reports whether the shipment matches every filter of the request.
+func shipmentMatches(shipment *pb.CombinedShipment, req *pb.ListShipmentsRequest) bool {
+	if req.GetCarrier() != "" && !strings.EqualFold(shipment.GetCarrier(), req.GetCarrier()) {
+		return false
+	}
+
+	if req.GetRegion() != "" && !strings.EqualFold(shipment.GetDestination().GetRegion(), req.GetRegion()) {
+		return false
+	}
+
+	if req.GetOrderId() != "" {
+		for _, order := range shipment.GetOrdersList() {
+			if order.GetId() == req.GetOrderId() {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrOutOfStock is returned when there is not enough stock of a laptop left to reserve.
+var ErrOutOfStock = errors.New("not enough stock left")
+
+// StockReservations keeps the laptop stock reserved for the orders.
+// Like the orders and the laptops, reservations are kept per tenant.
+type StockReservations interface {
+	// Reserve reserves a quantity of a laptop for an order.
+	Reserve(ctx context.Context, orderID string, laptopID string, quantity uint32) error
+	// ReserveOrder reserves the quantities of the laptops of a new order, all at
+	// once: if one of the laptops is out of stock, nothing is reserved and
+	// ErrOutOfStock is returned. It returns ErrAlreadyExists if the order
+	// already has reservations, and ErrNotFound if one of the laptops does not exist.
+	ReserveOrder(ctx context.Context, orderID string, quantities map[string]uint32) error
+	// ReplaceOrder replaces the reservations of an order with new quantities of
+	// laptops, all at once: if one of the laptops is out of stock, the order
+	// keeps its reservations and ErrOutOfStock is returned. It returns the
+	// quantities that were reserved for the order before.
+	ReplaceOrder(ctx context.Context, orderID string, quantities map[string]uint32) (map[string]uint32, error)
+	// Release releases everything reserved for an order.
+	// Releasing an order without reservations does nothing.
+	Release(ctx context.Context, orderID string) error
+	// Reserved returns the quantity of a laptop reserved by all the orders.
+	Reserved(ctx context.Context, laptopID string) uint32
+}
+
+// InMemoryStockReservations stores stock reservations in memory
+type InMemoryStockReservations struct {
+	mutex sync.RWMutex
+	// the first key is the tenant, the second key is the order ID, and the
+	// value is the quantity reserved for each laptop ID.
+	orders map[string]map[string]map[string]uint32
+	// laptopStore holds the stock of the laptops. Without it, the stock is not limited.
+	laptopStore LaptopStore
+}
+
+// StockReservationsOption configures an optional feature of the InMemoryStockReservations.
+type StockReservationsOption func(reservations *InMemoryStockReservations)
+
+// WithLaptopStock limits the reservations of a laptop to the stock of the
+// laptop in the store.
+func WithLaptopStock(laptopStore LaptopStore) StockReservationsOption {
+	return func(reservations *InMemoryStockReservations) {
+		reservations.laptopStore = laptopStore
+	}
+}
+
+// NewInMemoryStockReservations returns a new InMemoryStockReservations
+func NewInMemoryStockReservations(opts ...StockReservationsOption) *InMemoryStockReservations {
+	reservations := &InMemoryStockReservations{
+		orders: make(map[string]map[string]map[string]uint32),
+	}
+
+	for _, opt := range opts {
+		opt(reservations)
+	}
+
+	return reservations
+}
+
+// Reserve reserves a quantity of a laptop for an order
+func (reservations *InMemoryStockReservations) Reserve(ctx context.Context, orderID string, laptopID string, quantity uint32) error {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	orders := reservations.tenantOrders(ctx)
+	if orders[orderID] == nil {
+		orders[orderID] = make(map[string]uint32)
+	}
+
+	orders[orderID][laptopID] += quantity
+	return nil
+}
+
+// ReserveOrder reserves the laptops of an order if they are all in stock
+func (reservations *InMemoryStockReservations) ReserveOrder(ctx context.Context, orderID string, quantities map[string]uint32) error {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	orders := reservations.tenantOrders(ctx)
+	if orders[orderID] != nil {
+		return ErrAlreadyExists
+	}
+
+	// every laptop is checked before anything is reserved.
+	for laptopID, quantity := range quantities {
+		stock, limited, err := reservations.stock(ctx, laptopID)
+		if err != nil {
+			return err
+		}
+		if limited && uint64(reserved(orders, laptopID))+uint64(quantity) > uint64(stock) {
+			return ErrOutOfStock
+		}
+	}
+
+	laptops := make(map[string]uint32)
+	for laptopID, quantity := range quantities {
+		laptops[laptopID] = quantity
+	}
+	orders[orderID] = laptops
+
+	return nil
+}
+
+// ReplaceOrder replaces the reservations of an order if the new quantities are all in stock
+func (reservations *InMemoryStockReservations) ReplaceOrder(ctx context.Context, orderID string, quantities map[string]uint32) (map[string]uint32, error) {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	orders := reservations.tenantOrders(ctx)
+	previous := orders[orderID]
+
+	// the quantities the order has reserved are available to it again.
+	for laptopID, quantity := range quantities {
+		stock, limited, err := reservations.stock(ctx, laptopID)
+		if err != nil {
+			return nil, err
+		}
+		others := uint64(reserved(orders, laptopID)) - uint64(previous[laptopID])
+		if limited && others+uint64(quantity) > uint64(stock) {
+			return nil, ErrOutOfStock
+		}
+	}
+
+	laptops := make(map[string]uint32)
+	for laptopID, quantity := range quantities {
+		laptops[laptopID] = quantity
+	}
+	if len(laptops) == 0 {
+		delete(orders, orderID)
+	} else {
+		orders[orderID] = laptops
+	}
+
+	return previous, nil
+}
+
+// Release releases the reservations of an order
+func (reservations *InMemoryStockReservations) Release(ctx context.Context, orderID string) error {
+	reservations.mutex.Lock()
+	defer reservations.mutex.Unlock()
+
+	delete(reservations.orders[TenantFromContext(ctx)], orderID)
+	return nil
+}
+
+// Reserved returns the reserved quantity of a laptop
+func (reservations *InMemoryStockReservations) Reserved(ctx context.Context, laptopID string) uint32 {
+	reservations.mutex.RLock()
+	defer reservations.mutex.RUnlock()
+
+	return reserved(reservations.orders[TenantFromContext(ctx)], laptopID)
+}
+
+// tenantOrders() function returns the reservations of the orders of the
+// caller's tenant, creating its partition on first use. It must be called
+// with the mutex held.
+func (reservations *InMemoryStockReservations) tenantOrders(ctx context.Context) map[string]map[string]uint32 {
+	tenant := TenantFromContext(ctx)
+	orders := reservations.orders[tenant]
+	if orders == nil {
+		orders = make(map[string]map[string]uint32)
+		reservations.orders[tenant] = orders
+	}
+
+	return orders
+}
+
+// stock() function returns the stock of a laptop, and whether it is limited.
+func (reservations *InMemoryStockReservations) stock(ctx context.Context, laptopID string) (uint32, bool, error) {
+	if reservations.laptopStore == nil {
+		return 0, false, nil
+	}
+
+	laptop, err := reservations.laptopStore.Find(ctx, laptopID)
+	if status.Code(err) == codes.NotFound {
+		return 0, false, ErrNotFound
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if laptop.GetStock() == nil {
+		return 0, false, nil
+	}
+
+	return laptop.GetStock().GetValue(), true, nil
+}
+
+// reserved() function returns the quantity of a laptop reserved by the orders
+// of a tenant. It must be called with the mutex held.
+func reserved(orders map[string]map[string]uint32, laptopID string) uint32 {
+	var quantity uint32
+	for _, laptops := range orders {
+		quantity += laptops[laptopID]
+	}
+
+	return quantity
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTenant is the tenant of requests and users that do not name one.
+const DefaultTenant = "default"
+
+// tenantMetadataKey is the metadata key a caller uses to pick the storefront
+// (tenant) it talks to. Authenticated users cannot pick another tenant than
+// the one in their token.
+const tenantMetadataKey = "x-tenant-id"
+
+// tenant names end up in image folder paths, so they are restricted to a safe set of characters.
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx that carries the given tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored in ctx by the AuthInterceptor,
+// or DefaultTenant if there is none.
+func TenantFromContext(ctx context.Context) string {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	if !ok || tenant == "" {
+		return DefaultTenant
+	}
+
+	return tenant
+}
+
+// ValidateTenant checks that a tenant name is well-formed.
+func ValidateTenant(tenant string) error {
+	if !tenantPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	return nil
+}
+
+// resolveTenant returns the tenant of a call. It is the tenant in the caller's
+// claims if any, else the one requested in the x-tenant-id metadata, else the
+// default tenant. A caller asking for another tenant than its own is denied.
+func resolveTenant(ctx context.Context, claims *UserClaims) (string, error) {
+	requested := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[tenantMetadataKey]) > 0 {
+		requested = md[tenantMetadataKey][0]
+	}
+
+	tenant := requested
+	if claims != nil && claims.Tenant != "" {
+		if requested != "" && requested != claims.Tenant {
+			return "", status.Errorf(codes.PermissionDenied, "no permission to access tenant %q", requested)
+		}
+		tenant = claims.Tenant
+	}
+
+	if tenant == "" {
+		return DefaultTenant, nil
+	}
+
+	err := ValidateTenant(tenant)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return tenant, nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+Note: TOTP (RFC 6238) is the second factor used by authenticator apps.
+The server and the app share a secret. Every 30 seconds both compute a
+6 digit code from the secret and the current time step with the HOTP
+algorithm of RFC 4226, so the code proves that the user holds the secret.
+*/
+
+const (
+	// totpPeriod is the time step of the codes
+	totpPeriod = 30 * time.Second
+	// totpDigits is the number of digits of a code
+	totpDigits = 6
+	// totpSkew is the number of time steps before and after the current one
+	// whose codes are still accepted, to allow for clock drift.
+	totpSkew = 1
+	// totpIssuer is the name shown by the authenticator apps
+	totpIssuer = "ecommerce"
+	// recoveryCodeCount is the number of recovery codes given on enrollment
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded secret of 160 bits,
+// the size of a SHA-1 HMAC key recommended by RFC 4226.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate totp secret: %w", err)
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI of a secret, which authenticator apps
+// read from a QR code.
+func TOTPURI(account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	values.Set("digits", fmt.Sprint(totpDigits))
+
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// TOTPCode returns the code of the secret at the given time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, totpStep(t)), nil
+}
+
+// ValidateTOTP checks a code against the secret at the given time, allowing
+// for the clock skew. It returns the time step the code belongs to, so the
+// caller can refuse to accept the same code twice.
+func ValidateTOTP(secret, code string, t time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := totpStep(t)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := hotp(key, step+int64(i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid totp secret: %w", err)
+	}
+
+	return key, nil
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// hotp computes the HOTP code of RFC 4226 for a counter value.
+func hotp(key []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation: the low 4 bits of the last byte give the offset of
+	// the 31 bits used for the code.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// GenerateRecoveryCodes returns new random recovery codes, to be shown to the
+// user once, along with their hashes to keep in the user store.
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		random := make([]byte, 10)
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot generate recovery code: %w", err)
+		}
+
+		code := fmt.Sprintf("%x-%x", random[:5], random[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code. Like the API key secrets, the codes
+// are long random strings, so a plain SHA-256 is enough to protect them.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
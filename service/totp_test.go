@@ -0,0 +1,46 @@
+package service_test
+
+import (
+	"gRPC-Playground/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	t.Parallel()
+
+	// the SHA-1 test vectors of RFC 6238 appendix B, truncated to 6 digits.
+	// the secret is the base32 encoding of "12345678901234567890".
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tc := range testCases {
+		code, err := service.TOTPCode(secret, time.Unix(tc.unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, tc.code, code)
+	}
+
+	// codes of the previous and next time steps are accepted for clock drift.
+	now := time.Unix(1111111111, 0)
+	step, ok := service.ValidateTOTP(secret, "050471", now.Add(30*time.Second))
+	require.True(t, ok)
+	require.EqualValues(t, 1111111111/30, step)
+
+	_, ok = service.ValidateTOTP(secret, "050471", now.Add(90*time.Second))
+	require.False(t, ok)
+
+	_, ok = service.ValidateTOTP(secret, "123456", now)
+	require.False(t, ok)
+}
@@ -1,7 +1,10 @@
 package service
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -9,6 +12,21 @@ type User struct {
 	Username       string
 	HashedPassword string
 	Role           string
+	// Brand is only set for vendor users, and names the laptop brand they manage.
+	Brand string
+	// Tenant is the storefront the user belongs to. Users only ever see
+	// the data of their own tenant.
+	Tenant string
+	// TOTPSecret is the secret of the user's authenticator app. The user has
+	// a second factor when it is set.
+	TOTPSecret string
+	// TOTPPendingSecret is a secret being enrolled, that is not confirmed yet.
+	TOTPPendingSecret string
+	// TOTPLastStep is the time step of the last accepted code, so that a code
+	// cannot be used twice.
+	TOTPLastStep int64
+	// RecoveryCodeHashes are the hashes of the unused recovery codes.
+	RecoveryCodeHashes []string
 }
 
 func NewUser(username, password, role string) (*User, error) {
@@ -41,12 +59,51 @@ func (user *User) IsCorrectPassword(password string) bool {
 // Clone clones a user to store
 func (user *User) Clone() *User {
     return &User{
-        Username:       user.Username,
-        HashedPassword: user.HashedPassword,
-        Role:           user.Role,
+        Username:           user.Username,
+        HashedPassword:     user.HashedPassword,
+        Role:               user.Role,
+        Brand:              user.Brand,
+        Tenant:             user.Tenant,
+        TOTPSecret:         user.TOTPSecret,
+        TOTPPendingSecret:  user.TOTPPendingSecret,
+        TOTPLastStep:       user.TOTPLastStep,
+        RecoveryCodeHashes: append([]string(nil), user.RecoveryCodeHashes...),
     }
 }
 
+// HasTOTP reports whether the user has enrolled a second factor.
+func (user *User) HasTOTP() bool {
+	return user.TOTPSecret != ""
+}
+
+// UseSecondFactor checks a TOTP code or a recovery code of the user at the given
+// time, and consumes it, so that it cannot be used again. It reports whether
+// a recovery code was used.
+func (user *User) UseSecondFactor(totpCode, recoveryCode string, now time.Time) (bool, error) {
+	if !user.HasTOTP() {
+		return false, fmt.Errorf("user has no second factor: %w", ErrIncorrectSecondFactor)
+	}
+
+	if recoveryCode != "" {
+		hash := hashRecoveryCode(recoveryCode)
+		for i, recoveryCodeHash := range user.RecoveryCodeHashes {
+			if subtle.ConstantTimeCompare([]byte(recoveryCodeHash), []byte(hash)) == 1 {
+				user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i], user.RecoveryCodeHashes[i+1:]...)
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("recovery code: %w", ErrIncorrectSecondFactor)
+	}
+
+	step, ok := ValidateTOTP(user.TOTPSecret, totpCode, now)
+	if !ok || step <= user.TOTPLastStep {
+		return false, fmt.Errorf("totp code: %w", ErrIncorrectSecondFactor)
+	}
+
+	user.TOTPLastStep = step
+	return false, nil
+}
+
 // CreateUser create a user given its username, password and role, 
 // and saves it to the user store.
 func CreateUser(userStore UserStore, username, password, role string) error {
@@ -57,11 +114,27 @@ func CreateUser(userStore UserStore, username, password, role string) error {
     return userStore.Save(user)
 }
 
+// CreateVendor creates a vendor user who manages the laptops of the given brand,
+// and saves it to the user store.
+func CreateVendor(userStore UserStore, username, password, brand string) error {
+    user, err := NewUser(username, password, "vendor")
+    if err != nil {
+        return err
+    }
+    user.Brand = brand
+    return userStore.Save(user)
+}
+
+// SeedUsers creates the sample users of the default tenant.
 func SeedUsers(userStore UserStore) error {
     err := CreateUser(userStore, "admin1", "secret", "admin")
     if err != nil {
         return err
     }
+    err = CreateVendor(userStore, "vendor1", "secret", "Apple")
+    if err != nil {
+        return err
+    }
     return CreateUser(userStore, "user1", "secret", "user")
 }
 
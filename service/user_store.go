@@ -2,19 +2,28 @@ package service
 
 import "sync"
 
+// UserStore stores users per tenant. The same username can exist in
+// several tenants, and always refers to different users.
 type UserStore interface {
+	// Save saves the user to the store, in the tenant of the user
 	Save(user *User) error
-	Find(username string) (*User, error)
+	// Find finds a user of the tenant by username, it returns nil if the user is not found
+	Find(tenant, username string) (*User, error)
+	// Update calls update with a copy of the user, and saves the copy if update
+	// returns nil. Concurrent updates of the same user are serialized, so a
+	// recovery code cannot be used twice.
+	Update(tenant, username string, update func(user *User) error) error
 }
 
 type InMemoryUserStore struct {
 	mutex sync.RWMutex
-	users map[string]*User
+	// the first key is the tenant, the second key is the username.
+	users map[string]map[string]*User
 }
 
 func NewInMemoryUserStore() *InMemoryUserStore {
 	return &InMemoryUserStore{
-		users: make(map[string]*User),
+		users: make(map[string]map[string]*User),
 	}
 }
 
@@ -23,25 +32,61 @@ func (store *InMemoryUserStore) Save(user *User) error {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
+	// a user without a tenant belongs to the default one.
+	tenant := user.Tenant
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	users := store.users[tenant]
+	if users == nil {
+		users = make(map[string]*User)
+		store.users[tenant] = users
+	}
+
 	// check if a user with the same username already exists or not.
-	if store.users[user.Username] != nil {
+	if users[user.Username] != nil {
 		// It it does, we return an error.
 		return ErrAlreadyExists
 	}
 
 	// Otherwise, we just clone the input user and put it into the map.
-	store.users[user.Username] = user.Clone()
+	userCopy := user.Clone()
+	userCopy.Tenant = tenant
+	users[user.Username] = userCopy
 	return nil
 }
 
-func (store *InMemoryUserStore) Find(username string) (*User, error) {
+func (store *InMemoryUserStore) Find(tenant, username string) (*User, error) {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	user := store.users[username]
+	user := store.users[tenant][username]
 	if user == nil {
 		return nil, nil
 	}
 
 	return user.Clone(), nil
 }
+
+func (store *InMemoryUserStore) Update(tenant, username string, update func(user *User) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	user := store.users[tenant][username]
+	if user == nil {
+		return ErrNotFound
+	}
+
+	userCopy := user.Clone()
+	err := update(userCopy)
+	if err != nil {
+		return err
+	}
+
+	// the username and tenant are the key of the user, so they cannot change.
+	userCopy.Username = user.Username
+	userCopy.Tenant = user.Tenant
+	store.users[tenant][username] = userCopy
+	return nil
+}